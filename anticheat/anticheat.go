@@ -0,0 +1,119 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package anticheat inspects transfer reported by announces and flags the ones which look implausible
+package anticheat
+
+import (
+	"slices"
+
+	"chihaya/collector"
+	"chihaya/config"
+)
+
+// Announce Transfer reported by single announce, as seen by rules
+type Announce struct {
+	UserID    uint32
+	TorrentID uint32
+
+	RawDeltaUpload   int64
+	RawDeltaDownload int64
+	DeltaTime        int64 // seconds since previous announce of peer, 0 if unknown
+	Time             int64 // UNIX time of announce
+
+	// OtherLeechers Number of leechers in swarm apart from announcing peer
+	OtherLeechers int
+}
+
+// Rule Single check performed on every announce; returned details are stored alongside suspicion
+type Rule interface {
+	Name() string
+	Check(a *Announce) (details string, suspicious bool)
+}
+
+// Suspicion Announce flagged by rule
+type Suspicion struct {
+	Rule    string
+	Details string
+
+	// Withhold Whether upload credit of announce should be withheld
+	Withhold bool
+}
+
+// Engine Runs all configured rules against announces
+type Engine struct {
+	rules    []Rule
+	withhold []string
+}
+
+// NewEngine Creates engine running given rules; credit is withheld for announces flagged by rules named in withhold
+func NewEngine(rules []Rule, withhold []string) *Engine {
+	return &Engine{rules: rules, withhold: withhold}
+}
+
+// Inspect Returns suspicions raised by rules for given announce, nil if announce looks legitimate
+func (e *Engine) Inspect(a *Announce) (suspicions []Suspicion) {
+	if e == nil {
+		return nil
+	}
+
+	for _, rule := range e.rules {
+		if details, suspicious := rule.Check(a); suspicious {
+			collector.IncrementSuspicions(rule.Name())
+
+			suspicions = append(suspicions, Suspicion{
+				Rule:     rule.Name(),
+				Details:  details,
+				Withhold: slices.Contains(e.withhold, rule.Name()),
+			})
+		}
+	}
+
+	return suspicions
+}
+
+// Default Engine configured via anticheat section; nil (which never flags anything) if no rule is enabled
+var Default *Engine
+
+func init() {
+	anticheatConfig := config.Section("anticheat")
+
+	maxUploadSpeed, _ := anticheatConfig.GetInt("max_upload_speed", 0)
+	noLeechers, _ := anticheatConfig.GetBool("no_leechers", false)
+	swarmRatio, _ := anticheatConfig.GetInt("swarm_ratio", 0)
+	swarmMinUpload, _ := anticheatConfig.GetInt("swarm_min_upload", 10<<30)
+	swarmHalfLife, _ := anticheatConfig.GetInt("swarm_half_life", 86400)
+	withhold, _ := anticheatConfig.GetStrings("withhold", nil)
+
+	var rules []Rule
+
+	if maxUploadSpeed > 0 {
+		rules = append(rules, &UploadSpeedRule{MaxSpeed: int64(maxUploadSpeed)})
+	}
+
+	if noLeechers {
+		rules = append(rules, &NoLeechersRule{})
+	}
+
+	if swarmRatio > 0 && swarmHalfLife > 0 {
+		rules = append(rules, NewSwarmRatioRule(int64(swarmRatio), int64(swarmMinUpload), int64(swarmHalfLife)))
+	}
+
+	if len(rules) > 0 {
+		Default = NewEngine(rules, withhold)
+	}
+}
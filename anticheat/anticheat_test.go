@@ -0,0 +1,157 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package anticheat
+
+import (
+	"testing"
+)
+
+func testUploadSpeed(t *testing.T) {
+	rule := &UploadSpeedRule{MaxSpeed: 1000}
+
+	testCases := []struct {
+		uploaded, deltaTime int64
+		suspicious          bool
+	}{
+		{1000 * 60, 60, false},
+		{1001 * 60, 60, true},
+		{1 << 40, 0, false}, // time since previous announce is unknown
+	}
+
+	for _, testCase := range testCases {
+		if _, suspicious := rule.Check(&Announce{
+			RawDeltaUpload: testCase.uploaded,
+			DeltaTime:      testCase.deltaTime,
+		}); suspicious != testCase.suspicious {
+			t.Fatalf("Expected suspicious %t for %+v, got %t", testCase.suspicious, testCase, suspicious)
+		}
+	}
+}
+
+func testNoLeechers(t *testing.T) {
+	rule := &NoLeechersRule{}
+
+	if _, suspicious := rule.Check(&Announce{RawDeltaUpload: 100, OtherLeechers: 1}); suspicious {
+		t.Fatalf("Expected upload to other leecher not to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{RawDeltaUpload: 0, OtherLeechers: 0}); suspicious {
+		t.Fatalf("Expected announce without upload not to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{RawDeltaUpload: 100, OtherLeechers: 0}); !suspicious {
+		t.Fatalf("Expected upload without leechers to be suspicious")
+	}
+}
+
+func testSwarmRatio(t *testing.T) {
+	rule := NewSwarmRatioRule(2, 1000, 3600)
+
+	// Swarm upload below minimum is never suspicious
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaUpload: 1000}); suspicious {
+		t.Fatalf("Expected swarm upload below minimum not to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaDownload: 1000}); suspicious {
+		t.Fatalf("Expected download not to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaUpload: 1000}); suspicious {
+		t.Fatalf("Expected swarm upload within ratio not to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaUpload: 1}); !suspicious {
+		t.Fatalf("Expected swarm upload over ratio to be suspicious")
+	}
+
+	// Other swarms are not affected
+	if _, suspicious := rule.Check(&Announce{TorrentID: 2, RawDeltaUpload: 100}); suspicious {
+		t.Fatalf("Expected other swarm not to be suspicious")
+	}
+}
+
+func testSwarmRatioRecovery(t *testing.T) {
+	rule := NewSwarmRatioRule(2, 1000, 3600)
+
+	// Spike of upload nobody downloaded
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaUpload: 1 << 20, Time: 1000}); !suspicious {
+		t.Fatalf("Expected spike of swarm upload to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaUpload: 100, Time: 1000 + 3600}); !suspicious {
+		t.Fatalf("Expected swarm upload to be suspicious while spike is still recent")
+	}
+
+	// Ten half-lives later spike has decayed below minimum and legitimate transfer is not flagged
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaDownload: 600, Time: 1000 + 11*3600}); suspicious {
+		t.Fatalf("Expected download not to be suspicious")
+	}
+
+	if _, suspicious := rule.Check(&Announce{TorrentID: 1, RawDeltaUpload: 600, Time: 1000 + 11*3600}); suspicious {
+		t.Fatalf("Expected swarm to recover from past spike")
+	}
+
+	// Idle swarm is evicted once other swarm in the same shard is checked
+	rule.Check(&Announce{TorrentID: 1 + swarmShards, RawDeltaUpload: 1, Time: 1000 + 22*3600})
+
+	if _, exists := rule.shards[1].totals[1]; exists {
+		t.Fatalf("Expected idle swarm to be evicted")
+	}
+}
+
+func testEngine(t *testing.T) {
+	var nilEngine *Engine
+
+	if suspicions := nilEngine.Inspect(&Announce{RawDeltaUpload: 1 << 40}); suspicions != nil {
+		t.Fatalf("Expected disabled engine not to flag anything, got %v", suspicions)
+	}
+
+	engine := NewEngine([]Rule{&UploadSpeedRule{MaxSpeed: 10}, &NoLeechersRule{}}, []string{"no_leechers"})
+
+	suspicions := engine.Inspect(&Announce{RawDeltaUpload: 100, DeltaTime: 60})
+	if len(suspicions) != 1 || suspicions[0].Rule != "no_leechers" || !suspicions[0].Withhold {
+		t.Fatalf("Expected single withheld suspicion, got %+v", suspicions)
+	}
+
+	suspicions = engine.Inspect(&Announce{RawDeltaUpload: 6000, DeltaTime: 60, OtherLeechers: 1})
+	if len(suspicions) != 1 || suspicions[0].Rule != "upload_speed" || suspicions[0].Withhold {
+		t.Fatalf("Expected single suspicion not withheld, got %+v", suspicions)
+	}
+}
+
+func TestAnticheat(t *testing.T) {
+	t.Run("UploadSpeed", func(t *testing.T) {
+		testUploadSpeed(t)
+	})
+
+	t.Run("NoLeechers", func(t *testing.T) {
+		testNoLeechers(t)
+	})
+
+	t.Run("SwarmRatio", func(t *testing.T) {
+		testSwarmRatio(t)
+	})
+
+	t.Run("SwarmRatioRecovery", func(t *testing.T) {
+		testSwarmRatioRecovery(t)
+	})
+
+	t.Run("Engine", func(t *testing.T) {
+		testEngine(t)
+	})
+}
@@ -0,0 +1,163 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package anticheat
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// UploadSpeedRule Flags announces whose average upload speed since previous announce exceeds MaxSpeed (bytes/s)
+type UploadSpeedRule struct {
+	MaxSpeed int64
+}
+
+func (r *UploadSpeedRule) Name() string {
+	return "upload_speed"
+}
+
+func (r *UploadSpeedRule) Check(a *Announce) (string, bool) {
+	if a.DeltaTime <= 0 {
+		return "", false
+	}
+
+	if speed := a.RawDeltaUpload / a.DeltaTime; speed > r.MaxSpeed {
+		return fmt.Sprintf("uploaded %d bytes in %d seconds (%d B/s, max %d B/s)", a.RawDeltaUpload, a.DeltaTime,
+			speed, r.MaxSpeed), true
+	}
+
+	return "", false
+}
+
+// NoLeechersRule Flags announces reporting upload on torrent where nobody else is leeching
+type NoLeechersRule struct{}
+
+func (r *NoLeechersRule) Name() string {
+	return "no_leechers"
+}
+
+func (r *NoLeechersRule) Check(a *Announce) (string, bool) {
+	if a.RawDeltaUpload > 0 && a.OtherLeechers == 0 {
+		return fmt.Sprintf("uploaded %d bytes with no other leechers in swarm", a.RawDeltaUpload), true
+	}
+
+	return "", false
+}
+
+const (
+	swarmShards = 64
+
+	// swarmIdleHalfLives Totals not updated for this many half-lives (less than 0.1% left) are evicted
+	swarmIdleHalfLives = 10
+)
+
+type swarmTotals struct {
+	uploaded, downloaded float64
+	updated              int64
+}
+
+// decay Scales totals down by time passed since they were last updated
+func (t *swarmTotals) decay(now, halfLife int64) {
+	if now <= t.updated {
+		return
+	}
+
+	factor := math.Exp2(-float64(now-t.updated) / float64(halfLife))
+
+	t.uploaded *= factor
+	t.downloaded *= factor
+	t.updated = now
+}
+
+/*
+SwarmRatioRule Keeps totals of upload and download reported in each swarm and flags announces reporting upload once
+swarm upload exceeds MinUpload and is more than Ratio times larger than swarm download. As all uploads have to be
+downloaded by someone within swarm, such difference means that at least one of uploaders is lying.
+
+Totals decay exponentially with HalfLife (in seconds), so that swarm recovers from past spike of upload, and totals of
+swarms which went idle (including removed torrents) are evicted.
+*/
+type SwarmRatioRule struct {
+	Ratio     int64
+	MinUpload int64
+	HalfLife  int64
+
+	shards [swarmShards]struct {
+		sync.Mutex
+		totals map[uint32]*swarmTotals
+		swept  int64
+	}
+}
+
+func NewSwarmRatioRule(ratio, minUpload, halfLife int64) *SwarmRatioRule {
+	r := &SwarmRatioRule{Ratio: ratio, MinUpload: minUpload, HalfLife: halfLife}
+
+	for i := range r.shards {
+		r.shards[i].totals = make(map[uint32]*swarmTotals)
+	}
+
+	return r
+}
+
+func (r *SwarmRatioRule) Name() string {
+	return "swarm_ratio"
+}
+
+func (r *SwarmRatioRule) Check(a *Announce) (string, bool) {
+	if a.RawDeltaUpload == 0 && a.RawDeltaDownload == 0 {
+		return "", false
+	}
+
+	shard := &r.shards[a.TorrentID%swarmShards]
+
+	shard.Lock()
+
+	// Idle swarms are swept at most once per half-life, which keeps cost of eviction negligible
+	if a.Time-shard.swept >= r.HalfLife {
+		for id, totals := range shard.totals {
+			if a.Time-totals.updated >= swarmIdleHalfLives*r.HalfLife {
+				delete(shard.totals, id)
+			}
+		}
+
+		shard.swept = a.Time
+	}
+
+	totals, exists := shard.totals[a.TorrentID]
+	if !exists {
+		totals = &swarmTotals{updated: a.Time}
+		shard.totals[a.TorrentID] = totals
+	}
+
+	totals.decay(a.Time, r.HalfLife)
+
+	totals.uploaded += float64(a.RawDeltaUpload)
+	totals.downloaded += float64(a.RawDeltaDownload)
+
+	uploaded, downloaded := int64(totals.uploaded), int64(totals.downloaded)
+
+	shard.Unlock()
+
+	if a.RawDeltaUpload > 0 && uploaded > r.MinUpload && uploaded > r.Ratio*downloaded {
+		return fmt.Sprintf("uploaded %d bytes, swarm uploaded %d bytes and downloaded %d bytes", a.RawDeltaUpload,
+			uploaded, downloaded), true
+	}
+
+	return "", false
+}
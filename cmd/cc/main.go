@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"os"
 	"runtime"
@@ -43,6 +44,8 @@ func help() {
 	fmt.Println("  restore    marshals json files back into binary cache")
 	fmt.Println("  anonymize  anonymizes binary cache back into binary cache")
 	fmt.Println("             affects: user ids/flags/passkeys, peer ips/ports")
+	fmt.Println("  convert    rewrites binary cache in given format (framed, zstd or legacy)")
+	fmt.Println("             binary cache in any format is read by all commands, framed is written by default")
 }
 
 func main() {
@@ -59,31 +62,40 @@ func main() {
 
 	switch os.Args[1] {
 	case "dump":
-		dump(func(reader io.Reader) (map[cdb.TorrentHash]*cdb.Torrent, error) {
-			t := make(map[cdb.TorrentHash]*cdb.Torrent)
-			if err := cdb.LoadTorrents(reader, t); err != nil {
-				return nil, err
-			}
-
-			return t, nil
-		}, cdb.TorrentCacheFile)
-		dump(func(reader io.Reader) (map[string]*cdb.User, error) {
-			u := make(map[string]*cdb.User)
-			if err := cdb.LoadUsers(reader, u); err != nil {
-				return nil, err
-			}
+		dump(readTorrents, cdb.TorrentCacheFile)
+		dump(readUsers, cdb.UserCacheFile)
 
-			return u, nil
-		}, cdb.UserCacheFile)
+		if exists(fmt.Sprintf("%s.bin", cdb.StateCacheFile)) {
+			dump(readState, cdb.StateCacheFile)
+		}
 
 		return
 	case "restore":
-		restore(func(writer io.Writer, v map[cdb.TorrentHash]*cdb.Torrent) error {
-			return cdb.WriteTorrents(writer, v)
-		}, cdb.TorrentCacheFile)
-		restore(func(writer io.Writer, v map[string]*cdb.User) error {
-			return cdb.WriteUsers(writer, v)
-		}, cdb.UserCacheFile)
+		restore(writeTorrents(cdb.CacheFormatFramed), cdb.TorrentCacheFile)
+		restore(writeUsers(cdb.CacheFormatFramed), cdb.UserCacheFile)
+
+		if exists(fmt.Sprintf("%s.json", cdb.StateCacheFile)) {
+			restore(writeState(cdb.CacheFormatFramed), cdb.StateCacheFile)
+		}
+
+		return
+	case "convert":
+		if len(os.Args) < 3 {
+			help()
+			return
+		}
+
+		format, err := cdb.ParseCacheFormat(os.Args[2])
+		if err != nil {
+			panic(err)
+		}
+
+		convert(readTorrents, writeTorrents(format), cdb.TorrentCacheFile)
+		convert(readUsers, writeUsers(format), cdb.UserCacheFile)
+
+		if exists(fmt.Sprintf("%s.bin", cdb.StateCacheFile)) {
+			convert(readState, writeState(format), cdb.StateCacheFile)
+		}
 
 		return
 	case "anonymize":
@@ -118,6 +130,21 @@ func main() {
 			panic(err)
 		}
 
+		var state *cdb.State
+
+		if exists(fmt.Sprintf("%s.bin", cdb.StateCacheFile)) {
+			stateFile, err := os.OpenFile(fmt.Sprintf("%s.bin", cdb.StateCacheFile), os.O_RDONLY, 0600)
+			if err != nil {
+				panic(err)
+			}
+
+			if state, err = readState(stateFile); err != nil {
+				panic(err)
+			}
+
+			_ = stateFile.Close()
+		}
+
 		randomPasskey := func(n int) string {
 			const randomBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
@@ -163,35 +190,72 @@ func main() {
 		}
 
 		for _, torrent := range t {
-			newSeeders := make(map[cdb.PeerKey]*cdb.Peer)
+			for _, peers := range []*cdb.Peers{&torrent.Seeders, &torrent.Leechers} {
+				anonPeers := make([]*cdb.Peer, 0, peers.Len())
+
+				for _, s := range peers.All() {
+					s.UserID = anonUserMapping[s.UserID]
+					// Replace Port with valid random port
+					port := uint16(util.UnsafeIntn(math.MaxUint16-1025) + 1024)
+
+					if s.Addr.IsValid() {
+						// Replace IP
+						binary.BigEndian.PutUint32(s.Addr[:], util.UnsafeUint32())
+						binary.BigEndian.PutUint16(s.Addr[4:], port)
+					}
+
+					if s.Addr6.IsValid() {
+						// Replace IPv6
+						_, _ = util.UnsafeReadRand(s.Addr6[:16])
+						binary.BigEndian.PutUint16(s.Addr6[16:], port)
+					}
+
+					anonPeers = append(anonPeers, s)
+				}
 
-			for _, s := range torrent.Seeders {
-				s.UserID = anonUserMapping[s.UserID]
-				// Replace IP
-				binary.BigEndian.PutUint32(s.Addr[:], util.UnsafeUint32())
-				// Replace Port with valid random port
-				binary.BigEndian.PutUint16(s.Addr[4:], uint16(util.UnsafeIntn(math.MaxUint16-1025)+1024))
+				// Replaces userID in keys
+				peers.Clear()
 
-				// Replaces userID in map key
-				newSeeders[cdb.NewPeerKey(s.UserID, s.ID)] = s
+				for _, s := range anonPeers {
+					peers.Put(cdb.NewPeerKey(s.UserID, s.ID), s)
+				}
 			}
+		}
 
-			torrent.Seeders = newSeeders
+		if state != nil {
+			// Replaces userID in hit and runs and personal freeleech
+			hitAndRuns := make(map[cdb.UserTorrentPair]struct{}, len(state.HitAndRuns))
 
-			newLeechers := make(map[cdb.PeerKey]*cdb.Peer)
+			for pair := range state.HitAndRuns {
+				pair.UserID = anonUserMapping[pair.UserID]
+				hitAndRuns[pair] = struct{}{}
+			}
 
-			for _, s := range torrent.Leechers {
-				s.UserID = anonUserMapping[s.UserID]
-				// Replace IP
-				binary.BigEndian.PutUint32(s.Addr[:], util.UnsafeUint32())
-				// Replace Port with valid random port
-				binary.BigEndian.PutUint16(s.Addr[4:], uint16(util.UnsafeIntn(math.MaxUint16-1025)+1024))
+			usersFreeleech := make(map[cdb.UserTorrentPair]*cdb.UserFreeleech, len(state.UsersFreeleech))
 
-				// Replaces userID in map key
-				newLeechers[cdb.NewPeerKey(s.UserID, s.ID)] = s
+			for pair, freeleech := range state.UsersFreeleech {
+				pair.UserID = anonUserMapping[pair.UserID]
+				usersFreeleech[pair] = freeleech
 			}
 
-			torrent.Leechers = newLeechers
+			state.HitAndRuns = hitAndRuns
+			state.UsersFreeleech = usersFreeleech
+
+			anonStateFile, err := os.OpenFile(
+				fmt.Sprintf("%s.bin", cdb.StateCacheFile+"-anonymized"),
+				os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				panic(err)
+			}
+
+			defer func() {
+				_ = anonStateFile.Sync()
+				_ = anonStateFile.Close()
+			}()
+
+			if err = cdb.WriteState(anonStateFile, state, cdb.CacheFormatFramed); err != nil {
+				panic(err)
+			}
 		}
 
 		anonUserFile, err := os.OpenFile(
@@ -206,7 +270,7 @@ func main() {
 			_ = anonUserFile.Close()
 		}()
 
-		if err = cdb.WriteUsers(anonUserFile, newUsers); err != nil {
+		if err = cdb.WriteUsers(anonUserFile, newUsers, cdb.CacheFormatFramed); err != nil {
 			panic(err)
 		}
 
@@ -222,7 +286,7 @@ func main() {
 			_ = anonTorrentFile.Close()
 		}()
 
-		if err = cdb.WriteTorrents(anonTorrentFile, t); err != nil {
+		if err = cdb.WriteTorrents(anonTorrentFile, len(t), maps.All(t), cdb.CacheFormatFramed); err != nil {
 			panic(err)
 		}
 
@@ -234,6 +298,61 @@ func main() {
 	}
 }
 
+func readTorrents(reader io.Reader) (map[cdb.TorrentHash]*cdb.Torrent, error) {
+	t := make(map[cdb.TorrentHash]*cdb.Torrent)
+	if err := cdb.LoadTorrents(reader, t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func readUsers(reader io.Reader) (map[string]*cdb.User, error) {
+	u := make(map[string]*cdb.User)
+	if err := cdb.LoadUsers(reader, u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func readState(reader io.Reader) (*cdb.State, error) {
+	s := cdb.NewState()
+	if err := cdb.LoadState(reader, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func writeTorrents(format cdb.CacheFormat) func(writer io.Writer, v map[cdb.TorrentHash]*cdb.Torrent) error {
+	return func(writer io.Writer, v map[cdb.TorrentHash]*cdb.Torrent) error {
+		return cdb.WriteTorrents(writer, len(v), maps.All(v), format)
+	}
+}
+
+func writeUsers(format cdb.CacheFormat) func(writer io.Writer, v map[string]*cdb.User) error {
+	return func(writer io.Writer, v map[string]*cdb.User) error {
+		return cdb.WriteUsers(writer, v, format)
+	}
+}
+
+func writeState(format cdb.CacheFormat) func(writer io.Writer, v *cdb.State) error {
+	return func(writer io.Writer, v *cdb.State) error {
+		return cdb.WriteState(writer, v, format)
+	}
+}
+
+// exists Reports whether file exists; state cache is skipped when missing, as it is not written by older versions
+func exists(f string) bool {
+	if _, err := os.Stat(f); err != nil {
+		slog.Warn("skipping missing file", "file", f)
+		return false
+	}
+
+	return true
+}
+
 func dump[cdb any](readFunc func(reader io.Reader) (cdb, error), f string) {
 	logger := slog.Default().With("cdb", f)
 
@@ -297,3 +416,48 @@ func restore[cdb any](writeFunc func(writer io.Writer, v cdb) error, f string) {
 
 	logger.Info("finished")
 }
+
+// convert Reads binary cache and writes it again in place, through temporary file so that original is kept on failure
+func convert[cdb any](readFunc func(reader io.Reader) (cdb, error), writeFunc func(writer io.Writer, v cdb) error,
+	f string) {
+	logger := slog.Default().With("cdb", f)
+
+	logger.Info("converting data...")
+
+	binFilename := fmt.Sprintf("%s.bin", f)
+	tmpFilename := fmt.Sprintf("%s.tmp", binFilename)
+
+	binFile, err := os.OpenFile(binFilename, os.O_RDONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	var v cdb
+
+	if v, err = readFunc(binFile); err != nil {
+		panic(err)
+	}
+
+	_ = binFile.Close()
+
+	tmpFile, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	if err = writeFunc(tmpFile, v); err != nil {
+		panic(err)
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		panic(err)
+	}
+
+	_ = tmpFile.Close()
+
+	if err = os.Rename(tmpFilename, binFilename); err != nil {
+		panic(err)
+	}
+
+	logger.Info("finished")
+}
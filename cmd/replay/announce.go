@@ -0,0 +1,235 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cdb "chihaya/database/types"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zeebo/bencode"
+)
+
+// announce Single request to be sent to tracker
+type announce struct {
+	passkey  string
+	infoHash cdb.TorrentHash
+	peerID   cdb.PeerID
+	port     uint16
+
+	uploaded, downloaded, left uint64
+
+	event    string
+	ip, ipv6 string
+}
+
+func (a *announce) uri(tracker string) string {
+	var b strings.Builder
+
+	b.WriteString(tracker)
+	b.WriteByte('/')
+	b.WriteString(a.passkey)
+	b.WriteString("/announce?compact=1&info_hash=")
+	b.WriteString(url.QueryEscape(string(a.infoHash[:])))
+	b.WriteString("&peer_id=")
+	b.WriteString(url.QueryEscape(string(a.peerID[:])))
+	b.WriteString("&port=")
+	b.WriteString(strconv.FormatUint(uint64(a.port), 10))
+	b.WriteString("&uploaded=")
+	b.WriteString(strconv.FormatUint(a.uploaded, 10))
+	b.WriteString("&downloaded=")
+	b.WriteString(strconv.FormatUint(a.downloaded, 10))
+	b.WriteString("&left=")
+	b.WriteString(strconv.FormatUint(a.left, 10))
+
+	if a.event != "" {
+		b.WriteString("&event=")
+		b.WriteString(url.QueryEscape(a.event))
+	}
+
+	if a.ip != "" {
+		b.WriteString("&ip=")
+		b.WriteString(url.QueryEscape(a.ip))
+	}
+
+	if a.ipv6 != "" {
+		b.WriteString("&ipv6=")
+		b.WriteString(url.QueryEscape(a.ipv6))
+	}
+
+	return b.String()
+}
+
+// send Performs announce, returning failure reason (empty on success) and time it took
+func send(client *fasthttp.Client, tracker string, timeout time.Duration, a *announce) (string, time.Duration) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+
+	req.SetRequestURI(a.uri(tracker))
+
+	start := time.Now()
+	err := client.DoTimeout(req, resp, timeout)
+	latency := time.Since(start)
+
+	if err != nil {
+		return "error: " + err.Error(), latency
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Sprintf("http status %d", resp.StatusCode()), latency
+	}
+
+	return failureReason(resp.Body()), latency
+}
+
+// failureReason Decodes bencoded response and returns its failure reason, if any
+func failureReason(body []byte) string {
+	var res map[string]any
+
+	if err := bencode.DecodeBytes(body, &res); err != nil {
+		return "malformed response"
+	}
+
+	if reason, exists := res["failure reason"]; exists {
+		return fmt.Sprint(reason)
+	}
+
+	return ""
+}
+
+// stats Collects outcome of all sent announces
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	failures  map[string]int
+	lag       time.Duration
+}
+
+func newStats() *stats {
+	return &stats{failures: make(map[string]int)}
+}
+
+func (s *stats) add(failure string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latencies = append(s.latencies, latency)
+
+	if failure != "" {
+		s.failures[failure]++
+	}
+}
+
+// behind Records how far behind schedule announces are being sent, reported as maximum
+func (s *stats) behind(lag time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lag = max(s.lag, lag)
+}
+
+func (s *stats) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.latencies)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[max(int(math.Ceil(p*float64(len(sorted))))-1, 0)]
+}
+
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sorted := slices.Clone(s.latencies)
+	slices.Sort(sorted)
+
+	failed := 0
+	for _, count := range s.failures {
+		failed += count
+	}
+
+	_, _ = fmt.Fprintf(w, "announces: %d (%.1f/s), failed: %d, elapsed: %s, max lag: %s\n",
+		len(sorted), float64(len(sorted))/elapsed.Seconds(), failed, elapsed.Round(time.Millisecond), s.lag)
+
+	if len(sorted) > 0 {
+		_, _ = fmt.Fprintf(w, "latency: p50=%s p90=%s p99=%s p99.9=%s max=%s\n",
+			percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99), percentile(sorted, 0.999),
+			sorted[len(sorted)-1])
+	}
+
+	reasons := make([]string, 0, len(s.failures))
+	for reason := range s.failures {
+		reasons = append(reasons, reason)
+	}
+
+	// Most frequent first
+	slices.SortFunc(reasons, func(a, b string) int {
+		return s.failures[b] - s.failures[a]
+	})
+
+	for _, reason := range reasons {
+		_, _ = fmt.Fprintf(w, "  %8d  %s\n", s.failures[reason], reason)
+	}
+}
+
+// runWorkers Sends announces from jobs using given number of concurrent workers until jobs is closed
+func runWorkers(jobs <-chan *announce, concurrency int, tracker string, timeout time.Duration, s *stats) {
+	client := &fasthttp.Client{
+		Name:            "chihaya-replay",
+		MaxConnsPerHost: concurrency,
+		ReadTimeout:     timeout,
+		WriteTimeout:    timeout,
+	}
+
+	var wg sync.WaitGroup
+
+	for range concurrency {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for a := range jobs {
+				s.add(send(client, tracker, timeout, a))
+			}
+		}()
+	}
+
+	wg.Wait()
+}
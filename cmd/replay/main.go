@@ -0,0 +1,457 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	cdb "chihaya/database/types"
+	"chihaya/record"
+	"chihaya/util"
+)
+
+// provided at compile-time
+var (
+	BuildDate    = "0000-00-00T00:00:00+0000"
+	BuildVersion = "development"
+)
+
+func help() {
+	fmt.Printf("Usage of %s:\n", os.Args[0])
+	fmt.Println("  replay    replays event log files written with record_announces against tracker")
+	fmt.Println("            at original speed multiplied by -speed (0 sends them as fast as possible)")
+	fmt.Println("  generate  generates announces of swarms from binary cache (such as cc anonymize output)")
+	fmt.Println("            at -rate announces per second for -duration")
+	fmt.Println()
+	fmt.Println("Both need torrent and user cache to map events to info hashes and passkeys; tracker has to be")
+	fmt.Println("loaded with the same data. Run command with -h for all of its flags.")
+}
+
+// options Flags shared by all commands
+type options struct {
+	tracker     string
+	torrents    string
+	users       string
+	concurrency int
+	timeout     time.Duration
+	progress    time.Duration
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.tracker, "tracker", "http://127.0.0.1:34000", "base URL of tracker")
+	flags.StringVar(&o.torrents, "torrents", cdb.TorrentCacheFile+".bin", "torrent cache file")
+	flags.StringVar(&o.users, "users", cdb.UserCacheFile+".bin", "user cache file")
+	flags.IntVar(&o.concurrency, "concurrency", 64, "number of announces in flight at once")
+	flags.DurationVar(&o.timeout, "timeout", 5*time.Second, "timeout of single announce")
+	flags.DurationVar(&o.progress, "progress", 10*time.Second, "interval of progress reports, 0 disables them")
+}
+
+func main() {
+	fmt.Printf("replay utility for chihaya (kuroneko), ver=%s date=%s runtime=%s\n\n",
+		BuildVersion, BuildDate, runtime.Version())
+
+	if len(os.Args) < 2 {
+		help()
+		return
+	}
+
+	// Reconfigure logger
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	var opts options
+
+	switch os.Args[1] {
+	case "replay":
+		flags := flag.NewFlagSet("replay", flag.ExitOnError)
+		opts.register(flags)
+
+		speed := flags.Float64("speed", 1, "multiplier of original speed, 0 sends announces as fast as possible")
+
+		_ = flags.Parse(os.Args[2:])
+
+		if flags.NArg() == 0 {
+			fmt.Println("No event log files given")
+			return
+		}
+
+		torrents, passkeys := loadCache(&opts)
+		torrentHashes := make(map[uint32]cdb.TorrentHash, len(torrents))
+
+		for hash, torrent := range torrents {
+			torrentHashes[torrent.ID.Load()] = hash
+		}
+
+		run(&opts, func(jobs chan<- *announce, s *stats) {
+			replay(flags.Args(), *speed, torrentHashes, passkeys, jobs, s)
+		})
+	case "generate":
+		flags := flag.NewFlagSet("generate", flag.ExitOnError)
+		opts.register(flags)
+
+		rate := flags.Float64("rate", 1000, "announces per second")
+		duration := flags.Duration("duration", time.Minute, "how long to generate announces for")
+
+		_ = flags.Parse(os.Args[2:])
+
+		torrents, passkeys := loadCache(&opts)
+
+		run(&opts, func(jobs chan<- *announce, s *stats) {
+			generate(newSwarms(torrents, passkeys), *rate, *duration, jobs, s)
+		})
+	default:
+		help()
+	}
+}
+
+// run Feeds announces produced by produce to workers and prints report once all of them were sent
+func run(opts *options, produce func(jobs chan<- *announce, s *stats)) {
+	var (
+		s     = newStats()
+		jobs  = make(chan *announce, opts.concurrency)
+		done  = make(chan struct{})
+		start = time.Now()
+	)
+
+	go func() {
+		defer close(done)
+
+		runWorkers(jobs, opts.concurrency, strings.TrimSuffix(opts.tracker, "/"), opts.timeout, s)
+	}()
+
+	if opts.progress > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.progress)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					slog.Info("progress", "announces", s.count(), "elapsed", time.Since(start).Round(time.Second))
+				}
+			}
+		}()
+	}
+
+	produce(jobs, s)
+	close(jobs)
+
+	<-done
+
+	fmt.Println()
+	s.report(os.Stdout, time.Since(start))
+}
+
+// loadCache Returns torrents from cache and passkeys by user ID
+func loadCache(opts *options) (map[cdb.TorrentHash]*cdb.Torrent, map[uint32]string) {
+	torrents := make(map[cdb.TorrentHash]*cdb.Torrent)
+	u := make(map[string]*cdb.User)
+
+	torrentFile, err := os.OpenFile(opts.torrents, os.O_RDONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		_ = torrentFile.Close()
+	}()
+
+	if err = cdb.LoadTorrents(torrentFile, torrents); err != nil {
+		panic(err)
+	}
+
+	userFile, err := os.OpenFile(opts.users, os.O_RDONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		_ = userFile.Close()
+	}()
+
+	if err = cdb.LoadUsers(userFile, u); err != nil {
+		panic(err)
+	}
+
+	passkeys := make(map[uint32]string, len(u))
+	for passkey, user := range u {
+		passkeys[user.ID.Load()] = passkey
+	}
+
+	slog.Info("loaded cache", "torrents", len(torrents), "users", len(passkeys))
+
+	return torrents, passkeys
+}
+
+/*
+replay Sends announces from event log files in order they were recorded. Each announce is sent once time elapsed since
+first one (multiplied by speed) catches up with time elapsed between them in log
+*/
+func replay(files []string, speed float64, torrents map[uint32]cdb.TorrentHash, passkeys map[uint32]string,
+	jobs chan<- *announce, s *stats) {
+	var (
+		first   int64
+		started time.Time
+		skipped int
+	)
+
+	for _, name := range files {
+		err := readEvents(name, func(e *record.Event) {
+			if e.Version > record.FormatVersion {
+				skipped++
+				return
+			}
+
+			infoHash, exists := torrents[e.TorrentID]
+			if !exists {
+				skipped++
+				return
+			}
+
+			passkey, exists := passkeys[e.UserID]
+			if !exists {
+				skipped++
+				return
+			}
+
+			if started.IsZero() {
+				first, started = e.Time, time.Now()
+			}
+
+			if speed > 0 {
+				due := started.Add(time.Duration(float64(time.Duration(e.Time-first)*time.Second) / speed))
+				if wait := time.Until(due); wait > 0 {
+					time.Sleep(wait)
+				} else {
+					s.behind(-wait)
+				}
+			}
+
+			a := &announce{
+				passkey:    passkey,
+				infoHash:   infoHash,
+				peerID:     e.PeerID,
+				uploaded:   e.Uploaded,
+				downloaded: e.Downloaded,
+				left:       e.Left,
+				event:      e.Event,
+			}
+
+			if e.Addr.IsValid() {
+				a.ip, a.port = e.Addr.IPString(), e.Addr.Port()
+			}
+
+			if e.Addr6.IsValid() {
+				a.ipv6, a.port = e.Addr6.IPString(), e.Addr6.Port()
+			}
+
+			jobs <- a
+		})
+		if err != nil {
+			slog.Error("failed to read event log", "file", name, "err", err)
+		}
+	}
+
+	if skipped > 0 {
+		slog.Warn("skipped events of unknown torrents or users or of newer format", "count", skipped)
+	}
+}
+
+// readEvents Calls fn for each event in event log file, which may be gzip compressed
+func readEvents(name string, fn func(e *record.Event)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var reader io.Reader = file
+
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = gz.Close()
+		}()
+
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+
+	var e record.Event
+
+	for scanner.Scan() {
+		e = record.Event{}
+
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+
+		fn(&e)
+	}
+
+	return scanner.Err()
+}
+
+// simulatedPeer State of peer taken from cache which is advanced on each of its announces
+type simulatedPeer struct {
+	announce
+
+	announced bool
+	size      uint64
+}
+
+type swarm struct {
+	peers []*simulatedPeer
+}
+
+// newSwarms Creates swarms out of peers kept in cache, skipping ones of users with unknown passkey
+func newSwarms(torrents map[cdb.TorrentHash]*cdb.Torrent, passkeys map[uint32]string) (swarms []*swarm) {
+	for infoHash, torrent := range torrents {
+		sw := &swarm{}
+
+		for _, peers := range []*cdb.Peers{&torrent.Seeders, &torrent.Leechers} {
+			for _, peer := range peers.All() {
+				passkey, exists := passkeys[peer.UserID]
+				if !exists {
+					continue
+				}
+
+				p := &simulatedPeer{
+					announce: announce{
+						passkey:    passkey,
+						infoHash:   infoHash,
+						peerID:     peer.ID,
+						port:       peer.Port(),
+						uploaded:   peer.Uploaded,
+						downloaded: peer.Downloaded,
+						left:       peer.Left,
+					},
+					size: peer.Downloaded + peer.Left,
+				}
+
+				if peer.Addr.IsValid() {
+					p.ip = peer.Addr.IPString()
+				}
+
+				if peer.Addr6.IsValid() {
+					p.ipv6 = peer.Addr6.IPString()
+				}
+
+				sw.peers = append(sw.peers, p)
+			}
+		}
+
+		if len(sw.peers) > 0 {
+			swarms = append(swarms, sw)
+		}
+	}
+
+	return swarms
+}
+
+// next Advances state of peer as if time has passed since its previous announce and returns announce to send
+func (p *simulatedPeer) next() *announce {
+	a := p.announce
+
+	switch {
+	case !p.announced:
+		a.event = "started"
+		p.announced = true
+	case p.left > 0:
+		chunk := min(p.left, uint64(util.UnsafeIntn(64<<20)))
+
+		p.downloaded += chunk
+		p.left -= chunk
+		a.downloaded, a.left = p.downloaded, p.left
+
+		if p.left == 0 {
+			a.event = "completed"
+		}
+	default:
+		p.uploaded += uint64(util.UnsafeIntn(16 << 20))
+		a.uploaded = p.uploaded
+	}
+
+	return &a
+}
+
+/*
+generate Sends announces of random peers at given rate. Peers are picked by first picking random peer from all of
+them, so that busier swarms get proportionally more announces, same as they would in reality
+*/
+func generate(swarms []*swarm, rate float64, duration time.Duration, jobs chan<- *announce, s *stats) {
+	var peers []*simulatedPeer
+	for _, sw := range swarms {
+		peers = append(peers, sw.peers...)
+	}
+
+	if len(peers) == 0 {
+		slog.Error("cache contains no peers of known users to generate announces for")
+		return
+	}
+
+	slog.Info("generating announces", "swarms", len(swarms), "peers", len(peers), "rate", rate)
+
+	const tick = 10 * time.Millisecond
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var (
+		start = time.Now()
+		sent  float64
+	)
+
+	for now := range ticker.C {
+		elapsed := now.Sub(start)
+		if elapsed >= duration {
+			return
+		}
+
+		// Announces due by now, carrying over fractions between ticks
+		for due := rate * elapsed.Seconds(); sent < due; sent++ {
+			select {
+			case jobs <- peers[util.UnsafeIntn(len(peers))].next():
+			default:
+				// All workers are busy, wait for them instead of queueing up unbounded backlog
+				s.behind(time.Since(now))
+				jobs <- peers[util.UnsafeIntn(len(peers))].next()
+			}
+		}
+	}
+}
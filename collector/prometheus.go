@@ -30,15 +30,20 @@ var (
 	torrentsMetric   = metrics.NewGauge("chihaya_torrents", nil)
 	clientsMetric    = metrics.NewGauge("chihaya_clients", nil)
 	hitAndRunsMetric = metrics.NewGauge("chihaya_hnrs", nil)
+	usersFreeleech   = metrics.NewGauge("chihaya_users_freeleeches", nil)
 	peersMetric      = metrics.NewGauge("chihaya_peers", nil)
+	expiryMetric     = metrics.NewGauge("chihaya_expiry_scheduled_peers", nil)
+	connectedMetric  = metrics.NewGauge("chihaya_database_connected", nil)
 	requestsMetric   = metrics.NewCounter("chihaya_requests")
 	throughputMetric = metrics.NewGauge("chihaya_throughput", nil)
 
-	deadlockCountMetric   = metrics.NewCounter("chihaya_deadlock_count")
-	deadlockAbortedMetric = metrics.NewCounter("chihaya_deadlock_aborted_count")
-	deadlockTimeMetric    = metrics.NewFloatCounter("chihaya_deadlock_seconds_total")
-	erroredRequestsMetric = metrics.NewCounter("chihaya_requests_fail")
-	sqlErrorCountMetric   = metrics.NewCounter("chihaya_sql_errors_count")
+	deadlockCountMetric     = metrics.NewCounter("chihaya_deadlock_count")
+	deadlockAbortedMetric   = metrics.NewCounter("chihaya_deadlock_aborted_count")
+	deadlockTimeMetric      = metrics.NewFloatCounter("chihaya_deadlock_seconds_total")
+	erroredRequestsMetric   = metrics.NewCounter("chihaya_requests_fail")
+	peerKeyMismatchesMetric = metrics.NewCounter("chihaya_peer_key_mismatches")
+	recordedEventsMetric    = metrics.NewCounter("chihaya_record_events")
+	sqlErrorCountMetric     = metrics.NewCounter("chihaya_sql_errors_count")
 
 	serializationTime = metrics.NewHistogram("chihaya_serialization_seconds")
 	purgePeersTime    = metrics.NewHistogram("chihaya_purge_inactive_peers_seconds")
@@ -68,10 +73,36 @@ func UpdateHitAndRuns(count int) {
 	hitAndRunsMetric.Set(float64(count))
 }
 
+func UpdateUsersFreeleech(count int) {
+	usersFreeleech.Set(float64(count))
+}
+
+func UpdateDatabaseConnected(connected bool) {
+	if connected {
+		connectedMetric.Set(1)
+	} else {
+		connectedMetric.Set(0)
+	}
+}
+
 func IncrementRequests() {
 	requestsMetric.Inc()
 }
 
+func UpdateRequestDuration(endpoint, protocol string, time time.Duration) {
+	metrics.GetOrCreateHistogram(
+		fmt.Sprintf(`chihaya_request_duration_seconds{endpoint=%q,protocol=%q}`, endpoint, protocol),
+	).Update(time.Seconds())
+}
+
+func IncrementFailures(action, category string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_failures{action=%q,category=%q}`, action, category)).Inc()
+}
+
+func IncrementAnnounceEvents(event string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_announce_events{event=%q}`, event)).Inc()
+}
+
 func UpdateThroughput(rpm int) {
 	throughputMetric.Set(float64(rpm))
 }
@@ -100,14 +131,20 @@ func UpdateSerializationTime(v time.Duration) {
 	serializationTime.Update(v.Seconds())
 }
 
-func UpdateReloadTime(source string, time time.Duration) {
-	metrics.GetOrCreateHistogram(fmt.Sprintf(`chihaya_reload_seconds{source=%q}`, source)).Update(time.Seconds())
+func UpdateReloadTime(source, mode string, time time.Duration) {
+	metrics.GetOrCreateHistogram(
+		fmt.Sprintf(`chihaya_reload_seconds{source=%q,mode=%q}`, source, mode),
+	).Update(time.Seconds())
 }
 
 func UpdatePurgeInactivePeersTime(time time.Duration) {
 	purgePeersTime.Update(time.Seconds())
 }
 
+func UpdateExpiryScheduled(count int) {
+	expiryMetric.Set(float64(count))
+}
+
 func UpdateChannelFlushTime(channel string, time time.Duration) {
 	metrics.GetOrCreateHistogram(fmt.Sprintf(`chihaya_flush_seconds{channel=%q}`, channel)).Update(time.Seconds())
 }
@@ -115,3 +152,60 @@ func UpdateChannelFlushTime(channel string, time time.Duration) {
 func UpdateChannelFlushLen(channel string, length int) {
 	metrics.GetOrCreateHistogram(fmt.Sprintf(`chihaya_channel_len{channel=%q}`, channel)).Update(float64(length))
 }
+
+func UpdateChannelOccupancy(channel string, length, capacity int) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`chihaya_channel_occupancy{channel=%q}`, channel), nil).Set(float64(length))
+	metrics.GetOrCreateGauge(fmt.Sprintf(`chihaya_channel_capacity{channel=%q}`, channel), nil).Set(float64(capacity))
+}
+
+func IncrementCoalescedRows(channel string, count int) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_coalesced_rows{channel=%q}`, channel)).Add(count)
+}
+
+func UpdateChannelBacklog(channel string, count int) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`chihaya_channel_backlog{channel=%q}`, channel), nil).Set(float64(count))
+}
+
+func UpdateChannelBlocked(channel string, count int64) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`chihaya_channel_blocked{channel=%q}`, channel), nil).Set(float64(count))
+}
+
+func UpdateChannelCoalesced(channel string, count int) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`chihaya_channel_coalesced{channel=%q}`, channel), nil).Set(float64(count))
+}
+
+func IncrementThrottledRequests(action, limit string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_requests_throttled{action=%q,limit=%q}`, action, limit)).Inc()
+}
+
+func IncrementEarlyAnnounces(mode string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_announces_early{mode=%q}`, mode)).Inc()
+}
+
+func IncrementPeerKeyMismatches() {
+	peerKeyMismatchesMetric.Inc()
+}
+
+func IncrementRecordedEvents(count int) {
+	recordedEventsMetric.Add(count)
+}
+
+func IncrementRecordDropped(reason string, count int) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_record_dropped{reason=%q}`, reason)).Add(count)
+}
+
+func IncrementSuspicions(rule string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_suspicions{rule=%q}`, rule)).Inc()
+}
+
+func IncrementSpilledRows(channel string, count int) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_spilled_rows{channel=%q}`, channel)).Add(count)
+}
+
+func IncrementReplayedRows(channel string, count int) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`chihaya_replayed_rows{channel=%q}`, channel)).Add(count)
+}
+
+func UpdateSpillSize(channel string, size int64) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`chihaya_spill_bytes{channel=%q}`, channel), nil).Set(float64(size))
+}
@@ -47,6 +47,11 @@ func GetInt(s string, defaultValue int) (int, bool) {
 	return config.GetInt(s, defaultValue)
 }
 
+func GetStrings(s string, defaultValue []string) ([]string, bool) {
+	once.Do(readConfig)
+	return config.GetStrings(s, defaultValue)
+}
+
 func Section(s string) Map {
 	once.Do(readConfig)
 	return config.Section(s)
@@ -77,6 +82,26 @@ func (m Map) GetBool(s string, defaultValue bool) (bool, bool) {
 	return defaultValue, false
 }
 
+func (m Map) GetStrings(s string, defaultValue []string) ([]string, bool) {
+	values, exists := m[s].([]interface{})
+	if !exists {
+		return defaultValue, false
+	}
+
+	result := make([]string, 0, len(values))
+
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return defaultValue, false
+		}
+
+		result = append(result, str)
+	}
+
+	return result, true
+}
+
 func (m Map) Section(s string) Map {
 	result, _ := m[s].(map[string]interface{})
 	return result
@@ -55,6 +55,8 @@ func TestMain(m *testing.M) {
 	configTest["addr"] = ":34000"
 	configTest["numwant"] = json.Number("25")
 	configTest["log_flushes"] = true
+	configTest["trusted_proxies"] = []interface{}{"127.0.0.0/8", "::1/128"}
+	configTest["mixed"] = []interface{}{"127.0.0.0/8", json.Number("1")}
 
 	if err = json.NewEncoder(f).Encode(&configTest); err != nil {
 		panic(err)
@@ -131,6 +133,25 @@ func TestGetIntDefault(t *testing.T) {
 	}
 }
 
+func TestGetStrings(t *testing.T) {
+	got, _ := GetStrings("trusted_proxies", nil)
+	expected := []string{"127.0.0.0/8", "::1/128"}
+
+	if same := reflect.DeepEqual(got, expected); !same {
+		t.Fatalf("Got %v whereas expected %v for \"trusted_proxies\"!", got, expected)
+	}
+}
+
+func TestGetStringsDefault(t *testing.T) {
+	for _, key := range []string{"idontexist", "mixed", "addr"} {
+		got, exists := GetStrings(key, []string{"iamdefault"})
+
+		if exists || len(got) != 1 || got[0] != "iamdefault" {
+			t.Fatalf("Got %v whereas expected [iamdefault] for \"%s\"!", got, key)
+		}
+	}
+}
+
 func TestSection(t *testing.T) {
 	got := Section("database")
 	gotMap := make(map[string]interface{}, len(got))
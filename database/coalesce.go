@@ -0,0 +1,149 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	cdb "chihaya/database/types"
+)
+
+/*
+ * Updates of the same row can be merged into single update which has the same effect on storage as applying them one
+ * after another: deltas are summed and remaining fields are taken from the later update. Merge functions receive
+ * earlier update first.
+ */
+
+// transferIPKey Identifies row of transfer_ips table
+type transferIPKey struct {
+	UserID    uint32
+	TorrentID uint32
+	ClientID  uint16
+	IP        [4]byte
+	IP6       [16]byte
+}
+
+func addSnatches(a, b uint8) uint8 {
+	if sum := uint16(a) + uint16(b); sum <= 0xFF {
+		return uint8(sum)
+	}
+
+	return 0xFF
+}
+
+func torrentUpdateKey(u TorrentUpdate) uint32 {
+	return u.ID
+}
+
+func mergeTorrentUpdates(prev, next TorrentUpdate) TorrentUpdate {
+	next.DeltaSnatch = addSnatches(prev.DeltaSnatch, next.DeltaSnatch)
+	next.LastAction = max(prev.LastAction, next.LastAction)
+
+	// Status is only stored if it was changed by any of the updates, in which case latest change wins
+	if !next.StatusChanged {
+		next.StatusChanged, next.Status, next.PruneReason = prev.StatusChanged, prev.Status, prev.PruneReason
+	}
+
+	return next
+}
+
+func userUpdateKey(u UserUpdate) uint32 {
+	return u.ID
+}
+
+func mergeUserUpdates(prev, next UserUpdate) UserUpdate {
+	next.DeltaUp += prev.DeltaUp
+	next.DeltaDown += prev.DeltaDown
+	next.RawDeltaUp += prev.RawDeltaUp
+	next.RawDeltaDown += prev.RawDeltaDown
+
+	return next
+}
+
+func transferHistoryUpdateKey(u TransferHistoryUpdate) cdb.UserTorrentPair {
+	return cdb.UserTorrentPair{UserID: u.UserID, TorrentID: u.TorrentID}
+}
+
+func mergeTransferHistoryUpdates(prev, next TransferHistoryUpdate) TransferHistoryUpdate {
+	next.RawDeltaUp += prev.RawDeltaUp
+	next.RawDeltaDown += prev.RawDeltaDown
+	next.DeltaTime += prev.DeltaTime
+	next.DeltaSeedTime += prev.DeltaSeedTime
+	next.DeltaSnatch = addSnatches(prev.DeltaSnatch, next.DeltaSnatch)
+
+	// Start time is only stored when row is inserted, so it is taken from the first update
+	next.StartTime = prev.StartTime
+
+	return next
+}
+
+func transferIPUpdateKey(u TransferIPUpdate) transferIPKey {
+	return transferIPKey{
+		UserID:    u.UserID,
+		TorrentID: u.TorrentID,
+		ClientID:  u.ClientID,
+		IP:        u.Addr.IP(),
+		IP6:       u.Addr6.IP(),
+	}
+}
+
+func mergeTransferIPUpdates(prev, next TransferIPUpdate) TransferIPUpdate {
+	next.RawDeltaUp += prev.RawDeltaUp
+	next.RawDeltaDown += prev.RawDeltaDown
+	next.StartTime = prev.StartTime
+
+	return next
+}
+
+func snatchUpdateKey(u SnatchUpdate) cdb.UserTorrentPair {
+	return cdb.UserTorrentPair{UserID: u.UserID, TorrentID: u.TorrentID}
+}
+
+// mergeSnatchUpdates Only first snatch is recorded, so later ones are dropped
+func mergeSnatchUpdates(prev, _ SnatchUpdate) SnatchUpdate {
+	return prev
+}
+
+/*
+compact Merges rows of the same key in place, at position of the first one, and returns shortened rows. Index is
+scratch space kept by caller between calls. Rows are returned unchanged if merge is nil.
+*/
+func compact[K comparable, T any](rows []T, key func(row T) K, merge func(prev, next T) T, index map[K]int) []T {
+	if merge == nil || len(rows) < 2 {
+		return rows
+	}
+
+	clear(index)
+
+	n := 0
+
+	for _, row := range rows {
+		k := key(row)
+
+		if i, exists := index[k]; exists {
+			rows[i] = merge(rows[i], row)
+			continue
+		}
+
+		index[k] = n
+		rows[n] = row
+		n++
+	}
+
+	clear(rows[n:]) // do not keep strings of merged rows alive
+
+	return rows[:n]
+}
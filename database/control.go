@@ -0,0 +1,157 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	cdb "chihaya/database/types"
+)
+
+/*
+TorrentByID Returns torrent with given ID along with its info hash. Torrents are looked up through index of info hashes
+by ID kept for reloads, so that lookup does not have to go through all torrents.
+*/
+func (db *Database) TorrentByID(id uint32) (cdb.TorrentHash, *cdb.Torrent, bool) {
+	db.reloadLock.Lock()
+	infoHash, exists := db.torrentHashes[id]
+	db.reloadLock.Unlock()
+
+	if !exists {
+		return infoHash, nil, false
+	}
+
+	torrent, exists := db.Torrents.Get(infoHash)
+
+	return infoHash, torrent, exists
+}
+
+// StoreTorrents Replaces all torrents in memory, along with index of their info hashes by ID
+func (db *Database) StoreTorrents(torrents map[cdb.TorrentHash]*cdb.Torrent) {
+	db.reloadLock.Lock()
+	defer db.reloadLock.Unlock()
+
+	hashes := make(map[uint32]cdb.TorrentHash, len(torrents))
+	for infoHash, torrent := range torrents {
+		hashes[torrent.ID.Load()] = infoHash
+	}
+
+	db.Torrents.Store(cdb.NewTorrentShards(torrents))
+	db.torrentHashes = hashes
+}
+
+/*
+KickPeer Removes peer from torrent swarm in memory and marks it inactive in database, as if it has stopped. Peer is not
+prevented from announcing again, in which case it will simply rejoin the swarm.
+*/
+func (db *Database) KickPeer(torrent *cdb.Torrent, key cdb.PeerKey) bool {
+	torrent.PeerLock()
+	defer torrent.PeerUnlock()
+
+	if seeder, exists := torrent.Seeders.Get(key); exists {
+		torrent.Seeders.Delete(key)
+		torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+
+		db.queueInactive(seeder)
+	} else if leecher, exists := torrent.Leechers.Get(key); exists {
+		torrent.Leechers.Delete(key)
+		torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+		torrent.LeecherRemoved(leecher)
+
+		db.queueInactive(leecher)
+	} else {
+		return false
+	}
+
+	db.QueueTorrent(torrent, 0)
+
+	return true
+}
+
+/*
+queueInactive Marks peer removed from swarm inactive in transfer history, just like stopped announce does. Transfer IPs
+keep no activity state and stopped announce only adds its transfer to them, so there is nothing to queue for removed
+peer there.
+*/
+func (db *Database) queueInactive(peer *cdb.Peer) {
+	db.QueueTransferHistory(peer, 0, 0, 0, 0, 0, false)
+}
+
+/*
+EvictUser Removes user with given ID from memory along with all of its peers and returns number of peers removed.
+Unless user is also disabled in database, it will be loaded again on next reload.
+*/
+func (db *Database) EvictUser(id uint32) (found bool, peers int) {
+	db.reloadLock.Lock()
+	defer db.reloadLock.Unlock()
+
+	dbUsers := *db.Users.Load()
+	newUsers := make(map[string]*cdb.User, len(dbUsers))
+
+	for passkey, user := range dbUsers {
+		if user.ID.Load() == id {
+			found = true
+			continue
+		}
+
+		newUsers[passkey] = user
+	}
+
+	if !found {
+		return false, 0
+	}
+
+	db.Users.Store(&newUsers)
+
+	ofUser := func(_ cdb.PeerKey, peer *cdb.Peer) bool {
+		if peer.UserID != id {
+			return false
+		}
+
+		db.queueInactive(peer)
+
+		return true
+	}
+
+	for _, torrent := range db.Torrents.All() {
+		func() {
+			torrent.PeerLock()
+			defer torrent.PeerUnlock()
+
+			count := peers
+
+			peers += torrent.Seeders.DeleteFunc(ofUser)
+			peers += torrent.Leechers.DeleteFunc(func(key cdb.PeerKey, peer *cdb.Peer) bool {
+				if !ofUser(key, peer) {
+					return false
+				}
+
+				torrent.LeecherRemoved(peer)
+
+				return true
+			})
+
+			if count != peers {
+				torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+				torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+
+				db.QueueTorrent(torrent, 0)
+			}
+		}()
+	}
+
+	return true, peers
+}
@@ -18,11 +18,8 @@
 package database
 
 import (
-	"bytes"
 	"context"
-	"database/sql"
 	"log/slog"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,38 +27,68 @@ import (
 	"chihaya/collector"
 	"chihaya/config"
 	cdb "chihaya/database/types"
-	"chihaya/util"
-
-	"github.com/go-sql-driver/mysql"
 )
 
 type Database struct {
-	snatchChannel          chan *bytes.Buffer
-	transferHistoryChannel chan *bytes.Buffer
-	transferIpsChannel     chan *bytes.Buffer
-	torrentChannel         chan *bytes.Buffer
-	userChannel            chan *bytes.Buffer
-
-	loadTorrentsStmt              *sql.Stmt
-	loadTorrentGroupFreeleechStmt *sql.Stmt
-	loadClientsStmt               *sql.Stmt
-	loadFreeleechStmt             *sql.Stmt
-	loadHnrStmt                   *sql.Stmt
-	loadUsersStmt                 *sql.Stmt
-	cleanStalePeersStmt           *sql.Stmt
-	unPruneTorrentStmt            *sql.Stmt
+	snatchChannel          chan SnatchUpdate
+	transferHistoryChannel chan TransferHistoryUpdate
+	transferIpsChannel     chan TransferIPUpdate
+	torrentChannel         chan TorrentUpdate
+	userChannel            chan UserUpdate
+	suspicionChannel       chan SuspicionUpdate
+
+	snatchSpill          *spillFile[SnatchUpdate]
+	transferHistorySpill *spillFile[TransferHistoryUpdate]
+	transferIpsSpill     *spillFile[TransferIPUpdate]
+	torrentSpill         *spillFile[TorrentUpdate]
+	userSpill            *spillFile[UserUpdate]
+	suspicionSpill       *spillFile[SuspicionUpdate]
+
+	snatchOverflow          *overflow[cdb.UserTorrentPair, SnatchUpdate]
+	transferHistoryOverflow *overflow[cdb.UserTorrentPair, TransferHistoryUpdate]
+	transferIpsOverflow     *overflow[transferIPKey, TransferIPUpdate]
+	torrentOverflow         *overflow[uint32, TorrentUpdate]
+	userOverflow            *overflow[uint32, UserUpdate]
+	suspicionOverflow       *overflow[struct{}, SuspicionUpdate]
 
 	Users                 atomic.Pointer[map[string]*cdb.User]
 	HitAndRuns            atomic.Pointer[map[cdb.UserTorrentPair]struct{}]
-	Torrents              atomic.Pointer[map[cdb.TorrentHash]*cdb.Torrent]
+	Torrents              cdb.TorrentIndex
 	TorrentGroupFreeleech atomic.Pointer[map[cdb.TorrentGroupKey]*cdb.TorrentGroupFreeleech]
+	UsersFreeleech        atomic.Pointer[map[cdb.UserTorrentPair]*cdb.UserFreeleech]
+	FreeleechWindows      atomic.Pointer[cdb.FreeleechWindows]
 	Clients               atomic.Pointer[map[uint16]string]
 
-	bufferPool *util.BufferPool
-
 	transferHistoryLock sync.Mutex
 
-	conn *sql.DB
+	// expiry Schedule of peer expiry, see purgeInactivePeers
+	expiry peerExpiry
+
+	// pruning Schedule of torrent pruning, see purgeInactivePeers
+	pruning pruneSchedule
+
+	// reloadLock Serializes writers replacing in-memory maps (scheduled reloads and administrative changes)
+	reloadLock sync.Mutex
+
+	// torrentHashes Info hash of every loaded torrent by its ID for incremental reloads, guarded by reloadLock
+	torrentHashes map[uint32]cdb.TorrentHash
+
+	/* changeID, changeLogReady and lastFullReload Track position of incremental reloads, changeGaps holds IDs below
+	changeID which were skipped (their transactions may still commit) along with time they were first noticed.
+	All guarded by reloadLock */
+	changeID       uint64
+	changeGaps     map[uint64]time.Time
+	changeLogReady bool
+	lastFullReload time.Time
+
+	storage Storage
+
+	// disconnectedAt Time (in milliseconds since epoch) since which database is unavailable, 0 while it is available
+	disconnectedAt atomic.Int64
+
+	/* loaded Set once in-memory maps were loaded from cache or database. Until then they hold nothing worth keeping, so
+	they are not serialized, as that would overwrite cache which may be the only copy left while database is down. */
+	loaded atomic.Bool
 
 	terminate atomic.Bool
 	ctx       context.Context
@@ -70,98 +97,71 @@ type Database struct {
 }
 
 var (
-	deadlockWaitTime   int
-	maxDeadlockRetries int
+	connectInterval    int
+	connectMaxInterval int
 )
 
-const defaultDsn = "chihaya:@tcp(127.0.0.1:3306)/chihaya"
+func init() {
+	intervals := config.Section("intervals")
+
+	connectInterval, _ = intervals.GetInt("database_connect", 5)
+	connectMaxInterval, _ = intervals.GetInt("database_connect_max", 120)
+}
 
 func (db *Database) Init() {
 	db.terminate.Store(false)
 	db.ctx, db.ctxCancel = context.WithCancel(context.Background())
 
-	slog.Info("opening database connection")
-
-	db.conn = Open()
-
-	// Used for recording updates, so the max required size should be < 128 bytes. See queue.go for details
-	db.bufferPool = util.NewBufferPool(128)
+	channelsConfig := config.Section("channels")
+	torrentFlushBufferSize, _ = channelsConfig.GetInt("torrents", 5000)
+	userFlushBufferSize, _ = channelsConfig.GetInt("users", 5000)
+	transferHistoryFlushBufferSize, _ = channelsConfig.GetInt("transfer_history", 5000)
+	transferIpsFlushBufferSize, _ = channelsConfig.GetInt("transfer_ips", 5000)
+	snatchFlushBufferSize, _ = channelsConfig.GetInt("snatches", 25)
+	suspicionFlushBufferSize, _ = channelsConfig.GetInt("suspicions", 500)
 
-	var err error
+	dbUsers := make(map[string]*cdb.User)
+	db.Users.Store(&dbUsers)
 
-	db.loadUsersStmt, err = db.conn.Prepare(
-		"SELECT ID, torrent_pass, DownMultiplier, UpMultiplier, DisableDownload, TrackerHide " +
-			"FROM users_main WHERE Enabled = '1'")
-	if err != nil {
-		panic(err)
-	}
+	db.Torrents.Store(&cdb.TorrentShards{})
 
-	db.loadHnrStmt, err = db.conn.Prepare(
-		"SELECT h.uid, h.fid FROM transfer_history AS h " +
-			"JOIN users_main AS u ON u.ID = h.uid WHERE h.hnr = 1 AND u.Enabled = '1'")
-	if err != nil {
-		panic(err)
-	}
+	dbHitAndRuns := make(map[cdb.UserTorrentPair]struct{})
+	db.HitAndRuns.Store(&dbHitAndRuns)
 
-	db.loadTorrentsStmt, err = db.conn.Prepare(
-		"SELECT ID, info_hash, DownMultiplier, UpMultiplier, Snatched, Status, GroupID, TorrentType FROM torrents " +
-			"WHERE TorrentType != 'internal'")
-	if err != nil {
-		panic(err)
-	}
+	dbTorrentGroupFreeleech := make(map[cdb.TorrentGroupKey]*cdb.TorrentGroupFreeleech)
+	db.TorrentGroupFreeleech.Store(&dbTorrentGroupFreeleech)
 
-	db.loadTorrentGroupFreeleechStmt, err = db.conn.Prepare(
-		"SELECT GroupID, `Type`, DownMultiplier, UpMultiplier FROM torrent_group_freeleech")
-	if err != nil {
-		panic(err)
-	}
+	dbUsersFreeleech := make(map[cdb.UserTorrentPair]*cdb.UserFreeleech)
+	db.UsersFreeleech.Store(&dbUsersFreeleech)
 
-	db.loadClientsStmt, err = db.conn.Prepare(
-		"SELECT id, peer_id FROM approved_clients WHERE archived = 0")
-	if err != nil {
-		panic(err)
-	}
+	db.FreeleechWindows.Store(&cdb.FreeleechWindows{})
 
-	db.loadFreeleechStmt, err = db.conn.Prepare(
-		"SELECT mod_setting FROM mod_core WHERE mod_option = 'global_freeleech'")
-	if err != nil {
-		panic(err)
-	}
+	dbClients := make(map[uint16]string)
+	db.Clients.Store(&dbClients)
 
-	db.cleanStalePeersStmt, err = db.conn.Prepare(
-		"UPDATE transfer_history SET active = 0 WHERE last_announce < ? AND active = 1")
-	if err != nil {
-		panic(err)
-	}
+	cached := db.deserialize()
+	db.loaded.Store(cached)
 
-	db.unPruneTorrentStmt, err = db.conn.Prepare(
-		"UPDATE torrents SET Status = 0 WHERE ID = ?")
-	if err != nil {
-		panic(err)
-	}
+	// Storage is only set once database is reachable; until then, tracker serves from cache and flushes are held back
+	deferred := &deferredStorage{}
 
-	dbUsers := make(map[string]*cdb.User)
-	db.Users.Store(&dbUsers)
+	db.storage = deferred
+	db.setConnected(false)
 
-	dbTorrents := make(map[cdb.TorrentHash]*cdb.Torrent)
-	db.Torrents.Store(&dbTorrents)
+	slog.Info("opening database connection")
 
-	dbHitAndRuns := make(map[cdb.UserTorrentPair]struct{})
-	db.HitAndRuns.Store(&dbHitAndRuns)
+	// Run initial load to populate data in memory before we start accepting connections
+	if err := db.connect(deferred); err != nil {
+		if !cached {
+			slog.Warn("no cache to serve from, announces are rejected until database becomes available")
+		}
 
-	dbClients := make(map[uint16]string)
-	db.Clients.Store(&dbClients)
+		slog.Error("database is unavailable, starting in degraded mode", "err", err)
+	}
 
-	db.deserialize()
+	db.waitGroup.Add(1)
 
-	// Run initial load to populate data in memory before we start accepting connections
-	slog.Info("populating initial data into memory")
-	db.loadUsers()
-	db.loadHitAndRuns()
-	db.loadTorrents()
-	db.loadGroupsFreeleech()
-	db.loadConfig()
-	db.loadClients()
+	go db.monitorConnection(deferred)
 
 	slog.Info("starting goroutines")
 	db.startReloading()
@@ -169,118 +169,111 @@ func (db *Database) Init() {
 	db.startFlushing()
 }
 
-func (db *Database) Terminate() {
-	slog.Info("terminating database connection")
+/*
+connect Connects to database (or checks connection to it, if storage was created before) and reloads everything from
+it, leaving degraded mode. Statements are only prepared once database is reachable, as part of creating storage.
+*/
+func (db *Database) connect(deferred *deferredStorage) error {
+	if _, err := deferred.get(); err != nil {
+		storage, err := newStorage()
+		if err != nil {
+			return err
+		}
 
-	db.terminate.Store(true)
-	db.ctxCancel()
+		deferred.set(storage)
+	} else if err = deferred.Ping(); err != nil {
+		return err
+	}
 
-	slog.Info("closing all flush channels")
-	db.closeFlushChannels()
+	slog.Info("populating data from database into memory")
 
-	go func() {
-		time.Sleep(10 * time.Second)
-		slog.Info("waiting for database flushing to finish")
-	}()
+	db.Reload()
+	db.setConnected(true)
 
-	db.waitGroup.Wait()
-	_ = db.conn.Close()
-	db.serialize()
+	return nil
 }
 
-func Open() *sql.DB {
-	databaseConfig := config.Section("database")
-	deadlockWaitTime, _ = databaseConfig.GetInt("deadlock_pause", 1)
-	maxDeadlockRetries, _ = databaseConfig.GetInt("deadlock_retries", 5)
+/*
+monitorConnection Checks connection to database every database_connect interval. Once it is lost, tracker enters
+degraded mode and connection is retried with exponential backoff, up to database_connect_max interval between attempts.
+*/
+func (db *Database) monitorConnection(deferred *deferredStorage) {
+	defer db.waitGroup.Done()
 
-	channelsConfig := config.Section("channels")
-	torrentFlushBufferSize, _ = channelsConfig.GetInt("torrents", 5000)
-	userFlushBufferSize, _ = channelsConfig.GetInt("users", 5000)
-	transferHistoryFlushBufferSize, _ = channelsConfig.GetInt("transfer_history", 5000)
-	transferIpsFlushBufferSize, _ = channelsConfig.GetInt("transfer_ips", 5000)
-	snatchFlushBufferSize, _ = channelsConfig.GetInt("snatches", 25)
+	var (
+		minDelay = time.Duration(connectInterval) * time.Second
+		maxDelay = time.Duration(connectMaxInterval) * time.Second
+		delay    = minDelay
+	)
 
-	// DSN Format: username:password@protocol(address)/dbname?param=value
-	// First try to load the DSN from environment. Useful for tests.
-	databaseDsn := os.Getenv("DB_DSN")
-	if databaseDsn == "" {
-		databaseDsn, _ = databaseConfig.Get("dsn", defaultDsn)
-	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
-	sqlDb, err := sql.Open("mysql", databaseDsn)
-	if err != nil {
-		panic(err)
-	}
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-timer.C:
+		}
 
-	if err = sqlDb.Ping(); err != nil {
-		panic(err)
-	}
+		if !db.Degraded() {
+			if err := deferred.Ping(); err != nil {
+				slog.Error("lost connection to database, entering degraded mode", "err", err)
+				db.setConnected(false)
+			}
 
-	return sqlDb
-}
+			delay = minDelay
+		} else if err := db.connect(deferred); err != nil {
+			delay = min(delay*2, maxDelay)
+
+			slog.Warn("database is still unavailable", "err", err, "retry", delay)
+		} else {
+			slog.Info("connected to database, leaving degraded mode")
 
-func (db *Database) query(stmt *sql.Stmt, args ...interface{}) *sql.Rows { //nolint:unparam
-	rows, _ := perform(func() (interface{}, error) {
-		return stmt.Query(args...)
-	}).(*sql.Rows)
+			delay = minDelay
+		}
 
-	return rows
+		timer.Reset(delay)
+	}
 }
 
-func (db *Database) execute(stmt *sql.Stmt, args ...interface{}) sql.Result {
-	result, _ := perform(func() (interface{}, error) {
-		return stmt.Exec(args...)
-	}).(sql.Result)
+// setConnected Records whether database is available, along with time since which it is not
+func (db *Database) setConnected(connected bool) {
+	if connected {
+		db.disconnectedAt.Store(0)
+	} else {
+		db.disconnectedAt.CompareAndSwap(0, time.Now().UnixMilli())
+	}
 
-	return result
+	collector.UpdateDatabaseConnected(connected)
 }
 
-func (db *Database) exec(query *bytes.Buffer, args ...interface{}) sql.Result { //nolint:unparam
-	result, _ := perform(func() (interface{}, error) {
-		return db.conn.Exec(query.String(), args...)
-	}).(sql.Result)
+// Degraded Returns whether tracker serves without database, as it is currently unavailable
+func (db *Database) Degraded() bool {
+	return db.disconnectedAt.Load() != 0
+}
 
-	return result
+// DisconnectedAt Returns time (in milliseconds since epoch) since which database is unavailable, 0 if it is available
+func (db *Database) DisconnectedAt() int64 {
+	return db.disconnectedAt.Load()
 }
 
-func perform(exec func() (interface{}, error)) (result interface{}) {
-	var (
-		err   error
-		tries int
-		wait  time.Duration
-	)
+func (db *Database) Terminate() {
+	slog.Info("terminating database connection")
 
-	for tries = 1; tries <= maxDeadlockRetries; tries++ {
-		result, err = exec()
-		if err != nil {
-			//goland:noinspection GoTypeAssertionOnErrors
-			if merr, isMysqlError := err.(*mysql.MySQLError); isMysqlError {
-				if merr.Number == 1213 || merr.Number == 1205 {
-					wait = time.Duration(deadlockWaitTime*tries) * time.Second
-					slog.Warn("deadlock found", "wait", wait.String(), "try", tries, "max", maxDeadlockRetries)
-
-					if tries == 1 {
-						collector.IncrementDeadlockCount()
-					}
-
-					collector.IncrementDeadlockTime(wait)
-					time.Sleep(wait)
-
-					continue
-				}
-
-				slog.Error("sql error found", "err", merr.Number, "msg", merr.Message)
-				collector.IncrementSQLErrorCount()
-			} else {
-				panic(err)
-			}
-		}
+	db.terminate.Store(true)
+	db.ctxCancel()
 
-		return
-	}
+	slog.Info("closing all flush channels")
+	db.closeFlushChannels()
 
-	slog.Error("deadlock retries exceeded", "tries", tries)
-	collector.IncrementDeadlockAborted()
+	go func() {
+		time.Sleep(10 * time.Second)
+		slog.Info("waiting for database flushing to finish")
+	}()
 
-	return
+	db.waitGroup.Wait()
+	db.closeSpills()
+	_ = db.storage.Close()
+	db.serialize()
 }
@@ -18,7 +18,9 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
+	"maps"
 	"math"
 	"net/netip"
 	"os"
@@ -34,6 +36,7 @@ import (
 
 var (
 	db       *Database
+	conn     *sql.DB
 	fixtures *testfixtures.Context
 )
 
@@ -41,11 +44,20 @@ func TestMain(m *testing.M) {
 	var err error
 
 	flushSleepInterval = 1
+	spillDir = ""
 	db = &Database{}
 
 	db.Init()
 
-	fixtures, err = testfixtures.NewFolder(db.conn, "fixtures")
+	// Tracker starts even without database, but tests need it
+	storage, err := db.storage.(*deferredStorage).get()
+	if err != nil {
+		panic(err)
+	}
+
+	conn = storage.(*mysqlStorage).conn
+
+	fixtures, err = testfixtures.NewFolder(conn, "fixtures")
 	if err != nil {
 		panic(err)
 	}
@@ -138,13 +150,9 @@ func TestLoadHitAndRuns(t *testing.T) {
 func TestLoadTorrents(t *testing.T) {
 	prepareTestDatabase()
 
-	dbTorrents := make(map[cdb.TorrentHash]*cdb.Torrent)
-	db.Torrents.Store(&dbTorrents)
+	db.Torrents.Store(&cdb.TorrentShards{})
 
-	t1 := &cdb.Torrent{
-		Seeders:  map[cdb.PeerKey]*cdb.Peer{},
-		Leechers: map[cdb.PeerKey]*cdb.Peer{},
-	}
+	t1 := &cdb.Torrent{}
 	t1.ID.Store(1)
 	t1.Status.Store(1)
 	t1.Snatched.Store(2)
@@ -152,11 +160,9 @@ func TestLoadTorrents(t *testing.T) {
 	t1.UpMultiplier.Store(math.Float64bits(1))
 	t1.Group.GroupID.Store(1)
 	t1.Group.TorrentType.Store(cdb.MustTorrentTypeFromString("anime"))
+	t1.LastAction.Store(1585955952)
 
-	t2 := &cdb.Torrent{
-		Seeders:  map[cdb.PeerKey]*cdb.Peer{},
-		Leechers: map[cdb.PeerKey]*cdb.Peer{},
-	}
+	t2 := &cdb.Torrent{}
 	t2.ID.Store(2)
 	t2.Status.Store(0)
 	t2.Snatched.Store(0)
@@ -164,11 +170,9 @@ func TestLoadTorrents(t *testing.T) {
 	t2.UpMultiplier.Store(math.Float64bits(0.5))
 	t2.Group.GroupID.Store(1)
 	t2.Group.TorrentType.Store(cdb.MustTorrentTypeFromString("music"))
+	t2.LastAction.Store(1415463675)
 
-	t3 := &cdb.Torrent{
-		Seeders:  map[cdb.PeerKey]*cdb.Peer{},
-		Leechers: map[cdb.PeerKey]*cdb.Peer{},
-	}
+	t3 := &cdb.Torrent{}
 	t3.ID.Store(3)
 	t3.Status.Store(0)
 	t3.Snatched.Store(0)
@@ -176,6 +180,7 @@ func TestLoadTorrents(t *testing.T) {
 	t3.UpMultiplier.Store(math.Float64bits(1))
 	t3.Group.GroupID.Store(2)
 	t3.Group.TorrentType.Store(cdb.MustTorrentTypeFromString("anime"))
+	t3.LastAction.Store(1609032541)
 
 	torrents := map[cdb.TorrentHash]*cdb.Torrent{
 		{114, 239, 32, 237, 220, 181, 67, 143, 115, 182, 216, 141, 120, 196, 223, 193, 102, 123, 137, 56}: t1,
@@ -186,7 +191,7 @@ func TestLoadTorrents(t *testing.T) {
 	// Test with fresh data
 	db.loadTorrents()
 
-	dbTorrents = *db.Torrents.Load()
+	dbTorrents := maps.Collect(db.Torrents.All())
 
 	if len(dbTorrents) != len(torrents) {
 		t.Fatal(fixtureFailure("Did not load all torrents as expected from fixture file",
@@ -209,7 +214,7 @@ func TestLoadTorrents(t *testing.T) {
 
 	db.loadTorrents()
 
-	dbTorrents = *db.Torrents.Load()
+	dbTorrents = maps.Collect(db.Torrents.All())
 
 	if !cmp.Equal(oldTorrents, dbTorrents, cdb.TorrentTestCompareOptions...) {
 		t.Fatal(fixtureFailure("Did not reload torrents as expected from fixture file", oldTorrents, dbTorrents))
@@ -264,6 +269,61 @@ func TestLoadGroupsFreeleech(t *testing.T) {
 	}
 }
 
+func TestLoadUsersFreeleech(t *testing.T) {
+	prepareTestDatabase()
+
+	dbMap := make(map[cdb.UserTorrentPair]*cdb.UserFreeleech)
+	db.UsersFreeleech.Store(&dbMap)
+
+	// Expired entries are not loaded
+	usersFreeleech := map[cdb.UserTorrentPair]*cdb.UserFreeleech{
+		{UserID: 1, TorrentID: 1}: {
+			DownMultiplier: 0,
+			UpMultiplier:   1,
+			Expiry:         4102444800,
+		},
+		{UserID: 2, TorrentID: 1}: {
+			DownMultiplier: 1,
+			UpMultiplier:   2,
+			Expiry:         4102444800,
+		},
+	}
+
+	db.loadUsersFreeleech()
+
+	dbMap = *db.UsersFreeleech.Load()
+
+	if !reflect.DeepEqual(usersFreeleech, dbMap) {
+		t.Fatal(fixtureFailure("Did not load users freeleech data as expected from fixture file",
+			usersFreeleech,
+			dbMap))
+	}
+}
+
+func TestLoadFreeleechWindows(t *testing.T) {
+	prepareTestDatabase()
+
+	db.FreeleechWindows.Store(&cdb.FreeleechWindows{})
+
+	// Windows which have already ended are not loaded, future ones are
+	freeleechWindows := &cdb.FreeleechWindows{
+		Global: []cdb.FreeleechWindow{{Start: 1584996101, End: 4102444800, DownMultiplier: 1, UpMultiplier: 2}},
+		Groups: map[cdb.TorrentGroupKey][]cdb.FreeleechWindow{
+			cdb.MustTorrentGroupKeyFromString("anime", 2): {
+				{Start: 4102444700, End: 4102444800, DownMultiplier: 0, UpMultiplier: 1},
+			},
+		},
+	}
+
+	db.loadFreeleechWindows()
+
+	if dbWindows := db.FreeleechWindows.Load(); !reflect.DeepEqual(freeleechWindows, dbWindows) {
+		t.Fatal(fixtureFailure("Did not load freeleech windows as expected from fixture file",
+			freeleechWindows,
+			dbWindows))
+	}
+}
+
 func TestLoadConfig(t *testing.T) {
 	prepareTestDatabase()
 
@@ -305,7 +365,7 @@ func TestLoadClients(t *testing.T) {
 func TestUnPrune(t *testing.T) {
 	prepareTestDatabase()
 
-	dbTorrents := *db.Torrents.Load()
+	dbTorrents := maps.Collect(db.Torrents.All())
 
 	h := cdb.TorrentHash{114, 239, 32, 237, 220, 181, 67, 143, 115, 182, 216, 141, 120, 196, 223, 193, 102, 123, 137, 56}
 	dbTorrent := dbTorrents[h]
@@ -314,8 +374,8 @@ func TestUnPrune(t *testing.T) {
 		Seeders:  dbTorrent.Seeders,
 		Leechers: dbTorrent.Leechers,
 	}
-	torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
-	torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
+	torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+	torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
 	torrent.ID.Store(dbTorrent.ID.Load())
 	torrent.Status.Store(dbTorrent.Status.Load())
 	torrent.Snatched.Store(dbTorrent.Snatched.Load())
@@ -323,14 +383,22 @@ func TestUnPrune(t *testing.T) {
 	torrent.UpMultiplier.Store(dbTorrent.UpMultiplier.Load())
 	torrent.Group.GroupID.Store(dbTorrent.Group.GroupID.Load())
 	torrent.Group.TorrentType.Store(dbTorrent.Group.TorrentType.Load())
+	torrent.LastAction.Store(dbTorrent.LastAction.Load())
 
 	torrent.Status.Store(0)
 
-	db.UnPrune(dbTorrents[h])
+	dbTorrents[h].Status.Store(0)
+	db.QueueTorrentStatus(dbTorrents[h], "")
+
+	for len(db.torrentChannel) > 0 {
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(200 * time.Millisecond)
 
 	db.loadTorrents()
 
-	dbTorrents = *db.Torrents.Load()
+	dbTorrents = maps.Collect(db.Torrents.All())
 
 	if !cmp.Equal(&torrent, dbTorrents[h], cdb.TorrentTestCompareOptions...) {
 		t.Fatal(fixtureFailure(
@@ -369,7 +437,7 @@ func TestRecordAndFlushUsers(t *testing.T) {
 	deltaDownload = int64(float64(deltaRawDownload) * math.Float64frombits(testUser.DownMultiplier.Load()))
 	deltaUpload = int64(float64(deltaRawUpload) * math.Float64frombits(testUser.UpMultiplier.Load()))
 
-	row := db.conn.QueryRow("SELECT Uploaded, Downloaded, rawup, rawdl "+
+	row := conn.QueryRow("SELECT Uploaded, Downloaded, rawup, rawdl "+
 		"FROM users_main WHERE ID = ?", testUser.ID.Load())
 
 	err := row.Scan(&initUpload, &initDownload, &initRawUpload, &initRawDownload)
@@ -385,7 +453,7 @@ func TestRecordAndFlushUsers(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	row = db.conn.QueryRow("SELECT Uploaded, Downloaded, rawup, rawdl "+
+	row = conn.QueryRow("SELECT Uploaded, Downloaded, rawup, rawdl "+
 		"FROM users_main WHERE ID = ?", testUser.ID.Load())
 
 	err = row.Scan(&upload, &download, &rawUpload, &rawDownload)
@@ -466,7 +534,7 @@ func TestRecordAndFlushTransferHistory(t *testing.T) {
 	deltaActiveTime = 267
 	deltaSeedTime = 15
 
-	row := db.conn.QueryRow("SELECT uploaded, downloaded, activetime, seedtime, active, snatched "+
+	row := conn.QueryRow("SELECT uploaded, downloaded, activetime, seedtime, active, snatched "+
 		"FROM transfer_history WHERE uid = ? AND fid = ?", testPeer.UserID, testPeer.TorrentID)
 
 	err := row.Scan(&initRawUpload, &initRawDownload, &initActiveTime, &initSeedTime, &initActive, &initSnatch)
@@ -488,7 +556,7 @@ func TestRecordAndFlushTransferHistory(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	row = db.conn.QueryRow("SELECT uploaded, downloaded, activetime, seedtime, active, snatched "+
+	row = conn.QueryRow("SELECT uploaded, downloaded, activetime, seedtime, active, snatched "+
 		"FROM transfer_history WHERE uid = ? AND fid = ?", testPeer.UserID, testPeer.TorrentID)
 
 	err = row.Scan(&rawUpload, &rawDownload, &activeTime, &seedTime, &active, &snatch)
@@ -549,7 +617,7 @@ func TestRecordAndFlushTransferHistory(t *testing.T) {
 
 	var gotStartTime int64
 
-	row = db.conn.QueryRow("SELECT seeding, starttime, last_announce, remaining "+
+	row = conn.QueryRow("SELECT seeding, starttime, last_announce, remaining "+
 		"FROM transfer_history WHERE uid = ? AND fid = ?", gotPeer.UserID, gotPeer.TorrentID)
 
 	err = row.Scan(&gotPeer.Seeding, &gotStartTime, &gotPeer.LastAnnounce, &gotPeer.Left)
@@ -588,7 +656,7 @@ func TestRecordAndFlushTransferHistory(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	row = db.conn.QueryRow("SELECT seeding, starttime, last_announce, remaining "+
+	row = conn.QueryRow("SELECT seeding, starttime, last_announce, remaining "+
 		"FROM transfer_history WHERE uid = ? AND fid = ?", gotPeer.UserID, gotPeer.TorrentID)
 
 	err = row.Scan(&gotPeer.Seeding, &gotPeer.StartTime, &gotPeer.LastAnnounce, &gotPeer.Left)
@@ -625,7 +693,7 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 	deltaDownload = 236
 	deltaUpload = 3262
 
-	row := db.conn.QueryRow("SELECT uploaded, downloaded "+
+	row := conn.QueryRow("SELECT uploaded, downloaded "+
 		"FROM transfer_ips WHERE uid = ? AND fid = ? AND ip = ? AND client_id = ?",
 		testPeer.UserID, testPeer.TorrentID, testPeer.Addr.IPNumeric(), testPeer.ClientID)
 
@@ -634,7 +702,7 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 		panic(err)
 	}
 
-	db.QueueTransferIP(testPeer, testPeer.Addr, deltaUpload, deltaDownload)
+	db.QueueTransferIP(testPeer, testPeer.Addr, testPeer.Addr6, deltaUpload, deltaDownload)
 
 	for len(db.transferIpsChannel) > 0 {
 		time.Sleep(time.Second)
@@ -642,7 +710,7 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	row = db.conn.QueryRow("SELECT uploaded, downloaded "+
+	row = conn.QueryRow("SELECT uploaded, downloaded "+
 		"FROM transfer_ips WHERE uid = ? AND fid = ? AND ip = ? AND client_id = ?",
 		testPeer.UserID, testPeer.TorrentID, testPeer.Addr.IPNumeric(), testPeer.ClientID)
 
@@ -678,7 +746,7 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 
 	var gotStartTime int64
 
-	row = db.conn.QueryRow("SELECT port, starttime, last_announce "+
+	row = conn.QueryRow("SELECT port, starttime, last_announce "+
 		"FROM transfer_ips WHERE uid = ? AND fid = ? AND ip = ? AND client_id = ?",
 		testPeer.UserID, testPeer.TorrentID, testPeer.Addr.IPNumeric(), testPeer.ClientID)
 
@@ -709,7 +777,7 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 		LastAnnounce: time.Now().Unix(),
 	}
 
-	db.QueueTransferIP(testPeer, testPeer.Addr, 0, 0)
+	db.QueueTransferIP(testPeer, testPeer.Addr, testPeer.Addr6, 0, 0)
 
 	for len(db.transferIpsChannel) > 0 {
 		time.Sleep(time.Second)
@@ -724,7 +792,7 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 		Addr:      cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4(testPeer.Addr.IP()), 0),
 	}
 
-	row = db.conn.QueryRow("SELECT port, starttime, last_announce "+
+	row = conn.QueryRow("SELECT port, starttime, last_announce "+
 		"FROM transfer_ips WHERE uid = ? AND fid = ? AND ip = ? AND client_id = ?",
 		testPeer.UserID, testPeer.TorrentID, testPeer.Addr.IPNumeric(), testPeer.ClientID)
 
@@ -738,6 +806,47 @@ func TestRecordAndFlushTransferIP(t *testing.T) {
 	if !reflect.DeepEqual(testPeer, gotPeer) {
 		t.Fatal(fixtureFailure("New peer is incorrectly inserted in the database", testPeer, gotPeer))
 	}
+
+	// Now test for new IPv6-only peer not in database
+	testPeer = &cdb.Peer{
+		UserID:       1,
+		TorrentID:    2,
+		ClientID:     2,
+		Addr6:        cdb.NewPeerAddress6FromAddrPort(netip.MustParseAddr("2001:db8::1"), 63448),
+		StartTime:    time.Now().Unix(),
+		LastAnnounce: time.Now().Unix(),
+	}
+
+	db.QueueTransferIP(testPeer, testPeer.Addr, testPeer.Addr6, 0, 0)
+
+	for len(db.transferIpsChannel) > 0 {
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	gotPeer = &cdb.Peer{
+		UserID:    testPeer.UserID,
+		TorrentID: testPeer.TorrentID,
+		ClientID:  testPeer.ClientID,
+	}
+
+	ip6 := testPeer.Addr6.IP()
+
+	row = conn.QueryRow("SELECT port, starttime, last_announce "+
+		"FROM transfer_ips WHERE uid = ? AND fid = ? AND ip = 0 AND ip6 = ? AND client_id = ?",
+		testPeer.UserID, testPeer.TorrentID, ip6[:], testPeer.ClientID)
+
+	err = row.Scan(&port, &gotPeer.StartTime, &gotPeer.LastAnnounce)
+	if err != nil {
+		panic(err)
+	}
+
+	gotPeer.Addr6 = cdb.NewPeerAddress6FromAddrPort(netip.AddrFrom16(ip6), port)
+
+	if !reflect.DeepEqual(testPeer, gotPeer) {
+		t.Fatal(fixtureFailure("New IPv6 peer is incorrectly inserted in the database", testPeer, gotPeer))
+	}
 }
 
 func TestRecordAndFlushSnatch(t *testing.T) {
@@ -761,7 +870,7 @@ func TestRecordAndFlushSnatch(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	row := db.conn.QueryRow("SELECT snatched_time "+
+	row := conn.QueryRow("SELECT snatched_time "+
 		"FROM transfer_history WHERE uid = ? AND fid = ?", testPeer.UserID, testPeer.TorrentID)
 
 	err := row.Scan(&recordTime)
@@ -782,7 +891,7 @@ func TestRecordAndFlushSnatch(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 
-	row = db.conn.QueryRow("SELECT snatched_time "+
+	row = conn.QueryRow("SELECT snatched_time "+
 		"FROM transfer_history WHERE uid = ? AND fid = ?", testPeer.UserID, testPeer.TorrentID)
 
 	err = row.Scan(&recordTime)
@@ -802,24 +911,24 @@ func TestRecordAndFlushTorrents(t *testing.T) {
 	prepareTestDatabase()
 
 	h := cdb.TorrentHash{114, 239, 32, 237, 220, 181, 67, 143, 115, 182, 216, 141, 120, 196, 223, 193, 102, 123, 137, 56}
-	torrent := (*db.Torrents.Load())[h]
+	torrent, _ := db.Torrents.Get(h)
 	torrent.LastAction.Store(time.Now().Unix())
-	torrent.Seeders[cdb.NewPeerKey(1, cdb.PeerIDFromRawString("test_peer_id_num_one"))] = &cdb.Peer{
+	torrent.Seeders.Put(cdb.NewPeerKey(1, cdb.PeerIDFromRawString("test_peer_id_num_one")), &cdb.Peer{
 		UserID:       1,
 		TorrentID:    torrent.ID.Load(),
 		ClientID:     1,
 		StartTime:    time.Now().Unix(),
 		LastAnnounce: time.Now().Unix(),
-	}
-	torrent.Leechers[cdb.NewPeerKey(3, cdb.PeerIDFromRawString("test_peer_id_num_two"))] = &cdb.Peer{
+	})
+	torrent.Leechers.Put(cdb.NewPeerKey(3, cdb.PeerIDFromRawString("test_peer_id_num_two")), &cdb.Peer{
 		UserID:       3,
 		TorrentID:    torrent.ID.Load(),
 		ClientID:     2,
 		StartTime:    time.Now().Unix(),
 		LastAnnounce: time.Now().Unix(),
-	}
-	torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
-	torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
+	})
+	torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+	torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
 
 	db.QueueTorrent(torrent, 5)
 
@@ -836,7 +945,7 @@ func TestRecordAndFlushTorrents(t *testing.T) {
 		numSeeders  int
 	)
 
-	row := db.conn.QueryRow("SELECT Snatched, last_action, Seeders, Leechers "+
+	row := conn.QueryRow("SELECT Snatched, last_action, Seeders, Leechers "+
 		"FROM torrents WHERE ID = ?", torrent.ID.Load())
 
 	err := row.Scan(&snatched, &lastAction, &numSeeders, &numLeechers)
@@ -860,18 +969,18 @@ func TestRecordAndFlushTorrents(t *testing.T) {
 		))
 	}
 
-	if len(torrent.Seeders) != numSeeders {
+	if torrent.Seeders.Len() != numSeeders {
 		t.Fatal(fixtureFailure(
 			fmt.Sprintf("Seeders incorrectly updated in the database for torrent %x", h),
-			len(torrent.Seeders),
+			torrent.Seeders.Len(),
 			numSeeders,
 		))
 	}
 
-	if len(torrent.Leechers) != numLeechers {
+	if torrent.Leechers.Len() != numLeechers {
 		t.Fatal(fixtureFailure(
 			fmt.Sprintf("Leechers incorrectly updated in the database for torrent %x", h),
-			len(torrent.Leechers),
+			torrent.Leechers.Len(),
 			numLeechers,
 		))
 	}
@@ -879,7 +988,7 @@ func TestRecordAndFlushTorrents(t *testing.T) {
 	if int(torrent.SeedersLength.Load()) != numSeeders {
 		t.Fatal(fixtureFailure(
 			fmt.Sprintf("SeedersLength incorrectly updated in the database for torrent %x", h),
-			len(torrent.Seeders),
+			torrent.Seeders.Len(),
 			numSeeders,
 		))
 	}
@@ -887,12 +996,206 @@ func TestRecordAndFlushTorrents(t *testing.T) {
 	if int(torrent.LeechersLength.Load()) != numLeechers {
 		t.Fatal(fixtureFailure(
 			fmt.Sprintf("LeechersLength incorrectly updated in the database for torrent %x", h),
-			len(torrent.Leechers),
+			torrent.Leechers.Len(),
 			numLeechers,
 		))
 	}
 }
 
+func TestRecordAndFlushTorrentStatus(t *testing.T) {
+	prepareTestDatabase()
+
+	h := cdb.TorrentHash{22, 168, 45, 221, 87, 225, 140, 177, 94, 34, 242, 225, 196, 234, 222, 46, 187, 131, 177, 155}
+	torrent, _ := db.Torrents.Get(h)
+
+	// Prune followed by unprune must end up unpruned, regardless of being flushed in the same batch
+	torrent.Status.Store(1)
+	db.QueueTorrentStatus(torrent, pruneReasonInactive)
+
+	torrent.Status.Store(0)
+	db.QueueTorrentStatus(torrent, "")
+
+	torrent.Status.Store(1)
+	db.QueueTorrentStatus(torrent, pruneReasonInactive)
+
+	db.QueueTorrent(torrent, 0)
+
+	for len(db.torrentChannel) > 0 {
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	var (
+		status      uint8
+		pruneReason sql.NullString
+	)
+
+	row := conn.QueryRow("SELECT Status, prune_reason FROM torrents WHERE ID = ?", torrent.ID.Load())
+
+	if err := row.Scan(&status, &pruneReason); err != nil {
+		panic(err)
+	}
+
+	if status != 1 || pruneReason.String != pruneReasonInactive {
+		t.Fatal(fixtureFailure(
+			fmt.Sprintf("Prune status incorrectly updated in the database for torrent %x", h),
+			fmt.Sprintf("1 (%s)", pruneReasonInactive),
+			fmt.Sprintf("%d (%s)", status, pruneReason.String),
+		))
+	}
+
+	torrent.Status.Store(0)
+	db.QueueTorrentStatus(torrent, "")
+
+	for len(db.torrentChannel) > 0 {
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	row = conn.QueryRow("SELECT Status, prune_reason FROM torrents WHERE ID = ?", torrent.ID.Load())
+
+	if err := row.Scan(&status, &pruneReason); err != nil {
+		panic(err)
+	}
+
+	if status != 0 || pruneReason.Valid {
+		t.Fatal(fixtureFailure(
+			fmt.Sprintf("Torrent %x was not unpruned properly", h),
+			"0 (NULL)",
+			fmt.Sprintf("%d (%v)", status, pruneReason),
+		))
+	}
+}
+
+func TestRecordAndFlushSuspicion(t *testing.T) {
+	prepareTestDatabase()
+
+	testPeer := &cdb.Peer{
+		UserID:    1,
+		TorrentID: 1,
+	}
+
+	var (
+		now      = time.Now().Unix()
+		details  = "uploaded 'a lot' of bytes"
+		rule     string
+		gotRow   string
+		uploaded int64
+		withheld bool
+	)
+
+	db.QueueSuspicion(testPeer, "upload_speed", details, 1337, true, now)
+
+	for len(db.suspicionChannel) > 0 {
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	row := conn.QueryRow("SELECT rule, details, uploaded, withheld "+
+		"FROM tracker_suspicions WHERE uid = ? AND fid = ? AND time = ?", testPeer.UserID, testPeer.TorrentID, now)
+
+	err := row.Scan(&rule, &gotRow, &uploaded, &withheld)
+	if err != nil {
+		panic(err)
+	}
+
+	if rule != "upload_speed" || gotRow != details || uploaded != 1337 || !withheld {
+		t.Fatal(fixtureFailure("Suspicion incorrectly recorded in the database",
+			[]any{"upload_speed", details, 1337, true},
+			[]any{rule, gotRow, uploaded, withheld}))
+	}
+}
+
+func TestKickPeer(t *testing.T) {
+	prepareTestDatabase()
+
+	db.loadTorrents()
+
+	h := cdb.TorrentHash{114, 239, 32, 237, 220, 181, 67, 143, 115, 182, 216, 141, 120, 196, 223, 193, 102, 123, 137, 56}
+	torrent, _ := db.Torrents.Get(h)
+
+	k := cdb.NewPeerKey(1, cdb.PeerIDFromRawString("test_peer_id_num_one"))
+	torrent.Leechers.Put(k, &cdb.Peer{UserID: 1, TorrentID: torrent.ID.Load()})
+	torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+
+	if !db.KickPeer(torrent, k) {
+		t.Fatalf("Expected peer %s to be kicked from torrent %x", k, h)
+	}
+
+	if _, exists := torrent.Leechers.Get(k); exists || torrent.LeechersLength.Load() != uint32(torrent.Leechers.Len()) {
+		t.Fatal(fixtureFailure("Peer was not removed from torrent", torrent.Leechers.Len(), torrent.LeechersLength.Load()))
+	}
+
+	if db.KickPeer(torrent, k) {
+		t.Fatalf("Expected kicking non-existent peer %s to fail", k)
+	}
+
+	for len(db.transferHistoryChannel) > 0 {
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	var active bool
+
+	row := conn.QueryRow("SELECT active FROM transfer_history WHERE uid = ? AND fid = ?", 1, torrent.ID.Load())
+	if err := row.Scan(&active); err != nil {
+		panic(err)
+	}
+
+	if active {
+		t.Fatal(fixtureFailure("Kicked peer was not marked inactive in the database", false, active))
+	}
+}
+
+func TestEvictUser(t *testing.T) {
+	prepareTestDatabase()
+
+	db.loadUsers()
+	db.loadTorrents()
+
+	h := cdb.TorrentHash{114, 239, 32, 237, 220, 181, 67, 143, 115, 182, 216, 141, 120, 196, 223, 193, 102, 123, 137, 56}
+	torrent, _ := db.Torrents.Get(h)
+
+	torrent.Seeders.Put(cdb.NewPeerKey(2, cdb.PeerIDFromRawString("test_peer_id_num_one")), &cdb.Peer{
+		UserID:    2,
+		TorrentID: torrent.ID.Load(),
+	})
+	torrent.Leechers.Put(cdb.NewPeerKey(1, cdb.PeerIDFromRawString("test_peer_id_num_two")), &cdb.Peer{
+		UserID:    1,
+		TorrentID: torrent.ID.Load(),
+	})
+	torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+	torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+
+	found, peers := db.EvictUser(2)
+	if !found || peers != 1 {
+		t.Fatal(fixtureFailure("Did not evict user as expected", 1, peers))
+	}
+
+	if _, exists := (*db.Users.Load())["tbHfQDQ9xDaQdsNv5CZBtHPfk7KGzaCw"]; exists {
+		t.Fatalf("Expected user %d to be removed from memory", 2)
+	}
+
+	if torrent.Seeders.Len() != 0 || torrent.Leechers.Len() != 1 || torrent.SeedersLength.Load() != 0 {
+		t.Fatal(fixtureFailure("Did not remove peers of evicted user", 0, torrent.Seeders.Len()))
+	}
+
+	if found, _ = db.EvictUser(2); found {
+		t.Fatalf("Expected evicting non-existent user %d to fail", 2)
+	}
+
+	// Reload brings user back as it is still enabled in database
+	db.Reload()
+
+	if _, exists := (*db.Users.Load())["tbHfQDQ9xDaQdsNv5CZBtHPfk7KGzaCw"]; !exists {
+		t.Fatalf("Expected user %d to be reloaded from database", 2)
+	}
+}
+
 func TestTerminate(_ *testing.T) {
 	prepareTestDatabase()
 
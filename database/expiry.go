@@ -0,0 +1,154 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"sync"
+
+	cdb "chihaya/database/types"
+)
+
+// expiryResolution Width of expiry bucket in seconds; inactive peers are purged at most this much later than they would
+// be by scanning all of them
+const expiryResolution = 10
+
+// expiryEntry Peer scheduled for expiry; peer key is derived from peer itself, so that entry stays small
+type expiryEntry struct {
+	infoHash cdb.TorrentHash
+	peer     *cdb.Peer
+}
+
+/*
+peerExpiry Schedule of peer expiry, kept as buckets of peers by time of their last announce. Peers are scheduled once,
+when they join swarm; repeated announces only move their last announce forward. When bucket is due, peers which have
+announced since they were scheduled are scheduled again by their new last announce, peers which are no longer in swarm
+are forgotten and the rest are expired. This way purge only looks at peers which may have expired, each peer about
+once per peer_inactivity interval, instead of at every peer on every run.
+
+The zero value is ready to use.
+*/
+type peerExpiry struct {
+	mu      sync.Mutex
+	buckets map[int64][]expiryEntry
+	length  int
+}
+
+func (e *peerExpiry) add(infoHash cdb.TorrentHash, peer *cdb.Peer, lastAnnounce int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.buckets == nil {
+		e.buckets = make(map[int64][]expiryEntry)
+	}
+
+	b := lastAnnounce / expiryResolution
+
+	e.buckets[b] = append(e.buckets[b], expiryEntry{infoHash: infoHash, peer: peer})
+	e.length++
+}
+
+// due Removes and returns entries of buckets in which every peer last announced before oldestActive
+func (e *peerExpiry) due(oldestActive int64) (entries []expiryEntry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for b, bucket := range e.buckets {
+		if (b+1)*expiryResolution <= oldestActive {
+			entries = append(entries, bucket...)
+
+			delete(e.buckets, b)
+		}
+	}
+
+	e.length -= len(entries)
+
+	return entries
+}
+
+// len Returns number of scheduled entries, including those of peers which have already left swarm
+func (e *peerExpiry) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.length
+}
+
+// SchedulePeerExpiry Schedules expiry of peer which has just joined swarm; caller must hold peer lock of torrent
+func (db *Database) SchedulePeerExpiry(infoHash cdb.TorrentHash, peer *cdb.Peer) {
+	db.expiry.add(infoHash, peer, peer.LastAnnounce)
+}
+
+/*
+expirePeers Removes peers which were scheduled to expire before oldestActive and have not announced since, returning
+how many were removed. Torrents which lost peers are queued for flush once, after all due peers were processed.
+*/
+func (db *Database) expirePeers(oldestActive int64) (count int) {
+	touched := make(map[*cdb.Torrent]struct{})
+
+	for _, entry := range db.expiry.due(oldestActive) {
+		// Torrents removed from index are left alone, just like they were by scanning
+		torrent, exists := db.Torrents.Get(entry.infoHash)
+		if !exists {
+			continue
+		}
+
+		if db.expirePeer(torrent, entry, oldestActive) {
+			touched[torrent] = struct{}{}
+			count++
+		}
+	}
+
+	for torrent := range touched {
+		db.QueueTorrent(torrent, 0)
+	}
+
+	return count
+}
+
+// expirePeer Removes peer of entry from swarm if it is inactive, or schedules it again if it is not
+func (db *Database) expirePeer(torrent *cdb.Torrent, entry expiryEntry, oldestActive int64) bool {
+	torrent.PeerLock()
+	defer torrent.PeerUnlock()
+
+	key := cdb.NewPeerKey(entry.peer.UserID, entry.peer.ID)
+
+	// Peer which left swarm may have joined it again since, in which case it was scheduled again as new peer
+	peers := &torrent.Seeders
+	if peer, _ := peers.Get(key); peer != entry.peer {
+		peers = &torrent.Leechers
+		if peer, _ = peers.Get(key); peer != entry.peer {
+			return false
+		}
+	}
+
+	if entry.peer.LastAnnounce >= oldestActive {
+		db.expiry.add(entry.infoHash, entry.peer, entry.peer.LastAnnounce)
+		return false
+	}
+
+	peers.Delete(key)
+
+	if peers == &torrent.Leechers {
+		torrent.LeecherRemoved(entry.peer)
+	}
+
+	torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+	torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+
+	return true
+}
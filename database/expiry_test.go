@@ -0,0 +1,96 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"testing"
+
+	cdb "chihaya/database/types"
+)
+
+func TestExpirePeers(t *testing.T) {
+	db := &Database{}
+	db.torrentChannel = make(chan TorrentUpdate, 10)
+	db.torrentOverflow = newOverflow("torrents", db.torrentChannel, nil, torrentUpdateKey, mergeTorrentUpdates)
+
+	var (
+		infoHash, removedHash cdb.TorrentHash
+
+		torrent = &cdb.Torrent{}
+		removed = &cdb.Torrent{}
+
+		idle      = &cdb.Peer{UserID: 1, LastAnnounce: 100}
+		announced = &cdb.Peer{UserID: 2, LastAnnounce: 100}
+		left      = &cdb.Peer{UserID: 3, LastAnnounce: 100}
+		rejoined  = &cdb.Peer{UserID: 4, LastAnnounce: 100}
+		orphaned  = &cdb.Peer{UserID: 5, LastAnnounce: 100}
+	)
+
+	infoHash[0], removedHash[0] = 1, 2
+
+	db.Torrents.Store(cdb.NewTorrentShards(map[cdb.TorrentHash]*cdb.Torrent{infoHash: torrent}))
+
+	for _, peer := range []*cdb.Peer{idle, announced, rejoined} {
+		torrent.Seeders.Put(cdb.NewPeerKey(peer.UserID, peer.ID), peer)
+		db.SchedulePeerExpiry(infoHash, peer)
+	}
+
+	torrent.Leechers.Put(cdb.NewPeerKey(left.UserID, left.ID), left)
+	db.SchedulePeerExpiry(infoHash, left)
+
+	removed.Seeders.Put(cdb.NewPeerKey(orphaned.UserID, orphaned.ID), orphaned)
+	db.SchedulePeerExpiry(removedHash, orphaned)
+
+	// One peer announces again, one leaves swarm and one leaves and joins again as new peer
+	announced.LastAnnounce = 500
+	torrent.Leechers.Delete(cdb.NewPeerKey(left.UserID, left.ID))
+
+	rejoinedAgain := &cdb.Peer{UserID: 4, LastAnnounce: 400}
+	torrent.Seeders.Put(cdb.NewPeerKey(rejoined.UserID, rejoined.ID), rejoinedAgain)
+	db.SchedulePeerExpiry(infoHash, rejoinedAgain)
+
+	if count := db.expirePeers(100); count != 0 {
+		t.Fatalf("Expected no peers to expire before they become inactive, got %d", count)
+	}
+
+	if count := db.expirePeers(300); count != 1 {
+		t.Fatalf("Expected 1 peer to expire, got %d", count)
+	}
+
+	if _, exists := torrent.Seeders.Get(cdb.NewPeerKey(idle.UserID, idle.ID)); exists {
+		t.Fatalf("Expected idle peer to be removed")
+	}
+
+	if torrent.Seeders.Len() != 2 || torrent.SeedersLength.Load() != 2 || removed.Seeders.Len() != 1 {
+		t.Fatalf("Expected 2 seeders left and peer of removed torrent left alone, got %d (%d) and %d",
+			torrent.Seeders.Len(), torrent.SeedersLength.Load(), removed.Seeders.Len())
+	}
+
+	if len(db.torrentChannel) != 1 {
+		t.Fatalf("Expected torrent to be queued once, got %d updates", len(db.torrentChannel))
+	}
+
+	// Peer which announced was scheduled again, as was peer which rejoined
+	if scheduled := db.expiry.len(); scheduled != 2 {
+		t.Fatalf("Expected 2 peers to stay scheduled, got %d", scheduled)
+	}
+
+	if count := db.expirePeers(1000); count != 2 || torrent.Seeders.Len() != 0 || db.expiry.len() != 0 {
+		t.Fatalf("Expected remaining peers to expire, got %d (%d seeders left)", count, torrent.Seeders.Len())
+	}
+}
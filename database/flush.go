@@ -18,20 +18,20 @@
 package database
 
 import (
-	"bytes"
 	"errors"
 	"log/slog"
+	"sync"
 	"time"
 
 	"chihaya/collector"
 	"chihaya/config"
-	cdb "chihaya/database/types"
 	"chihaya/util"
 )
 
 var (
 	peerInactivityInterval     int
 	purgeInactivePeersInterval int
+	pruneInactiveInterval      int
 	flushSleepInterval         int
 	logFlushes                 bool
 )
@@ -41,6 +41,7 @@ func init() {
 
 	peerInactivityInterval, _ = intervals.GetInt("peer_inactivity", 3900)
 	purgeInactivePeersInterval, _ = intervals.GetInt("purge_inactive_peers", 120)
+	pruneInactiveInterval, _ = intervals.GetInt("prune_inactive_torrents", 0)
 	flushSleepInterval, _ = intervals.GetInt("flush", 5)
 
 	logFlushes, _ = config.GetBool("log_flushes", true)
@@ -49,8 +50,10 @@ func init() {
 /*
  * Channels are used for flushing to limit throughput to a manageable level.
  * If a client causes an update that requires a flush, it writes to the channel requesting that a flush occur.
- * However, if the channel is already full (to xFlushBufferSize), the client thread blocks until a flush occurs.
- * This way, rather than thrashing and missing flushes, clients are simply forced to wait longer.
+ * However, if the channel is already full (to xFlushBufferSize), the update is queued behind it in bounded in-memory
+ * backlog and handled according to overflow policy (see overflow.go): it is either spilled to disk by flusher (see
+ * spill.go), coalesced in memory with other pending updates of the same row, or held until a flush occurs. This way,
+ * rather than thrashing and missing flushes, clients never wait on database and updates keep their order.
  *
  * This tradeoff can be adjusted by tweaking the various xFlushBufferSize values to suit the server.
  *
@@ -68,23 +71,52 @@ var (
 	transferHistoryFlushBufferSize int
 	transferIpsFlushBufferSize     int
 	snatchFlushBufferSize          int
+	suspicionFlushBufferSize       int
 
-	errDbTerminate       = errors.New("shutting down database connection")
-	errGotNilFromChannel = errors.New("got nil while receiving from non-empty channel")
+	errDbTerminate = errors.New("shutting down database connection")
 )
 
 func (db *Database) startFlushing() {
-	db.torrentChannel = make(chan *bytes.Buffer, torrentFlushBufferSize)
-	db.userChannel = make(chan *bytes.Buffer, userFlushBufferSize)
-	db.transferHistoryChannel = make(chan *bytes.Buffer, transferHistoryFlushBufferSize)
-	db.transferIpsChannel = make(chan *bytes.Buffer, transferIpsFlushBufferSize)
-	db.snatchChannel = make(chan *bytes.Buffer, snatchFlushBufferSize)
-
-	go db.flushTorrents()
-	go db.flushUsers()
-	go db.flushTransferHistory() // Can not be blocking or it will lock purgeInactivePeers when chan is empty
-	go db.flushTransferIps()
-	go db.flushSnatches()
+	db.torrentChannel = make(chan TorrentUpdate, torrentFlushBufferSize)
+	db.userChannel = make(chan UserUpdate, userFlushBufferSize)
+	db.transferHistoryChannel = make(chan TransferHistoryUpdate, transferHistoryFlushBufferSize)
+	db.transferIpsChannel = make(chan TransferIPUpdate, transferIpsFlushBufferSize)
+	db.snatchChannel = make(chan SnatchUpdate, snatchFlushBufferSize)
+	db.suspicionChannel = make(chan SuspicionUpdate, suspicionFlushBufferSize)
+
+	db.torrentSpill = mustOpenSpill[TorrentUpdate]("torrents")
+	db.userSpill = mustOpenSpill[UserUpdate]("users")
+	db.transferHistorySpill = mustOpenSpill[TransferHistoryUpdate]("transfer_history")
+	db.transferIpsSpill = mustOpenSpill[TransferIPUpdate]("transfer_ips")
+	db.snatchSpill = mustOpenSpill[SnatchUpdate]("snatches")
+	db.suspicionSpill = mustOpenSpill[SuspicionUpdate]("suspicions")
+
+	db.torrentOverflow = newOverflow("torrents", db.torrentChannel, db.torrentSpill, torrentUpdateKey,
+		mergeTorrentUpdates)
+	db.userOverflow = newOverflow("users", db.userChannel, db.userSpill, userUpdateKey, mergeUserUpdates)
+	db.transferHistoryOverflow = newOverflow("transfer_history", db.transferHistoryChannel, db.transferHistorySpill,
+		transferHistoryUpdateKey, mergeTransferHistoryUpdates)
+	db.transferIpsOverflow = newOverflow("transfer_ips", db.transferIpsChannel, db.transferIpsSpill,
+		transferIPUpdateKey, mergeTransferIPUpdates)
+	db.snatchOverflow = newOverflow("snatches", db.snatchChannel, db.snatchSpill, snatchUpdateKey, mergeSnatchUpdates)
+	db.suspicionOverflow = newOverflow[struct{}]("suspicions", db.suspicionChannel, db.suspicionSpill, nil, nil)
+
+	// Callers are never made to wait for database which is known to be unavailable
+	db.torrentOverflow.degraded = db.Degraded
+	db.userOverflow.degraded = db.Degraded
+	db.transferHistoryOverflow.degraded = db.Degraded
+	db.transferIpsOverflow.degraded = db.Degraded
+	db.snatchOverflow.degraded = db.Degraded
+	db.suspicionOverflow.degraded = db.Degraded
+
+	go flushChannel(db, db.torrentOverflow, torrentFlushBufferSize, nil, db.storage.FlushTorrents)
+	go flushChannel(db, db.userOverflow, userFlushBufferSize, nil, db.storage.FlushUsers)
+	// Can not be blocking or it will lock purgeInactivePeers when chan is empty
+	go flushChannel(db, db.transferHistoryOverflow, transferHistoryFlushBufferSize, &db.transferHistoryLock,
+		db.storage.FlushTransferHistory)
+	go flushChannel(db, db.transferIpsOverflow, transferIpsFlushBufferSize, nil, db.storage.FlushTransferIps)
+	go flushChannel(db, db.snatchOverflow, snatchFlushBufferSize, nil, db.storage.FlushSnatches)
+	go flushChannel(db, db.suspicionOverflow, suspicionFlushBufferSize, nil, db.storage.FlushSuspicions)
 
 	go func() {
 		time.Sleep(2 * time.Second)
@@ -99,363 +131,198 @@ func (db *Database) closeFlushChannels() {
 	close(db.transferHistoryChannel)
 	close(db.transferIpsChannel)
 	close(db.snatchChannel)
+	close(db.suspicionChannel)
 }
 
-func (db *Database) flushTorrents() {
-	db.waitGroup.Add(1)
-	defer db.waitGroup.Done()
-
-	var (
-		query bytes.Buffer
-		count int
-	)
-
-	for {
-		query.Reset()
-		query.WriteString("INSERT IGNORE INTO torrents (ID, Snatched, Seeders, Leechers, last_action) VALUES ")
-
-		length := len(db.torrentChannel)
+// closeSpills Closes spill files once flushing has finished; anything left in them is replayed on next start
+func (db *Database) closeSpills() {
+	_ = db.torrentSpill.close()
+	_ = db.userSpill.close()
+	_ = db.transferHistorySpill.close()
+	_ = db.transferIpsSpill.close()
+	_ = db.snatchSpill.close()
+	_ = db.suspicionSpill.close()
+}
 
-		for count = 0; count < length; count++ {
-			b := <-db.torrentChannel
-			if b == nil {
-				panic(errGotNilFromChannel)
-			}
+func mustOpenSpill[T any](name string) *spillFile[T] {
+	spill, err := openSpill[T](spillDir, name)
+	if err != nil {
+		panic(err)
+	}
 
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
+	return spill
+}
 
-			if count != length-1 {
-				query.WriteRune(',')
-			}
+/*
+flushOrSpill Passes rows to storage, unless there are spilled rows waiting to be replayed, in which case rows are
+spilled behind them to preserve order. Rows which storage fails to flush are spilled as well. Returns false if rows
+could not be spilled, in which case they have to be passed again ahead of anything queued since; without spill file,
+rows which storage fails to flush are lost.
+*/
+func flushOrSpill[T any](spill *spillFile[T], rows []T, flush func(rows []T) error) bool {
+	if spill.pending() {
+		if err := spill.append(rows); err != nil {
+			return false
 		}
 
-		if count > 0 {
-			if logFlushes && !db.terminate.Load() {
-				slog.Info("flushing", "channel", "torrents", "count", count)
-			}
-
-			startTime := time.Now()
+		_ = spill.replay(flush)
 
-			query.WriteString(" ON DUPLICATE KEY UPDATE Snatched = Snatched + VALUE(Snatched), " +
-				"Seeders = VALUE(Seeders), Leechers = VALUE(Leechers), " +
-				"last_action = IF(last_action < VALUE(last_action), VALUE(last_action), last_action)")
-			db.exec(&query)
-
-			if !db.terminate.Load() {
-				collector.UpdateChannelFlushTime("torrents", time.Since(startTime))
-				collector.UpdateChannelFlushLen("torrents", count)
-			}
+		return true
+	}
 
-			if length < (torrentFlushBufferSize >> 1) {
-				time.Sleep(time.Duration(flushSleepInterval) * time.Second)
-			}
-		} else if db.terminate.Load() {
-			break
-		} else {
-			time.Sleep(time.Second)
-		}
+	if err := flush(rows); err != nil && spill != nil {
+		return spill.append(rows) == nil // Errors are already reported by storage
 	}
+
+	return true
 }
 
-func (db *Database) flushUsers() {
+/*
+flushChannel Periodically takes everything that is currently queued in channel (followed by rows coalesced on
+overflow), merges updates of the same row and passes it to storage as single batch, until channel is closed and
+drained. Rows which did not fit into channel are spilled behind that batch in single append (unless overflow policy
+is hold, or spilling is disabled, in which case they are passed to storage as part of it). If lock is given, it is
+held for duration of each flush. While channel is idle, rows spilled earlier are replayed. In degraded mode, nothing is
+flushed or replayed; rows are spilled as they are queued instead, or left queued if spilling is disabled.
+*/
+func flushChannel[K comparable, T any](db *Database, queue *overflow[K, T], bufferSize int, lock sync.Locker,
+	flush func(rows []T) error) {
 	db.waitGroup.Add(1)
 	defer db.waitGroup.Done()
 
 	var (
-		query bytes.Buffer
-		count int
+		name    = queue.name
+		channel = queue.channel
+		spill   = queue.spill
+
+		rows    = make([]T, 0, bufferSize)
+		backlog []T
+		carry   []T // rows which could not be spilled, passed again ahead of everything queued since
+		index   = make(map[K]int)
 	)
 
 	for {
-		query.Reset()
-		query.WriteString("INSERT IGNORE INTO users_main (ID, Uploaded, Downloaded, rawdl, rawup) VALUES ")
-
-		length := len(db.userChannel)
-
-		for count = 0; count < length; count++ {
-			b := <-db.userChannel
-			if b == nil {
-				panic(errGotNilFromChannel)
+		length, err := func() (int, error) {
+			if lock != nil {
+				lock.Lock()
+				defer lock.Unlock()
 			}
 
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
+			collector.UpdateChannelOccupancy(name, len(channel), cap(channel))
 
-			if count != length-1 {
-				query.WriteRune(',')
-			}
-		}
+			degraded := db.Degraded() && !db.terminate.Load()
 
-		if count > 0 {
-			if logFlushes && !db.terminate.Load() {
-				slog.Info("flushing", "channel", "users", "count", count)
+			/* Without spill file, updates wait in channel (and backlog, once channel is full) while database is
+			unavailable; on shutdown, they are flushed if database has become available in the meantime. */
+			if degraded && spill == nil {
+				return 0, nil
 			}
 
-			startTime := time.Now()
+			carried := len(carry)
 
-			query.WriteString(" ON DUPLICATE KEY UPDATE Uploaded = Uploaded + VALUE(Uploaded), " +
-				"Downloaded = Downloaded + VALUE(Downloaded), rawdl = rawdl + VALUE(rawdl), rawup = rawup + VALUE(rawup)")
-			db.exec(&query)
+			rows = append(rows[:0], carry...)
+			carry = carry[:0]
 
-			if !db.terminate.Load() {
-				collector.UpdateChannelFlushTime("users", time.Since(startTime))
-				collector.UpdateChannelFlushLen("users", count)
-			}
+			rows, backlog = queue.take(rows, backlog[:0])
+			queued := len(rows) + len(backlog)
 
-			if length < (userFlushBufferSize >> 1) {
-				time.Sleep(time.Duration(flushSleepInterval) * time.Second)
+			// Backlog which is not spilled separately is passed on along with rows queued before it
+			if spill == nil || queue.policy == overflowHold || degraded {
+				rows = append(rows, backlog...)
+				backlog = backlog[:0]
 			}
-		} else if db.terminate.Load() {
-			break
-		} else {
-			time.Sleep(time.Second)
-		}
-	}
-}
-
-func (db *Database) flushTransferHistory() {
-	db.waitGroup.Add(1)
-	defer db.waitGroup.Done()
-
-	var (
-		query bytes.Buffer
-		count int
-	)
-
-	for {
-		length, err := func() (int, error) {
-			db.transferHistoryLock.Lock()
-			defer db.transferHistoryLock.Unlock()
-
-			query.Reset()
-			query.WriteString("INSERT INTO transfer_history (uid, fid, uploaded, downloaded, " +
-				"seeding, starttime, last_announce, activetime, seedtime, active, snatched, remaining) VALUES\n")
 
-			length := len(db.transferHistoryChannel)
+			// Updates of the same row are summed up, so that storage receives single update per row
+			rows = compact(rows, queue.key, queue.merge, index)
+			backlog = compact(backlog, queue.key, queue.merge, index)
 
-			for count = 0; count < length; count++ {
-				b := <-db.transferHistoryChannel
-				if b == nil {
-					panic(errGotNilFromChannel)
+			if queued > 0 {
+				if logFlushes && !db.terminate.Load() {
+					slog.Info("flushing", "channel", name, "count", len(rows), "spilled", len(backlog),
+						"queued", queued)
 				}
 
-				query.Write(b.Bytes())
-				db.bufferPool.Give(b)
+				collector.IncrementCoalescedRows(name, queued-len(rows)-len(backlog))
 
-				if count != length-1 {
-					query.WriteRune(',')
-				}
-			}
+				startTime := time.Now()
 
-			if count > 0 {
-				if logFlushes && !db.terminate.Load() {
-					slog.Info("flushing", "channel", "transfer_history", "count", count)
+				switch {
+				case len(rows) == 0:
+				case degraded:
+					// Everything is spilled in order it was queued and replayed once database is available again
+					if spill.append(rows) != nil {
+						carry = append(carry, rows...)
+					}
+				case !flushOrSpill(spill, rows, flush):
+					carry = append(carry, rows...)
 				}
 
-				startTime := time.Now()
+				// Backlog must not get ahead of rows which could not be spilled
+				if len(backlog) > 0 && (len(carry) > 0 || spill.append(backlog) != nil) {
+					carry = append(carry, backlog...)
+				}
 
-				query.WriteString("\nON DUPLICATE KEY UPDATE uploaded = uploaded + VALUE(uploaded), " +
-					"downloaded = downloaded + VALUE(downloaded), remaining = VALUE(remaining), " +
-					"seeding = VALUE(seeding), activetime = activetime + VALUE(activetime), " +
-					"seedtime = seedtime + VALUE(seedtime), last_announce = VALUE(last_announce), " +
-					"active = VALUE(active), snatched = snatched + VALUE(snatched);")
+				if len(carry) > 0 && db.terminate.Load() {
+					slog.Error("dropping rows which could not be spilled", "channel", name, "count", len(carry))
 
-				db.exec(&query)
+					carry = carry[:0]
+				}
 
 				if !db.terminate.Load() {
-					collector.UpdateChannelFlushTime("transfer_history", time.Since(startTime))
-					collector.UpdateChannelFlushLen("transfer_history", count)
+					collector.UpdateChannelFlushTime(name, time.Since(startTime))
+					collector.UpdateChannelFlushLen(name, len(rows))
 				}
 
-				return length, nil
+				// Rows carried over do not count, so that failing spill file is not retried without pause
+				return queued - carried, nil
 			} else if db.terminate.Load() {
 				return 0, errDbTerminate
+			} else if !degraded && spill.pending() {
+				_ = spill.replay(flush)
 			}
 
-			return length, nil
+			return 0, nil
 		}()
 		if err != nil {
 			break
-		} else if length < (transferHistoryFlushBufferSize >> 1) {
-			time.Sleep(time.Duration(flushSleepInterval) * time.Second)
-		} else {
-			time.Sleep(time.Second)
-		}
-	}
-}
-
-func (db *Database) flushTransferIps() {
-	db.waitGroup.Add(1)
-	defer db.waitGroup.Done()
-
-	var (
-		query bytes.Buffer
-		count int
-	)
-
-	for {
-		query.Reset()
-		query.WriteString("INSERT INTO transfer_ips (uid, fid, client_id, ip, port, uploaded, downloaded, " +
-			"starttime, last_announce) VALUES\n")
-
-		length := len(db.transferIpsChannel)
-
-		for count = 0; count < length; count++ {
-			b := <-db.transferIpsChannel
-			if b == nil {
-				panic(errGotNilFromChannel)
-			}
-
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
-		}
-
-		if count > 0 {
-			if logFlushes && !db.terminate.Load() {
-				slog.Info("flushing", "channel", "transfer_ips", "count", count)
-			}
-
-			startTime := time.Now()
-
-			// TODO: port should be part of PK
-			query.WriteString("\nON DUPLICATE KEY UPDATE port = VALUE(port), downloaded = downloaded + VALUE(downloaded), " +
-				"uploaded = uploaded + VALUE(uploaded), last_announce = VALUE(last_announce)")
-			db.exec(&query)
-
-			if !db.terminate.Load() {
-				collector.UpdateChannelFlushTime("transfer_ips", time.Since(startTime))
-				collector.UpdateChannelFlushLen("transfer_ips", count)
-			}
-
-			if length < (transferIpsFlushBufferSize >> 1) {
-				time.Sleep(time.Duration(flushSleepInterval) * time.Second)
-			}
-		} else if db.terminate.Load() {
-			break
-		} else {
-			time.Sleep(time.Second)
-		}
-	}
-}
-
-func (db *Database) flushSnatches() {
-	db.waitGroup.Add(1)
-	defer db.waitGroup.Done()
-
-	var (
-		query bytes.Buffer
-		count int
-	)
-
-	for {
-		query.Reset()
-		query.WriteString("INSERT INTO transfer_history (uid, fid, snatched_time) VALUES\n")
-
-		length := len(db.snatchChannel)
-
-		for count = 0; count < length; count++ {
-			b := <-db.snatchChannel
-			if b == nil {
-				panic(errGotNilFromChannel)
-			}
-
-			query.Write(b.Bytes())
-			db.bufferPool.Give(b)
-
-			if count != length-1 {
-				query.WriteRune(',')
-			}
-		}
-
-		if count > 0 {
-			if logFlushes && !db.terminate.Load() {
-				slog.Info("flushing", "channel", "snatches", "count", count)
-			}
-
-			startTime := time.Now()
-
-			query.WriteString("\nON DUPLICATE KEY UPDATE snatched_time = " +
-				"IF(snatched_time = 0, VALUE(snatched_time), snatched_time)")
-			db.exec(&query)
-
-			if !db.terminate.Load() {
-				collector.UpdateChannelFlushTime("snatches", time.Since(startTime))
-				collector.UpdateChannelFlushLen("snatches", count)
-			}
-
-			if length < (snatchFlushBufferSize >> 1) {
-				time.Sleep(time.Duration(flushSleepInterval) * time.Second)
-			}
-		} else if db.terminate.Load() {
-			break
-		} else {
+		} else if length == 0 {
 			time.Sleep(time.Second)
+		} else if length < (bufferSize >> 1) {
+			time.Sleep(time.Duration(flushSleepInterval) * time.Second)
 		}
 	}
 }
 
+/*
+purgeInactivePeers Periodically removes peers which have not announced for peer_inactivity seconds from memory and marks
+them inactive in database. Peers are found through their expiry schedule (see peerExpiry), so that only peers which may
+have expired are looked at and peer locks of other torrents are not taken at all.
+*/
 func (db *Database) purgeInactivePeers() {
 	var (
 		startTime time.Time
 		count     int
+		pruned    int
 	)
 
 	util.ContextTick(db.ctx, time.Duration(purgeInactivePeersInterval)*time.Second, func() {
 		startTime = time.Now()
-		count = 0
 
 		oldestActive := time.Now().Unix() - int64(peerInactivityInterval)
 
 		// First, remove inactive peers from memory
-		dbTorrents := *db.Torrents.Load()
-		for _, torrent := range dbTorrents {
-			func() {
-				torrent.PeerLock() // Take write lock to operate on peer entries
-				defer torrent.PeerUnlock()
-
-				countThisTorrent := count
-
-				for id, peer := range torrent.Leechers {
-					if peer.LastAnnounce < oldestActive {
-						delete(torrent.Leechers, id)
-
-						count++
-					}
-				}
-
-				if countThisTorrent != count && len(torrent.Leechers) == 0 {
-					/* Deallocate previous map since Go does not free space used on maps when deleting objects.
-					We're doing it only for Leechers as potential advantage from freeing one or two Seeders is
-					virtually nil, while Leechers can incur significant memory leaks due to initial swarm activity. */
-					torrent.Leechers = make(map[cdb.PeerKey]*cdb.Peer)
-				}
-
-				for id, peer := range torrent.Seeders {
-					if peer.LastAnnounce < oldestActive {
-						delete(torrent.Seeders, id)
+		count = db.expirePeers(oldestActive)
 
-						count++
-					}
-				}
+		collector.UpdatePurgeInactivePeersTime(time.Since(startTime))
+		collector.UpdateExpiryScheduled(db.expiry.len())
 
-				if countThisTorrent != count {
-					// Update lengths of peers
-					torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
-					torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
-
-					db.QueueTorrent(torrent, 0)
-				}
-			}()
+		if pruneInactiveInterval > 0 {
+			now := time.Now().Unix()
+			pruned = db.pruneInactiveTorrents(now-int64(pruneInactiveInterval), now)
 		}
 
 		elapsedTime := time.Since(startTime)
-		collector.UpdatePurgeInactivePeersTime(elapsedTime)
-		slog.Info("purged inactive peers from memory", "count", count, "elapsed", elapsedTime)
+		slog.Info("purged inactive peers from memory", "count", count, "pruned", pruned, "elapsed", elapsedTime)
 
 		// Set peers as inactive in the database
 		func() {
@@ -468,9 +335,7 @@ func (db *Database) purgeInactivePeers() {
 
 			startTime = time.Now()
 
-			result := db.execute(db.cleanStalePeersStmt, oldestActive)
-			if result != nil {
-				rows, _ := result.RowsAffected()
+			if rows, err := db.storage.CleanStalePeers(oldestActive); err == nil {
 				slog.Info("updated inactive peers in database", "rows", rows, "elapsed", time.Since(startTime))
 			}
 		}()
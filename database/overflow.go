@@ -0,0 +1,268 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"chihaya/collector"
+	"chihaya/config"
+)
+
+/*
+ * Overflow policies decide what happens to update which does not fit into full channel:
+ *  - block: caller waits until there is room in channel, that is until flush routine takes next batch
+ *  - hold: update is put into backlog in memory and flush routine passes it to storage with next batch
+ *  - spill: update is put into backlog, which flush routine appends to spill file (see spill.go) behind everything
+ *    queued before it; spilled updates are replayed later
+ *  - coalesce: update is merged in memory with other pending updates of the same row (see coalesce.go)
+ *
+ * Coalesced updates are bounded by overflowCoalesceLimit distinct rows per channel. Updates which can not be
+ * coalesced (either because limit was reached or because channel does not support it) are spilled instead, and if
+ * spilling is disabled, held. With block policy, callers (which usually hold torrent lock) wait for database, so it is
+ * meant only for deployments which prefer slowing announces down to buffering updates; while database is unavailable
+ * updates are held or spilled instead, so that callers do not wait for it indefinitely.
+ *
+ * Once backlog holds any update, every later update goes there as well, even if channel has room again, so that updates
+ * reach storage in order they were queued. Backlog is bounded by overflowBacklogLimit rows per channel; should flush
+ * routine fall that far behind, callers wait for it to take backlog rather than losing updates.
+ */
+
+const (
+	overflowBlock    = "block"
+	overflowHold     = "hold"
+	overflowSpill    = "spill"
+	overflowCoalesce = "coalesce"
+)
+
+var (
+	overflowPolicy        string
+	overflowCoalesceLimit int
+	overflowBacklogLimit  int
+)
+
+func init() {
+	channelsConfig := config.Section("channels")
+
+	overflowPolicy, _ = channelsConfig.Get("overflow", overflowSpill)
+	overflowCoalesceLimit, _ = channelsConfig.GetInt("coalesce_limit", 100000)
+	overflowBacklogLimit, _ = channelsConfig.GetInt("backlog_limit", 1000000)
+
+	switch overflowPolicy {
+	case overflowBlock, overflowHold, overflowSpill, overflowCoalesce:
+	default:
+		slog.Error("unknown channel overflow policy, using default", "policy", overflowPolicy, "default", overflowSpill)
+
+		overflowPolicy = overflowSpill
+	}
+}
+
+// overflow Queues updates into channel and handles ones that do not fit according to overflow policy
+type overflow[K comparable, T any] struct {
+	name    string
+	channel chan T
+	spill   *spillFile[T]
+	policy  string
+	limit   int
+
+	// key and merge are nil for channels which do not support coalescing
+	key   func(row T) K
+	merge func(prev, next T) T
+
+	mu        sync.Mutex
+	coalesced []T
+	index     map[K]int
+	pending   atomic.Int32 // number of coalesced rows, checked without taking lock
+
+	backlog      []T         // rows which did not fit into channel, newer than anything in it
+	backlogged   atomic.Bool // whether backlog holds any rows, checked without taking lock
+	backlogLimit int
+	room         *sync.Cond // signalled whenever backlog is taken
+
+	blocked atomic.Int64 // number of callers waiting for room in channel or backlog
+
+	// degraded Reports whether database is unavailable, in which case callers are not made to wait for it
+	degraded func() bool
+}
+
+func newOverflow[K comparable, T any](name string, channel chan T, spill *spillFile[T], key func(row T) K,
+	merge func(prev, next T) T) *overflow[K, T] {
+	o := &overflow[K, T]{
+		name:    name,
+		channel: channel,
+		spill:   spill,
+		policy:  overflowPolicy,
+		limit:   overflowCoalesceLimit,
+		key:     key,
+		merge:   merge,
+		index:   make(map[K]int),
+
+		backlogLimit: overflowBacklogLimit,
+	}
+
+	o.room = sync.NewCond(&o.mu)
+
+	return o
+}
+
+/*
+enqueue Sends row to channel; if channel is full, row is handled according to overflow policy. Rows of which earlier
+update is still coalesced are always merged into it, and rows queued while backlog holds anything follow it there, so
+that they are not flushed out of order.
+*/
+func (o *overflow[K, T]) enqueue(row T) {
+	if o.pending.Load() > 0 && o.coalesce(row, false) {
+		return
+	}
+
+	if !o.backlogged.Load() {
+		select {
+		case o.channel <- row:
+			return
+		default:
+		}
+
+		switch {
+		case o.policy == overflowCoalesce && o.coalesce(row, true):
+			return
+		case o.policy == overflowBlock && (o.degraded == nil || !o.degraded()):
+			o.updateBlocked(1)
+			o.channel <- row
+			o.updateBlocked(-1)
+
+			return
+		}
+	}
+
+	o.addBacklog(row)
+}
+
+// updateBlocked Tracks number of callers waiting for room
+func (o *overflow[K, T]) updateBlocked(delta int64) {
+	collector.UpdateChannelBlocked(o.name, o.blocked.Add(delta))
+}
+
+// coalesce Merges row into pending update of the same row; if there is none, row is only added if add is set
+func (o *overflow[K, T]) coalesce(row T, add bool) bool {
+	if o.merge == nil {
+		return false
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := o.key(row)
+
+	if i, exists := o.index[key]; exists {
+		o.coalesced[i] = o.merge(o.coalesced[i], row)
+		return true
+	}
+
+	if !add || len(o.coalesced) >= o.limit {
+		return false
+	}
+
+	o.index[key] = len(o.coalesced)
+	o.coalesced = append(o.coalesced, row)
+	o.pending.Store(int32(len(o.coalesced))) //nolint:gosec
+
+	collector.UpdateChannelCoalesced(o.name, len(o.coalesced))
+
+	return true
+}
+
+/*
+addBacklog Puts row into backlog, which is spilled or flushed by flush routine, so that caller does not wait for it. If
+backlog is full, caller waits until flush routine takes it, as dropping row would lose credit it carries.
+*/
+func (o *overflow[K, T]) addBacklog(row T) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.backlog) >= o.backlogLimit {
+		o.updateBlocked(1)
+
+		for len(o.backlog) >= o.backlogLimit {
+			o.room.Wait()
+		}
+
+		o.updateBlocked(-1)
+	}
+
+	o.backlog = append(o.backlog, row)
+	o.backlogged.Store(true)
+
+	collector.UpdateChannelBacklog(o.name, len(o.backlog))
+}
+
+/*
+take Appends everything queued to rows in order it was queued: rows from channel followed by coalesced rows, which are
+newer than anything in channel. Rows from backlog are newer than both and are appended to backlog separately, so that
+they can be spilled. Coalesced rows never share key with rows in backlog, as rows are only coalesced while backlog is
+empty and later updates of coalesced rows are merged into them.
+*/
+func (o *overflow[K, T]) take(rows, backlog []T) ([]T, []T) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Channel is read while holding lock, so that no row can get into backlog ahead of one which is in channel already
+read:
+	for range cap(o.channel) {
+		select {
+		case row, ok := <-o.channel:
+			if !ok {
+				break read
+			}
+
+			rows = append(rows, row)
+		default:
+			break read
+		}
+	}
+
+	if o.backlogged.Load() {
+		backlog = append(backlog, o.backlog...)
+
+		clear(o.backlog)
+
+		o.backlog = o.backlog[:0]
+		o.backlogged.Store(false)
+
+		collector.UpdateChannelBacklog(o.name, 0)
+
+		o.room.Broadcast()
+	}
+
+	if o.pending.Load() == 0 {
+		return rows, backlog
+	}
+
+	rows = append(rows, o.coalesced...)
+
+	clear(o.index)
+	clear(o.coalesced) // do not keep strings of dropped rows alive
+
+	o.coalesced = o.coalesced[:0]
+	o.pending.Store(0)
+
+	collector.UpdateChannelCoalesced(o.name, 0)
+
+	return rows, backlog
+}
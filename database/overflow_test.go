@@ -0,0 +1,280 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOverflowCoalesce(t *testing.T) {
+	channel := make(chan UserUpdate, 1)
+
+	o := newOverflow("users", channel, nil, userUpdateKey, mergeUserUpdates)
+	o.policy, o.limit = overflowCoalesce, 2
+
+	o.enqueue(UserUpdate{ID: 1, DeltaUp: 1}) // fits into channel
+	o.enqueue(UserUpdate{ID: 2, DeltaUp: 2})
+	o.enqueue(UserUpdate{ID: 3, DeltaUp: 3})
+	o.enqueue(UserUpdate{ID: 2, DeltaUp: 20, RawDeltaUp: 5})
+
+	if len(o.coalesced) != 2 {
+		t.Fatalf("Expected 2 coalesced rows, got %v", o.coalesced)
+	}
+
+	// Limit is reached, so new row is put into backlog instead of waiting for room in channel
+	o.backlogLimit = 2
+
+	o.enqueue(UserUpdate{ID: 4, DeltaUp: 4})
+
+	// Rows still coalesced are merged even though backlog holds rows
+	o.enqueue(UserUpdate{ID: 3, DeltaDown: 30})
+
+	// Channel has room, but rows keep following backlog until it is full
+	<-channel
+
+	o.enqueue(UserUpdate{ID: 5, DeltaUp: 5})
+
+	// Row which does not fit into full backlog waits for it to be taken instead of being dropped
+	done := make(chan struct{})
+
+	go func() {
+		o.enqueue(UserUpdate{ID: 6, DeltaUp: 6})
+		close(done)
+	}()
+
+	for o.blocked.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(channel) != 0 {
+		t.Fatalf("Expected rows to follow backlog, got %d in channel", len(channel))
+	}
+
+	rows, backlog := o.take(nil, nil)
+
+	expected := []UserUpdate{{ID: 2, DeltaUp: 22, RawDeltaUp: 5}, {ID: 3, DeltaUp: 3, DeltaDown: 30}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected rows %v, got %v", expected, rows)
+	}
+
+	if expected = []UserUpdate{{ID: 4, DeltaUp: 4}, {ID: 5, DeltaUp: 5}}; !reflect.DeepEqual(backlog, expected) {
+		t.Fatalf("Expected backlog %v, got %v", expected, backlog)
+	}
+
+	if o.pending.Load() != 0 || len(o.index) != 0 {
+		t.Fatalf("Expected coalesced rows to be forgotten after take")
+	}
+
+	<-done
+
+	if _, backlog = o.take(nil, nil); !reflect.DeepEqual(backlog, []UserUpdate{{ID: 6, DeltaUp: 6}}) {
+		t.Fatalf("Expected waiting row to be put into backlog once it was taken, got %v", backlog)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	channel := make(chan UserUpdate, 1)
+
+	o := newOverflow("users", channel, nil, userUpdateKey, mergeUserUpdates)
+	o.policy = overflowBlock
+
+	o.enqueue(UserUpdate{ID: 1})
+
+	done := make(chan struct{})
+
+	go func() {
+		o.enqueue(UserUpdate{ID: 2})
+		close(done)
+	}()
+
+	for o.blocked.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if rows, _ := o.take(nil, nil); !reflect.DeepEqual(rows, []UserUpdate{{ID: 1}}) {
+		t.Fatalf("Expected queued row to be taken, got %v", rows)
+	}
+
+	<-done
+
+	if len(channel) != 1 || o.backlogged.Load() {
+		t.Fatalf("Expected waiting row to be sent to channel once it had room")
+	}
+
+	// Nobody waits for database which is unavailable
+	o.degraded = func() bool { return true }
+
+	o.enqueue(UserUpdate{ID: 3})
+
+	if rows, backlog := o.take(nil, nil); len(rows) != 1 || !reflect.DeepEqual(backlog, []UserUpdate{{ID: 3}}) {
+		t.Fatalf("Expected row to be put into backlog while degraded, got %v and %v", rows, backlog)
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	spill, err := openSpill[SuspicionUpdate](t.TempDir(), "suspicions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan SuspicionUpdate, 1)
+
+	// Suspicions can not be coalesced, so they are spilled instead
+	o := newOverflow[struct{}]("suspicions", channel, spill, nil, nil)
+	o.policy = overflowCoalesce
+
+	o.enqueue(SuspicionUpdate{UserID: 1})
+	o.enqueue(SuspicionUpdate{UserID: 2})
+
+	if len(channel) != 1 || len(o.backlog) != 1 || o.pending.Load() != 0 {
+		t.Fatalf("Expected second row to be put into backlog, got %d in channel and %d in backlog",
+			len(channel), len(o.backlog))
+	}
+
+	// Rows are spilled by flush routine, not by caller
+	if spill.pending() {
+		t.Fatalf("Expected nothing to be spilled before flush")
+	}
+
+	// Channel has room again, but row must not get ahead of one in backlog
+	<-channel
+
+	o.enqueue(SuspicionUpdate{UserID: 3})
+
+	rows, backlog := o.take(nil, nil)
+
+	expected := []SuspicionUpdate{{UserID: 2}, {UserID: 3}}
+	if len(rows) != 0 || !reflect.DeepEqual(backlog, expected) || o.backlogged.Load() {
+		t.Fatalf("Expected rows %v to be taken from backlog, got %v and %v", expected, rows, backlog)
+	}
+}
+
+func TestOverflowOrder(t *testing.T) {
+	spill, err := openSpill[TorrentUpdate](t.TempDir(), "torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan TorrentUpdate, 1)
+
+	o := newOverflow("torrents", channel, spill, torrentUpdateKey, mergeTorrentUpdates)
+	o.policy = overflowSpill
+
+	var (
+		stored  = make(map[uint32]TorrentUpdate)
+		failing = true
+	)
+
+	flush := func(rows []TorrentUpdate) error {
+		if failing {
+			return errQueryFailed
+		}
+
+		for _, row := range rows {
+			stored[row.ID] = row
+		}
+
+		return nil
+	}
+
+	// Torrent is pruned and unpruned again while channel is full, so that unprune overflows
+	o.enqueue(TorrentUpdate{ID: 1, LastAction: 10, StatusChanged: true, Status: 1, PruneReason: "inactive"})
+	o.enqueue(TorrentUpdate{ID: 1, Seeders: 1, LastAction: 20, StatusChanged: true})
+
+	// Storage is down, so that both updates end up in spill file
+	db := &Database{}
+	db.terminate.Store(true)
+
+	flushChannel(db, o, cap(channel), nil, flush)
+
+	failing = false
+	spill.nextReplay = time.Time{}
+
+	if err = spill.replay(flush); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := TorrentUpdate{ID: 1, Seeders: 1, LastAction: 20, StatusChanged: true}
+	if stored[1] != expected {
+		t.Fatalf("Expected later update %+v to win, got %+v", expected, stored[1])
+	}
+}
+
+func TestMergeUpdates(t *testing.T) {
+	torrent := mergeTorrentUpdates(
+		TorrentUpdate{ID: 1, DeltaSnatch: 200, LastAction: 20, StatusChanged: true, Status: 1, PruneReason: "x"},
+		TorrentUpdate{ID: 1, DeltaSnatch: 100, Seeders: 5, Leechers: 6, LastAction: 10},
+	)
+
+	expectedTorrent := TorrentUpdate{
+		ID: 1, DeltaSnatch: 255, Seeders: 5, Leechers: 6, LastAction: 20, StatusChanged: true, Status: 1, PruneReason: "x",
+	}
+	if torrent != expectedTorrent {
+		t.Fatalf("Expected merged torrent update %+v, got %+v", expectedTorrent, torrent)
+	}
+
+	history := mergeTransferHistoryUpdates(
+		TransferHistoryUpdate{UserID: 1, TorrentID: 2, RawDeltaUp: 10, StartTime: 100, LastAnnounce: 100, Left: 50},
+		TransferHistoryUpdate{UserID: 1, TorrentID: 2, RawDeltaUp: 5, DeltaTime: 60, StartTime: 160,
+			LastAnnounce: 160, Seeding: true, DeltaSnatch: 1},
+	)
+
+	expectedHistory := TransferHistoryUpdate{UserID: 1, TorrentID: 2, RawDeltaUp: 15, DeltaTime: 60, StartTime: 100,
+		LastAnnounce: 160, Seeding: true, DeltaSnatch: 1}
+	if history != expectedHistory {
+		t.Fatalf("Expected merged transfer history update %+v, got %+v", expectedHistory, history)
+	}
+
+	snatch := mergeSnatchUpdates(SnatchUpdate{UserID: 1, Time: 1}, SnatchUpdate{UserID: 1, Time: 2})
+	if snatch.Time != 1 {
+		t.Fatalf("Expected first snatch to be kept, got %+v", snatch)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	index := make(map[uint32]int)
+
+	rows := compact([]UserUpdate{
+		{ID: 1, DeltaUp: 1},
+		{ID: 2, DeltaUp: 2},
+		{ID: 1, DeltaUp: 10, RawDeltaDown: 4},
+		{ID: 3, DeltaDown: 3},
+		{ID: 2, DeltaUp: 20},
+	}, userUpdateKey, mergeUserUpdates, index)
+
+	expected := []UserUpdate{{ID: 1, DeltaUp: 11, RawDeltaDown: 4}, {ID: 2, DeltaUp: 22}, {ID: 3, DeltaDown: 3}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected compacted rows %v, got %v", expected, rows)
+	}
+
+	// Index is reused, so nothing from previous batch may leak into next one
+	rows = compact([]UserUpdate{{ID: 3, DeltaUp: 1}, {ID: 3, DeltaUp: 1}}, userUpdateKey, mergeUserUpdates, index)
+
+	if expected = []UserUpdate{{ID: 3, DeltaUp: 2}}; !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected compacted rows %v, got %v", expected, rows)
+	}
+
+	// Rows of channels which can not be merged are left alone
+	suspicions := []SuspicionUpdate{{UserID: 1}, {UserID: 1}}
+
+	if compacted := compact[struct{}](suspicions, nil, nil, nil); len(compacted) != 2 {
+		t.Fatalf("Expected suspicions to be left alone, got %v", compacted)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"sync"
+
+	cdb "chihaya/database/types"
+)
+
+// pruneResolution Width of prune bucket in seconds; inactive torrents are pruned at most this much later
+const pruneResolution = 60
+
+// pruneReasonInactive Stored alongside torrents pruned by purgeInactivePeers
+const pruneReasonInactive = "no seeders and no activity"
+
+/*
+pruneSchedule Schedule of torrent pruning, kept as buckets of info hashes by last action of torrent. Torrents are
+scheduled when they are loaded or unpruned and each of them is scheduled at most once. When bucket is due, torrents
+which were seeded since are scheduled again by their new last action, torrents which are pruned or gone are forgotten
+and the rest are pruned. This way purge looks at each torrent about once per prune_inactive_torrents interval, instead
+of at every torrent on every run.
+
+The zero value is ready to use.
+*/
+type pruneSchedule struct {
+	mu        sync.Mutex
+	buckets   map[int64][]cdb.TorrentHash
+	scheduled map[cdb.TorrentHash]struct{}
+}
+
+func (s *pruneSchedule) add(infoHash cdb.TorrentHash, lastAction int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets == nil {
+		s.buckets = make(map[int64][]cdb.TorrentHash)
+		s.scheduled = make(map[cdb.TorrentHash]struct{})
+	}
+
+	if _, exists := s.scheduled[infoHash]; exists {
+		return
+	}
+
+	b := lastAction / pruneResolution
+
+	s.buckets[b] = append(s.buckets[b], infoHash)
+	s.scheduled[infoHash] = struct{}{}
+}
+
+// due Removes and returns info hashes of buckets in which every torrent was last active before oldestUnpruned
+func (s *pruneSchedule) due(oldestUnpruned int64) (infoHashes []cdb.TorrentHash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for b, bucket := range s.buckets {
+		if (b+1)*pruneResolution <= oldestUnpruned {
+			infoHashes = append(infoHashes, bucket...)
+
+			delete(s.buckets, b)
+		}
+	}
+
+	for _, infoHash := range infoHashes {
+		delete(s.scheduled, infoHash)
+	}
+
+	return infoHashes
+}
+
+// len Returns number of scheduled torrents
+func (s *pruneSchedule) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.scheduled)
+}
+
+/*
+SchedulePrune Schedules pruning of torrent which was loaded or unpruned, unless pruning is disabled or torrent is
+already scheduled; torrents which were never seeded are checked again one interval after now.
+*/
+func (db *Database) SchedulePrune(infoHash cdb.TorrentHash, torrent *cdb.Torrent, now int64) {
+	if pruneInactiveInterval <= 0 || torrent.Status.Load() != 0 {
+		return
+	}
+
+	if lastAction := torrent.LastAction.Load(); lastAction > 0 {
+		now = lastAction
+	}
+
+	db.pruning.add(infoHash, now)
+}
+
+/*
+pruneInactiveTorrents Prunes torrents without seeders which had no seeding activity since oldestUnpruned, returning how
+many were pruned. Only torrents due in prune schedule are looked at. Torrents which were never seeded (last action is
+unknown) are left alone, as there is no telling for how long they have been inactive.
+*/
+func (db *Database) pruneInactiveTorrents(oldestUnpruned, now int64) (pruned int) {
+	for _, infoHash := range db.pruning.due(oldestUnpruned) {
+		torrent, exists := db.Torrents.Get(infoHash)
+		if !exists {
+			continue
+		}
+
+		if db.pruneTorrent(infoHash, torrent, oldestUnpruned, now) {
+			pruned++
+		}
+	}
+
+	return pruned
+}
+
+// pruneTorrent Prunes torrent if it is still inactive, or schedules it again if it is not
+func (db *Database) pruneTorrent(infoHash cdb.TorrentHash, torrent *cdb.Torrent, oldestUnpruned, now int64) bool {
+	// Announce may be adding seeder to torrent in the meantime
+	torrent.PeerLock()
+	defer torrent.PeerUnlock()
+
+	if torrent.Status.Load() != 0 {
+		// Unprune schedules torrent again
+		return false
+	}
+
+	if lastAction := torrent.LastAction.Load(); lastAction >= oldestUnpruned {
+		db.pruning.add(infoHash, lastAction)
+		return false
+	} else if lastAction == 0 || torrent.SeedersLength.Load() > 0 {
+		db.pruning.add(infoHash, now)
+		return false
+	}
+
+	/* Pruned status is queued together with other torrent updates, so that it can not overtake unprune queued
+	by announce. */
+	torrent.Status.Store(1)
+
+	db.QueueTorrentStatus(torrent, pruneReasonInactive)
+
+	return true
+}
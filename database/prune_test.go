@@ -0,0 +1,108 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"testing"
+
+	cdb "chihaya/database/types"
+)
+
+func TestPruneInactiveTorrents(t *testing.T) {
+	pruneInactiveInterval = 1000
+	defer func() {
+		pruneInactiveInterval = 0
+	}()
+
+	db := &Database{}
+	db.torrentChannel = make(chan TorrentUpdate, 10)
+	db.torrentOverflow = newOverflow("torrents", db.torrentChannel, nil, torrentUpdateKey, mergeTorrentUpdates)
+
+	var (
+		inactiveHash, seededHash, seederHash, unseededHash, prunedHash, removedHash cdb.TorrentHash
+
+		inactive = &cdb.Torrent{}
+		seeded   = &cdb.Torrent{}
+		seeder   = &cdb.Torrent{}
+		unseeded = &cdb.Torrent{}
+		pruned   = &cdb.Torrent{}
+		removed  = &cdb.Torrent{}
+	)
+
+	inactiveHash[0], seededHash[0], seederHash[0], unseededHash[0], prunedHash[0], removedHash[0] = 1, 2, 3, 4, 5, 6
+
+	for _, torrent := range []*cdb.Torrent{inactive, seeded, seeder, pruned, removed} {
+		torrent.LastAction.Store(100)
+	}
+
+	pruned.Status.Store(1)
+
+	db.Torrents.Store(cdb.NewTorrentShards(map[cdb.TorrentHash]*cdb.Torrent{
+		inactiveHash: inactive,
+		seededHash:   seeded,
+		seederHash:   seeder,
+		unseededHash: unseeded,
+		prunedHash:   pruned,
+	}))
+
+	for infoHash, torrent := range map[cdb.TorrentHash]*cdb.Torrent{
+		inactiveHash: inactive,
+		seededHash:   seeded,
+		seederHash:   seeder,
+		unseededHash: unseeded,
+		prunedHash:   pruned,
+		removedHash:  removed,
+	} {
+		db.SchedulePrune(infoHash, torrent, 100)
+		db.SchedulePrune(infoHash, torrent, 100)
+	}
+
+	// Pruned torrent is never scheduled and every other torrent only once
+	if scheduled := db.pruning.len(); scheduled != 5 {
+		t.Fatalf("Expected 5 torrents to be scheduled, got %d", scheduled)
+	}
+
+	// One torrent is seeded again since it was scheduled and one still has seeder which has not announced
+	seeded.LastAction.Store(500)
+	seeder.SeedersLength.Store(1)
+
+	if count := db.pruneInactiveTorrents(100, 1100); count != 0 {
+		t.Fatalf("Expected no torrents to be pruned before they become inactive, got %d", count)
+	}
+
+	if count := db.pruneInactiveTorrents(300, 1300); count != 1 || inactive.Status.Load() != 1 {
+		t.Fatalf("Expected inactive torrent to be pruned, got %d", count)
+	}
+
+	if seeded.Status.Load() != 0 || seeder.Status.Load() != 0 || unseeded.Status.Load() != 0 {
+		t.Fatalf("Expected other torrents not to be pruned")
+	}
+
+	if len(db.torrentChannel) != 1 {
+		t.Fatalf("Expected pruned torrent to be queued, got %d updates", len(db.torrentChannel))
+	}
+
+	// Seeded torrent, torrent with seeder and torrent which was never seeded were scheduled again
+	if scheduled := db.pruning.len(); scheduled != 3 {
+		t.Fatalf("Expected 3 torrents to stay scheduled, got %d", scheduled)
+	}
+
+	if count := db.pruneInactiveTorrents(1000, 2000); count != 1 || seeded.Status.Load() != 1 {
+		t.Fatalf("Expected torrent which is no longer seeded to be pruned, got %d", count)
+	}
+}
@@ -18,44 +18,40 @@
 package database
 
 import (
-	"strconv"
-
 	cdb "chihaya/database/types"
-	"chihaya/util"
 )
 
 /*
  * For these, we assume that the caller already has a read lock on the record
  *
- * Buffers are used for efficient string concatenation
- * It may look ugly with all the explicit type conversions, but this tracker is about speed
- *
- * These functions take from the buffer pool but don't give back,
- * so it's expected that the buffers are returned in the flush functions
+ * Updates are passed by value, so that they do not keep any reference to the records they were made from
  */
 
 func (db *Database) QueueTorrent(torrent *cdb.Torrent, deltaSnatch uint8) {
-	tq := db.bufferPool.Take()
-
-	tq.WriteString("(")
-	tq.WriteString(strconv.FormatUint(uint64(torrent.ID.Load()), 10))
-	tq.WriteString(",")
-	tq.WriteString(strconv.FormatUint(uint64(deltaSnatch), 10))
-	tq.WriteString(",")
-	tq.WriteString(strconv.FormatUint(uint64(torrent.SeedersLength.Load()), 10))
-	tq.WriteString(",")
-	tq.WriteString(strconv.FormatUint(uint64(torrent.LeechersLength.Load()), 10))
-	tq.WriteString(",")
-	tq.WriteString(strconv.FormatInt(torrent.LastAction.Load(), 10))
-	tq.WriteString(")")
-
-	select {
-	case db.torrentChannel <- tq:
-	default:
-		go func() {
-			db.torrentChannel <- tq
-		}()
+	tq := TorrentUpdate{
+		ID:          torrent.ID.Load(),
+		DeltaSnatch: deltaSnatch,
+		Seeders:     torrent.SeedersLength.Load(),
+		Leechers:    torrent.LeechersLength.Load(),
+		LastAction:  torrent.LastAction.Load(),
 	}
+
+	db.torrentOverflow.enqueue(tq)
+}
+
+// QueueTorrentStatus Same as QueueTorrent, but also stores current status of torrent along with reason for pruning
+func (db *Database) QueueTorrentStatus(torrent *cdb.Torrent, pruneReason string) {
+	tq := TorrentUpdate{
+		ID:            torrent.ID.Load(),
+		Seeders:       torrent.SeedersLength.Load(),
+		Leechers:      torrent.LeechersLength.Load(),
+		LastAction:    torrent.LastAction.Load(),
+		StatusChanged: true,
+		Status:        uint8(torrent.Status.Load()), //nolint:gosec
+		PruneReason:   pruneReason,
+	}
+
+	db.torrentOverflow.enqueue(tq)
 }
 
 func (db *Database) QueueUser(user *cdb.User, rawDeltaUp, rawDeltaDown, deltaUp, deltaDown int64) {
@@ -63,120 +59,75 @@ func (db *Database) QueueUser(user *cdb.User, rawDeltaUp, rawDeltaDown, deltaUp,
 		return // Do not consume channel for empty actions
 	}
 
-	uq := db.bufferPool.Take()
-
-	uq.WriteString("(")
-	uq.WriteString(strconv.FormatUint(uint64(user.ID.Load()), 10))
-	uq.WriteString(",")
-	uq.WriteString(strconv.FormatInt(deltaUp, 10))
-	uq.WriteString(",")
-	uq.WriteString(strconv.FormatInt(deltaDown, 10))
-	uq.WriteString(",")
-	uq.WriteString(strconv.FormatInt(rawDeltaDown, 10))
-	uq.WriteString(",")
-	uq.WriteString(strconv.FormatInt(rawDeltaUp, 10))
-	uq.WriteString(")")
-
-	select {
-	case db.userChannel <- uq:
-	default:
-		go func() {
-			db.userChannel <- uq
-		}()
+	uq := UserUpdate{
+		ID:           user.ID.Load(),
+		DeltaUp:      deltaUp,
+		DeltaDown:    deltaDown,
+		RawDeltaUp:   rawDeltaUp,
+		RawDeltaDown: rawDeltaDown,
 	}
+
+	db.userOverflow.enqueue(uq)
 }
 
 func (db *Database) QueueTransferHistory(peer *cdb.Peer, rawDeltaUp, rawDeltaDown, deltaTime, deltaSeedTime int64,
 	deltaSnatch uint8, active bool) {
-	th := db.bufferPool.Take()
-
-	th.WriteString("(")
-	th.WriteString(strconv.FormatUint(uint64(peer.UserID), 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatUint(uint64(peer.TorrentID), 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatInt(rawDeltaUp, 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatInt(rawDeltaDown, 10))
-	th.WriteString(",")
-	th.WriteString(util.Btoa(peer.Seeding))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatInt(peer.StartTime, 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatInt(peer.LastAnnounce, 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatInt(deltaTime, 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatInt(deltaSeedTime, 10))
-	th.WriteString(",")
-	th.WriteString(util.Btoa(active))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatUint(uint64(deltaSnatch), 10))
-	th.WriteString(",")
-	th.WriteString(strconv.FormatUint(peer.Left, 10))
-	th.WriteString(")")
-
-	select {
-	case db.transferHistoryChannel <- th:
-	default:
-		go func() {
-			db.transferHistoryChannel <- th
-		}()
+	th := TransferHistoryUpdate{
+		UserID:        peer.UserID,
+		TorrentID:     peer.TorrentID,
+		RawDeltaUp:    rawDeltaUp,
+		RawDeltaDown:  rawDeltaDown,
+		Seeding:       peer.Seeding,
+		StartTime:     peer.StartTime,
+		LastAnnounce:  peer.LastAnnounce,
+		DeltaTime:     deltaTime,
+		DeltaSeedTime: deltaSeedTime,
+		Active:        active,
+		DeltaSnatch:   deltaSnatch,
+		Left:          peer.Left,
 	}
+
+	db.transferHistoryOverflow.enqueue(th)
 }
 
-func (db *Database) QueueTransferIP(peer *cdb.Peer, persistAddr cdb.PeerAddress, rawDeltaUp, rawDeltaDown int64) {
-	ti := db.bufferPool.Take()
-
-	ti.WriteString("(")
-	ti.WriteString(strconv.FormatUint(uint64(peer.UserID), 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatUint(uint64(peer.TorrentID), 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatUint(uint64(peer.ClientID), 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatUint(uint64(persistAddr.IPNumeric()), 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatUint(uint64(persistAddr.Port()), 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatInt(rawDeltaUp, 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatInt(rawDeltaDown, 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatInt(peer.StartTime, 10))
-	ti.WriteString(",")
-	ti.WriteString(strconv.FormatInt(peer.LastAnnounce, 10))
-	ti.WriteString(")")
-
-	select {
-	case db.transferIpsChannel <- ti:
-	default:
-		go func() {
-			db.transferIpsChannel <- ti
-		}()
+func (db *Database) QueueTransferIP(peer *cdb.Peer, persistAddr cdb.PeerAddress, persistAddr6 cdb.PeerAddress6,
+	rawDeltaUp, rawDeltaDown int64) {
+	ti := TransferIPUpdate{
+		UserID:       peer.UserID,
+		TorrentID:    peer.TorrentID,
+		ClientID:     peer.ClientID,
+		Addr:         persistAddr,
+		Addr6:        persistAddr6,
+		Port:         peer.Port(),
+		RawDeltaUp:   rawDeltaUp,
+		RawDeltaDown: rawDeltaDown,
+		StartTime:    peer.StartTime,
+		LastAnnounce: peer.LastAnnounce,
 	}
+
+	db.transferIpsOverflow.enqueue(ti)
 }
 
 func (db *Database) QueueSnatch(peer *cdb.Peer, now int64) {
-	sn := db.bufferPool.Take()
-
-	sn.WriteString("(")
-	sn.WriteString(strconv.FormatUint(uint64(peer.UserID), 10))
-	sn.WriteString(",")
-	sn.WriteString(strconv.FormatUint(uint64(peer.TorrentID), 10))
-	sn.WriteString(",")
-	sn.WriteString(strconv.FormatInt(now, 10))
-	sn.WriteString(")")
-
-	select {
-	case db.snatchChannel <- sn:
-	default:
-		go func() {
-			db.snatchChannel <- sn
-		}()
+	sn := SnatchUpdate{
+		UserID:    peer.UserID,
+		TorrentID: peer.TorrentID,
+		Time:      now,
 	}
+
+	db.snatchOverflow.enqueue(sn)
 }
 
-func (db *Database) UnPrune(torrent *cdb.Torrent) {
-	db.execute(db.unPruneTorrentStmt, torrent.ID.Load())
+func (db *Database) QueueSuspicion(peer *cdb.Peer, rule, details string, rawDeltaUp int64, withheld bool, now int64) {
+	su := SuspicionUpdate{
+		UserID:     peer.UserID,
+		TorrentID:  peer.TorrentID,
+		Rule:       rule,
+		Details:    details,
+		RawDeltaUp: rawDeltaUp,
+		Withheld:   withheld,
+		Time:       now,
+	}
+
+	db.suspicionOverflow.enqueue(su)
 }
@@ -18,8 +18,11 @@
 package database
 
 import (
+	"errors"
 	"log/slog"
+	"maps"
 	"math"
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -29,17 +32,34 @@ import (
 	"chihaya/util"
 )
 
+// Modes of reload as reported in metrics
+const (
+	reloadFull        = "full"
+	reloadIncremental = "incremental"
+)
+
 // GlobalFreeleech indicates whether site is now in freeleech mode (takes precedence over torrent-specific multipliers)
 var GlobalFreeleech atomic.Bool
 
 var (
-	reloadInterval int
+	reloadInterval     int
+	fullReloadInterval int
+	changeLogEnabled   bool
+	changeLogLimit     int
+	changeLogGapWait   int
 )
 
+var errChangeLogGap = errors.New("too many change log entries are missing")
+
 func init() {
 	intervals := config.Section("intervals")
+	databaseConfig := config.Section("database")
 
 	reloadInterval, _ = intervals.GetInt("database_reload", 45)
+	fullReloadInterval, _ = intervals.GetInt("full_reload", 3600)
+	changeLogEnabled, _ = databaseConfig.GetBool("change_log", false)
+	changeLogLimit, _ = databaseConfig.GetInt("change_log_limit", 10000)
+	changeLogGapWait, _ = databaseConfig.GetInt("change_log_gap_wait", 300)
 }
 
 /*
@@ -56,103 +76,320 @@ func (db *Database) startReloading() {
 			db.waitGroup.Add(1)
 			defer db.waitGroup.Done()
 
-			db.loadUsers()
-			db.loadHitAndRuns()
-			db.loadTorrents()
-			db.loadGroupsFreeleech()
-			db.loadConfig()
-			db.loadClients()
+			db.reload()
 		})
 	}()
 }
 
-func (db *Database) loadUsers() {
-	startTime := time.Now()
+// Reload Reloads all caches from database at once; this is also done periodically (see reload)
+func (db *Database) Reload() {
+	db.reloadLock.Lock()
+	defer db.reloadLock.Unlock()
 
-	dbUsers := *db.Users.Load()
-	newUsers := make(map[string]*cdb.User, len(dbUsers))
+	db.reloadFull()
+}
 
-	rows := db.query(db.loadUsersStmt)
-	if rows == nil {
-		slog.Error("failed to reload from database", "source", "users")
+/*
+reload Performs periodic reload. With change log enabled, only users, torrents, group freeleech and hit and runs
+logged as changed since previous reload are reloaded, except once every full_reload interval (or whenever incremental
+reload fails), when everything is reloaded to reconcile whatever change log might have missed. Remaining tables are
+small and are always reloaded in full. Nothing is reloaded in degraded mode, where data in memory is kept as it is until
+database becomes available again.
+*/
+func (db *Database) reload() {
+	db.reloadLock.Lock()
+	defer db.reloadLock.Unlock()
+
+	if db.Degraded() {
 		return
 	}
 
-	defer func() {
-		_ = rows.Close()
-	}()
+	if !changeLogEnabled || !db.changeLogReady ||
+		time.Since(db.lastFullReload) >= time.Duration(fullReloadInterval)*time.Second {
+		db.reloadFull()
+		return
+	}
 
-	for rows.Next() {
-		var (
-			id                           uint32
-			torrentPass                  string
-			downMultiplier, upMultiplier float64
-			disableDownload, trackerHide bool
-		)
+	if err := db.reloadChanges(); err != nil {
+		slog.Error("failed to reload changes from database, reloading everything", "err", err)
 
-		if err := rows.Scan(&id, &torrentPass, &downMultiplier, &upMultiplier, &disableDownload, &trackerHide); err != nil {
-			slog.Warn("error scanning row", "source", "users", "err", err)
-			continue
+		db.reloadFull()
+
+		return
+	}
+
+	db.loadUsersFreeleech()
+	db.loadFreeleechWindows()
+	db.loadConfig()
+	db.loadClients()
+}
+
+func (db *Database) reloadFull() {
+	/* Position in change log is taken before loading, so that changes made during load are applied again next time.
+	Incremental reloads are only possible once tables tracked by change log were loaded successfully. */
+	var (
+		changeID uint64
+		err      error
+	)
+
+	if changeLogEnabled {
+		if changeID, err = db.storage.LastChangeID(); err != nil {
+			slog.Error("failed to load position in change log", "err", err)
 		}
+	}
 
-		if old, exists := dbUsers[torrentPass]; exists && old != nil {
-			old.ID.Store(id)
-			old.DownMultiplier.Store(math.Float64bits(downMultiplier))
-			old.UpMultiplier.Store(math.Float64bits(upMultiplier))
-			old.DisableDownload.Store(disableDownload)
-			old.TrackerHide.Store(trackerHide)
+	loaded := db.loadUsers()
+	loaded = db.loadHitAndRuns() && loaded
+	loaded = db.loadTorrents() && loaded
+	loaded = db.loadGroupsFreeleech() && loaded
 
-			newUsers[torrentPass] = old
-		} else {
-			u := &cdb.User{}
-			u.ID.Store(id)
-			u.DownMultiplier.Store(math.Float64bits(downMultiplier))
-			u.UpMultiplier.Store(math.Float64bits(upMultiplier))
-			u.DisableDownload.Store(disableDownload)
-			u.TrackerHide.Store(trackerHide)
-			newUsers[torrentPass] = u
+	db.loadUsersFreeleech()
+	db.loadFreeleechWindows()
+	db.loadConfig()
+	db.loadClients()
+
+	if loaded {
+		db.loaded.Store(true)
+	}
+
+	db.changeID, db.changeLogReady = changeID, changeLogEnabled && err == nil && loaded
+	db.changeGaps = nil
+	db.lastFullReload = time.Now()
+}
+
+/*
+reloadChanges Applies entries of change log logged since previous reload. IDs are assigned when entries are inserted,
+but transactions may commit in different order, so IDs skipped on the way are remembered as gaps and looked for again
+by following reloads, until they show up or change_log_gap_wait passes (IDs are also skipped by rolled back
+transactions). Gaps too large to track fail the reload, so that everything is reloaded instead.
+*/
+func (db *Database) reloadChanges() error {
+	startTime := time.Now()
+
+	var (
+		users    = make(map[uint32]struct{})
+		torrents = make(map[uint32]struct{})
+		groups   = make(map[TorrentGroupRow]struct{})
+		hnrs     = make(map[cdb.UserTorrentPair]struct{})
+
+		lastID   = db.changeID
+		found    []uint64
+		missing  []uint64
+		tooLarge bool
+		count    int
+	)
+
+	collect := func(row *ChangeRow) {
+		count++
+
+		switch row.Source {
+		case changeUsers:
+			users[row.UserID] = struct{}{}
+		case changeTorrents:
+			torrents[row.TorrentID] = struct{}{}
+		case changeGroupsFreeleech:
+			groups[TorrentGroupRow{GroupID: row.GroupID, TorrentType: row.TorrentType}] = struct{}{}
+		case changeHitAndRuns:
+			hnrs[cdb.UserTorrentPair{UserID: row.UserID, TorrentID: row.TorrentID}] = struct{}{}
+		default:
+			slog.Warn("unknown source in change log", "source", row.Source, "id", row.ID)
+		}
+	}
+
+	if len(db.changeGaps) > 0 {
+		first := db.changeID
+
+		for id := range db.changeGaps {
+			first = min(first, id)
+		}
+
+		// Entries between first gap and current position are read again, but only those which were missing are applied
+		if err := db.storage.LoadChanges(first-1, int(db.changeID-first+1), func(row *ChangeRow) {
+			if _, exists := db.changeGaps[row.ID]; exists && row.ID <= db.changeID {
+				found = append(found, row.ID)
+				collect(row)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := db.storage.LoadChanges(db.changeID, changeLogLimit, func(row *ChangeRow) {
+		switch {
+		case tooLarge:
+			return
+		case row.ID-lastID-1 > uint64(changeLogLimit):
+			tooLarge = true
+			return
+		}
+
+		for id := lastID + 1; id < row.ID; id++ {
+			missing = append(missing, id)
+		}
+
+		lastID = row.ID
+
+		collect(row)
+	}); err != nil {
+		return err
+	}
+
+	if tooLarge {
+		return errChangeLogGap
+	}
+
+	// Position in change log only moves once all changes were applied; applying them again is harmless
+	if len(users) > 0 {
+		if err := db.loadChangedUsers(slices.Collect(maps.Keys(users))); err != nil {
+			return err
+		}
+	}
+
+	if len(hnrs) > 0 {
+		if err := db.loadChangedHitAndRuns(slices.Collect(maps.Keys(hnrs))); err != nil {
+			return err
+		}
+	}
+
+	if len(torrents) > 0 {
+		if err := db.loadChangedTorrents(slices.Collect(maps.Keys(torrents))); err != nil {
+			return err
 		}
 	}
 
+	if len(groups) > 0 {
+		if err := db.loadChangedGroupsFreeleech(slices.Collect(maps.Keys(groups))); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range found {
+		delete(db.changeGaps, id)
+	}
+
+	for id, since := range db.changeGaps {
+		if startTime.Sub(since) >= time.Duration(changeLogGapWait)*time.Second {
+			delete(db.changeGaps, id)
+		}
+	}
+
+	if len(missing) > 0 && db.changeGaps == nil {
+		db.changeGaps = make(map[uint64]time.Time, len(missing))
+	}
+
+	for _, id := range missing {
+		db.changeGaps[id] = startTime
+	}
+
+	db.changeID = lastID
+
+	elapsedTime := time.Since(startTime)
+
+	collector.UpdateReloadTime("tracker_changes", reloadIncremental, elapsedTime)
+
+	slog.Info("reload from database", "source", "tracker_changes", "rows", count, "elapsed", elapsedTime,
+		"users", len(users), "hit_and_runs", len(hnrs), "torrents", len(torrents), "groups_freeleech", len(groups),
+		"gaps", len(db.changeGaps))
+
+	return nil
+}
+
+func updateUser(u *cdb.User, row *UserRow) {
+	u.ID.Store(row.ID)
+	u.DownMultiplier.Store(math.Float64bits(row.DownMultiplier))
+	u.UpMultiplier.Store(math.Float64bits(row.UpMultiplier))
+	u.DisableDownload.Store(row.DisableDownload)
+	u.TrackerHide.Store(row.TrackerHide)
+}
+
+func (db *Database) loadUsers() bool {
+	startTime := time.Now()
+
+	dbUsers := *db.Users.Load()
+	newUsers := make(map[string]*cdb.User, len(dbUsers))
+
+	if err := db.storage.LoadUsers(func(row *UserRow) {
+		u, exists := dbUsers[row.Passkey]
+		if !exists || u == nil {
+			u = &cdb.User{}
+		}
+
+		updateUser(u, row)
+
+		newUsers[row.Passkey] = u
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "users", "err", err)
+		return false
+	}
+
 	db.Users.Store(&newUsers)
 
 	elapsedTime := time.Since(startTime)
 	lenUsers := len(newUsers)
 
-	collector.UpdateReloadTime("users", elapsedTime)
+	collector.UpdateReloadTime("users", reloadFull, elapsedTime)
 	collector.UpdateUsers(lenUsers)
 
 	slog.Info("reload from database", "source", "users", "rows", lenUsers, "elapsed", elapsedTime)
+
+	return true
 }
 
-func (db *Database) loadHitAndRuns() {
+/*
+loadChangedUsers Reloads users with given IDs; users which are no longer loaded from storage are removed. Existing
+user objects are reused even if passkey has changed, so that references held elsewhere stay valid.
+*/
+func (db *Database) loadChangedUsers(ids []uint32) error {
 	startTime := time.Now()
 
-	newHnr := make(map[cdb.UserTorrentPair]struct{})
-
-	rows := db.query(db.loadHnrStmt)
-	if rows == nil {
-		slog.Error("failed to reload from database", "source", "hit_and_runs")
-		return
+	changed := make(map[uint32]*cdb.User, len(ids))
+	for _, id := range ids {
+		changed[id] = nil
 	}
 
-	defer func() {
-		_ = rows.Close()
-	}()
-
-	for rows.Next() {
-		var uid, fid uint32
+	dbUsers := *db.Users.Load()
+	newUsers := make(map[string]*cdb.User, len(dbUsers))
 
-		if err := rows.Scan(&uid, &fid); err != nil {
-			slog.Warn("error scanning row", "source", "hit_and_runs", "err", err)
+	for passkey, u := range dbUsers {
+		if _, exists := changed[u.ID.Load()]; exists {
+			changed[u.ID.Load()] = u
 			continue
 		}
 
-		hnr := cdb.UserTorrentPair{
-			UserID:    uid,
-			TorrentID: fid,
+		newUsers[passkey] = u
+	}
+
+	if err := db.storage.LoadUsersByID(ids, func(row *UserRow) {
+		u := changed[row.ID]
+		if u == nil {
+			u = &cdb.User{}
 		}
-		newHnr[hnr] = struct{}{}
+
+		updateUser(u, row)
+
+		newUsers[row.Passkey] = u
+	}); err != nil {
+		return err
+	}
+
+	db.Users.Store(&newUsers)
+
+	collector.UpdateReloadTime("users", reloadIncremental, time.Since(startTime))
+	collector.UpdateUsers(len(newUsers))
+
+	return nil
+}
+
+func (db *Database) loadHitAndRuns() bool {
+	startTime := time.Now()
+
+	newHnr := make(map[cdb.UserTorrentPair]struct{})
+
+	if err := db.storage.LoadHitAndRuns(func(pair cdb.UserTorrentPair) {
+		newHnr[pair] = struct{}{}
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "hit_and_runs", "err", err)
+		return false
 	}
 
 	db.HitAndRuns.Store(&newHnr)
@@ -160,137 +397,172 @@ func (db *Database) loadHitAndRuns() {
 	elapsedTime := time.Since(startTime)
 	lenHnr := len(newHnr)
 
-	collector.UpdateReloadTime("hit_and_runs", elapsedTime)
+	collector.UpdateReloadTime("hit_and_runs", reloadFull, elapsedTime)
 	collector.UpdateHitAndRuns(lenHnr)
 
 	slog.Info("reload from database", "source", "hit_and_runs", "rows", lenHnr, "elapsed", elapsedTime)
+
+	return true
 }
 
-func (db *Database) loadTorrents() {
+func (db *Database) loadChangedHitAndRuns(pairs []cdb.UserTorrentPair) error {
 	startTime := time.Now()
 
-	dbTorrents := *db.Torrents.Load()
-	newTorrents := make(map[cdb.TorrentHash]*cdb.Torrent, len(dbTorrents))
+	newHnr := maps.Clone(*db.HitAndRuns.Load())
+	for _, pair := range pairs {
+		delete(newHnr, pair)
+	}
 
-	rows := db.query(db.loadTorrentsStmt)
-	if rows == nil {
-		slog.Error("failed to reload from database", "source", "torrents")
-		return
+	if err := db.storage.LoadHitAndRunsByPair(pairs, func(pair cdb.UserTorrentPair) {
+		newHnr[pair] = struct{}{}
+	}); err != nil {
+		return err
 	}
 
-	defer func() {
-		_ = rows.Close()
-	}()
+	db.HitAndRuns.Store(&newHnr)
 
-	for rows.Next() {
-		var (
-			infoHash                     cdb.TorrentHash
-			id                           uint32
-			downMultiplier, upMultiplier float64
-			snatched                     uint16
-			status                       uint8
-			groupID                      uint32
-			torrentType                  string
-		)
-
-		if err := rows.Scan(
-			&id,
-			&infoHash,
-			&downMultiplier,
-			&upMultiplier,
-			&snatched,
-			&status,
-			&groupID,
-			&torrentType,
-		); err != nil {
-			slog.Warn("error scanning row", "source", "torrents", "err", err)
-			continue
-		}
+	collector.UpdateReloadTime("hit_and_runs", reloadIncremental, time.Since(startTime))
+	collector.UpdateHitAndRuns(len(newHnr))
 
-		torrentTypeUint64, err := cdb.TorrentTypeFromString(torrentType)
-		if err != nil {
-			slog.Warn("error storing row", "source", "torrents", "err", err)
-			continue
-		}
+	return nil
+}
 
-		if old, exists := dbTorrents[infoHash]; exists && old != nil {
-			old.ID.Store(id)
-			old.DownMultiplier.Store(math.Float64bits(downMultiplier))
-			old.UpMultiplier.Store(math.Float64bits(upMultiplier))
-			old.Snatched.Store(uint32(snatched))
-			old.Status.Store(uint32(status))
+func updateTorrent(t *cdb.Torrent, row *TorrentRow, torrentType uint64) {
+	t.ID.Store(row.ID)
+	t.DownMultiplier.Store(math.Float64bits(row.DownMultiplier))
+	t.UpMultiplier.Store(math.Float64bits(row.UpMultiplier))
+	t.Snatched.Store(uint32(row.Snatched))
+	t.Status.Store(uint32(row.Status))
+	t.LastAction.Store(max(t.LastAction.Load(), row.LastAction))
 
-			old.Group.TorrentType.Store(torrentTypeUint64)
-			old.Group.GroupID.Store(groupID)
+	t.Group.TorrentType.Store(torrentType)
+	t.Group.GroupID.Store(row.GroupID)
+}
 
-			newTorrents[infoHash] = old
-		} else {
-			t := &cdb.Torrent{
-				Seeders:  make(map[cdb.PeerKey]*cdb.Peer),
-				Leechers: make(map[cdb.PeerKey]*cdb.Peer),
-			}
+func (db *Database) loadTorrents() bool {
+	startTime := time.Now()
+	now := startTime.Unix()
 
-			t.ID.Store(id)
-			t.DownMultiplier.Store(math.Float64bits(downMultiplier))
-			t.UpMultiplier.Store(math.Float64bits(upMultiplier))
-			t.Snatched.Store(uint32(snatched))
-			t.Status.Store(uint32(status))
+	var newTorrents cdb.TorrentShards
 
-			t.Group.TorrentType.Store(torrentTypeUint64)
-			t.Group.GroupID.Store(groupID)
+	newHashes := make(map[uint32]cdb.TorrentHash, len(db.torrentHashes))
 
-			newTorrents[infoHash] = t
+	if err := db.storage.LoadTorrents(func(row *TorrentRow) {
+		torrentTypeUint64, err := cdb.TorrentTypeFromString(row.TorrentType)
+		if err != nil {
+			slog.Warn("error storing row", "source", "torrents", "err", err)
+			return
 		}
+
+		t, exists := db.Torrents.Get(row.InfoHash)
+		if !exists || t == nil {
+			t = &cdb.Torrent{}
+		}
+
+		updateTorrent(t, row, torrentTypeUint64)
+		db.SchedulePrune(row.InfoHash, t, now)
+
+		newTorrents.Put(row.InfoHash, t)
+		newHashes[row.ID] = row.InfoHash
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "torrents", "err", err)
+		return false
 	}
 
 	db.Torrents.Store(&newTorrents)
+	db.torrentHashes = newHashes
 
 	elapsedTime := time.Since(startTime)
-	lenTorrents := len(newTorrents)
+	lenTorrents := newTorrents.Len()
 
-	collector.UpdateReloadTime("torrents", elapsedTime)
+	collector.UpdateReloadTime("torrents", reloadFull, elapsedTime)
 	collector.UpdateTorrents(lenTorrents)
 
 	slog.Info("reload from database", "source", "torrents", "rows", lenTorrents, "elapsed", elapsedTime)
+
+	return true
 }
 
-func (db *Database) loadGroupsFreeleech() {
+/*
+loadChangedTorrents Reloads torrents with given IDs; torrents which are no longer loaded from storage are removed
+along with their peers. Existing torrent objects (and so their peers) are kept even if info hash has changed. Torrents
+are found by their ID in torrentHashes and only shards of index holding changed torrents are copied, so that work done
+is proportional to number of changes rather than to number of torrents.
+*/
+func (db *Database) loadChangedTorrents(ids []uint32) error {
 	startTime := time.Now()
 
-	newTorrentGroupFreeleech := make(map[cdb.TorrentGroupKey]*cdb.TorrentGroupFreeleech)
+	changed := make(map[uint32]*cdb.Torrent, len(ids))
 
-	rows := db.query(db.loadTorrentGroupFreeleechStmt)
-	if rows == nil {
-		slog.Error("failed to reload from database", "source", "torrents_group_freeleech")
-		return
-	}
+	// Changed torrents are removed from index unless they are loaded again below
+	changes := make(map[cdb.TorrentHash]*cdb.Torrent, len(ids))
 
-	defer func() {
-		_ = rows.Close()
-	}()
+	for _, id := range ids {
+		if infoHash, exists := db.torrentHashes[id]; exists {
+			changed[id], _ = db.Torrents.Get(infoHash)
+			changes[infoHash] = nil
+		}
+	}
 
-	for rows.Next() {
-		var (
-			downMultiplier, upMultiplier float64
-			groupID                      uint32
-			torrentType                  string
-		)
+	loaded := make(map[uint32]cdb.TorrentHash, len(ids))
 
-		if err := rows.Scan(&groupID, &torrentType, &downMultiplier, &upMultiplier); err != nil {
-			slog.Warn("error scanning row", "source", "torrents_group_freeleech", "err", err)
-			continue
+	if err := db.storage.LoadTorrentsByID(ids, func(row *TorrentRow) {
+		torrentTypeUint64, err := cdb.TorrentTypeFromString(row.TorrentType)
+		if err != nil {
+			slog.Warn("error storing row", "source", "torrents", "err", err)
+			return
 		}
 
-		k, err := cdb.TorrentGroupKeyFromString(torrentType, groupID)
-		if err != nil {
-			slog.Warn("error storing row", "source", "torrents_group_freeleech", "err", err)
-			continue
+		t := changed[row.ID]
+		if t == nil {
+			t = &cdb.Torrent{}
 		}
 
-		newTorrentGroupFreeleech[k] = &cdb.TorrentGroupFreeleech{
-			UpMultiplier:   upMultiplier,
-			DownMultiplier: downMultiplier,
+		updateTorrent(t, row, torrentTypeUint64)
+		db.SchedulePrune(row.InfoHash, t, startTime.Unix())
+
+		changes[row.InfoHash] = t
+		loaded[row.ID] = row.InfoHash
+	}); err != nil {
+		return err
+	}
+
+	db.Torrents.Update(changes)
+
+	for _, id := range ids {
+		delete(db.torrentHashes, id)
+	}
+
+	maps.Copy(db.torrentHashes, loaded)
+
+	collector.UpdateReloadTime("torrents", reloadIncremental, time.Since(startTime))
+	collector.UpdateTorrents(db.Torrents.Len())
+
+	return nil
+}
+
+func newGroupFreeleech(row *GroupFreeleechRow) (cdb.TorrentGroupKey, *cdb.TorrentGroupFreeleech, bool) {
+	k, err := cdb.TorrentGroupKeyFromString(row.TorrentType, row.GroupID)
+	if err != nil {
+		slog.Warn("error storing row", "source", "torrents_group_freeleech", "err", err)
+		return k, nil, false
+	}
+
+	return k, &cdb.TorrentGroupFreeleech{UpMultiplier: row.UpMultiplier, DownMultiplier: row.DownMultiplier}, true
+}
+
+func (db *Database) loadGroupsFreeleech() bool {
+	startTime := time.Now()
+
+	newTorrentGroupFreeleech := make(map[cdb.TorrentGroupKey]*cdb.TorrentGroupFreeleech)
+
+	if err := db.storage.LoadGroupsFreeleech(func(row *GroupFreeleechRow) {
+		if k, freeleech, ok := newGroupFreeleech(row); ok {
+			newTorrentGroupFreeleech[k] = freeleech
 		}
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "torrents_group_freeleech", "err", err)
+		return false
 	}
 
 	db.TorrentGroupFreeleech.Store(&newTorrentGroupFreeleech)
@@ -298,61 +570,128 @@ func (db *Database) loadGroupsFreeleech() {
 	elapsedTime := time.Since(startTime)
 	lenTorrentGroupFreeleech := len(newTorrentGroupFreeleech)
 
-	collector.UpdateReloadTime("groups_freeleech", elapsedTime)
+	collector.UpdateReloadTime("groups_freeleech", reloadFull, elapsedTime)
 
 	slog.Info("reload from database", "source", "torrents_group_freeleech",
 		"rows", lenTorrentGroupFreeleech, "elapsed", elapsedTime)
-}
 
-func (db *Database) loadConfig() {
-	rows := db.query(db.loadFreeleechStmt)
-	if rows == nil {
-		slog.Error("failed to reload from database", "source", "config")
-		return
-	}
+	return true
+}
 
-	defer func() {
-		_ = rows.Close()
-	}()
+func (db *Database) loadChangedGroupsFreeleech(groups []TorrentGroupRow) error {
+	startTime := time.Now()
 
-	for rows.Next() {
-		var globalFreelech bool
+	newTorrentGroupFreeleech := maps.Clone(*db.TorrentGroupFreeleech.Load())
 
-		if err := rows.Scan(&globalFreelech); err != nil {
-			slog.Warn("error scanning row", "source", "config", "err", err)
-			continue
+	for _, group := range groups {
+		if k, err := cdb.TorrentGroupKeyFromString(group.TorrentType, group.GroupID); err == nil {
+			delete(newTorrentGroupFreeleech, k)
 		}
+	}
 
-		GlobalFreeleech.Store(globalFreelech)
+	if err := db.storage.LoadGroupsFreeleechByGroup(groups, func(row *GroupFreeleechRow) {
+		if k, freeleech, ok := newGroupFreeleech(row); ok {
+			newTorrentGroupFreeleech[k] = freeleech
+		}
+	}); err != nil {
+		return err
 	}
+
+	db.TorrentGroupFreeleech.Store(&newTorrentGroupFreeleech)
+
+	collector.UpdateReloadTime("groups_freeleech", reloadIncremental, time.Since(startTime))
+
+	return nil
 }
 
-func (db *Database) loadClients() {
+func (db *Database) loadUsersFreeleech() {
 	startTime := time.Now()
 
-	newClients := make(map[uint16]string)
+	newUsersFreeleech := make(map[cdb.UserTorrentPair]*cdb.UserFreeleech)
 
-	rows := db.query(db.loadClientsStmt)
-	if rows == nil {
-		slog.Error("failed to reload from database", "source", "approved_clients")
+	if err := db.storage.LoadUsersFreeleech(func(row *UserFreeleechRow) {
+		newUsersFreeleech[cdb.UserTorrentPair{UserID: row.UserID, TorrentID: row.TorrentID}] = &cdb.UserFreeleech{
+			UpMultiplier:   row.UpMultiplier,
+			DownMultiplier: row.DownMultiplier,
+			Expiry:         row.Expiry,
+		}
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "users_freeleeches", "err", err)
 		return
 	}
 
-	defer func() {
-		_ = rows.Close()
-	}()
+	db.UsersFreeleech.Store(&newUsersFreeleech)
+
+	elapsedTime := time.Since(startTime)
+	lenUsersFreeleech := len(newUsersFreeleech)
+
+	collector.UpdateReloadTime("users_freeleeches", reloadFull, elapsedTime)
+	collector.UpdateUsersFreeleech(lenUsersFreeleech)
+
+	slog.Info("reload from database", "source", "users_freeleeches", "rows", lenUsersFreeleech,
+		"elapsed", elapsedTime)
+}
 
-	for rows.Next() {
-		var (
-			id     uint16
-			peerID string
-		)
+func (db *Database) loadFreeleechWindows() {
+	startTime := time.Now()
+
+	newFreeleechWindows := cdb.FreeleechWindows{Groups: make(map[cdb.TorrentGroupKey][]cdb.FreeleechWindow)}
+	lenFreeleechWindows := 0
+
+	if err := db.storage.LoadFreeleechWindows(func(row *FreeleechWindowRow) {
+		w := cdb.FreeleechWindow{
+			Start:          row.StartTime,
+			End:            row.EndTime,
+			DownMultiplier: row.DownMultiplier,
+			UpMultiplier:   row.UpMultiplier,
+		}
+
+		if row.GroupID == 0 {
+			newFreeleechWindows.Global = append(newFreeleechWindows.Global, w)
+		} else {
+			k, err := cdb.TorrentGroupKeyFromString(row.TorrentType, row.GroupID)
+			if err != nil {
+				slog.Warn("error storing row", "source", "freeleech_windows", "err", err)
+				return
+			}
 
-		if err := rows.Scan(&id, &peerID); err != nil {
-			slog.Warn("error scanning row", "source", "approved_clients", "err", err)
+			newFreeleechWindows.Groups[k] = append(newFreeleechWindows.Groups[k], w)
 		}
 
-		newClients[id] = peerID
+		lenFreeleechWindows++
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "freeleech_windows", "err", err)
+		return
+	}
+
+	db.FreeleechWindows.Store(&newFreeleechWindows)
+
+	elapsedTime := time.Since(startTime)
+
+	collector.UpdateReloadTime("freeleech_windows", reloadFull, elapsedTime)
+
+	slog.Info("reload from database", "source", "freeleech_windows", "rows", lenFreeleechWindows,
+		"elapsed", elapsedTime)
+}
+
+func (db *Database) loadConfig() {
+	if err := db.storage.LoadGlobalFreeleech(func(enabled bool) {
+		GlobalFreeleech.Store(enabled)
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "config", "err", err)
+	}
+}
+
+func (db *Database) loadClients() {
+	startTime := time.Now()
+
+	newClients := make(map[uint16]string)
+
+	if err := db.storage.LoadClients(func(row *ClientRow) {
+		newClients[row.ID] = row.PeerID
+	}); err != nil {
+		slog.Error("failed to reload from database", "source", "approved_clients", "err", err)
+		return
 	}
 
 	db.Clients.Store(&newClients)
@@ -360,7 +699,7 @@ func (db *Database) loadClients() {
 	elapsedTime := time.Since(startTime)
 	lenClients := len(newClients)
 
-	collector.UpdateReloadTime("clients", elapsedTime)
+	collector.UpdateReloadTime("clients", reloadFull, elapsedTime)
 	collector.UpdateClients(lenClients)
 
 	slog.Info("reload from database", "source", "approved_clients", "rows", lenClients, "elapsed", elapsedTime)
@@ -0,0 +1,250 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cdb "chihaya/database/types"
+)
+
+func TestIncrementalReload(t *testing.T) {
+	seed := filepath.Join(t.TempDir(), "seed.json")
+	if err := os.WriteFile(seed, []byte(memorySeedJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(enabled bool) {
+		changeLogEnabled = enabled
+	}(changeLogEnabled)
+
+	changeLogEnabled = true
+
+	s := newMemoryStorage(seed)
+	db := &Database{storage: s}
+
+	dbUsers := make(map[string]*cdb.User)
+	db.Users.Store(&dbUsers)
+
+	db.Torrents.Store(&cdb.TorrentShards{})
+
+	db.UsersFreeleech.Store(&map[cdb.UserTorrentPair]*cdb.UserFreeleech{})
+	db.FreeleechWindows.Store(&cdb.FreeleechWindows{})
+	db.Clients.Store(&map[uint16]string{})
+
+	s.logChange(ChangeRow{Source: changeUsers, UserID: 1}) // logged before start, so it is not loaded again
+	db.Reload()
+
+	if !db.changeLogReady || db.changeID != 1 {
+		t.Fatalf("Expected full reload to take position in change log, got %d (ready %t)",
+			db.changeID, db.changeLogReady)
+	}
+
+	user := (*db.Users.Load())["mUztWMpBYNCqzmge6vGeEUGSrctJbgpQ"]
+
+	var infoHash cdb.TorrentHash
+
+	copy(infoHash[:], []byte{1, 2, 3})
+
+	torrent, _ := db.Torrents.Get(infoHash)
+	torrent.Seeders.Put(cdb.PeerKey{1}, &cdb.Peer{UserID: 1})
+
+	// Site changes passkey of user, adds another user, touches torrent and issues hit and run and group freeleech
+	s.users[1].Passkey = "Yb5lZqbR1YGLdKSDqwLyEMAYnjYbFE6Q"
+	s.users[2] = &memoryUser{UserRow: UserRow{ID: 2, Passkey: "2qhSDjCZwXn0YKiJQXHwrXZnWbZUZbXU"}}
+	s.torrents[1].snatched = 10
+	s.torrents[2].TorrentType = "anime"
+	s.transferHistory[cdb.UserTorrentPair{UserID: 1, TorrentID: 2}] = &memoryTransferHistory{hnr: true}
+	s.groupsFreeleech = append(s.groupsFreeleech, GroupFreeleechRow{GroupID: 5, TorrentType: "anime"})
+
+	s.logChange(ChangeRow{Source: changeUsers, UserID: 1})
+	s.logChange(ChangeRow{Source: changeUsers, UserID: 2})
+	s.logChange(ChangeRow{Source: changeTorrents, TorrentID: 1})
+	s.logChange(ChangeRow{Source: changeHitAndRuns, UserID: 1, TorrentID: 1})
+	s.logChange(ChangeRow{Source: changeHitAndRuns, UserID: 1, TorrentID: 2})
+	s.logChange(ChangeRow{Source: changeGroupsFreeleech, GroupID: 5, TorrentType: "anime"})
+
+	// Removed hit and run is not logged, so it is only noticed by full reload
+	delete(s.transferHistory, cdb.UserTorrentPair{UserID: 2, TorrentID: 1})
+
+	db.reload()
+
+	users := *db.Users.Load()
+	if len(users) != 2 || users["Yb5lZqbR1YGLdKSDqwLyEMAYnjYbFE6Q"] != user ||
+		users["mUztWMpBYNCqzmge6vGeEUGSrctJbgpQ"] != nil {
+		t.Fatalf("Expected user to be kept under new passkey, got %v", users)
+	}
+
+	torrents := maps.Collect(db.Torrents.All())
+	if len(torrents) != 1 || torrents[infoHash] != torrent || torrent.Snatched.Load() != 10 ||
+		torrent.Seeders.Len() != 1 {
+		t.Fatalf("Expected only logged torrent to be updated with its peers kept, got %v", torrents)
+	}
+
+	hnrs := *db.HitAndRuns.Load()
+	if _, exists := hnrs[cdb.UserTorrentPair{UserID: 1, TorrentID: 2}]; !exists || len(hnrs) != 2 {
+		t.Fatalf("Expected new hit and run to be loaded, got %v", hnrs)
+	}
+
+	if groups := *db.TorrentGroupFreeleech.Load(); len(groups) != 1 {
+		t.Fatalf("Expected group freeleech to be loaded, got %v", groups)
+	}
+
+	if db.changeID != 7 {
+		t.Fatalf("Expected position in change log to advance to 7, got %d", db.changeID)
+	}
+
+	// Torrent whose info hash changed keeps its peers under new hash, removed torrent is dropped
+	var newInfoHash cdb.TorrentHash
+
+	copy(newInfoHash[:], []byte{4, 5, 6})
+
+	s.torrents[1].InfoHash = newInfoHash
+	s.logChange(ChangeRow{Source: changeTorrents, TorrentID: 1})
+
+	db.reload()
+
+	torrents = maps.Collect(db.Torrents.All())
+	if len(torrents) != 1 || torrents[newInfoHash] != torrent || db.torrentHashes[1] != newInfoHash {
+		t.Fatalf("Expected torrent to be moved under new info hash, got %v", torrents)
+	}
+
+	s.torrents[1].TorrentType = "internal"
+	s.logChange(ChangeRow{Source: changeTorrents, TorrentID: 1})
+
+	db.reload()
+
+	if torrents = maps.Collect(db.Torrents.All()); len(torrents) != 0 || len(db.torrentHashes) != 0 {
+		t.Fatalf("Expected torrent which is no longer loaded to be removed, got %v", torrents)
+	}
+
+	// Full reload reconciles whatever was not logged
+	db.lastFullReload = time.Now().Add(-time.Duration(fullReloadInterval) * time.Second)
+	db.reload()
+
+	if torrents = maps.Collect(db.Torrents.All()); len(torrents) != 1 || len(db.torrentHashes) != 1 {
+		t.Fatalf("Expected full reload to load unlogged torrent, got %v", torrents)
+	}
+
+	if hnrs = *db.HitAndRuns.Load(); len(hnrs) != 2 {
+		t.Fatalf("Expected hit and runs to match storage after full reload, got %v", hnrs)
+	}
+}
+
+func TestIncrementalReloadGaps(t *testing.T) {
+	seed := filepath.Join(t.TempDir(), "seed.json")
+	if err := os.WriteFile(seed, []byte(memorySeedJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(enabled bool, limit int) {
+		changeLogEnabled, changeLogLimit = enabled, limit
+	}(changeLogEnabled, changeLogLimit)
+
+	changeLogEnabled = true
+
+	s := newMemoryStorage(seed)
+	db := &Database{storage: s}
+
+	dbUsers := make(map[string]*cdb.User)
+	db.Users.Store(&dbUsers)
+
+	db.Torrents.Store(&cdb.TorrentShards{})
+
+	db.UsersFreeleech.Store(&map[cdb.UserTorrentPair]*cdb.UserFreeleech{})
+	db.FreeleechWindows.Store(&cdb.FreeleechWindows{})
+	db.Clients.Store(&map[uint16]string{})
+
+	db.Reload()
+
+	// Transaction adding user takes its ID in change log first, but commits after one touching torrent
+	s.users[2] = &memoryUser{UserRow: UserRow{ID: 2, Passkey: "2qhSDjCZwXn0YKiJQXHwrXZnWbZUZbXU"}}
+	s.torrents[1].snatched = 10
+
+	userChange := s.logUncommittedChange(ChangeRow{Source: changeUsers, UserID: 2})
+	s.logChange(ChangeRow{Source: changeTorrents, TorrentID: 1})
+
+	if err := db.reloadChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	var infoHash cdb.TorrentHash
+
+	copy(infoHash[:], []byte{1, 2, 3})
+
+	if torrent, _ := db.Torrents.Get(infoHash); torrent.Snatched.Load() != 10 {
+		t.Fatalf("Expected committed change to be applied, got %d snatched", torrent.Snatched.Load())
+	}
+
+	if _, exists := db.changeGaps[userChange]; !exists || db.changeID != 2 || len(*db.Users.Load()) != 1 {
+		t.Fatalf("Expected change %d to be remembered as gap at position %d, got %v at %d",
+			userChange, 2, db.changeGaps, db.changeID)
+	}
+
+	s.commitChange(userChange)
+
+	if err := db.reloadChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := (*db.Users.Load())["2qhSDjCZwXn0YKiJQXHwrXZnWbZUZbXU"]; !exists || len(db.changeGaps) != 0 {
+		t.Fatalf("Expected late change to be applied once committed, got gaps %v", db.changeGaps)
+	}
+
+	// Rolled back transaction leaves gap which is given up on after a while
+	rolledBack := s.logUncommittedChange(ChangeRow{Source: changeUsers, UserID: 3})
+	s.logChange(ChangeRow{Source: changeUsers, UserID: 1})
+
+	if err := db.reloadChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.changeGaps[rolledBack] = time.Now().Add(-time.Duration(changeLogGapWait) * time.Second)
+
+	if err := db.reloadChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.changeGaps) != 0 || db.changeID != 4 {
+		t.Fatalf("Expected expired gap to be forgotten at position %d, got %v at %d", 4, db.changeGaps, db.changeID)
+	}
+
+	// Gaps which are too large to track make everything reload instead
+	changeLogLimit = 2
+
+	for range 3 {
+		s.logUncommittedChange(ChangeRow{Source: changeUsers, UserID: 1})
+	}
+
+	s.logChange(ChangeRow{Source: changeUsers, UserID: 1})
+
+	if err := db.reloadChanges(); !errors.Is(err, errChangeLogGap) || db.changeID != 4 {
+		t.Fatalf("Expected large gap to fail incremental reload at position %d, got %v at %d", 4, err, db.changeID)
+	}
+
+	db.reload()
+
+	if db.changeID != 8 || len(db.changeGaps) != 0 {
+		t.Fatalf("Expected full reload to take position %d, got %d with gaps %v", 8, db.changeID, db.changeGaps)
+	}
+}
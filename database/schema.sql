@@ -5,6 +5,17 @@ create table approved_clients
     archived tinyint(1) default 0 not null
 );
 
+create table freeleech_windows
+(
+    ID             int(10) auto_increment primary key,
+    GroupID        int(10)                 default null,
+    Type           enum ('anime', 'music') default null,
+    DownMultiplier float                   default 1 not null,
+    UpMultiplier   float                   default 1 not null,
+    StartTime      int unsigned            not null,
+    EndTime        int unsigned            not null
+);
+
 create table mod_core
 (
     mod_option  varchar(121)      not null primary key,
@@ -34,9 +45,35 @@ create table torrents
     DownMultiplier float                   default 1       not null,
     UpMultiplier   float                   default 1       not null,
     Status         int                     default 0       not null,
+    prune_reason   varchar(64)             default null,
     constraint InfoHash unique (info_hash (20))
 );
 
+create table tracker_changes
+(
+    ID      bigint unsigned auto_increment primary key,
+    source  enum ('users', 'torrents', 'torrents_group_freeleech', 'hit_and_runs') not null,
+    uid     int unsigned default 0  not null,
+    fid     int unsigned default 0  not null,
+    GroupID int(10)      default 0  not null,
+    Type    varchar(8)   default '' not null,
+    time    timestamp    default current_timestamp() not null
+);
+
+create table tracker_suspicions
+(
+    ID       bigint unsigned auto_increment primary key,
+    uid      int unsigned               not null,
+    fid      int unsigned               not null,
+    rule     varchar(32)                not null,
+    details  varchar(255)               not null,
+    uploaded bigint unsigned  default 0 not null,
+    withheld tinyint(1)       default 0 not null,
+    time     int unsigned               not null,
+    key uid (uid),
+    key fid (fid)
+);
+
 create table transfer_history
 (
     uid           int     not null,
@@ -63,11 +100,22 @@ create table transfer_ips
     uid           int unsigned       not null,
     fid           int unsigned       not null,
     ip            int unsigned       not null,
+    ip6           varbinary(16)      default '' not null,
     client_id     mediumint unsigned not null,
     uploaded      bigint unsigned    default 0 not null,
     downloaded    bigint unsigned    default 0 not null,
     port          smallint unsigned zerofill default 0 not null,
-    primary key (uid, fid, ip, client_id)
+    primary key (uid, fid, ip, ip6, client_id)
+);
+
+create table users_freeleeches
+(
+    UserID         int unsigned          not null,
+    TorrentID      int unsigned          not null,
+    DownMultiplier float      default 1 not null,
+    UpMultiplier   float      default 1 not null,
+    Expiry         int unsigned          not null,
+    primary key (UserID, TorrentID)
 );
 
 create table users_main
@@ -29,11 +29,23 @@ import (
 	"chihaya/util"
 )
 
-var serializeInterval int
+var (
+	serializeInterval int
+	cacheFormat       cdb.CacheFormat
+)
 
 func init() {
 	intervals := config.Section("intervals")
 	serializeInterval, _ = intervals.GetInt("database_serialize", 68)
+
+	format, _ := config.Section("database").Get("cache_format", cdb.CacheFormatFramed.String())
+
+	var err error
+	if cacheFormat, err = cdb.ParseCacheFormat(format); err != nil {
+		slog.Error("unknown cache format, using default", "format", format, "default", cdb.CacheFormatFramed)
+
+		cacheFormat = cdb.CacheFormatFramed
+	}
 }
 
 func (db *Database) startSerializing() {
@@ -45,18 +57,25 @@ func (db *Database) startSerializing() {
 }
 
 func (db *Database) serialize() {
+	if !db.loaded.Load() {
+		slog.Warn("nothing was loaded from cache or database yet, keeping existing cache files")
+		return
+	}
+
 	slog.Info("serializing database to cache file")
 
 	torrentBinFilename := fmt.Sprintf("%s.bin", cdb.TorrentCacheFile)
 	userBinFilename := fmt.Sprintf("%s.bin", cdb.UserCacheFile)
+	stateBinFilename := fmt.Sprintf("%s.bin", cdb.StateCacheFile)
 
 	torrentTmpFilename := fmt.Sprintf("%s.tmp", torrentBinFilename)
 	userTmpFilename := fmt.Sprintf("%s.tmp", userBinFilename)
+	stateTmpFilename := fmt.Sprintf("%s.tmp", stateBinFilename)
 
 	start := time.Now()
 
 	if func() error {
-		torrentFile, err := os.OpenFile(torrentTmpFilename, os.O_WRONLY|os.O_CREATE, 0600)
+		torrentFile, err := os.OpenFile(torrentTmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			slog.Error("couldn't open file for writing", "err", err, "cdb", cdb.TorrentCacheFile)
 			return err
@@ -68,7 +87,9 @@ func (db *Database) serialize() {
 			torrentFile.Close()
 		}()
 
-		if err = cdb.WriteTorrents(torrentFile, *db.Torrents.Load()); err != nil {
+		dbTorrents := db.Torrents.Snapshot()
+
+		if err = cdb.WriteTorrents(torrentFile, dbTorrents.Len(), dbTorrents.All(), cacheFormat); err != nil {
 			slog.Error("failed to encode cdb for serialization", "err", err, "cdb", cdb.TorrentCacheFile)
 			return err
 		}
@@ -81,7 +102,7 @@ func (db *Database) serialize() {
 	}
 
 	if func() error {
-		userFile, err := os.OpenFile(userTmpFilename, os.O_WRONLY|os.O_CREATE, 0600)
+		userFile, err := os.OpenFile(userTmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			slog.Error("couldn't open file for writing", "err", err, "cdb", cdb.UserCacheFile)
 			return err
@@ -93,7 +114,7 @@ func (db *Database) serialize() {
 			userFile.Close()
 		}()
 
-		if err = cdb.WriteUsers(userFile, *db.Users.Load()); err != nil {
+		if err = cdb.WriteUsers(userFile, *db.Users.Load(), cacheFormat); err != nil {
 			slog.Error("failed to encode cdb for serialization", "err", err, "cdb", cdb.UserCacheFile)
 			return err
 		}
@@ -105,22 +126,60 @@ func (db *Database) serialize() {
 		}
 	}
 
+	if func() error {
+		stateFile, err := os.OpenFile(stateTmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			slog.Error("couldn't open file for writing", "err", err, "cdb", cdb.StateCacheFile)
+			return err
+		}
+
+		//goland:noinspection GoUnhandledErrorResult
+		defer func() {
+			stateFile.Sync() //nolint:errcheck
+			stateFile.Close()
+		}()
+
+		state := &cdb.State{
+			HitAndRuns:            *db.HitAndRuns.Load(),
+			Clients:               *db.Clients.Load(),
+			TorrentGroupFreeleech: *db.TorrentGroupFreeleech.Load(),
+			UsersFreeleech:        *db.UsersFreeleech.Load(),
+			FreeleechWindows:      db.FreeleechWindows.Load(),
+			GlobalFreeleech:       GlobalFreeleech.Load(),
+		}
+
+		if err = cdb.WriteState(stateFile, state, cacheFormat); err != nil {
+			slog.Error("failed to encode cdb for serialization", "err", err, "cdb", cdb.StateCacheFile)
+			return err
+		}
+
+		return nil
+	}() == nil {
+		if err := os.Rename(stateTmpFilename, stateBinFilename); err != nil {
+			slog.Error("couldn't write new cache file", "err", err, "cdb", cdb.StateCacheFile)
+		}
+	}
+
 	elapsedTime := time.Since(start)
 	collector.UpdateSerializationTime(elapsedTime)
 	slog.Info("done serializing", "elapsed", elapsedTime)
 }
 
-func (db *Database) deserialize() {
+// deserialize Loads in-memory maps from cache files, returning whether torrents and users were loaded
+func (db *Database) deserialize() bool {
 	slog.Info("deserializing database from cache file")
 
 	torrentBinFilename := fmt.Sprintf("%s.bin", cdb.TorrentCacheFile)
 	userBinFilename := fmt.Sprintf("%s.bin", cdb.UserCacheFile)
+	stateBinFilename := fmt.Sprintf("%s.bin", cdb.StateCacheFile)
 
 	var (
 		start    = time.Now()
 		torrents = 0
 		peers    = 0
 		users    = 0
+
+		torrentsLoaded, usersLoaded bool
 	)
 
 	func() {
@@ -141,11 +200,19 @@ func (db *Database) deserialize() {
 
 		torrents = len(dbTorrents)
 
-		for _, t := range dbTorrents {
+		for infoHash, t := range dbTorrents {
 			peers += int(t.LeechersLength.Load()) + int(t.SeedersLength.Load())
+
+			for _, swarm := range []*cdb.Peers{&t.Seeders, &t.Leechers} {
+				for _, peer := range swarm.All() {
+					db.expiry.add(infoHash, peer, peer.LastAnnounce)
+				}
+			}
 		}
 
-		db.Torrents.Store(&dbTorrents)
+		db.StoreTorrents(dbTorrents)
+
+		torrentsLoaded = true
 	}()
 
 	func() {
@@ -167,8 +234,37 @@ func (db *Database) deserialize() {
 		users = len(dbUsers)
 
 		db.Users.Store(&dbUsers)
+
+		usersLoaded = true
+	}()
+
+	// State cache is missing after upgrade from version which did not write it, in which case maps stay empty
+	func() {
+		stateFile, err := os.OpenFile(stateBinFilename, os.O_RDONLY, 0)
+		if err != nil {
+			slog.Warn("cache file missing", "err", err, "cdb", cdb.StateCacheFile)
+			return
+		}
+
+		//goland:noinspection GoUnhandledErrorResult
+		defer stateFile.Close()
+
+		state := cdb.NewState()
+		if err = cdb.LoadState(stateFile, state); err != nil {
+			slog.Warn("failed to deserialize cache", "err", err, "cdb", cdb.StateCacheFile)
+			return
+		}
+
+		db.HitAndRuns.Store(&state.HitAndRuns)
+		db.Clients.Store(&state.Clients)
+		db.TorrentGroupFreeleech.Store(&state.TorrentGroupFreeleech)
+		db.UsersFreeleech.Store(&state.UsersFreeleech)
+		db.FreeleechWindows.Store(state.FreeleechWindows)
+		GlobalFreeleech.Store(state.GlobalFreeleech)
 	}()
 
 	slog.Info("deserialization complete", "elapsed", time.Since(start),
 		"users", users, "torrents", torrents, "peers", peers)
+
+	return torrentsLoaded && usersLoaded
 }
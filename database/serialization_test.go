@@ -18,8 +18,11 @@
 package database
 
 import (
+	"fmt"
+	"maps"
 	"math"
 	"net/netip"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -48,6 +51,7 @@ func TestSerializer(t *testing.T) {
 		TorrentID:    10,
 		ClientID:     4,
 		Addr:         cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 63448),
+		Addr6:        cdb.NewPeerAddress6FromAddrPort(netip.IPv6Loopback(), 63448),
 		StartTime:    time.Now().Unix(),
 		LastAnnounce: time.Now().Unix(),
 		Seeding:      true,
@@ -62,10 +66,9 @@ func TestSerializer(t *testing.T) {
 	}
 
 	torrent := &cdb.Torrent{
-		Seeders: map[cdb.PeerKey]*cdb.Peer{
+		Seeders: cdb.NewPeers(map[cdb.PeerKey]*cdb.Peer{
 			cdb.NewPeerKey(12, cdb.PeerIDFromRawString("peer_is_twenty_chars")): testPeer,
-		},
-		Leechers: map[cdb.PeerKey]*cdb.Peer{},
+		}),
 	}
 	torrent.ID.Store(10)
 	torrent.Status.Store(1)
@@ -73,40 +76,52 @@ func TestSerializer(t *testing.T) {
 	torrent.LastAction.Store(time.Now().Unix())
 	torrent.DownMultiplier.Store(math.Float64bits(1))
 	torrent.UpMultiplier.Store(math.Float64bits(1))
-	torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
+	torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
 
 	torrent.Group.GroupID.Store(1)
 	torrent.Group.TorrentType.Store(cdb.MustTorrentTypeFromString("anime"))
 
 	testTorrents[testTorrentHash] = torrent
 
-	// Prepare empty map to populate with test data
-	dbTorrents := make(map[cdb.TorrentHash]*cdb.Torrent)
-	db.Torrents.Store(&dbTorrents)
+	// Torrents are not modified by serialization, so they are stored as they are
+	db.Torrents.Store(cdb.NewTorrentShards(testTorrents))
 
+	// Prepare empty map to populate with test data
 	dbUsers := make(map[string]*cdb.User)
 	db.Users.Store(&dbUsers)
 
-	if err := copier.Copy(&dbTorrents, testTorrents); err != nil {
-		panic(err)
-	}
-
 	if err := copier.Copy(&dbUsers, testUsers); err != nil {
 		panic(err)
 	}
 
+	testHitAndRuns := map[cdb.UserTorrentPair]struct{}{{UserID: 12, TorrentID: 10}: {}}
+	testClients := map[uint16]string{4: "-TR"}
+
+	dbHitAndRuns := maps.Clone(testHitAndRuns)
+	db.HitAndRuns.Store(&dbHitAndRuns)
+
+	dbClients := maps.Clone(testClients)
+	db.Clients.Store(&dbClients)
+
 	db.serialize()
 
-	// Reset map to fully test deserialization
-	dbTorrents = make(map[cdb.TorrentHash]*cdb.Torrent)
-	db.Torrents.Store(&dbTorrents)
+	// Reset maps to fully test deserialization
+	db.Torrents.Store(&cdb.TorrentShards{})
 
 	dbUsers = make(map[string]*cdb.User)
 	db.Users.Store(&dbUsers)
 
-	db.deserialize()
+	dbHitAndRuns = make(map[cdb.UserTorrentPair]struct{})
+	db.HitAndRuns.Store(&dbHitAndRuns)
+
+	dbClients = make(map[uint16]string)
+	db.Clients.Store(&dbClients)
+
+	if !db.deserialize() {
+		t.Fatalf("Torrents and users were not loaded from cache files!")
+	}
 
-	dbTorrents = *db.Torrents.Load()
+	dbTorrents := maps.Collect(db.Torrents.All())
 	dbUsers = *db.Users.Load()
 
 	if !cmp.Equal(dbTorrents, testTorrents, cdb.TorrentTestCompareOptions...) {
@@ -118,4 +133,42 @@ func TestSerializer(t *testing.T) {
 		t.Fatalf("Users (%v) after serialization and deserialization do not match original users (%v)!",
 			dbUsers, testUsers)
 	}
+
+	if !reflect.DeepEqual(*db.HitAndRuns.Load(), testHitAndRuns) || !reflect.DeepEqual(*db.Clients.Load(), testClients) {
+		t.Fatalf("Hit and runs (%v) and clients (%v) after serialization and deserialization do not match original ones!",
+			*db.HitAndRuns.Load(), *db.Clients.Load())
+	}
+}
+
+func TestSerializeBeforeLoad(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	unloaded := &Database{}
+	unloaded.Torrents.Store(&cdb.TorrentShards{})
+	unloaded.Users.Store(&map[string]*cdb.User{})
+	unloaded.HitAndRuns.Store(&map[cdb.UserTorrentPair]struct{}{})
+	unloaded.Clients.Store(&map[uint16]string{})
+	unloaded.TorrentGroupFreeleech.Store(&map[cdb.TorrentGroupKey]*cdb.TorrentGroupFreeleech{})
+	unloaded.UsersFreeleech.Store(&map[cdb.UserTorrentPair]*cdb.UserFreeleech{})
+	unloaded.FreeleechWindows.Store(&cdb.FreeleechWindows{})
+
+	torrentBinFilename := fmt.Sprintf("%s.bin", cdb.TorrentCacheFile)
+
+	// Cache which could not be read is still the only copy left while database is down
+	if err := os.WriteFile(torrentBinFilename, []byte("unreadable"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	unloaded.serialize()
+
+	if buf, _ := os.ReadFile(torrentBinFilename); string(buf) != "unreadable" {
+		t.Fatalf("Expected cache not to be overwritten before anything was loaded")
+	}
+
+	unloaded.loaded.Store(true)
+	unloaded.serialize()
+
+	if buf, _ := os.ReadFile(torrentBinFilename); string(buf) == "unreadable" {
+		t.Fatalf("Expected cache to be written once data was loaded")
+	}
 }
@@ -0,0 +1,292 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"chihaya/collector"
+	"chihaya/config"
+)
+
+var spillDir string
+
+func init() {
+	spillDir, _ = config.Section("database").Get("spill_dir", "spill")
+}
+
+/*
+ * Spill files hold batches that could not be flushed to storage, either because storage has failed or because channel
+ * was full at the time of queueing. Each batch is appended as single JSON line and fsync'ed before append returns.
+ *
+ * Batches are replayed strictly in order they were appended. Offset of first batch not yet replayed is kept in
+ * separate file next to spill file, so that replay resumes where it left off after restart. Offset is only persisted
+ * after batch has been flushed successfully, so replay is at-least-once: crash (or failure to persist offset) right
+ * after batch was flushed replays that single batch again on next start, applying its deltas twice. Batches carry no
+ * idempotency key, as storage merges updates into rows without keeping track of where they came from.
+ *
+ * Once everything is replayed, spill file is truncated and offset is reset to 0. Nothing is appended until offset
+ * file agrees with truncated spill file, so that stale offset can never point into newly appended batches.
+ */
+
+// spillReplayBackoff Minimum time between replay attempts after one has failed
+const spillReplayBackoff = 5 * time.Second
+
+type spillFile[T any] struct {
+	mu sync.Mutex
+
+	name       string
+	file       *os.File
+	offsetPath string
+
+	offset int64 // start of first batch not yet replayed
+	size   int64 // end of last appended batch
+
+	// offsetStale Set while offset file may still hold offset from before spill file was truncated
+	offsetStale bool
+
+	nextReplay time.Time
+}
+
+/*
+openSpill Opens (or creates) spill file for given channel in spill directory. Returns nil (which disables spilling)
+if spill directory is not configured.
+*/
+func openSpill[T any](dir, name string) (*spillFile[T], error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, name+".spill")
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spillFile[T]{name: name, file: file, offsetPath: path + ".offset"}
+
+	if s.size, err = file.Seek(0, io.SeekEnd); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if buf, err := os.ReadFile(s.offsetPath); err == nil {
+		s.offset, _ = strconv.ParseInt(string(buf), 10, 64)
+	}
+
+	if s.offset < 0 || s.offset > s.size {
+		s.offset = 0
+	}
+
+	// Batch cut short by crash is terminated, so that it does not swallow following one; it is skipped on replay
+	if s.size > 0 {
+		var last [1]byte
+
+		if _, err = file.ReadAt(last[:], s.size-1); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+
+		if last[0] != '\n' {
+			if _, err = file.Write([]byte{'\n'}); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+
+			s.size++
+		}
+	}
+
+	if s.offset < s.size {
+		slog.Warn("found spilled rows pending replay", "channel", name, "bytes", s.size-s.offset)
+	}
+
+	collector.UpdateSpillSize(name, s.size-s.offset)
+
+	return s, nil
+}
+
+// pending Returns whether there are any batches waiting to be replayed
+func (s *spillFile[T]) pending() bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offset < s.size
+}
+
+// append Durably appends rows to spill file as single batch
+func (s *spillFile[T]) append(rows []T) error {
+	buf, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offsetStale {
+		if err = s.saveOffset(0); err != nil {
+			slog.Error("failed to reset spill offset, not spilling", "channel", s.name, "count", len(rows), "err", err)
+			return err
+		}
+
+		s.offsetStale = false
+	}
+
+	n, err := s.file.WriteAt(buf, s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+
+	if err != nil {
+		// Partially written batch is overwritten by next append
+		slog.Error("failed to spill rows", "channel", s.name, "count", len(rows), "err", err)
+		return err
+	}
+
+	s.size += int64(n)
+
+	collector.IncrementSpilledRows(s.name, len(rows))
+	collector.UpdateSpillSize(s.name, s.size-s.offset)
+
+	return nil
+}
+
+/*
+replay Passes spilled batches to flush in order they were appended, until there are none left or flush fails.
+Errors are logged by replay (or storage) already. Must not be called concurrently with itself.
+*/
+func (s *spillFile[T]) replay(flush func(rows []T) error) error {
+	s.mu.Lock()
+	retry := time.Now().Before(s.nextReplay)
+	s.mu.Unlock()
+
+	if retry {
+		return nil
+	}
+
+	for {
+		s.mu.Lock()
+		offset, size := s.offset, s.size
+		s.mu.Unlock()
+
+		if offset == size {
+			return s.reset()
+		}
+
+		// Section up to size is never modified once written, so it can be read without holding lock
+		line, err := bufio.NewReader(io.NewSectionReader(s.file, offset, size-offset)).ReadBytes('\n')
+		if err != nil {
+			slog.Error("failed to read spilled batch", "channel", s.name, "offset", offset, "err", err)
+			return err
+		}
+
+		var rows []T
+
+		if err = json.Unmarshal(line, &rows); err != nil {
+			slog.Error("skipping corrupted spilled batch", "channel", s.name, "offset", offset, "err", err)
+		} else if err = flush(rows); err != nil {
+			s.mu.Lock()
+			s.nextReplay = time.Now().Add(spillReplayBackoff)
+			s.mu.Unlock()
+
+			return err
+		} else {
+			collector.IncrementReplayedRows(s.name, len(rows))
+		}
+
+		s.mu.Lock()
+		s.offset = offset + int64(len(line))
+		collector.UpdateSpillSize(s.name, s.size-s.offset)
+		s.mu.Unlock()
+
+		if err = s.saveOffset(offset + int64(len(line))); err != nil {
+			slog.Error("failed to save spill offset", "channel", s.name, "err", err)
+			return err
+		}
+	}
+}
+
+// reset Truncates spill file if everything in it has been replayed in the meantime
+func (s *spillFile[T]) reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offset != s.size || s.size == 0 {
+		return nil
+	}
+
+	if err := s.file.Truncate(0); err != nil {
+		slog.Error("failed to truncate spill file", "channel", s.name, "err", err)
+		return err
+	}
+
+	s.offset, s.size = 0, 0
+
+	/* Offset is reset only after truncation, as offset of 0 next to spill file which was not truncated yet would replay
+	everything again after crash. Offset past end of truncated file is discarded on open, but once anything is appended
+	it would point into new batches, hence append refuses to write until reset offset is persisted. */
+	if err := s.saveOffset(0); err != nil {
+		s.offsetStale = true
+
+		slog.Error("failed to reset spill offset", "channel", s.name, "err", err)
+
+		return err
+	}
+
+	slog.Info("replayed all spilled rows", "channel", s.name)
+
+	return nil
+}
+
+func (s *spillFile[T]) saveOffset(offset int64) error {
+	tmp := s.offsetPath + ".tmp"
+
+	if err := os.WriteFile(tmp, strconv.AppendInt(nil, offset, 10), 0o640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.offsetPath)
+}
+
+func (s *spillFile[T]) close() error {
+	if s == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
@@ -0,0 +1,308 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpill(t *testing.T) {
+	dir := t.TempDir()
+
+	spill, err := openSpill[UserUpdate](dir, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		flushed []UserUpdate
+		failing = true
+	)
+
+	flush := func(rows []UserUpdate) error {
+		if failing {
+			return errQueryFailed
+		}
+
+		flushed = append(flushed, rows...)
+
+		return nil
+	}
+
+	// Storage is down, rows end up in spill file
+	flushOrSpill(spill, []UserUpdate{{ID: 1, DeltaUp: 10}}, flush)
+	flushOrSpill(spill, []UserUpdate{{ID: 2, DeltaUp: 20}, {ID: 3, DeltaUp: 30}}, flush)
+
+	if !spill.pending() || len(flushed) != 0 {
+		t.Fatalf("Expected rows to be spilled, got pending %t and flushed %v", spill.pending(), flushed)
+	}
+
+	// Storage is back, but new rows must still wait behind spilled ones
+	failing = false
+	spill.nextReplay = spill.nextReplay.Add(-spillReplayBackoff)
+
+	if err = spill.replay(func(rows []UserUpdate) error {
+		if len(flushed) > 0 {
+			return errQueryFailed
+		}
+
+		return flush(rows)
+	}); !errors.Is(err, errQueryFailed) {
+		t.Fatalf("Expected replay to stop on failure, got %v", err)
+	}
+
+	if err = spill.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart resumes replay after first batch
+	if spill, err = openSpill[UserUpdate](dir, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	flushOrSpill(spill, []UserUpdate{{ID: 4, DeltaUp: 40}}, flush)
+
+	expected := []UserUpdate{{ID: 1, DeltaUp: 10}, {ID: 2, DeltaUp: 20}, {ID: 3, DeltaUp: 30}, {ID: 4, DeltaUp: 40}}
+	if !reflect.DeepEqual(flushed, expected) {
+		t.Fatalf("Expected rows to be flushed in order %v, got %v", expected, flushed)
+	}
+
+	if spill.pending() {
+		t.Fatalf("Expected spill to be empty after replay")
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "users.spill")); err != nil || info.Size() != 0 {
+		t.Fatalf("Expected spill file to be truncated after replay, got %v (%v)", info, err)
+	}
+}
+
+func TestSpillTruncatedBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	// Simulate crash in the middle of writing second batch
+	if err := os.WriteFile(filepath.Join(dir, "snatches.spill"),
+		[]byte(`[{"UserID":1,"TorrentID":2,"Time":3}]`+"\n"+`[{"UserID":4,"Tor`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	spill, err := openSpill[SnatchUpdate](dir, "snatches")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = spill.append([]SnatchUpdate{{UserID: 5, TorrentID: 6, Time: 7}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var flushed []SnatchUpdate
+
+	if err = spill.replay(func(rows []SnatchUpdate) error {
+		flushed = append(flushed, rows...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SnatchUpdate{{UserID: 1, TorrentID: 2, Time: 3}, {UserID: 5, TorrentID: 6, Time: 7}}
+	if !reflect.DeepEqual(flushed, expected) {
+		t.Fatalf("Expected complete batches to be replayed %v, got %v", expected, flushed)
+	}
+}
+
+func TestSpillDegraded(t *testing.T) {
+	spill, err := openSpill[TorrentUpdate](t.TempDir(), "torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan TorrentUpdate, 1)
+
+	o := newOverflow("torrents", channel, spill, torrentUpdateKey, mergeTorrentUpdates)
+	o.policy = overflowHold
+
+	var flushed []TorrentUpdate
+
+	flush := func(rows []TorrentUpdate) error {
+		flushed = append(flushed, rows...)
+		return nil
+	}
+
+	db := &Database{}
+	db.setConnected(false)
+
+	// Second update does not fit into channel
+	o.enqueue(TorrentUpdate{ID: 1, Seeders: 1, LastAction: 10})
+	o.enqueue(TorrentUpdate{ID: 1, Seeders: 2, LastAction: 20})
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		flushChannel(db, o, cap(channel), nil, flush)
+	}()
+
+	for !spill.pending() {
+		time.Sleep(time.Millisecond)
+	}
+
+	db.terminate.Store(true)
+
+	<-done
+
+	if len(flushed) != 0 {
+		t.Fatalf("Expected nothing to be flushed in degraded mode, got %v", flushed)
+	}
+
+	if err = spill.replay(flush); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TorrentUpdate{{ID: 1, Seeders: 2, LastAction: 20}}
+	if !reflect.DeepEqual(flushed, expected) {
+		t.Fatalf("Expected spilled rows %v, got %v", expected, flushed)
+	}
+}
+
+// blockOffset Makes saving spill offset fail by putting non-empty directory in place of offset file
+func blockOffset(t *testing.T, offsetPath string) func() {
+	t.Helper()
+
+	_ = os.Remove(offsetPath)
+
+	if err := os.MkdirAll(filepath.Join(offsetPath, "blocked"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(offsetPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpillAtLeastOnce(t *testing.T) {
+	dir := t.TempDir()
+
+	spill, err := openSpill[UserUpdate](dir, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = spill.append([]UserUpdate{{ID: 1, DeltaUp: 10}})
+	_ = spill.append([]UserUpdate{{ID: 2, DeltaUp: 20}})
+
+	var flushed []UserUpdate
+
+	flush := func(rows []UserUpdate) error {
+		flushed = append(flushed, rows...)
+		return nil
+	}
+
+	// Batch is flushed, but its offset is not persisted, as if tracker crashed right after flush
+	unblock := blockOffset(t, spill.offsetPath)
+
+	if err = spill.replay(flush); err == nil {
+		t.Fatalf("Expected replay to fail when offset can not be saved")
+	}
+
+	_ = spill.close()
+
+	unblock()
+
+	if spill, err = openSpill[UserUpdate](dir, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = spill.replay(flush); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay is at-least-once: batch flushed before crash is flushed again, including its deltas
+	expected := []UserUpdate{{ID: 1, DeltaUp: 10}, {ID: 1, DeltaUp: 10}, {ID: 2, DeltaUp: 20}}
+	if !reflect.DeepEqual(flushed, expected) {
+		t.Fatalf("Expected batch without persisted offset to be replayed again %v, got %v", expected, flushed)
+	}
+
+	if spill.pending() {
+		t.Fatalf("Expected nothing to be pending after replay")
+	}
+}
+
+func TestSpillStaleOffset(t *testing.T) {
+	dir := t.TempDir()
+
+	spill, err := openSpill[UserUpdate](dir, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = spill.append([]UserUpdate{{ID: 1, DeltaUp: 10}, {ID: 2, DeltaUp: 20}, {ID: 3, DeltaUp: 30}})
+
+	flush := func(_ []UserUpdate) error {
+		return nil
+	}
+
+	// Everything is replayed and spill file truncated, but offset can not be reset
+	unblock := blockOffset(t, spill.offsetPath)
+
+	_ = spill.replay(flush)
+
+	if err = spill.replay(flush); err == nil {
+		t.Fatalf("Expected reset to fail when offset can not be saved")
+	}
+
+	if err = spill.append([]UserUpdate{{ID: 4, DeltaUp: 40}}); err == nil {
+		t.Fatalf("Expected nothing to be appended while offset is stale")
+	}
+
+	unblock()
+
+	// Offset left behind by earlier replay would point into batch appended below
+	if err = os.WriteFile(spill.offsetPath, []byte("10"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = spill.append([]UserUpdate{{ID: 4, DeltaUp: 40}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = spill.close()
+
+	if spill, err = openSpill[UserUpdate](dir, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	var flushed []UserUpdate
+
+	if err = spill.replay(func(rows []UserUpdate) error {
+		flushed = append(flushed, rows...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []UserUpdate{{ID: 4, DeltaUp: 40}}; !reflect.DeepEqual(flushed, expected) {
+		t.Fatalf("Expected batch appended after reset to be replayed whole %v, got %v", expected, flushed)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"chihaya/config"
+	cdb "chihaya/database/types"
+)
+
+// UserRow Single user as loaded from storage
+type UserRow struct {
+	ID              uint32  `json:"id"`
+	Passkey         string  `json:"passkey"`
+	DownMultiplier  float64 `json:"down_multiplier"`
+	UpMultiplier    float64 `json:"up_multiplier"`
+	DisableDownload bool    `json:"disable_download"`
+	TrackerHide     bool    `json:"tracker_hide"`
+}
+
+// TorrentRow Single torrent as loaded from storage
+type TorrentRow struct {
+	ID             uint32          `json:"id"`
+	InfoHash       cdb.TorrentHash `json:"info_hash"`
+	DownMultiplier float64         `json:"down_multiplier"`
+	UpMultiplier   float64         `json:"up_multiplier"`
+	Snatched       uint16          `json:"snatched"`
+	Status         uint8           `json:"status"`
+	GroupID        uint32          `json:"group_id"`
+	TorrentType    string          `json:"torrent_type"`
+	LastAction     int64           `json:"last_action"`
+}
+
+// GroupFreeleechRow Multipliers of single torrent group as loaded from storage
+type GroupFreeleechRow struct {
+	GroupID        uint32  `json:"group_id"`
+	TorrentType    string  `json:"torrent_type"`
+	DownMultiplier float64 `json:"down_multiplier"`
+	UpMultiplier   float64 `json:"up_multiplier"`
+}
+
+// FreeleechWindowRow Scheduled freeleech as loaded from storage; GroupID is 0 for windows applying to all torrents
+type FreeleechWindowRow struct {
+	GroupID        uint32  `json:"group_id"`
+	TorrentType    string  `json:"torrent_type"`
+	DownMultiplier float64 `json:"down_multiplier"`
+	UpMultiplier   float64 `json:"up_multiplier"`
+	StartTime      int64   `json:"start_time"`
+	EndTime        int64   `json:"end_time"`
+}
+
+// UserFreeleechRow Multipliers applying to single user on single torrent as loaded from storage
+type UserFreeleechRow struct {
+	UserID         uint32  `json:"user_id"`
+	TorrentID      uint32  `json:"torrent_id"`
+	DownMultiplier float64 `json:"down_multiplier"`
+	UpMultiplier   float64 `json:"up_multiplier"`
+	Expiry         int64   `json:"expiry"`
+}
+
+// ClientRow Single approved client as loaded from storage
+type ClientRow struct {
+	ID     uint16 `json:"id"`
+	PeerID string `json:"peer_id"`
+}
+
+// Sources of change log entries
+const (
+	changeUsers           = "users"
+	changeTorrents        = "torrents"
+	changeGroupsFreeleech = "torrents_group_freeleech"
+	changeHitAndRuns      = "hit_and_runs"
+)
+
+/*
+ChangeRow Entry of change log, telling that row of given source was changed (or removed) and should be reloaded.
+Users are identified by UserID, torrents by TorrentID, group freeleech by GroupID and TorrentType and hit and runs
+by UserID and TorrentID.
+*/
+type ChangeRow struct {
+	ID          uint64 `json:"id"`
+	Source      string `json:"source"`
+	UserID      uint32 `json:"user_id"`
+	TorrentID   uint32 `json:"torrent_id"`
+	GroupID     uint32 `json:"group_id"`
+	TorrentType string `json:"torrent_type"`
+}
+
+// TorrentGroupRow Identifies single torrent group
+type TorrentGroupRow struct {
+	GroupID     uint32
+	TorrentType string
+}
+
+/*
+TorrentUpdate Change of torrent state; Seeders, Leechers and LastAction are absolute, DeltaSnatch is added.
+Status and PruneReason are only stored if StatusChanged is set
+*/
+type TorrentUpdate struct {
+	ID          uint32
+	DeltaSnatch uint8
+	Seeders     uint32
+	Leechers    uint32
+	LastAction  int64
+
+	StatusChanged bool
+	Status        uint8
+	PruneReason   string
+}
+
+// UserUpdate Change of user statistics; all values are added to existing ones
+type UserUpdate struct {
+	ID           uint32
+	DeltaUp      int64
+	DeltaDown    int64
+	RawDeltaUp   int64
+	RawDeltaDown int64
+}
+
+// TransferHistoryUpdate Change of user's transfer on torrent; deltas are added, remaining fields replace existing ones
+type TransferHistoryUpdate struct {
+	UserID        uint32
+	TorrentID     uint32
+	RawDeltaUp    int64
+	RawDeltaDown  int64
+	Seeding       bool
+	StartTime     int64
+	LastAnnounce  int64
+	DeltaTime     int64
+	DeltaSeedTime int64
+	Active        bool
+	DeltaSnatch   uint8
+	Left          uint64
+}
+
+// TransferIPUpdate Change of user's transfer on torrent from single address; deltas are added
+type TransferIPUpdate struct {
+	UserID       uint32
+	TorrentID    uint32
+	ClientID     uint16
+	Addr         cdb.PeerAddress
+	Addr6        cdb.PeerAddress6
+	Port         uint16
+	RawDeltaUp   int64
+	RawDeltaDown int64
+	StartTime    int64
+	LastAnnounce int64
+}
+
+// SnatchUpdate Time user has completed torrent; only first one is recorded
+type SnatchUpdate struct {
+	UserID    uint32
+	TorrentID uint32
+	Time      int64
+}
+
+// SuspicionUpdate Announce flagged by anticheat rule
+type SuspicionUpdate struct {
+	UserID     uint32
+	TorrentID  uint32
+	Rule       string
+	Details    string
+	RawDeltaUp int64
+	Withheld   bool
+	Time       int64
+}
+
+/*
+Storage Backend persisting tracker state. Loaders pass every row to given function and return error only if rows
+could not be loaded at all. Errors are reported (logged and counted) by storage itself, so callers only need to know
+whether operation has succeeded.
+*/
+type Storage interface {
+	LoadUsers(fn func(row *UserRow)) error
+	LoadHitAndRuns(fn func(pair cdb.UserTorrentPair)) error
+	LoadTorrents(fn func(row *TorrentRow)) error
+	LoadGroupsFreeleech(fn func(row *GroupFreeleechRow)) error
+	LoadUsersFreeleech(fn func(row *UserFreeleechRow)) error
+	LoadFreeleechWindows(fn func(row *FreeleechWindowRow)) error
+	LoadGlobalFreeleech(fn func(enabled bool)) error
+	LoadClients(fn func(row *ClientRow)) error
+
+	// LastChangeID Returns ID of the latest change log entry, 0 if log is empty
+	LastChangeID() (uint64, error)
+	// LoadChanges Calls fn for at most limit change log entries newer than given ID, in order of their IDs
+	LoadChanges(after uint64, limit int, fn func(row *ChangeRow)) error
+	/* LoadUsersByID, LoadTorrentsByID, LoadGroupsFreeleechByGroup and LoadHitAndRunsByPair Same as their full
+	counterparts, but only load given rows; rows which no longer exist (or are no longer loaded) are skipped */
+	LoadUsersByID(ids []uint32, fn func(row *UserRow)) error
+	LoadTorrentsByID(ids []uint32, fn func(row *TorrentRow)) error
+	LoadGroupsFreeleechByGroup(groups []TorrentGroupRow, fn func(row *GroupFreeleechRow)) error
+	LoadHitAndRunsByPair(pairs []cdb.UserTorrentPair, fn func(pair cdb.UserTorrentPair)) error
+
+	FlushTorrents(rows []TorrentUpdate) error
+	FlushUsers(rows []UserUpdate) error
+	FlushTransferHistory(rows []TransferHistoryUpdate) error
+	FlushTransferIps(rows []TransferIPUpdate) error
+	FlushSnatches(rows []SnatchUpdate) error
+	FlushSuspicions(rows []SuspicionUpdate) error
+
+	// CleanStalePeers Marks peers which have not announced since oldestActive as inactive, returns number of them
+	CleanStalePeers(oldestActive int64) (int64, error)
+
+	// Ping Checks that database is still reachable
+	Ping() error
+	Close() error
+}
+
+var errUnknownDriver = errors.New("unknown database driver")
+
+/*
+newStorage Creates storage for driver configured in database section; fails if database is unreachable or driver is
+unknown. Once created, storage reconnects to database on its own, so it is never created again.
+*/
+func newStorage() (Storage, error) {
+	databaseConfig := config.Section("database")
+
+	driver, _ := databaseConfig.Get("driver", "mysql")
+
+	switch driver {
+	case "mysql":
+		s, err := newMySQLStorage()
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	case "memory":
+		seed, _ := databaseConfig.Get("seed", "")
+		return newMemoryStorage(seed), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errUnknownDriver, driver)
+}
@@ -0,0 +1,164 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"errors"
+	"sync/atomic"
+
+	cdb "chihaya/database/types"
+)
+
+var errStorageUnavailable = errors.New("database is not available yet")
+
+/*
+deferredStorage Storage standing in for database until tracker connects to it. Until backend is set (see
+Database.connect), every operation fails, so that loads keep maps loaded from cache; afterwards, all operations are
+passed to backend.
+*/
+type deferredStorage struct {
+	backend atomic.Pointer[Storage]
+}
+
+func (s *deferredStorage) set(backend Storage) {
+	s.backend.Store(&backend)
+}
+
+func (s *deferredStorage) get() (Storage, error) {
+	if backend := s.backend.Load(); backend != nil {
+		return *backend, nil
+	}
+
+	return nil, errStorageUnavailable
+}
+
+// call Passes backend to fn, or fails with errStorageUnavailable while there is none
+func (s *deferredStorage) call(fn func(backend Storage) error) error {
+	backend, err := s.get()
+	if err != nil {
+		return err
+	}
+
+	return fn(backend)
+}
+
+func (s *deferredStorage) LoadUsers(fn func(row *UserRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadUsers(fn) })
+}
+
+func (s *deferredStorage) LoadHitAndRuns(fn func(pair cdb.UserTorrentPair)) error {
+	return s.call(func(backend Storage) error { return backend.LoadHitAndRuns(fn) })
+}
+
+func (s *deferredStorage) LoadTorrents(fn func(row *TorrentRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadTorrents(fn) })
+}
+
+func (s *deferredStorage) LoadGroupsFreeleech(fn func(row *GroupFreeleechRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadGroupsFreeleech(fn) })
+}
+
+func (s *deferredStorage) LoadUsersFreeleech(fn func(row *UserFreeleechRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadUsersFreeleech(fn) })
+}
+
+func (s *deferredStorage) LoadFreeleechWindows(fn func(row *FreeleechWindowRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadFreeleechWindows(fn) })
+}
+
+func (s *deferredStorage) LoadGlobalFreeleech(fn func(enabled bool)) error {
+	return s.call(func(backend Storage) error { return backend.LoadGlobalFreeleech(fn) })
+}
+
+func (s *deferredStorage) LoadClients(fn func(row *ClientRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadClients(fn) })
+}
+
+func (s *deferredStorage) LastChangeID() (id uint64, err error) {
+	err = s.call(func(backend Storage) (err error) {
+		id, err = backend.LastChangeID()
+		return err
+	})
+
+	return id, err
+}
+
+func (s *deferredStorage) LoadChanges(after uint64, limit int, fn func(row *ChangeRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadChanges(after, limit, fn) })
+}
+
+func (s *deferredStorage) LoadUsersByID(ids []uint32, fn func(row *UserRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadUsersByID(ids, fn) })
+}
+
+func (s *deferredStorage) LoadTorrentsByID(ids []uint32, fn func(row *TorrentRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadTorrentsByID(ids, fn) })
+}
+
+func (s *deferredStorage) LoadGroupsFreeleechByGroup(groups []TorrentGroupRow, fn func(row *GroupFreeleechRow)) error {
+	return s.call(func(backend Storage) error { return backend.LoadGroupsFreeleechByGroup(groups, fn) })
+}
+
+func (s *deferredStorage) LoadHitAndRunsByPair(pairs []cdb.UserTorrentPair, fn func(pair cdb.UserTorrentPair)) error {
+	return s.call(func(backend Storage) error { return backend.LoadHitAndRunsByPair(pairs, fn) })
+}
+
+func (s *deferredStorage) FlushTorrents(rows []TorrentUpdate) error {
+	return s.call(func(backend Storage) error { return backend.FlushTorrents(rows) })
+}
+
+func (s *deferredStorage) FlushUsers(rows []UserUpdate) error {
+	return s.call(func(backend Storage) error { return backend.FlushUsers(rows) })
+}
+
+func (s *deferredStorage) FlushTransferHistory(rows []TransferHistoryUpdate) error {
+	return s.call(func(backend Storage) error { return backend.FlushTransferHistory(rows) })
+}
+
+func (s *deferredStorage) FlushTransferIps(rows []TransferIPUpdate) error {
+	return s.call(func(backend Storage) error { return backend.FlushTransferIps(rows) })
+}
+
+func (s *deferredStorage) FlushSnatches(rows []SnatchUpdate) error {
+	return s.call(func(backend Storage) error { return backend.FlushSnatches(rows) })
+}
+
+func (s *deferredStorage) FlushSuspicions(rows []SuspicionUpdate) error {
+	return s.call(func(backend Storage) error { return backend.FlushSuspicions(rows) })
+}
+
+func (s *deferredStorage) CleanStalePeers(oldestActive int64) (count int64, err error) {
+	err = s.call(func(backend Storage) (err error) {
+		count, err = backend.CleanStalePeers(oldestActive)
+		return err
+	})
+
+	return count, err
+}
+
+func (s *deferredStorage) Ping() error {
+	return s.call(func(backend Storage) error { return backend.Ping() })
+}
+
+func (s *deferredStorage) Close() error {
+	if backend, err := s.get(); err == nil {
+		return backend.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeferredStorage(t *testing.T) {
+	var s deferredStorage
+
+	if _, err := s.LastChangeID(); !errors.Is(err, errStorageUnavailable) {
+		t.Fatalf("Expected storage without backend to be unavailable, got %v", err)
+	}
+
+	if err := s.FlushUsers(nil); !errors.Is(err, errStorageUnavailable) {
+		t.Fatalf("Expected storage without backend to be unavailable, got %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Expected closing storage without backend to succeed, got %v", err)
+	}
+
+	backend := newMemoryStorage("")
+	backend.logChange(ChangeRow{Source: changeUsers, UserID: 1})
+
+	s.set(backend)
+
+	if id, err := s.LastChangeID(); err != nil || id != 1 {
+		t.Fatalf("Expected position %d to be passed from backend, got %d (%v)", 1, id, err)
+	}
+
+	var rows []ChangeRow
+
+	if err := s.LoadChanges(0, 10, func(row *ChangeRow) { rows = append(rows, *row) }); err != nil || len(rows) != 1 {
+		t.Fatalf("Expected change to be loaded from backend, got %v (%v)", rows, err)
+	}
+}
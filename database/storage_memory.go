@@ -0,0 +1,545 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	cdb "chihaya/database/types"
+)
+
+type memoryUser struct {
+	UserRow
+
+	uploaded, downloaded, rawUp, rawDown int64
+}
+
+type memoryTorrent struct {
+	TorrentRow
+
+	seeders, leechers uint32
+	lastAction        int64
+	snatched          uint32
+	pruneReason       string
+}
+
+type memoryTransferHistory struct {
+	hnr bool
+
+	uploaded, downloaded, activeTime, seedTime int64
+	seeding, active                            bool
+	startTime, lastAnnounce, snatchedTime      int64
+	snatched                                   uint32
+	remaining                                  uint64
+}
+
+type memoryTransferIPKey struct {
+	cdb.UserTorrentPair
+
+	clientID uint16
+	addr     [4]byte
+	addr6    [16]byte
+}
+
+type memoryTransferIP struct {
+	port                    uint16
+	uploaded, downloaded    int64
+	startTime, lastAnnounce int64
+}
+
+// memorySeed Initial content of memory storage as read from seed file
+type memorySeed struct {
+	Users      []UserRow `json:"users"`
+	HitAndRuns []struct {
+		UserID    uint32 `json:"user_id"`
+		TorrentID uint32 `json:"torrent_id"`
+	} `json:"hit_and_runs"`
+	Torrents         []TorrentRow         `json:"torrents"`
+	GroupsFreeleech  []GroupFreeleechRow  `json:"groups_freeleech"`
+	UsersFreeleech   []UserFreeleechRow   `json:"users_freeleeches"`
+	FreeleechWindows []FreeleechWindowRow `json:"freeleech_windows"`
+	GlobalFreeleech  bool                 `json:"global_freeleech"`
+	Clients          []ClientRow          `json:"clients"`
+}
+
+/*
+memoryStorage Storage keeping everything in process memory, meant for tests and local development without MariaDB.
+Flushes follow semantics of MySQL queries, so that state can be inspected the same way as database would be.
+*/
+type memoryStorage struct {
+	mu sync.Mutex
+
+	users            map[uint32]*memoryUser
+	torrents         map[uint32]*memoryTorrent
+	transferHistory  map[cdb.UserTorrentPair]*memoryTransferHistory
+	transferIps      map[memoryTransferIPKey]*memoryTransferIP
+	groupsFreeleech  []GroupFreeleechRow
+	usersFreeleech   []UserFreeleechRow
+	freeleechWindows []FreeleechWindowRow
+	globalFreeleech  bool
+	clients          []ClientRow
+	suspicions       []SuspicionUpdate
+	changes          []ChangeRow
+	uncommitted      map[uint64]struct{}
+}
+
+// newMemoryStorage Creates memory storage, populated from seed file if path is not empty
+func newMemoryStorage(seed string) *memoryStorage {
+	s := &memoryStorage{
+		users:           make(map[uint32]*memoryUser),
+		torrents:        make(map[uint32]*memoryTorrent),
+		transferHistory: make(map[cdb.UserTorrentPair]*memoryTransferHistory),
+		transferIps:     make(map[memoryTransferIPKey]*memoryTransferIP),
+	}
+
+	if seed == "" {
+		return s
+	}
+
+	f, err := os.Open(seed)
+	if err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var data memorySeed
+
+	if err = json.NewDecoder(f).Decode(&data); err != nil {
+		panic(err)
+	}
+
+	for _, row := range data.Users {
+		s.users[row.ID] = &memoryUser{UserRow: row}
+	}
+
+	for _, row := range data.Torrents {
+		s.torrents[row.ID] = &memoryTorrent{TorrentRow: row, snatched: uint32(row.Snatched), lastAction: row.LastAction}
+	}
+
+	for _, hnr := range data.HitAndRuns {
+		s.transferHistory[cdb.UserTorrentPair{UserID: hnr.UserID, TorrentID: hnr.TorrentID}] =
+			&memoryTransferHistory{hnr: true}
+	}
+
+	s.groupsFreeleech = data.GroupsFreeleech
+	s.usersFreeleech = data.UsersFreeleech
+	s.freeleechWindows = data.FreeleechWindows
+	s.globalFreeleech = data.GlobalFreeleech
+	s.clients = data.Clients
+
+	return s
+}
+
+func (s *memoryStorage) LoadUsers(fn func(row *UserRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		row := u.UserRow
+		fn(&row)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadHitAndRuns(fn func(pair cdb.UserTorrentPair)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for pair, th := range s.transferHistory {
+		if _, exists := s.users[pair.UserID]; exists && th.hnr {
+			fn(pair)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadTorrents(fn func(row *TorrentRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.torrents {
+		if t.TorrentType == "internal" {
+			continue
+		}
+
+		row := t.TorrentRow
+		row.Snatched = uint16(t.snatched) //nolint:gosec
+		row.LastAction = t.lastAction
+
+		fn(&row)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadGroupsFreeleech(fn func(row *GroupFreeleechRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range s.groupsFreeleech {
+		row := g
+		fn(&row)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadUsersFreeleech(fn func(row *UserFreeleechRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	for _, f := range s.usersFreeleech {
+		if f.Expiry > now {
+			row := f
+			fn(&row)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadFreeleechWindows(fn func(row *FreeleechWindowRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	for _, w := range s.freeleechWindows {
+		if w.EndTime > now {
+			row := w
+			fn(&row)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadGlobalFreeleech(fn func(enabled bool)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s.globalFreeleech)
+
+	return nil
+}
+
+func (s *memoryStorage) LoadClients(fn func(row *ClientRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.clients {
+		row := c
+		fn(&row)
+	}
+
+	return nil
+}
+
+// logChange Appends entry to change log, as site would do after changing row
+func (s *memoryStorage) logChange(row ChangeRow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row.ID = uint64(len(s.changes) + 1)
+	s.changes = append(s.changes, row)
+}
+
+/*
+logUncommittedChange Appends entry to change log which stays invisible until commitChange is called, as if
+transaction which logged it was still running
+*/
+func (s *memoryStorage) logUncommittedChange(row ChangeRow) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.uncommitted == nil {
+		s.uncommitted = make(map[uint64]struct{})
+	}
+
+	row.ID = uint64(len(s.changes) + 1)
+	s.changes = append(s.changes, row)
+	s.uncommitted[row.ID] = struct{}{}
+
+	return row.ID
+}
+
+func (s *memoryStorage) commitChange(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uncommitted, id)
+}
+
+func (s *memoryStorage) LastChangeID() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := uint64(len(s.changes)); id > 0; id-- {
+		if _, exists := s.uncommitted[id]; !exists {
+			return id, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (s *memoryStorage) LoadChanges(after uint64, limit int, fn func(row *ChangeRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Change IDs are positions in log, starting from 1
+	for i := after; i < uint64(len(s.changes)) && limit > 0; i++ {
+		row := s.changes[i]
+		if _, exists := s.uncommitted[row.ID]; exists {
+			continue
+		}
+
+		fn(&row)
+
+		limit--
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadUsersByID(ids []uint32, fn func(row *UserRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if u, exists := s.users[id]; exists {
+			row := u.UserRow
+			fn(&row)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadTorrentsByID(ids []uint32, fn func(row *TorrentRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if t, exists := s.torrents[id]; exists && t.TorrentType != "internal" {
+			row := t.TorrentRow
+			row.Snatched = uint16(t.snatched) //nolint:gosec
+			row.LastAction = t.lastAction
+
+			fn(&row)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadGroupsFreeleechByGroup(groups []TorrentGroupRow, fn func(row *GroupFreeleechRow)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range s.groupsFreeleech {
+		for _, group := range groups {
+			if g.GroupID == group.GroupID && g.TorrentType == group.TorrentType {
+				row := g
+				fn(&row)
+
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) LoadHitAndRunsByPair(pairs []cdb.UserTorrentPair, fn func(pair cdb.UserTorrentPair)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pair := range pairs {
+		if th, exists := s.transferHistory[pair]; exists && th.hnr {
+			if _, exists = s.users[pair.UserID]; exists {
+				fn(pair)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) FlushTorrents(rows []TorrentUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range rows {
+		// Unknown torrents are ignored, same as INSERT IGNORE does for rows missing mandatory columns
+		t, exists := s.torrents[row.ID]
+		if !exists {
+			continue
+		}
+
+		t.snatched += uint32(row.DeltaSnatch)
+		t.seeders = row.Seeders
+		t.leechers = row.Leechers
+		t.lastAction = max(t.lastAction, row.LastAction)
+
+		if row.StatusChanged {
+			t.Status = row.Status
+			t.pruneReason = row.PruneReason
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) FlushUsers(rows []UserUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range rows {
+		u, exists := s.users[row.ID]
+		if !exists {
+			continue
+		}
+
+		u.uploaded += row.DeltaUp
+		u.downloaded += row.DeltaDown
+		u.rawUp += row.RawDeltaUp
+		u.rawDown += row.RawDeltaDown
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) FlushTransferHistory(rows []TransferHistoryUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range rows {
+		pair := cdb.UserTorrentPair{UserID: row.UserID, TorrentID: row.TorrentID}
+
+		th, exists := s.transferHistory[pair]
+		if !exists {
+			th = &memoryTransferHistory{startTime: row.StartTime}
+			s.transferHistory[pair] = th
+		}
+
+		th.uploaded += row.RawDeltaUp
+		th.downloaded += row.RawDeltaDown
+		th.remaining = row.Left
+		th.seeding = row.Seeding
+		th.activeTime += row.DeltaTime
+		th.seedTime += row.DeltaSeedTime
+		th.lastAnnounce = row.LastAnnounce
+		th.active = row.Active
+		th.snatched += uint32(row.DeltaSnatch)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) FlushTransferIps(rows []TransferIPUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range rows {
+		key := memoryTransferIPKey{
+			UserTorrentPair: cdb.UserTorrentPair{UserID: row.UserID, TorrentID: row.TorrentID},
+			clientID:        row.ClientID,
+			addr:            row.Addr.IP(),
+		}
+
+		if row.Addr6.IsValid() {
+			key.addr6 = row.Addr6.IP()
+		}
+
+		ti, exists := s.transferIps[key]
+		if !exists {
+			ti = &memoryTransferIP{startTime: row.StartTime}
+			s.transferIps[key] = ti
+		}
+
+		ti.port = row.Port
+		ti.uploaded += row.RawDeltaUp
+		ti.downloaded += row.RawDeltaDown
+		ti.lastAnnounce = row.LastAnnounce
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) FlushSnatches(rows []SnatchUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range rows {
+		pair := cdb.UserTorrentPair{UserID: row.UserID, TorrentID: row.TorrentID}
+
+		th, exists := s.transferHistory[pair]
+		if !exists {
+			th = &memoryTransferHistory{}
+			s.transferHistory[pair] = th
+		}
+
+		if th.snatchedTime == 0 {
+			th.snatchedTime = row.Time
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) FlushSuspicions(rows []SuspicionUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.suspicions = append(s.suspicions, rows...)
+
+	return nil
+}
+
+func (s *memoryStorage) CleanStalePeers(oldestActive int64) (count int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, th := range s.transferHistory {
+		if th.active && th.lastAnnounce < oldestActive {
+			th.active = false
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryStorage) Ping() error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
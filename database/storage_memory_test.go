@@ -0,0 +1,115 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	cdb "chihaya/database/types"
+)
+
+const memorySeedJSON = `{
+	"users": [{"id": 1, "passkey": "mUztWMpBYNCqzmge6vGeEUGSrctJbgpQ", "down_multiplier": 1, "up_multiplier": 1}],
+	"hit_and_runs": [{"user_id": 1, "torrent_id": 1}, {"user_id": 2, "torrent_id": 1}],
+	"torrents": [
+		{"id": 1, "info_hash": "0102030000000000000000000000000000000000", "snatched": 2, "torrent_type": "anime"},
+		{"id": 2, "info_hash": "0102040000000000000000000000000000000000", "torrent_type": "internal"}
+	],
+	"users_freeleeches": [
+		{"user_id": 1, "torrent_id": 1, "down_multiplier": 0, "up_multiplier": 1, "expiry": 4102444800},
+		{"user_id": 1, "torrent_id": 2, "down_multiplier": 0, "up_multiplier": 1, "expiry": 1}
+	],
+	"clients": [{"id": 1, "peer_id": "-TR"}],
+	"global_freeleech": true
+}`
+
+func TestMemoryStorage(t *testing.T) {
+	seed := filepath.Join(t.TempDir(), "seed.json")
+	if err := os.WriteFile(seed, []byte(memorySeedJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemoryStorage(seed)
+
+	var (
+		users, torrents []uint32
+		hnrs            []cdb.UserTorrentPair
+		usersFreeleech  []*UserFreeleechRow
+		freeleech       bool
+	)
+
+	_ = s.LoadUsers(func(row *UserRow) { users = append(users, row.ID) })
+	_ = s.LoadTorrents(func(row *TorrentRow) { torrents = append(torrents, row.ID) })
+	_ = s.LoadHitAndRuns(func(pair cdb.UserTorrentPair) { hnrs = append(hnrs, pair) })
+	_ = s.LoadUsersFreeleech(func(row *UserFreeleechRow) { usersFreeleech = append(usersFreeleech, row) })
+	_ = s.LoadGlobalFreeleech(func(enabled bool) { freeleech = enabled })
+
+	if len(users) != 1 || len(torrents) != 1 || torrents[0] != 1 || len(hnrs) != 1 || !freeleech {
+		t.Fatalf("Unexpected seed load: users %v, torrents %v, hnrs %v, freeleech %t", users, torrents, hnrs, freeleech)
+	}
+
+	if len(usersFreeleech) != 1 || usersFreeleech[0].TorrentID != 1 {
+		t.Fatalf("Expected only unexpired personal freeleech to be loaded, got %v", usersFreeleech)
+	}
+
+	_ = s.FlushTorrents([]TorrentUpdate{{ID: 1, DeltaSnatch: 1, Seeders: 3, LastAction: 10}, {ID: 5, Seeders: 1}})
+	_ = s.FlushUsers([]UserUpdate{{ID: 1, DeltaUp: 10, RawDeltaUp: 20}, {ID: 1, DeltaUp: 5, RawDeltaUp: 5}})
+	_ = s.FlushTransferHistory([]TransferHistoryUpdate{
+		{UserID: 1, TorrentID: 1, RawDeltaUp: 10, Active: true, LastAnnounce: 100, StartTime: 50},
+		{UserID: 1, TorrentID: 1, RawDeltaUp: 10, Active: true, LastAnnounce: 200, StartTime: 150},
+	})
+	_ = s.FlushSnatches([]SnatchUpdate{{UserID: 1, TorrentID: 1, Time: 300}, {UserID: 1, TorrentID: 1, Time: 400}})
+
+	if torrent := s.torrents[1]; torrent.snatched != 3 || torrent.seeders != 3 || torrent.lastAction != 10 {
+		t.Fatalf("Unexpected torrent state after flush: %+v", torrent)
+	}
+
+	if _, exists := s.torrents[5]; exists {
+		t.Fatalf("Expected unknown torrent not to be inserted")
+	}
+
+	_ = s.FlushTorrents([]TorrentUpdate{
+		{ID: 1, StatusChanged: true, Status: 1, PruneReason: "inactive"},
+		{ID: 1, Seeders: 1},
+	})
+
+	if torrent := s.torrents[1]; torrent.Status != 1 || torrent.pruneReason != "inactive" || torrent.seeders != 1 {
+		t.Fatalf("Expected torrent to be pruned, got %+v", torrent)
+	}
+
+	_ = s.FlushTorrents([]TorrentUpdate{{ID: 1, Seeders: 1, StatusChanged: true}})
+
+	if torrent := s.torrents[1]; torrent.Status != 0 || torrent.pruneReason != "" {
+		t.Fatalf("Expected torrent to be unpruned, got %+v", torrent)
+	}
+
+	if user := s.users[1]; user.uploaded != 15 || user.rawUp != 25 {
+		t.Fatalf("Unexpected user state after flush: %+v", user)
+	}
+
+	th := s.transferHistory[cdb.UserTorrentPair{UserID: 1, TorrentID: 1}]
+	if th.uploaded != 20 || th.lastAnnounce != 200 || th.startTime != 0 || th.snatchedTime != 300 || !th.hnr {
+		t.Fatalf("Unexpected transfer history state after flush: %+v", th)
+	}
+
+	if count, _ := s.CleanStalePeers(250); count != 1 || th.active {
+		t.Fatalf("Expected single stale peer to be marked inactive, got %d", count)
+	}
+}
@@ -0,0 +1,731 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"chihaya/collector"
+	"chihaya/config"
+	cdb "chihaya/database/types"
+	"chihaya/util"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	deadlockWaitTime   int
+	maxDeadlockRetries int
+
+	errQueryFailed = errors.New("query failed")
+)
+
+const defaultDsn = "chihaya:@tcp(127.0.0.1:3306)/chihaya"
+
+// pingTimeout Limits health check of connection, so that unresponsive database is noticed quickly
+const pingTimeout = 5 * time.Second
+
+// Queries shared by full and incremental loads; incremental ones append condition restricting loaded rows
+const (
+	selectUsers = "SELECT ID, torrent_pass, DownMultiplier, UpMultiplier, DisableDownload, TrackerHide " +
+		"FROM users_main WHERE Enabled = '1'"
+	selectHitAndRuns = "SELECT h.uid, h.fid FROM transfer_history AS h " +
+		"JOIN users_main AS u ON u.ID = h.uid WHERE h.hnr = 1 AND u.Enabled = '1'"
+	selectTorrents = "SELECT ID, info_hash, DownMultiplier, UpMultiplier, Snatched, Status, GroupID, TorrentType, " +
+		"last_action FROM torrents WHERE TorrentType != 'internal'"
+	selectGroupsFreeleech = "SELECT GroupID, `Type`, DownMultiplier, UpMultiplier FROM torrent_group_freeleech"
+)
+
+type mysqlStorage struct {
+	conn *sql.DB
+
+	loadTorrentsStmt              *sql.Stmt
+	loadTorrentGroupFreeleechStmt *sql.Stmt
+	loadUsersFreeleechStmt        *sql.Stmt
+	loadFreeleechWindowsStmt      *sql.Stmt
+	loadClientsStmt               *sql.Stmt
+	loadFreeleechStmt             *sql.Stmt
+	loadHnrStmt                   *sql.Stmt
+	loadUsersStmt                 *sql.Stmt
+	cleanStalePeersStmt           *sql.Stmt
+	lastChangeStmt                *sql.Stmt
+	loadChangesStmt               *sql.Stmt
+}
+
+func newMySQLStorage() (*mysqlStorage, error) {
+	conn, err := Open()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mysqlStorage{conn: conn}
+
+	for _, statement := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.loadUsersStmt, selectUsers},
+		{&s.loadHnrStmt, selectHitAndRuns},
+		{&s.loadTorrentsStmt, selectTorrents},
+		{&s.loadTorrentGroupFreeleechStmt, selectGroupsFreeleech},
+		{&s.loadUsersFreeleechStmt, "SELECT UserID, TorrentID, DownMultiplier, UpMultiplier, Expiry " +
+			"FROM users_freeleeches WHERE Expiry > UNIX_TIMESTAMP()"},
+		{&s.loadFreeleechWindowsStmt, "SELECT COALESCE(GroupID, 0), COALESCE(`Type`, ''), DownMultiplier, " +
+			"UpMultiplier, StartTime, EndTime FROM freeleech_windows WHERE EndTime > UNIX_TIMESTAMP()"},
+		{&s.loadClientsStmt, "SELECT id, peer_id FROM approved_clients WHERE archived = 0"},
+		{&s.loadFreeleechStmt, "SELECT mod_setting FROM mod_core WHERE mod_option = 'global_freeleech'"},
+		{&s.cleanStalePeersStmt, "UPDATE transfer_history SET active = 0 WHERE last_announce < ? AND active = 1"},
+		{&s.lastChangeStmt, "SELECT COALESCE(MAX(ID), 0) FROM tracker_changes"},
+		{&s.loadChangesStmt, "SELECT ID, source, uid, fid, GroupID, `Type` FROM tracker_changes " +
+			"WHERE ID > ? ORDER BY ID LIMIT ?"},
+	} {
+		if *statement.stmt, err = conn.Prepare(statement.query); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Open Connects to database configured in database section and checks that it is reachable
+func Open() (*sql.DB, error) {
+	databaseConfig := config.Section("database")
+	deadlockWaitTime, _ = databaseConfig.GetInt("deadlock_pause", 1)
+	maxDeadlockRetries, _ = databaseConfig.GetInt("deadlock_retries", 5)
+
+	// DSN Format: username:password@protocol(address)/dbname?param=value
+	// First try to load the DSN from environment. Useful for tests.
+	databaseDsn := os.Getenv("DB_DSN")
+	if databaseDsn == "" {
+		databaseDsn, _ = databaseConfig.Get("dsn", defaultDsn)
+	}
+
+	sqlDb, err := sql.Open("mysql", databaseDsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sqlDb.Ping(); err != nil {
+		_ = sqlDb.Close()
+		return nil, err
+	}
+
+	return sqlDb, nil
+}
+
+// load Runs query and calls scan for every row; rows that fail to scan are logged and skipped
+func (s *mysqlStorage) load(stmt *sql.Stmt, source string, scan func(rows *sql.Rows) error, args ...any) error {
+	return scanRows(s.query(stmt, args...), source, scan)
+}
+
+// loadQuery Same as load, but for query which is not prepared
+func (s *mysqlStorage) loadQuery(query *bytes.Buffer, source string, scan func(rows *sql.Rows) error,
+	args ...any) error {
+	rows, _ := perform(func() (interface{}, error) {
+		return s.conn.Query(query.String(), args...)
+	}).(*sql.Rows)
+
+	return scanRows(rows, source, scan)
+}
+
+func scanRows(rows *sql.Rows, source string, scan func(rows *sql.Rows) error) error {
+	if rows == nil {
+		return errQueryFailed
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			slog.Warn("error scanning row", "source", source, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *mysqlStorage) LoadUsers(fn func(row *UserRow)) error {
+	return s.load(s.loadUsersStmt, "users", scanUsers(fn))
+}
+
+func scanUsers(fn func(row *UserRow)) func(rows *sql.Rows) error {
+	var row UserRow
+
+	return func(rows *sql.Rows) error {
+		if err := rows.Scan(&row.ID, &row.Passkey, &row.DownMultiplier, &row.UpMultiplier, &row.DisableDownload,
+			&row.TrackerHide); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	}
+}
+
+func (s *mysqlStorage) LoadHitAndRuns(fn func(pair cdb.UserTorrentPair)) error {
+	return s.load(s.loadHnrStmt, "hit_and_runs", scanHitAndRuns(fn))
+}
+
+func scanHitAndRuns(fn func(pair cdb.UserTorrentPair)) func(rows *sql.Rows) error {
+	return func(rows *sql.Rows) error {
+		var pair cdb.UserTorrentPair
+
+		if err := rows.Scan(&pair.UserID, &pair.TorrentID); err != nil {
+			return err
+		}
+
+		fn(pair)
+
+		return nil
+	}
+}
+
+func (s *mysqlStorage) LoadTorrents(fn func(row *TorrentRow)) error {
+	return s.load(s.loadTorrentsStmt, "torrents", scanTorrents(fn))
+}
+
+func scanTorrents(fn func(row *TorrentRow)) func(rows *sql.Rows) error {
+	var row TorrentRow
+
+	return func(rows *sql.Rows) error {
+		if err := rows.Scan(
+			&row.ID,
+			&row.InfoHash,
+			&row.DownMultiplier,
+			&row.UpMultiplier,
+			&row.Snatched,
+			&row.Status,
+			&row.GroupID,
+			&row.TorrentType,
+			&row.LastAction,
+		); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	}
+}
+
+func (s *mysqlStorage) LoadGroupsFreeleech(fn func(row *GroupFreeleechRow)) error {
+	return s.load(s.loadTorrentGroupFreeleechStmt, "torrents_group_freeleech", scanGroupsFreeleech(fn))
+}
+
+func scanGroupsFreeleech(fn func(row *GroupFreeleechRow)) func(rows *sql.Rows) error {
+	var row GroupFreeleechRow
+
+	return func(rows *sql.Rows) error {
+		if err := rows.Scan(&row.GroupID, &row.TorrentType, &row.DownMultiplier, &row.UpMultiplier); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	}
+}
+
+func (s *mysqlStorage) LoadUsersFreeleech(fn func(row *UserFreeleechRow)) error {
+	var row UserFreeleechRow
+
+	return s.load(s.loadUsersFreeleechStmt, "users_freeleeches", func(rows *sql.Rows) error {
+		if err := rows.Scan(&row.UserID, &row.TorrentID, &row.DownMultiplier, &row.UpMultiplier,
+			&row.Expiry); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	})
+}
+
+func (s *mysqlStorage) LoadFreeleechWindows(fn func(row *FreeleechWindowRow)) error {
+	var row FreeleechWindowRow
+
+	return s.load(s.loadFreeleechWindowsStmt, "freeleech_windows", func(rows *sql.Rows) error {
+		if err := rows.Scan(&row.GroupID, &row.TorrentType, &row.DownMultiplier, &row.UpMultiplier, &row.StartTime,
+			&row.EndTime); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	})
+}
+
+func (s *mysqlStorage) LoadGlobalFreeleech(fn func(enabled bool)) error {
+	return s.load(s.loadFreeleechStmt, "config", func(rows *sql.Rows) error {
+		var enabled bool
+
+		if err := rows.Scan(&enabled); err != nil {
+			return err
+		}
+
+		fn(enabled)
+
+		return nil
+	})
+}
+
+func (s *mysqlStorage) LoadClients(fn func(row *ClientRow)) error {
+	var row ClientRow
+
+	return s.load(s.loadClientsStmt, "approved_clients", func(rows *sql.Rows) error {
+		if err := rows.Scan(&row.ID, &row.PeerID); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	})
+}
+
+func (s *mysqlStorage) LastChangeID() (id uint64, err error) {
+	if err = s.load(s.lastChangeStmt, "tracker_changes", func(rows *sql.Rows) error {
+		return rows.Scan(&id)
+	}); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *mysqlStorage) LoadChanges(after uint64, limit int, fn func(row *ChangeRow)) error {
+	var row ChangeRow
+
+	return s.load(s.loadChangesStmt, "tracker_changes", func(rows *sql.Rows) error {
+		if err := rows.Scan(&row.ID, &row.Source, &row.UserID, &row.TorrentID, &row.GroupID,
+			&row.TorrentType); err != nil {
+			return err
+		}
+
+		fn(&row)
+
+		return nil
+	}, after, limit)
+}
+
+// writeIDs Writes comma separated list of IDs into query
+func writeIDs(query *bytes.Buffer, ids []uint32) {
+	for i, id := range ids {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString(strconv.FormatUint(uint64(id), 10))
+	}
+}
+
+func (s *mysqlStorage) LoadUsersByID(ids []uint32, fn func(row *UserRow)) error {
+	var query bytes.Buffer
+
+	query.WriteString(selectUsers + " AND ID IN (")
+	writeIDs(&query, ids)
+	query.WriteString(")")
+
+	return s.loadQuery(&query, "users", scanUsers(fn))
+}
+
+func (s *mysqlStorage) LoadTorrentsByID(ids []uint32, fn func(row *TorrentRow)) error {
+	var query bytes.Buffer
+
+	query.WriteString(selectTorrents + " AND ID IN (")
+	writeIDs(&query, ids)
+	query.WriteString(")")
+
+	return s.loadQuery(&query, "torrents", scanTorrents(fn))
+}
+
+func (s *mysqlStorage) LoadGroupsFreeleechByGroup(groups []TorrentGroupRow, fn func(row *GroupFreeleechRow)) error {
+	var (
+		query bytes.Buffer
+		args  = make([]any, 0, len(groups)*2)
+	)
+
+	query.WriteString(selectGroupsFreeleech + " WHERE (GroupID, `Type`) IN (")
+
+	for i, group := range groups {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(?,?)")
+
+		args = append(args, group.GroupID, group.TorrentType)
+	}
+
+	query.WriteString(")")
+
+	return s.loadQuery(&query, "torrents_group_freeleech", scanGroupsFreeleech(fn), args...)
+}
+
+func (s *mysqlStorage) LoadHitAndRunsByPair(pairs []cdb.UserTorrentPair, fn func(pair cdb.UserTorrentPair)) error {
+	var query bytes.Buffer
+
+	query.WriteString(selectHitAndRuns + " AND (h.uid, h.fid) IN (")
+
+	for i, pair := range pairs {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(")
+		query.WriteString(strconv.FormatUint(uint64(pair.UserID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(pair.TorrentID), 10))
+		query.WriteString(")")
+	}
+
+	query.WriteString(")")
+
+	return s.loadQuery(&query, "hit_and_runs", scanHitAndRuns(fn))
+}
+
+/*
+ * Flushes are done as single multi-row INSERT ... ON DUPLICATE KEY UPDATE query per batch.
+ * It may look ugly with all the explicit type conversions, but this tracker is about speed
+ */
+
+func (s *mysqlStorage) FlushTorrents(rows []TorrentUpdate) error {
+	var (
+		query bytes.Buffer
+		args  []any
+	)
+
+	query.WriteString("INSERT IGNORE INTO torrents (ID, Snatched, Seeders, Leechers, last_action, Status, prune_reason) " +
+		"VALUES ")
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(")
+		query.WriteString(strconv.FormatUint(uint64(row.ID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.DeltaSnatch), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.Seeders), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.Leechers), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.LastAction, 10))
+
+		// Negative status marks rows which leave status and prune reason untouched
+		switch {
+		case !row.StatusChanged:
+			query.WriteString(",-1,NULL)")
+		case row.PruneReason == "":
+			query.WriteString(",")
+			query.WriteString(strconv.FormatUint(uint64(row.Status), 10))
+			query.WriteString(",NULL)")
+		default:
+			query.WriteString(",")
+			query.WriteString(strconv.FormatUint(uint64(row.Status), 10))
+			query.WriteString(",?)")
+
+			args = append(args, row.PruneReason)
+		}
+	}
+
+	query.WriteString(" ON DUPLICATE KEY UPDATE Snatched = Snatched + VALUE(Snatched), " +
+		"Seeders = VALUE(Seeders), Leechers = VALUE(Leechers), " +
+		"last_action = IF(last_action < VALUE(last_action), VALUE(last_action), last_action), " +
+		"prune_reason = IF(VALUE(Status) < 0, prune_reason, VALUE(prune_reason)), " +
+		"Status = IF(VALUE(Status) < 0, Status, VALUE(Status))")
+
+	return s.exec(&query, args...)
+}
+
+func (s *mysqlStorage) FlushUsers(rows []UserUpdate) error {
+	var query bytes.Buffer
+
+	query.WriteString("INSERT IGNORE INTO users_main (ID, Uploaded, Downloaded, rawdl, rawup) VALUES ")
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(")
+		query.WriteString(strconv.FormatUint(uint64(row.ID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.DeltaUp, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.DeltaDown, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.RawDeltaDown, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.RawDeltaUp, 10))
+		query.WriteString(")")
+	}
+
+	query.WriteString(" ON DUPLICATE KEY UPDATE Uploaded = Uploaded + VALUE(Uploaded), " +
+		"Downloaded = Downloaded + VALUE(Downloaded), rawdl = rawdl + VALUE(rawdl), rawup = rawup + VALUE(rawup)")
+
+	return s.exec(&query)
+}
+
+func (s *mysqlStorage) FlushTransferHistory(rows []TransferHistoryUpdate) error {
+	var query bytes.Buffer
+
+	query.WriteString("INSERT INTO transfer_history (uid, fid, uploaded, downloaded, " +
+		"seeding, starttime, last_announce, activetime, seedtime, active, snatched, remaining) VALUES\n")
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(")
+		query.WriteString(strconv.FormatUint(uint64(row.UserID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.TorrentID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.RawDeltaUp, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.RawDeltaDown, 10))
+		query.WriteString(",")
+		query.WriteString(util.Btoa(row.Seeding))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.StartTime, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.LastAnnounce, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.DeltaTime, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.DeltaSeedTime, 10))
+		query.WriteString(",")
+		query.WriteString(util.Btoa(row.Active))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.DeltaSnatch), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(row.Left, 10))
+		query.WriteString(")")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE uploaded = uploaded + VALUE(uploaded), " +
+		"downloaded = downloaded + VALUE(downloaded), remaining = VALUE(remaining), " +
+		"seeding = VALUE(seeding), activetime = activetime + VALUE(activetime), " +
+		"seedtime = seedtime + VALUE(seedtime), last_announce = VALUE(last_announce), " +
+		"active = VALUE(active), snatched = snatched + VALUE(snatched);")
+
+	return s.exec(&query)
+}
+
+func (s *mysqlStorage) FlushTransferIps(rows []TransferIPUpdate) error {
+	var query bytes.Buffer
+
+	query.WriteString("INSERT INTO transfer_ips (uid, fid, client_id, ip, ip6, port, uploaded, downloaded, " +
+		"starttime, last_announce) VALUES\n")
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(")
+		query.WriteString(strconv.FormatUint(uint64(row.UserID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.TorrentID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.ClientID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.Addr.IPNumeric()), 10))
+		query.WriteString(",")
+
+		if row.Addr6.IsValid() {
+			ip6 := row.Addr6.IP()
+
+			query.WriteString("0x")
+			query.WriteString(hex.EncodeToString(ip6[:]))
+		} else {
+			query.WriteString("''")
+		}
+
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.Port), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.RawDeltaUp, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.RawDeltaDown, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.StartTime, 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.LastAnnounce, 10))
+		query.WriteString(")")
+	}
+
+	// TODO: port should be part of PK
+	query.WriteString("\nON DUPLICATE KEY UPDATE port = VALUE(port), downloaded = downloaded + VALUE(downloaded), " +
+		"uploaded = uploaded + VALUE(uploaded), last_announce = VALUE(last_announce)")
+
+	return s.exec(&query)
+}
+
+func (s *mysqlStorage) FlushSnatches(rows []SnatchUpdate) error {
+	var query bytes.Buffer
+
+	query.WriteString("INSERT INTO transfer_history (uid, fid, snatched_time) VALUES\n")
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(")
+		query.WriteString(strconv.FormatUint(uint64(row.UserID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatUint(uint64(row.TorrentID), 10))
+		query.WriteString(",")
+		query.WriteString(strconv.FormatInt(row.Time, 10))
+		query.WriteString(")")
+	}
+
+	query.WriteString("\nON DUPLICATE KEY UPDATE snatched_time = " +
+		"IF(snatched_time = 0, VALUE(snatched_time), snatched_time)")
+
+	return s.exec(&query)
+}
+
+func (s *mysqlStorage) FlushSuspicions(rows []SuspicionUpdate) error {
+	var query bytes.Buffer
+
+	// Details are free-form text, so unlike elsewhere, values are passed as query arguments
+	args := make([]interface{}, 0, len(rows)*7)
+
+	query.WriteString("INSERT INTO tracker_suspicions (uid, fid, rule, details, uploaded, withheld, time) VALUES\n")
+
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteRune(',')
+		}
+
+		query.WriteString("(?,?,?,?,?,?,?)")
+
+		args = append(args, row.UserID, row.TorrentID, row.Rule, row.Details, row.RawDeltaUp, row.Withheld, row.Time)
+	}
+
+	return s.exec(&query, args...)
+}
+
+func (s *mysqlStorage) CleanStalePeers(oldestActive int64) (int64, error) {
+	result := s.execute(s.cleanStalePeersStmt, oldestActive)
+	if result == nil {
+		return 0, errQueryFailed
+	}
+
+	return result.RowsAffected()
+}
+
+func (s *mysqlStorage) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	return s.conn.PingContext(ctx)
+}
+
+func (s *mysqlStorage) Close() error {
+	return s.conn.Close()
+}
+
+func (s *mysqlStorage) query(stmt *sql.Stmt, args ...interface{}) *sql.Rows { //nolint:unparam
+	rows, _ := perform(func() (interface{}, error) {
+		return stmt.Query(args...)
+	}).(*sql.Rows)
+
+	return rows
+}
+
+func (s *mysqlStorage) execute(stmt *sql.Stmt, args ...interface{}) sql.Result {
+	result, _ := perform(func() (interface{}, error) {
+		return stmt.Exec(args...)
+	}).(sql.Result)
+
+	return result
+}
+
+func (s *mysqlStorage) exec(query *bytes.Buffer, args ...interface{}) error {
+	if _, ok := perform(func() (interface{}, error) {
+		return s.conn.Exec(query.String(), args...)
+	}).(sql.Result); !ok {
+		return errQueryFailed
+	}
+
+	return nil
+}
+
+func perform(exec func() (interface{}, error)) (result interface{}) {
+	var (
+		err   error
+		tries int
+		wait  time.Duration
+	)
+
+	for tries = 1; tries <= maxDeadlockRetries; tries++ {
+		result, err = exec()
+		if err != nil {
+			//goland:noinspection GoTypeAssertionOnErrors
+			if merr, isMysqlError := err.(*mysql.MySQLError); isMysqlError {
+				if merr.Number == 1213 || merr.Number == 1205 {
+					wait = time.Duration(deadlockWaitTime*tries) * time.Second
+					slog.Warn("deadlock found", "wait", wait.String(), "try", tries, "max", maxDeadlockRetries)
+
+					if tries == 1 {
+						collector.IncrementDeadlockCount()
+					}
+
+					collector.IncrementDeadlockTime(wait)
+					time.Sleep(wait)
+
+					continue
+				}
+
+				slog.Error("sql error found", "err", merr.Number, "msg", merr.Message)
+			} else {
+				// Most likely connection to database has been lost; caller is expected to retry later
+				slog.Error("sql error found", "err", err)
+			}
+
+			collector.IncrementSQLErrorCount()
+		}
+
+		return
+	}
+
+	slog.Error("deadlock retries exceeded", "tries", tries)
+	collector.IncrementDeadlockAborted()
+
+	return
+}
@@ -0,0 +1,412 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Cache files are written in one of two formats, both carrying records of the same version (see TorrentCacheVersion and
+UserCacheVersion):
+
+  - legacy format consists of header (see WriteSerializeHeader) directly followed by records
+  - framed format starts with magic, revision of framing, compression and version of records, followed by blocks of
+    records and trailer. Each block is prefixed by its stored and raw length and number of records in it, and is
+    followed by CRC-32C of all of that. Blocks may be compressed by zstd as whole. Trailer consists of zero length,
+    total number of records and CRC-32C of both, so that file cut off anywhere can not pass as complete.
+
+Framed format is recognised by its magic, which can not be mistaken for legacy header as long as version of records
+stays below 67.
+*/
+
+// CacheFormat Format in which cache files are written; any of them is recognised when reading
+type CacheFormat uint8
+
+const (
+	// CacheFormatFramed Records are written in checksummed blocks followed by trailer with number of records
+	CacheFormatFramed CacheFormat = iota
+	// CacheFormatZstd Same as CacheFormatFramed, with each block compressed by zstd
+	CacheFormatZstd
+	/* CacheFormatLegacy Header is directly followed by records, without framing. Only container differs, records are
+	still of current version, so trackers predating framed format reject them unless they know that version too */
+	CacheFormatLegacy
+)
+
+var cacheFormatNames = [...]string{
+	CacheFormatFramed: "framed",
+	CacheFormatZstd:   "zstd",
+	CacheFormatLegacy: "legacy",
+}
+
+func (f CacheFormat) String() string {
+	if int(f) < len(cacheFormatNames) {
+		return cacheFormatNames[f]
+	}
+
+	return fmt.Sprintf("CacheFormat(%d)", uint8(f))
+}
+
+var errUnknownCacheFormat = errors.New("unknown cache format")
+
+func ParseCacheFormat(s string) (CacheFormat, error) {
+	for f, name := range cacheFormatNames {
+		if name == s {
+			return CacheFormat(f), nil //nolint:gosec
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", errUnknownCacheFormat, s)
+}
+
+const (
+	cacheMagic    = "CHYC"
+	cacheRevision = 1
+
+	cacheCompressionNone = 0
+	cacheCompressionZstd = 1
+
+	// cacheBlockSize Size of raw records after which block is written out
+	cacheBlockSize = 1 << 20
+	// maxCacheBlockSize Upper bound of block size accepted when reading, so that corrupted length can not exhaust memory
+	maxCacheBlockSize = 1 << 28
+)
+
+var (
+	errCacheTruncated        = errors.New("cache file is truncated")
+	errCacheChecksum         = errors.New("cache block checksum mismatch")
+	errCacheCorrupt          = errors.New("cache block is corrupt")
+	errCacheRecordCount      = errors.New("number of records does not match cache trailer")
+	errUnknownCacheRevision  = errors.New("unknown cache framing revision")
+	errUnknownCompression    = errors.New("unknown cache compression")
+	errCacheBlockSizeTooLong = errors.New("cache block size too long")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// cacheWriter Writes records of cache file in given format; close has to be called once all records were written
+type cacheWriter struct {
+	writer  *bufio.Writer
+	format  CacheFormat
+	encoder *zstd.Encoder
+
+	block   []byte
+	stored  []byte
+	frame   []byte
+	records uint64
+	total   uint64
+}
+
+// newCacheWriter Writes header of cache file; n is number of records to follow, which only legacy format needs upfront
+func newCacheWriter(w io.Writer, format CacheFormat, version uint64, n int) (_ *cacheWriter, err error) {
+	c := &cacheWriter{writer: bufio.NewWriterSize(w, 1024*64), format: format}
+
+	switch format {
+	case CacheFormatLegacy:
+		return c, WriteSerializeHeader(c.writer, n, version)
+	case CacheFormatFramed, CacheFormatZstd:
+		header := append([]byte(cacheMagic), cacheRevision, cacheCompressionNone)
+
+		if format == CacheFormatZstd {
+			header[len(cacheMagic)+1] = cacheCompressionZstd
+
+			if c.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1),
+				zstd.WithEncoderLevel(zstd.SpeedFastest)); err != nil {
+				return nil, err
+			}
+		}
+
+		c.block = make([]byte, 0, cacheBlockSize+4096)
+		_, err = c.writer.Write(binary.AppendUvarint(header, version))
+
+		return c, err
+	default:
+		return nil, errUnknownCacheFormat
+	}
+}
+
+func (c *cacheWriter) write(record []byte) error {
+	if c.format == CacheFormatLegacy {
+		_, err := c.writer.Write(record)
+		return err
+	}
+
+	c.block = append(c.block, record...)
+	c.records++
+
+	if len(c.block) >= cacheBlockSize {
+		return c.writeBlock()
+	}
+
+	return nil
+}
+
+func (c *cacheWriter) writeBlock() error {
+	if c.records == 0 {
+		return nil
+	}
+
+	stored := c.block
+	if c.encoder != nil {
+		c.stored = c.encoder.EncodeAll(c.block, c.stored[:0])
+		stored = c.stored
+	}
+
+	frame := binary.AppendUvarint(c.frame[:0], uint64(len(stored)))
+	frame = binary.AppendUvarint(frame, uint64(len(c.block)))
+	frame = binary.AppendUvarint(frame, c.records)
+
+	checksum := crc32.Update(crc32.Checksum(frame, crc32c), crc32c, stored)
+
+	if _, err := c.writer.Write(frame); err != nil {
+		return err
+	}
+
+	if _, err := c.writer.Write(stored); err != nil {
+		return err
+	}
+
+	if _, err := c.writer.Write(binary.LittleEndian.AppendUint32(c.frame[:0], checksum)); err != nil {
+		return err
+	}
+
+	c.total += c.records
+	c.block, c.records, c.frame = c.block[:0], 0, frame
+
+	return nil
+}
+
+// close Writes out last block and trailer and flushes everything to underlying writer
+func (c *cacheWriter) close() error {
+	if c.encoder != nil {
+		defer func() {
+			_ = c.encoder.Close()
+		}()
+	}
+
+	if c.format != CacheFormatLegacy {
+		if err := c.writeBlock(); err != nil {
+			return err
+		}
+
+		trailer := binary.AppendUvarint([]byte{0}, c.total)
+		trailer = binary.LittleEndian.AppendUint32(trailer, crc32.Checksum(trailer, crc32c))
+
+		if _, err := c.writer.Write(trailer); err != nil {
+			return err
+		}
+	}
+
+	return c.writer.Flush()
+}
+
+/*
+readCache Reads cache file in any format, calling load for each record; load has to consume exactly one record from
+given reader. Blocks of framed format are verified before any of their records is loaded, yet records of earlier blocks
+are already loaded by the time corruption or truncation is found, so whatever load filled has to be discarded on error.
+*/
+func readCache(r io.Reader, maxVersion uint64, load func(version uint64, reader readerAndByteReader) error) error {
+	reader := bufio.NewReaderSize(r, 1024*64)
+
+	if magic, err := reader.Peek(len(cacheMagic)); err == nil && string(magic) == cacheMagic {
+		return readFramedCache(reader, maxVersion, load)
+	}
+
+	n, version, err := LoadSerializeHeader(reader, maxVersion)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		if err = load(version, reader); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readFramedCache(reader *bufio.Reader, maxVersion uint64,
+	load func(version uint64, reader readerAndByteReader) error) (err error) {
+	var header [len(cacheMagic) + 2]byte
+
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		return truncated(err)
+	}
+
+	if header[len(cacheMagic)] != cacheRevision {
+		return errUnknownCacheRevision
+	}
+
+	var decoder *zstd.Decoder
+
+	switch header[len(cacheMagic)+1] {
+	case cacheCompressionNone:
+	case cacheCompressionZstd:
+		if decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxCacheBlockSize)); err != nil {
+			return err
+		}
+
+		defer decoder.Close()
+	default:
+		return errUnknownCompression
+	}
+
+	version, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return truncated(err)
+	}
+
+	if version == 0 || version > maxVersion {
+		return errUnsupportedVersion
+	}
+
+	var (
+		stored, decoded, raw []byte
+		total                uint64
+		block                bytes.Reader
+	)
+
+	for {
+		frame, storedLen, rawLen, records, err := readBlockFrame(reader)
+		if err != nil {
+			return err
+		}
+
+		if storedLen == 0 {
+			return readCacheTrailer(reader, frame, total)
+		}
+
+		if cap(stored) < int(storedLen) {
+			stored = make([]byte, storedLen)
+		}
+
+		stored = stored[:storedLen]
+
+		if _, err = io.ReadFull(reader, stored); err != nil {
+			return truncated(err)
+		}
+
+		var checksum [4]byte
+
+		if _, err = io.ReadFull(reader, checksum[:]); err != nil {
+			return truncated(err)
+		}
+
+		if crc32.Update(crc32.Checksum(frame, crc32c), crc32c, stored) != binary.LittleEndian.Uint32(checksum[:]) {
+			return errCacheChecksum
+		}
+
+		raw = stored
+		if decoder != nil {
+			if decoded, err = decoder.DecodeAll(stored, decoded[:0]); err != nil {
+				return errors.Join(errCacheCorrupt, err)
+			}
+
+			raw = decoded
+		}
+
+		if uint64(len(raw)) != rawLen {
+			return errCacheCorrupt
+		}
+
+		block.Reset(raw)
+
+		for range records {
+			if err = load(version, &block); err != nil {
+				return errors.Join(errCacheCorrupt, err)
+			}
+		}
+
+		if block.Len() != 0 {
+			return errCacheCorrupt
+		}
+
+		total += records
+	}
+}
+
+// readBlockFrame Reads lengths and number of records preceding block, returning them along with their encoding
+func readBlockFrame(reader *bufio.Reader) (frame []byte, storedLen, rawLen, records uint64, err error) {
+	if storedLen, err = binary.ReadUvarint(reader); err != nil {
+		return nil, 0, 0, 0, truncated(err)
+	}
+
+	frame = binary.AppendUvarint(nil, storedLen)
+
+	if storedLen == 0 {
+		return frame, 0, 0, 0, nil
+	}
+
+	if rawLen, err = binary.ReadUvarint(reader); err != nil {
+		return nil, 0, 0, 0, truncated(err)
+	}
+
+	if records, err = binary.ReadUvarint(reader); err != nil {
+		return nil, 0, 0, 0, truncated(err)
+	}
+
+	if storedLen > maxCacheBlockSize || rawLen > maxCacheBlockSize || records > rawLen {
+		return nil, 0, 0, 0, errCacheBlockSizeTooLong
+	}
+
+	frame = binary.AppendUvarint(frame, rawLen)
+	frame = binary.AppendUvarint(frame, records)
+
+	return frame, storedLen, rawLen, records, nil
+}
+
+func readCacheTrailer(reader *bufio.Reader, frame []byte, total uint64) error {
+	records, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return truncated(err)
+	}
+
+	var checksum [4]byte
+
+	if _, err = io.ReadFull(reader, checksum[:]); err != nil {
+		return truncated(err)
+	}
+
+	if crc32.Checksum(binary.AppendUvarint(frame, records), crc32c) != binary.LittleEndian.Uint32(checksum[:]) {
+		return errCacheChecksum
+	}
+
+	if records != total {
+		return errCacheRecordCount
+	}
+
+	return nil
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errCacheTruncated
+	}
+
+	return err
+}
@@ -0,0 +1,155 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func cacheTestData() (map[TorrentHash]*Torrent, map[string]*User) {
+	torrents := make(map[TorrentHash]*Torrent)
+
+	// Enough peers for framed formats to need several blocks
+	for i := range 300 {
+		torrent := &Torrent{}
+		torrent.ID.Store(uint32(i)) //nolint:gosec
+		torrent.Snatched.Store(uint32(i * 2))
+
+		for j := range uint32(50) {
+			peer := &Peer{UserID: j, TorrentID: uint32(i), LastAnnounce: int64(i)} //nolint:gosec
+			peer.Addr = PeerAddress{1, 2, 3, 4, 5, 6}
+			peer.ID[0] = byte(j)
+
+			torrent.Seeders.Put(NewPeerKey(peer.UserID, peer.ID), peer)
+		}
+
+		torrent.SeedersLength.Store(uint32(torrent.Seeders.Len())) //nolint:gosec
+
+		torrents[TorrentHash{byte(i), byte(i >> 8)}] = torrent
+	}
+
+	users := make(map[string]*User)
+
+	for i := range uint32(20) {
+		user := &User{}
+		user.ID.Store(i)
+		user.TrackerHide.Store(i%2 == 0)
+
+		users[string(rune('a'+i))+"passkey"] = user
+	}
+
+	return torrents, users
+}
+
+func TestCacheFormats(t *testing.T) {
+	torrents, users := cacheTestData()
+
+	for _, format := range []CacheFormat{CacheFormatFramed, CacheFormatZstd, CacheFormatLegacy} {
+		t.Run(format.String(), func(t *testing.T) {
+			var torrentBuf, userBuf bytes.Buffer
+
+			if err := WriteTorrents(&torrentBuf, len(torrents), maps.All(torrents), format); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := WriteUsers(&userBuf, users, format); err != nil {
+				t.Fatal(err)
+			}
+
+			if framed := bytes.HasPrefix(torrentBuf.Bytes(), []byte(cacheMagic)); framed == (format == CacheFormatLegacy) {
+				t.Fatalf("Expected magic to be written only by framed formats")
+			}
+
+			loadedTorrents := make(map[TorrentHash]*Torrent)
+			if err := LoadTorrents(&torrentBuf, loadedTorrents); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(torrents, loadedTorrents, TorrentTestCompareOptions...) {
+				t.Fatalf("Torrents changed after round trip: %s",
+					cmp.Diff(torrents, loadedTorrents, TorrentTestCompareOptions...))
+			}
+
+			loadedUsers := make(map[string]*User)
+			if err := LoadUsers(&userBuf, loadedUsers); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(users, loadedUsers, TorrentTestCompareOptions...) {
+				t.Fatalf("Users changed after round trip: %s", cmp.Diff(users, loadedUsers, TorrentTestCompareOptions...))
+			}
+		})
+	}
+}
+
+func TestCacheCorruption(t *testing.T) {
+	torrents, _ := cacheTestData()
+
+	for _, format := range []CacheFormat{CacheFormatFramed, CacheFormatZstd} {
+		var buf bytes.Buffer
+
+		if err := WriteTorrents(&buf, len(torrents), maps.All(torrents), format); err != nil {
+			t.Fatal(err)
+		}
+
+		valid := buf.Bytes()
+
+		flipped := bytes.Clone(valid)
+		flipped[len(flipped)/2] ^= 0x10
+
+		if err := LoadTorrents(bytes.NewReader(flipped), make(map[TorrentHash]*Torrent)); !errors.Is(err, errCacheChecksum) {
+			t.Fatalf("Expected checksum mismatch of flipped bit in %s format, got %v", format, err)
+		}
+
+		// Cut off at the end of header, inside of block and inside of trailer
+		for _, size := range []int{len(cacheMagic) + 3, len(valid) / 2, len(valid) - 2} {
+			err := LoadTorrents(bytes.NewReader(valid[:size]), make(map[TorrentHash]*Torrent))
+			if !errors.Is(err, errCacheTruncated) {
+				t.Fatalf("Expected %s file cut off at %d bytes to be reported as truncated, got %v", format, size, err)
+			}
+		}
+	}
+
+	// Legacy header followed by records of unsupported version
+	var buf bytes.Buffer
+
+	if err := WriteSerializeHeader(&buf, 1, TorrentCacheVersion+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadTorrents(&buf, make(map[TorrentHash]*Torrent)); !errors.Is(err, errUnsupportedVersion) {
+		t.Fatalf("Expected unsupported version, got %v", err)
+	}
+}
+
+func TestParseCacheFormat(t *testing.T) {
+	for _, format := range []CacheFormat{CacheFormatFramed, CacheFormatZstd, CacheFormatLegacy} {
+		if parsed, err := ParseCacheFormat(format.String()); err != nil || parsed != format {
+			t.Fatalf("Expected %s to be parsed back, got %v (%v)", format, parsed, err)
+		}
+	}
+
+	if _, err := ParseCacheFormat("gzip"); !errors.Is(err, errUnknownCacheFormat) {
+		t.Fatalf("Expected unknown format to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+// FreeleechWindow Multipliers which apply from Start (inclusive) until End (exclusive), both as unix timestamps
+type FreeleechWindow struct {
+	Start          int64
+	End            int64
+	DownMultiplier float64
+	UpMultiplier   float64
+}
+
+// Active Returns whether window applies at given time
+func (w *FreeleechWindow) Active(now int64) bool {
+	return w.Start <= now && now < w.End
+}
+
+// FreeleechWindows Scheduled freeleech windows, either applying to all torrents or only to single torrent group
+type FreeleechWindows struct {
+	Global []FreeleechWindow
+	Groups map[TorrentGroupKey][]FreeleechWindow
+}
+
+/*
+Multipliers Returns product of multipliers of all global windows and windows of given group that are active at given
+time; if there are none, both multipliers are 1
+*/
+func (w *FreeleechWindows) Multipliers(key TorrentGroupKey, now int64) (down, up float64) {
+	down, up = 1, 1
+
+	for _, windows := range [][]FreeleechWindow{w.Global, w.Groups[key]} {
+		for i := range windows {
+			if windows[i].Active(now) {
+				down *= windows[i].DownMultiplier
+				up *= windows[i].UpMultiplier
+			}
+		}
+	}
+
+	return down, up
+}
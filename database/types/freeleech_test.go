@@ -0,0 +1,54 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"testing"
+)
+
+func TestFreeleechWindows(t *testing.T) {
+	group := MustTorrentGroupKeyFromString("anime", 2)
+
+	windows := FreeleechWindows{
+		Global: []FreeleechWindow{{Start: 100, End: 200, DownMultiplier: 1, UpMultiplier: 2}},
+		Groups: map[TorrentGroupKey][]FreeleechWindow{
+			group: {{Start: 150, End: 300, DownMultiplier: 0, UpMultiplier: 1}},
+		},
+	}
+
+	testCases := []struct {
+		key      TorrentGroupKey
+		now      int64
+		down, up float64
+	}{
+		{group, 99, 1, 1},
+		{group, 100, 1, 2},
+		{group, 150, 0, 2},
+		{group, 200, 0, 1},
+		{group, 300, 1, 1},
+		{MustTorrentGroupKeyFromString("music", 2), 150, 1, 2},
+	}
+
+	for _, testCase := range testCases {
+		down, up := windows.Multipliers(testCase.key, testCase.now)
+		if down != testCase.down || up != testCase.up {
+			t.Fatalf("Expected multipliers (%v, %v) at %d, got (%v, %v)", testCase.down, testCase.up, testCase.now,
+				down, up)
+		}
+	}
+}
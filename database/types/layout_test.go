@@ -0,0 +1,310 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+Benchmarks comparing layout of torrents and peers (TorrentIndex and Peers) with previous one, which kept all torrents
+in single map and peers of each torrent in two maps. By default they run on synthetic swarms; set CHIHAYA_BENCH_CACHE
+to torrent cache file (such as torrent-cache-anonymized.bin written by cc anonymize) to run them on real swarms.
+*/
+
+// mapTorrent Previous layout of torrent, reduced to what benchmarks need
+type mapTorrent struct {
+	mu       sync.Mutex
+	seeders  map[PeerKey]*Peer
+	leechers map[PeerKey]*Peer
+}
+
+type benchData struct {
+	hashes []TorrentHash
+
+	index TorrentIndex
+	maps  atomic.Pointer[map[TorrentHash]*mapTorrent]
+}
+
+var (
+	benchOnce sync.Once
+	bench     benchData
+)
+
+func loadBenchTorrents(b *testing.B) map[TorrentHash]*Torrent {
+	torrents := make(map[TorrentHash]*Torrent)
+
+	if name := os.Getenv("CHIHAYA_BENCH_CACHE"); name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer func() {
+			_ = f.Close()
+		}()
+
+		if err = LoadTorrents(f, torrents); err != nil {
+			b.Fatal(err)
+		}
+
+		return torrents
+	}
+
+	// Most swarms are tiny while few are huge, so number of peers follows power law
+	r := rand.New(rand.NewSource(1)) //nolint:gosec
+
+	for range 100000 {
+		var h TorrentHash
+
+		_, _ = r.Read(h[:])
+
+		t := &Torrent{}
+
+		for i := range int(1 / (r.Float64() + 0.001)) {
+			peer := &Peer{UserID: r.Uint32(), Addr: PeerAddress{1, 2, 3, 4, 0x60, 0x00}}
+			_, _ = r.Read(peer.ID[:])
+
+			if i%4 == 0 {
+				t.Leechers.Put(NewPeerKey(peer.UserID, peer.ID), peer)
+			} else {
+				t.Seeders.Put(NewPeerKey(peer.UserID, peer.ID), peer)
+			}
+		}
+
+		torrents[h] = t
+	}
+
+	return torrents
+}
+
+func benchSetup(b *testing.B) *benchData {
+	benchOnce.Do(func() {
+		torrents := loadBenchTorrents(b)
+		mapTorrents := make(map[TorrentHash]*mapTorrent, len(torrents))
+
+		for h, t := range torrents {
+			mt := &mapTorrent{
+				seeders:  make(map[PeerKey]*Peer, t.Seeders.Len()),
+				leechers: make(map[PeerKey]*Peer, t.Leechers.Len()),
+			}
+
+			for k, peer := range t.Seeders.All() {
+				mt.seeders[k] = peer
+			}
+
+			for k, peer := range t.Leechers.All() {
+				mt.leechers[k] = peer
+			}
+
+			mapTorrents[h] = mt
+			bench.hashes = append(bench.hashes, h)
+		}
+
+		bench.index.Store(NewTorrentShards(torrents))
+		bench.maps.Store(&mapTorrents)
+	})
+
+	if len(bench.hashes) == 0 {
+		b.Skip("no torrents to benchmark with")
+	}
+
+	return &bench
+}
+
+func BenchmarkTorrentLookup(b *testing.B) {
+	d := benchSetup(b)
+
+	b.Run("Map", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := rand.Int(); pb.Next(); i++ { //nolint:gosec
+				if _, exists := (*d.maps.Load())[d.hashes[i%len(d.hashes)]]; !exists {
+					b.Fatal("torrent not found")
+				}
+			}
+		})
+	})
+	b.Run("Sharded", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := rand.Int(); pb.Next(); i++ { //nolint:gosec
+				if _, exists := d.index.Get(d.hashes[i%len(d.hashes)]); !exists {
+					b.Fatal("torrent not found")
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkTorrentUpdate Replacing single torrent, as incremental reload does
+func BenchmarkTorrentUpdate(b *testing.B) {
+	d := benchSetup(b)
+
+	b.Run("Map", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			current := *d.maps.Load()
+			h := d.hashes[i%len(d.hashes)]
+
+			updated := make(map[TorrentHash]*mapTorrent, len(current))
+			for k, v := range current {
+				updated[k] = v
+			}
+
+			updated[h] = current[h]
+
+			d.maps.Store(&updated)
+		}
+	})
+	b.Run("Sharded", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			h := d.hashes[i%len(d.hashes)]
+			t, _ := d.index.Get(h)
+
+			d.index.Update(map[TorrentHash]*Torrent{h: t})
+		}
+	})
+}
+
+// BenchmarkPeerSelection Picking up to 50 peers for leecher from random torrent while other goroutines do the same
+func BenchmarkPeerSelection(b *testing.B) {
+	const numWant = 50
+
+	d := benchSetup(b)
+
+	b.Run("Map", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			selected := make([]*Peer, 0, numWant)
+
+			for i := rand.Int(); pb.Next(); i++ { //nolint:gosec
+				t := (*d.maps.Load())[d.hashes[i%len(d.hashes)]]
+				selected = selected[:0]
+
+				t.mu.Lock()
+
+				for _, peer := range t.seeders {
+					if len(selected) >= numWant {
+						break
+					}
+
+					selected = append(selected, peer)
+				}
+
+				for _, peer := range t.leechers {
+					if len(selected) >= numWant {
+						break
+					}
+
+					selected = append(selected, peer)
+				}
+
+				t.mu.Unlock()
+			}
+		})
+	})
+	b.Run("Slice", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			selected := make([]*Peer, 0, numWant)
+
+			for i := rand.Int(); pb.Next(); i++ { //nolint:gosec
+				t, _ := d.index.Get(d.hashes[i%len(d.hashes)])
+				selected = selected[:0]
+
+				t.PeerLock()
+
+				for _, peer := range t.Seeders.From(i) {
+					if len(selected) >= numWant {
+						break
+					}
+
+					selected = append(selected, peer)
+				}
+
+				for _, peer := range t.Leechers.From(i) {
+					if len(selected) >= numWant {
+						break
+					}
+
+					selected = append(selected, peer)
+				}
+
+				t.PeerUnlock()
+			}
+		})
+	})
+}
+
+// BenchmarkPeerChurn Peer joining swarm of random torrent and leaving it again
+func BenchmarkPeerChurn(b *testing.B) {
+	d := benchSetup(b)
+
+	b.Run("Map", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			peer := &Peer{}
+
+			for i := rand.Int(); pb.Next(); i++ { //nolint:gosec
+				t := (*d.maps.Load())[d.hashes[i%len(d.hashes)]]
+				k := NewPeerKey(uint32(i), PeerID{1}) //nolint:gosec
+
+				t.mu.Lock()
+				t.leechers[k] = peer
+				delete(t.leechers, k)
+				t.mu.Unlock()
+			}
+		})
+	})
+	b.Run("Slice", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			peer := &Peer{}
+
+			for i := rand.Int(); pb.Next(); i++ { //nolint:gosec
+				t, _ := d.index.Get(d.hashes[i%len(d.hashes)])
+				k := NewPeerKey(uint32(i), PeerID{1}) //nolint:gosec
+
+				t.PeerLock()
+				t.Leechers.Put(k, peer)
+				t.Leechers.Delete(k)
+				t.PeerUnlock()
+			}
+		})
+	})
+}
+
+// BenchmarkTorrentAppend Serialization of all torrents, which holds peer lock of each torrent while it is encoded
+func BenchmarkTorrentAppend(b *testing.B) {
+	d := benchSetup(b)
+
+	b.Run("Slice", func(b *testing.B) {
+		buf := make([]byte, 0, 1<<20)
+
+		for i := 0; i < b.N; i++ {
+			t, _ := d.index.Get(d.hashes[i%len(d.hashes)])
+			buf = t.Append(buf[:0])
+		}
+	})
+}
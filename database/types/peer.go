@@ -23,6 +23,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"hash/fnv"
 	"io"
 	"net/netip"
 	"strconv"
@@ -155,6 +156,11 @@ func NewPeerAddressFromAddrPort(addr netip.Addr, port uint16) PeerAddress {
 	return a
 }
 
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress) IsValid() bool {
+	return a.IPNumeric() != 0
+}
+
 //goland:noinspection GoMixedReceiverTypes
 func (a PeerAddress) IP() [4]byte {
 	return [4]byte(a[:4])
@@ -262,11 +268,91 @@ func (a *PeerAddress) UnmarshalText(b []byte) error {
 	return nil
 }
 
+const PeerAddress6Size = 16 + 2
+
+// PeerAddress6 IPv6 counterpart of PeerAddress, laid out as expected by BEP-7 compact "peers6" string
+type PeerAddress6 [PeerAddress6Size]byte
+
+func NewPeerAddress6FromAddrPort(addr netip.Addr, port uint16) PeerAddress6 {
+	if !addr.Is6() || addr.Is4In6() {
+		panic("ip address is not IPv6")
+	}
+
+	var a PeerAddress6
+
+	ip := addr.As16()
+
+	copy(a[:], ip[:])
+	binary.BigEndian.PutUint16(a[16:], port)
+
+	return a
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) IsValid() bool {
+	return a.IP() != [16]byte{}
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) IP() [16]byte {
+	return [16]byte(a[:16])
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) IPString() string {
+	return netip.AddrFrom16(a.IP()).String()
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) IPStringLen() int {
+	// static allocation
+	var digits [len("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")]byte
+
+	return len(netip.AddrFrom16(a.IP()).AppendTo(digits[:0]))
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) AppendIPString(buf *bytes.Buffer) {
+	// static allocation
+	var digits [len("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")]byte
+
+	buf.Write(netip.AddrFrom16(a.IP()).AppendTo(digits[:0]))
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) Port() uint16 {
+	return binary.BigEndian.Uint16(a[16:])
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a PeerAddress6) MarshalText() ([]byte, error) {
+	return netip.AddrPortFrom(netip.AddrFrom16(a.IP()), a.Port()).MarshalText()
+}
+
+//goland:noinspection GoMixedReceiverTypes
+func (a *PeerAddress6) UnmarshalText(b []byte) error {
+	addrPort, err := netip.ParseAddrPort(string(b))
+	if err != nil {
+		return errInvalidPeerAddress
+	}
+
+	if !addrPort.Addr().Is6() || addrPort.Addr().Is4In6() {
+		return errInvalidPeerAddress
+	}
+
+	*a = NewPeerAddress6FromAddrPort(addrPort.Addr().WithZone(""), addrPort.Port())
+
+	return nil
+}
+
 // Peer
-// Theoretical min layout size: 6 + 8 + 8 + 8 + 8 + 8 + 8 + 4 + 4 + 6 + 2 + 1 = 71 bytes
-// Current layout size go1.20.4: 80 bytes via unsafe.Sizeof(Peer{})
+// Theoretical min layout size: 6 + 18 + 8 + 8 + 8 + 8 + 8 + 8 + 4 + 4 + 20 + 2 + 1 + 1 = 104 bytes
+// Current layout size go1.25: 104 bytes via unsafe.Sizeof(Peer{})
 type Peer struct {
+	// Addr IPv4 address of peer; zero value when peer did not announce one
 	Addr PeerAddress
+	// Addr6 IPv6 address of peer; zero value when peer did not announce one
+	Addr6 PeerAddress6
 
 	Uploaded   uint64
 	Downloaded uint64
@@ -275,6 +361,9 @@ type Peer struct {
 	StartTime    int64 // unix time
 	LastAnnounce int64
 
+	// KeyHash Hash of key sent by peer (see HashPeerKey), 0 if peer never sent one
+	KeyHash uint64
+
 	TorrentID uint32
 	UserID    uint32
 
@@ -284,6 +373,30 @@ type Peer struct {
 	ClientID uint16
 
 	Seeding bool
+	// PartialSeed Peer announced event=paused or upload_only (BEP-21), it has all pieces it wants but is not seeding
+	PartialSeed bool
+}
+
+/*
+HashPeerKey Returns hash of key param sent by peer, so that key itself does not have to be kept around.
+Keys which are hex numbers (as most clients send them over HTTP, and as keys from UDP announces are formatted) are
+hashed by their value, so that letter case or leading zeros do not matter and peer can switch between protocols.
+Empty key hashes to 0
+*/
+func HashPeerKey(key string) uint64 {
+	if key == "" {
+		return 0
+	}
+
+	h := fnv.New64a()
+
+	if value, err := strconv.ParseUint(key, 16, 64); err == nil {
+		_, _ = h.Write(binary.BigEndian.AppendUint64(nil, value))
+	} else {
+		_, _ = h.Write([]byte(key))
+	}
+
+	return h.Sum64()
 }
 
 var errInvalidAddrLength = errors.New("invalid Addr length")
@@ -338,6 +451,12 @@ func (p *Peer) Load(version uint64, reader readerAndByteReader) (err error) {
 		}
 	}
 
+	if version >= 4 {
+		if _, err = io.ReadFull(reader, p.Addr6[:]); err != nil {
+			return err
+		}
+	}
+
 	if err = binary.Read(reader, binary.LittleEndian, &p.Uploaded); err != nil {
 		return err
 	}
@@ -358,6 +477,12 @@ func (p *Peer) Load(version uint64, reader readerAndByteReader) (err error) {
 		return err
 	}
 
+	if version >= 6 {
+		if err = binary.Read(reader, binary.LittleEndian, &p.KeyHash); err != nil {
+			return err
+		}
+	}
+
 	if err = binary.Read(reader, binary.LittleEndian, &p.TorrentID); err != nil {
 		return err
 	}
@@ -370,18 +495,37 @@ func (p *Peer) Load(version uint64, reader readerAndByteReader) (err error) {
 		return err
 	}
 
-	return binary.Read(reader, binary.LittleEndian, &p.Seeding)
+	if err = binary.Read(reader, binary.LittleEndian, &p.Seeding); err != nil {
+		return err
+	}
+
+	if version >= 5 {
+		return binary.Read(reader, binary.LittleEndian, &p.PartialSeed)
+	}
+
+	return nil
+}
+
+// Port returns port on which peer accepts connections, regardless of address family it was announced with
+func (p *Peer) Port() uint16 {
+	if p.Addr.IsValid() {
+		return p.Addr.Port()
+	}
+
+	return p.Addr6.Port()
 }
 
 func (p *Peer) Append(preAllocatedBuffer []byte) (buf []byte) {
 	buf = preAllocatedBuffer
 	buf = append(buf, p.ID[:]...)
 	buf = append(buf, p.Addr[:]...)
+	buf = append(buf, p.Addr6[:]...)
 	buf = binary.LittleEndian.AppendUint64(buf, p.Uploaded)
 	buf = binary.LittleEndian.AppendUint64(buf, p.Downloaded)
 	buf = binary.LittleEndian.AppendUint64(buf, p.Left)
 	buf = binary.LittleEndian.AppendUint64(buf, uint64(p.StartTime))
 	buf = binary.LittleEndian.AppendUint64(buf, uint64(p.LastAnnounce))
+	buf = binary.LittleEndian.AppendUint64(buf, p.KeyHash)
 	buf = binary.LittleEndian.AppendUint32(buf, p.TorrentID)
 	buf = binary.LittleEndian.AppendUint32(buf, p.UserID)
 	buf = binary.LittleEndian.AppendUint16(buf, p.ClientID)
@@ -392,5 +536,11 @@ func (p *Peer) Append(preAllocatedBuffer []byte) (buf []byte) {
 		buf = append(buf, 0)
 	}
 
+	if p.PartialSeed {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
 	return buf
 }
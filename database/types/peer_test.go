@@ -112,6 +112,151 @@ func testPeerAddressUnmarshalText(t *testing.T) {
 	}
 }
 
+func testNewPeerAddress6FromAddrPort(t *testing.T) {
+	a := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 95, 192}
+	b := NewPeerAddress6FromAddrPort(netip.MustParseAddr("2001:db8::1"), 24512)
+
+	if !bytes.Equal(a, b[:]) {
+		t.Fatalf("Expected PeerAddress6 %v, got %v", a, b)
+	}
+}
+
+func testPeerAddress6IsValid(t *testing.T) {
+	var a PeerAddress6
+
+	if a.IsValid() {
+		t.Fatalf("Expected zero PeerAddress6 %v to be invalid", a)
+	}
+
+	if b := NewPeerAddress6FromAddrPort(netip.MustParseAddr("2001:db8::1"), 24512); !b.IsValid() {
+		t.Fatalf("Expected PeerAddress6 %v to be valid", b)
+	}
+}
+
+func testPeerAddress6IPStringLen(t *testing.T) {
+	testCases := []string{
+		"2001:db8::1",
+		"2606:4700:4700::1111",
+		"fe80:dead:beef:1234:5678:9abc:def0:1",
+	}
+
+	for _, testCase := range testCases {
+		gotLen := NewPeerAddress6FromAddrPort(netip.MustParseAddr(testCase), 24512).IPStringLen()
+		if gotLen != len(testCase) {
+			t.Fatalf("IP string %s has length of %d but got %d instead", testCase, len(testCase), gotLen)
+		}
+	}
+}
+
+func testPeerAddress6MarshalText(t *testing.T) {
+	a := []byte("[2001:db8::1]:24512")
+
+	if b, err := NewPeerAddress6FromAddrPort(netip.MustParseAddr("2001:db8::1"), 24512).MarshalText(); err != nil {
+		panic(err)
+	} else if !bytes.Equal(a, b) {
+		t.Fatalf("Expected marshaled PeerAddress6 %s, got %s", a, b)
+	}
+}
+
+func testPeerAddress6UnmarshalText(t *testing.T) {
+	a := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 95, 192}
+
+	var b PeerAddress6
+	if err := b.UnmarshalText([]byte("[2001:db8::1]:24512")); err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(a, b[:]) {
+		t.Fatalf("Expected unmarshaled PeerAddress6 %v, got %v", a, b)
+	}
+
+	if err := b.UnmarshalText([]byte("9.10.11.123:24512")); err == nil {
+		t.Fatalf("Expected IPv4 address to be rejected by PeerAddress6")
+	}
+}
+
+func testPeerPort(t *testing.T) {
+	p := Peer{Addr6: NewPeerAddress6FromAddrPort(netip.MustParseAddr("2001:db8::1"), 24512)}
+	if p.Port() != 24512 {
+		t.Fatalf("Expected port %d, got %d", 24512, p.Port())
+	}
+
+	p.Addr = NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{9, 10, 11, 123}), 24513)
+	if p.Port() != 24513 {
+		t.Fatalf("Expected port %d, got %d", 24513, p.Port())
+	}
+}
+
+func testPeerLoad(t *testing.T) {
+	p := Peer{
+		Addr:        NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{9, 10, 11, 123}), 24512),
+		Uploaded:    100,
+		Left:        200,
+		KeyHash:     HashPeerKey("abcdef"),
+		TorrentID:   3,
+		UserID:      4,
+		PartialSeed: true,
+	}
+
+	buf := p.Append(nil)
+
+	var loaded Peer
+	if err := loaded.Load(TorrentCacheVersion, bytes.NewReader(buf)); err != nil {
+		panic(err)
+	}
+
+	if loaded != p {
+		t.Fatalf("Expected loaded peer %+v, got %+v", p, loaded)
+	}
+
+	// Version 5 did not have key hash
+	keyHashOffset := len(p.ID) + len(p.Addr) + len(p.Addr6) + 5*8
+	buf = append(buf[:keyHashOffset:keyHashOffset], buf[keyHashOffset+8:]...)
+
+	loaded = Peer{}
+	if err := loaded.Load(5, bytes.NewReader(buf)); err != nil {
+		panic(err)
+	}
+
+	p.KeyHash = 0
+
+	if loaded != p {
+		t.Fatalf("Expected loaded peer %+v, got %+v", p, loaded)
+	}
+
+	// Version 4 did not have partial seed flag either
+	loaded = Peer{}
+	if err := loaded.Load(4, bytes.NewReader(buf[:len(buf)-1])); err != nil {
+		panic(err)
+	}
+
+	p.PartialSeed = false
+
+	if loaded != p {
+		t.Fatalf("Expected loaded peer %+v, got %+v", p, loaded)
+	}
+}
+
+func testHashPeerKey(t *testing.T) {
+	if h := HashPeerKey(""); h != 0 {
+		t.Fatalf("Expected empty key to hash to 0, got %d", h)
+	}
+
+	for _, key := range []string{"001A2B3C", "001a2b3c", "1A2B3C"} {
+		if HashPeerKey(key) != HashPeerKey("1a2b3c") {
+			t.Fatalf("Expected hex key %s to hash same as %s", key, "1a2b3c")
+		}
+	}
+
+	if HashPeerKey("1a2b3c") == HashPeerKey("1a2b3d") {
+		t.Fatalf("Expected different hex keys to hash differently")
+	}
+
+	if HashPeerKey("not-hex") == 0 || HashPeerKey("not-hex") == HashPeerKey("NOT-HEX") {
+		t.Fatalf("Expected non-hex keys to be hashed as opaque strings")
+	}
+}
+
 func TestPeer(t *testing.T) {
 	t.Run("PeerAddress", func(t *testing.T) {
 		testNewPeerAddressFromAddrPort(t)
@@ -123,4 +268,24 @@ func TestPeer(t *testing.T) {
 		testPeerAddressMarshalText(t)
 		testPeerAddressUnmarshalText(t)
 	})
+
+	t.Run("PeerAddress6", func(t *testing.T) {
+		testNewPeerAddress6FromAddrPort(t)
+		testPeerAddress6IsValid(t)
+		testPeerAddress6IPStringLen(t)
+		testPeerAddress6MarshalText(t)
+		testPeerAddress6UnmarshalText(t)
+	})
+
+	t.Run("Port", func(t *testing.T) {
+		testPeerPort(t)
+	})
+
+	t.Run("Load", func(t *testing.T) {
+		testPeerLoad(t)
+	})
+
+	t.Run("HashPeerKey", func(t *testing.T) {
+		testHashPeerKey(t)
+	})
 }
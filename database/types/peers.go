@@ -0,0 +1,247 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"encoding/json"
+	"iter"
+)
+
+// peersIndexThreshold Number of peers above which lookups go through index map instead of scanning keys
+const peersIndexThreshold = 16
+
+/*
+Peers Swarm of peers (either seeders or leechers of torrent) keyed by PeerKey. Peers are kept in slice, so that they
+can be iterated without allocation and starting at any position; removal swaps last peer into place of removed one.
+Most swarms are small, so lookups only go through index map once there are more than peersIndexThreshold peers.
+
+Zero value is empty swarm ready to use. Peers is not safe for concurrent use, callers hold peer lock of torrent;
+it must not be copied after first use.
+*/
+type Peers struct {
+	keys  []PeerKey
+	peers []*Peer
+	index map[PeerKey]int
+}
+
+// NewPeers Creates swarm out of given peers
+func NewPeers(peers map[PeerKey]*Peer) (p Peers) {
+	for k, peer := range peers {
+		p.Put(k, peer)
+	}
+
+	return p
+}
+
+func (p *Peers) Len() int {
+	return len(p.peers)
+}
+
+func (p *Peers) find(k PeerKey) int {
+	if p.index != nil {
+		if i, exists := p.index[k]; exists {
+			return i
+		}
+
+		return -1
+	}
+
+	for i := range p.keys {
+		if p.keys[i] == k {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (p *Peers) Get(k PeerKey) (*Peer, bool) {
+	if i := p.find(k); i >= 0 {
+		return p.peers[i], true
+	}
+
+	return nil, false
+}
+
+// Put Adds peer to swarm or replaces peer already stored under the same key
+func (p *Peers) Put(k PeerKey, peer *Peer) {
+	if i := p.find(k); i >= 0 {
+		p.peers[i] = peer
+		return
+	}
+
+	p.keys = append(p.keys, k)
+	p.peers = append(p.peers, peer)
+
+	if p.index != nil {
+		p.index[k] = len(p.peers) - 1
+	} else if len(p.peers) > peersIndexThreshold {
+		p.index = make(map[PeerKey]int, len(p.peers))
+
+		for i, key := range p.keys {
+			p.index[key] = i
+		}
+	}
+}
+
+// Delete Removes peer from swarm, returning whether it was there
+func (p *Peers) Delete(k PeerKey) bool {
+	i := p.find(k)
+	if i < 0 {
+		return false
+	}
+
+	p.remove(i)
+	p.shrink()
+
+	return true
+}
+
+// DeleteFunc Removes all peers for which del returns true and returns how many were removed
+func (p *Peers) DeleteFunc(del func(k PeerKey, peer *Peer) bool) (n int) {
+	// Iterating backwards visits peer swapped into place of removed one before it is reached
+	for i := len(p.peers) - 1; i >= 0; i-- {
+		if del(p.keys[i], p.peers[i]) {
+			p.remove(i)
+
+			n++
+		}
+	}
+
+	if n > 0 {
+		p.shrink()
+	}
+
+	return n
+}
+
+func (p *Peers) remove(i int) {
+	last := len(p.peers) - 1
+
+	if p.index != nil {
+		delete(p.index, p.keys[i])
+
+		if i != last {
+			p.index[p.keys[last]] = i
+		}
+	}
+
+	p.keys[i], p.peers[i] = p.keys[last], p.peers[last]
+	p.peers[last] = nil // do not keep removed peer alive
+
+	p.keys, p.peers = p.keys[:last], p.peers[:last]
+}
+
+// shrink Releases memory of swarm which has lost most of its peers, as Go never shrinks slices nor maps by itself
+func (p *Peers) shrink() {
+	n := len(p.peers)
+
+	// Small arrays are kept, so that peer repeatedly joining and leaving otherwise empty swarm does not allocate
+	if n == 0 && cap(p.peers) > peersIndexThreshold {
+		p.Clear()
+		return
+	}
+
+	if p.index != nil && n <= peersIndexThreshold/2 {
+		p.index = nil
+	}
+
+	if c := cap(p.peers); c > 2*peersIndexThreshold && n < c/4 {
+		p.keys = append(make([]PeerKey, 0, 2*n), p.keys...)
+		p.peers = append(make([]*Peer, 0, 2*n), p.peers...)
+
+		if p.index != nil {
+			index := make(map[PeerKey]int, n)
+			for k, i := range p.index {
+				index[k] = i
+			}
+
+			p.index = index
+		}
+	}
+}
+
+// Clear Removes all peers and releases memory held by swarm
+func (p *Peers) Clear() {
+	p.keys, p.peers, p.index = nil, nil, nil
+}
+
+// At Returns peer at given position, which has to be less than Len
+func (p *Peers) At(i int) (PeerKey, *Peer) {
+	return p.keys[i], p.peers[i]
+}
+
+// All Returns all peers in order they are stored in
+func (p *Peers) All() iter.Seq2[PeerKey, *Peer] {
+	return p.From(0)
+}
+
+// From Returns all peers, starting at given position and wrapping around
+func (p *Peers) From(start int) iter.Seq2[PeerKey, *Peer] {
+	return p.Stride(start, 1)
+}
+
+/*
+Stride Returns all peers, starting at given position and advancing by step, wrapping around. Step has to be coprime
+with Len, otherwise some peers are returned more than once and others never. Peers are stored in order they joined,
+except for removals, so random start and step is how selection of peers is randomized without shuffling them.
+*/
+func (p *Peers) Stride(start, step int) iter.Seq2[PeerKey, *Peer] {
+	return func(yield func(PeerKey, *Peer) bool) {
+		n := len(p.peers)
+		if n == 0 {
+			return
+		}
+
+		i := start % n
+
+		for range n {
+			if !yield(p.keys[i], p.peers[i]) {
+				return
+			}
+
+			i = (i + step) % n
+		}
+	}
+}
+
+// MarshalJSON Peers are encoded as object keyed by PeerKey, same as map would be
+func (p *Peers) MarshalJSON() ([]byte, error) {
+	peers := make(map[PeerKey]*Peer, len(p.peers))
+	for k, peer := range p.All() {
+		peers[k] = peer
+	}
+
+	return json.Marshal(peers)
+}
+
+func (p *Peers) UnmarshalJSON(buf []byte) error {
+	var peers map[PeerKey]*Peer
+
+	if err := json.Unmarshal(buf, &peers); err != nil {
+		return err
+	}
+
+	p.Clear()
+
+	for k, peer := range peers {
+		p.Put(k, peer)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func testPeersPutGet(t *testing.T) {
+	var p Peers
+
+	// Crosses threshold both ways, so lookups are tested with and without index
+	for i := range uint32(2 * peersIndexThreshold) {
+		p.Put(NewPeerKey(i, PeerID{}), &Peer{UserID: i})
+	}
+
+	if p.Len() != 2*peersIndexThreshold || p.index == nil {
+		t.Fatalf("Expected %d indexed peers, got %d", 2*peersIndexThreshold, p.Len())
+	}
+
+	p.Put(NewPeerKey(3, PeerID{}), &Peer{UserID: 33})
+
+	if peer, exists := p.Get(NewPeerKey(3, PeerID{})); !exists || peer.UserID != 33 || p.Len() != 2*peersIndexThreshold {
+		t.Fatalf("Expected peer to be replaced, got %v", peer)
+	}
+
+	for i := range uint32(2*peersIndexThreshold - 2) {
+		if !p.Delete(NewPeerKey(i, PeerID{})) {
+			t.Fatalf("Expected peer %d to be deleted", i)
+		}
+	}
+
+	if p.index != nil || p.Len() != 2 {
+		t.Fatalf("Expected index to be dropped with %d peers left", p.Len())
+	}
+
+	for _, i := range []uint32{2*peersIndexThreshold - 2, 2*peersIndexThreshold - 1} {
+		if peer, exists := p.Get(NewPeerKey(i, PeerID{})); !exists || peer.UserID != i {
+			t.Fatalf("Expected peer %d to be kept after removals, got %v", i, peer)
+		}
+	}
+
+	if p.Delete(NewPeerKey(0, PeerID{})) {
+		t.Fatalf("Expected deleted peer to be gone")
+	}
+}
+
+func testPeersDeleteFunc(t *testing.T) {
+	var p Peers
+
+	for i := range uint32(100) {
+		p.Put(NewPeerKey(i, PeerID{}), &Peer{UserID: i})
+	}
+
+	if n := p.DeleteFunc(func(_ PeerKey, peer *Peer) bool { return peer.UserID%3 != 0 }); n != 66 {
+		t.Fatalf("Expected 66 peers to be deleted, got %d", n)
+	}
+
+	for k, peer := range p.All() {
+		if peer.UserID%3 != 0 || k.ID() != peer.UserID {
+			t.Fatalf("Unexpected peer %v left under key %v", peer, k)
+		}
+
+		if found, exists := p.Get(k); !exists || found != peer {
+			t.Fatalf("Expected peer %v to be found after removals", peer)
+		}
+	}
+
+	if cap(p.peers) >= 100 {
+		t.Fatalf("Expected memory to be released, capacity is %d", cap(p.peers))
+	}
+
+	p.DeleteFunc(func(PeerKey, *Peer) bool { return true })
+
+	if p.Len() != 0 || p.peers != nil || p.index != nil {
+		t.Fatalf("Expected empty swarm to release memory")
+	}
+}
+
+func testPeersFrom(t *testing.T) {
+	var p Peers
+
+	for i := range uint32(5) {
+		p.Put(NewPeerKey(i, PeerID{}), &Peer{UserID: i})
+	}
+
+	var order []uint32
+	for _, peer := range p.From(3) {
+		order = append(order, peer.UserID)
+	}
+
+	if len(order) != 5 || order[0] != 3 || order[1] != 4 || order[2] != 0 || order[4] != 2 {
+		t.Fatalf("Expected iteration to wrap around, got %v", order)
+	}
+
+	order = order[:0]
+	for _, peer := range p.Stride(1, 3) {
+		order = append(order, peer.UserID)
+	}
+
+	if !slices.Equal(order, []uint32{1, 4, 2, 0, 3}) {
+		t.Fatalf("Expected iteration by step to visit every peer once, got %v", order)
+	}
+}
+
+func testPeersJSON(t *testing.T) {
+	p := NewPeers(map[PeerKey]*Peer{
+		NewPeerKey(1, PeerID{1}): {UserID: 1},
+		NewPeerKey(2, PeerID{2}): {UserID: 2},
+	})
+
+	buf, err := json.Marshal(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Peers
+
+	if err = json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalPeers(p, decoded) {
+		t.Fatalf("Expected peers %s to survive JSON round trip", buf)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	t.Run("PutGet", func(t *testing.T) {
+		testPeersPutGet(t)
+	})
+	t.Run("DeleteFunc", func(t *testing.T) {
+		testPeersDeleteFunc(t)
+	})
+	t.Run("From", func(t *testing.T) {
+		testPeersFrom(t)
+	})
+	t.Run("JSON", func(t *testing.T) {
+		testPeersJSON(t)
+	})
+}
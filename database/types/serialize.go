@@ -18,10 +18,10 @@
 package types
 
 import (
-	"bufio"
 	"encoding/binary"
 	"errors"
 	"io"
+	"iter"
 )
 
 type readerAndByteReader interface {
@@ -63,13 +63,10 @@ func LoadSerializeHeader(reader readerAndByteReader, maxSupportedVersion uint64)
 	return int(records), version, nil
 }
 
-func WriteTorrents(w io.Writer, torrents map[TorrentHash]*Torrent) error {
-	writer := bufio.NewWriterSize(w, 1024*64)
-	defer func(writer *bufio.Writer) {
-		_ = writer.Flush()
-	}(writer)
-
-	if err := WriteSerializeHeader(writer, len(torrents), TorrentCacheVersion); err != nil {
+// WriteTorrents Writes n torrents in given format; n has to match number of torrents yielded
+func WriteTorrents(w io.Writer, n int, torrents iter.Seq2[TorrentHash, *Torrent], format CacheFormat) error {
+	writer, err := newCacheWriter(w, format, TorrentCacheVersion, n)
+	if err != nil {
 		return err
 	}
 
@@ -80,27 +77,21 @@ func WriteTorrents(w io.Writer, torrents map[TorrentHash]*Torrent) error {
 		buf = append(buf, k[:]...)
 		buf = v.Append(buf)
 
-		if _, err := writer.Write(buf); err != nil {
+		if err = writer.write(buf); err != nil {
 			return err
 		}
 
 		preAllocatedBuffer = buf
 	}
 
-	return nil
+	return writer.close()
 }
 
+// LoadTorrents Reads torrents from cache file in any format; on error, torrents may be partially filled
 func LoadTorrents(r io.Reader, torrents map[TorrentHash]*Torrent) error {
-	reader := bufio.NewReader(r)
-
-	n, version, err := LoadSerializeHeader(reader, TorrentCacheVersion)
-	if err != nil {
-		return err
-	}
-
 	var k TorrentHash
 
-	for i := 0; i < n; i++ {
+	return readCache(r, TorrentCacheVersion, func(version uint64, reader readerAndByteReader) error {
 		if _, err := io.ReadFull(reader, k[:]); err != nil {
 			return err
 		}
@@ -112,18 +103,15 @@ func LoadTorrents(r io.Reader, torrents map[TorrentHash]*Torrent) error {
 		}
 
 		torrents[k] = t
-	}
 
-	return nil
+		return nil
+	})
 }
 
-func WriteUsers(w io.Writer, users map[string]*User) error {
-	writer := bufio.NewWriterSize(w, 1024*64)
-	defer func(writer *bufio.Writer) {
-		_ = writer.Flush()
-	}(writer)
-
-	if err := WriteSerializeHeader(writer, len(users), UserCacheVersion); err != nil {
+// WriteUsers Writes users in given format
+func WriteUsers(w io.Writer, users map[string]*User, format CacheFormat) error {
+	writer, err := newCacheWriter(w, format, UserCacheVersion, len(users))
+	if err != nil {
 		return err
 	}
 
@@ -135,28 +123,21 @@ func WriteUsers(w io.Writer, users map[string]*User) error {
 		buf = append(buf, k[:]...)
 		buf = v.Append(buf)
 
-		if _, err := writer.Write(buf); err != nil {
+		if err = writer.write(buf); err != nil {
 			return err
 		}
 
 		preAllocatedBuffer = buf
 	}
 
-	return nil
+	return writer.close()
 }
 
+// LoadUsers Reads users from cache file in any format; on error, users may be partially filled
 func LoadUsers(r io.Reader, users map[string]*User) error {
-	reader := bufio.NewReader(r)
-
-	n, version, err := LoadSerializeHeader(reader, UserCacheVersion)
-	if err != nil {
-		return err
-	}
-
-	var varIntLen uint64
-
-	for i := 0; i < n; i++ {
-		if varIntLen, err = binary.ReadUvarint(reader); err != nil {
+	return readCache(r, UserCacheVersion, func(version uint64, reader readerAndByteReader) error {
+		varIntLen, err := binary.ReadUvarint(reader)
+		if err != nil {
 			return err
 		}
 
@@ -167,12 +148,12 @@ func LoadUsers(r io.Reader, users map[string]*User) error {
 		}
 
 		u := &User{}
-		if err := u.Load(version, reader); err != nil {
+		if err = u.Load(version, reader); err != nil {
 			return err
 		}
 
 		users[string(buf)] = u
-	}
 
-	return nil
+		return nil
+	})
 }
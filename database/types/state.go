@@ -0,0 +1,310 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+)
+
+/*
+State Everything tracker loads from database besides torrents and users, kept in cache file so that tracker can serve
+announces from cache alone while database is unavailable. In cache file, every entry is single record starting with
+its kind.
+*/
+type State struct {
+	HitAndRuns            map[UserTorrentPair]struct{}
+	Clients               map[uint16]string
+	TorrentGroupFreeleech map[TorrentGroupKey]*TorrentGroupFreeleech
+	UsersFreeleech        map[UserTorrentPair]*UserFreeleech
+	FreeleechWindows      *FreeleechWindows
+	GlobalFreeleech       bool
+}
+
+// NewState Returns state with empty maps
+func NewState() *State {
+	return &State{
+		HitAndRuns:            make(map[UserTorrentPair]struct{}),
+		Clients:               make(map[uint16]string),
+		TorrentGroupFreeleech: make(map[TorrentGroupKey]*TorrentGroupFreeleech),
+		UsersFreeleech:        make(map[UserTorrentPair]*UserFreeleech),
+		FreeleechWindows:      &FreeleechWindows{Groups: make(map[TorrentGroupKey][]FreeleechWindow)},
+	}
+}
+
+// Kinds of state records
+const (
+	stateHitAndRun uint8 = iota + 1
+	stateClient
+	stateGroupFreeleech
+	stateUserFreeleech
+	stateFreeleechWindow
+	stateGlobalFreeleech
+)
+
+var errUnknownStateRecord = errors.New("unknown kind of state record")
+
+// StateCacheFile holds filename used by serializer for this type
+var StateCacheFile = "state-cache"
+
+// StateCacheVersion Used to distinguish old versions on the on-disk cache.
+// Bump when layout of any state record is altered
+const StateCacheVersion = 1
+
+// WriteState Writes state in given format
+func WriteState(w io.Writer, s *State, format CacheFormat) error {
+	n := len(s.HitAndRuns) + len(s.Clients) + len(s.TorrentGroupFreeleech) + len(s.UsersFreeleech) +
+		len(s.FreeleechWindows.Global) + 1
+
+	for _, windows := range s.FreeleechWindows.Groups {
+		n += len(windows)
+	}
+
+	writer, err := newCacheWriter(w, format, StateCacheVersion, n)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, 256)
+
+	write := func(kind uint8, values ...any) {
+		if err != nil {
+			return
+		}
+
+		buf = append(buf[:0], kind)
+
+		for _, v := range values {
+			if buf, err = binary.Append(buf, binary.LittleEndian, v); err != nil {
+				return
+			}
+		}
+
+		err = writer.write(buf)
+	}
+
+	for pair := range s.HitAndRuns {
+		write(stateHitAndRun, pair)
+	}
+
+	for id, peerID := range s.Clients {
+		write(stateClient, id, uint16(len(peerID)), []byte(peerID)) //nolint:gosec
+	}
+
+	for k, freeleech := range s.TorrentGroupFreeleech {
+		write(stateGroupFreeleech, k, freeleech)
+	}
+
+	for pair, freeleech := range s.UsersFreeleech {
+		write(stateUserFreeleech, pair, freeleech)
+	}
+
+	// Global windows are stored under zero key, which no torrent group can have
+	for _, window := range s.FreeleechWindows.Global {
+		write(stateFreeleechWindow, TorrentGroupKey{}, window)
+	}
+
+	for k, windows := range s.FreeleechWindows.Groups {
+		for _, window := range windows {
+			write(stateFreeleechWindow, k, window)
+		}
+	}
+
+	write(stateGlobalFreeleech, s.GlobalFreeleech)
+
+	if err != nil {
+		return err
+	}
+
+	return writer.close()
+}
+
+// LoadState Reads state from cache file in any format into s (see NewState); on error, s may be partially filled
+func LoadState(r io.Reader, s *State) error {
+	return readCache(r, StateCacheVersion, func(_ uint64, reader readerAndByteReader) error {
+		kind, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case stateHitAndRun:
+			var pair UserTorrentPair
+
+			err = binary.Read(reader, binary.LittleEndian, &pair)
+			s.HitAndRuns[pair] = struct{}{}
+		case stateClient:
+			var id, length uint16
+
+			if err = binary.Read(reader, binary.LittleEndian, &id); err != nil {
+				return err
+			}
+
+			if err = binary.Read(reader, binary.LittleEndian, &length); err != nil {
+				return err
+			}
+
+			peerID := make([]byte, length)
+			_, err = io.ReadFull(reader, peerID)
+			s.Clients[id] = string(peerID)
+		case stateGroupFreeleech:
+			var (
+				k         TorrentGroupKey
+				freeleech TorrentGroupFreeleech
+			)
+
+			err = binary.Read(reader, binary.LittleEndian, &k)
+			if err == nil {
+				err = binary.Read(reader, binary.LittleEndian, &freeleech)
+			}
+
+			s.TorrentGroupFreeleech[k] = &freeleech
+		case stateUserFreeleech:
+			var (
+				pair      UserTorrentPair
+				freeleech UserFreeleech
+			)
+
+			err = binary.Read(reader, binary.LittleEndian, &pair)
+			if err == nil {
+				err = binary.Read(reader, binary.LittleEndian, &freeleech)
+			}
+
+			s.UsersFreeleech[pair] = &freeleech
+		case stateFreeleechWindow:
+			var (
+				k      TorrentGroupKey
+				window FreeleechWindow
+			)
+
+			err = binary.Read(reader, binary.LittleEndian, &k)
+			if err == nil {
+				err = binary.Read(reader, binary.LittleEndian, &window)
+			}
+
+			if k == (TorrentGroupKey{}) {
+				s.FreeleechWindows.Global = append(s.FreeleechWindows.Global, window)
+			} else {
+				s.FreeleechWindows.Groups[k] = append(s.FreeleechWindows.Groups[k], window)
+			}
+		case stateGlobalFreeleech:
+			err = binary.Read(reader, binary.LittleEndian, &s.GlobalFreeleech)
+		default:
+			return errUnknownStateRecord
+		}
+
+		return err
+	})
+}
+
+type stateJSON struct {
+	HitAndRuns            []UserTorrentPair
+	Clients               map[uint16]string
+	TorrentGroupFreeleech []groupFreeleechJSON
+	UsersFreeleech        []userFreeleechJSON
+	FreeleechWindows      []freeleechWindowJSON
+	GlobalFreeleech       bool
+}
+
+type groupFreeleechJSON struct {
+	Key TorrentGroupKey
+	TorrentGroupFreeleech
+}
+
+type userFreeleechJSON struct {
+	UserTorrentPair
+	UserFreeleech
+}
+
+// freeleechWindowJSON Window of torrent group, or global window if Key is zero
+type freeleechWindowJSON struct {
+	Key TorrentGroupKey
+	FreeleechWindow
+}
+
+// MarshalJSON Maps keyed by structs are written as lists, as JSON only allows string keys
+func (s *State) MarshalJSON() ([]byte, error) {
+	v := stateJSON{
+		HitAndRuns:      slices.Collect(maps.Keys(s.HitAndRuns)),
+		Clients:         s.Clients,
+		GlobalFreeleech: s.GlobalFreeleech,
+	}
+
+	for k, freeleech := range s.TorrentGroupFreeleech {
+		v.TorrentGroupFreeleech = append(v.TorrentGroupFreeleech, groupFreeleechJSON{k, *freeleech})
+	}
+
+	for pair, freeleech := range s.UsersFreeleech {
+		v.UsersFreeleech = append(v.UsersFreeleech, userFreeleechJSON{pair, *freeleech})
+	}
+
+	for _, window := range s.FreeleechWindows.Global {
+		v.FreeleechWindows = append(v.FreeleechWindows, freeleechWindowJSON{FreeleechWindow: window})
+	}
+
+	for k, windows := range s.FreeleechWindows.Groups {
+		for _, window := range windows {
+			v.FreeleechWindows = append(v.FreeleechWindows, freeleechWindowJSON{k, window})
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON Reverses MarshalJSON
+func (s *State) UnmarshalJSON(buf []byte) error {
+	var v stateJSON
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+
+	*s = *NewState()
+
+	for _, pair := range v.HitAndRuns {
+		s.HitAndRuns[pair] = struct{}{}
+	}
+
+	for id, peerID := range v.Clients {
+		s.Clients[id] = peerID
+	}
+
+	for _, freeleech := range v.TorrentGroupFreeleech {
+		s.TorrentGroupFreeleech[freeleech.Key] = &freeleech.TorrentGroupFreeleech
+	}
+
+	for _, freeleech := range v.UsersFreeleech {
+		s.UsersFreeleech[freeleech.UserTorrentPair] = &freeleech.UserFreeleech
+	}
+
+	for _, window := range v.FreeleechWindows {
+		if window.Key == (TorrentGroupKey{}) {
+			s.FreeleechWindows.Global = append(s.FreeleechWindows.Global, window.FreeleechWindow)
+		} else {
+			s.FreeleechWindows.Groups[window.Key] = append(s.FreeleechWindows.Groups[window.Key],
+				window.FreeleechWindow)
+		}
+	}
+
+	s.GlobalFreeleech = v.GlobalFreeleech
+
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func stateTestData() *State {
+	s := NewState()
+
+	groupKey := MustTorrentGroupKeyFromString("anime", 42)
+
+	s.HitAndRuns[UserTorrentPair{UserID: 1, TorrentID: 2}] = struct{}{}
+	s.HitAndRuns[UserTorrentPair{UserID: 3, TorrentID: 4}] = struct{}{}
+	s.Clients[1] = "-TR2"
+	s.Clients[2] = "-qB4"
+	s.TorrentGroupFreeleech[groupKey] = &TorrentGroupFreeleech{UpMultiplier: 2, DownMultiplier: 0}
+	s.UsersFreeleech[UserTorrentPair{UserID: 1, TorrentID: 5}] = &UserFreeleech{DownMultiplier: 0.5, Expiry: 100}
+	s.FreeleechWindows.Global = []FreeleechWindow{{Start: 10, End: 20, UpMultiplier: 1}}
+	s.FreeleechWindows.Groups[groupKey] = []FreeleechWindow{{Start: 30, End: 40, UpMultiplier: 1.5}}
+	s.GlobalFreeleech = true
+
+	return s
+}
+
+func TestState(t *testing.T) {
+	s := stateTestData()
+
+	for _, format := range []CacheFormat{CacheFormatFramed, CacheFormatZstd, CacheFormatLegacy} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+
+			if err := WriteState(&buf, s, format); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded := NewState()
+			if err := LoadState(&buf, loaded); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(s, loaded) {
+				t.Fatalf("State changed after round trip: %s", cmp.Diff(s, loaded))
+			}
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		buf, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var loaded *State
+		if err = json.Unmarshal(buf, &loaded); err != nil {
+			t.Fatal(err)
+		}
+
+		if !cmp.Equal(s, loaded) {
+			t.Fatalf("State changed after json round trip: %s", cmp.Diff(s, loaded))
+		}
+	})
+}
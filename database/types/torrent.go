@@ -124,13 +124,16 @@ func (h *TorrentHash) UnmarshalText(b []byte) error {
 }
 
 type Torrent struct {
-	Seeders  map[PeerKey]*Peer
-	Leechers map[PeerKey]*Peer
+	Seeders  Peers
+	Leechers Peers
 
 	// SeedersLength Contains the length of Seeders. When Seeders is modified this field must be updated
 	SeedersLength atomic.Uint32
 	// LeechersLength Contains the length of Leechers. When LeechersLength is modified this field must be updated
 	LeechersLength atomic.Uint32
+	/* PartialSeedsLength Contains the number of Leechers which are partial seeds. When Leechers or PartialSeed
+	of any of them is modified this field must be updated */
+	PartialSeedsLength atomic.Uint32
 
 	Group TorrentGroup
 	ID    atomic.Uint32
@@ -160,6 +163,46 @@ func (t *Torrent) PeerUnlock() {
 	t.peerLock.Unlock()
 }
 
+// Downloaders Returns number of leechers which are actively downloading, that is ones which are not partial seeds
+func (t *Torrent) Downloaders() int {
+	return max(int(t.LeechersLength.Load())-int(t.PartialSeedsLength.Load()), 0)
+}
+
+// SetPartialSeed Updates PartialSeed of leecher along with PartialSeedsLength; torrent peers must be locked
+func (t *Torrent) SetPartialSeed(leecher *Peer, partialSeed bool) {
+	if leecher.PartialSeed == partialSeed {
+		return
+	}
+
+	leecher.PartialSeed = partialSeed
+
+	if partialSeed {
+		t.PartialSeedsLength.Add(1)
+	} else {
+		t.PartialSeedsLength.Add(^uint32(0))
+	}
+}
+
+// LeecherRemoved Updates PartialSeedsLength after leecher was removed from Leechers; torrent peers must be locked
+func (t *Torrent) LeecherRemoved(leecher *Peer) {
+	if leecher.PartialSeed {
+		t.PartialSeedsLength.Add(^uint32(0))
+	}
+}
+
+// countPartialSeeds Recounts PartialSeedsLength from scratch, used only when Leechers are replaced as whole
+func (t *Torrent) countPartialSeeds() {
+	var n uint32
+
+	for _, leecher := range t.Leechers.All() {
+		if leecher.PartialSeed {
+			n++
+		}
+	}
+
+	t.PartialSeedsLength.Store(n)
+}
+
 func (t *Torrent) Load(version uint64, reader readerAndByteReader) (err error) {
 	var (
 		id                           uint32
@@ -175,7 +218,7 @@ func (t *Torrent) Load(version uint64, reader readerAndByteReader) (err error) {
 		return err
 	}
 
-	t.Seeders = make(map[PeerKey]*Peer, varIntLen)
+	t.Seeders.Clear()
 
 	var k PeerKey
 	for i := uint64(0); i < varIntLen; i++ {
@@ -189,16 +232,16 @@ func (t *Torrent) Load(version uint64, reader readerAndByteReader) (err error) {
 			return err
 		}
 
-		t.Seeders[k] = s
+		t.Seeders.Put(k, s)
 	}
 
-	t.SeedersLength.Store(uint32(len(t.Seeders)))
+	t.SeedersLength.Store(uint32(t.Seeders.Len()))
 
 	if varIntLen, err = binary.ReadUvarint(reader); err != nil {
 		return err
 	}
 
-	t.Leechers = make(map[PeerKey]*Peer, varIntLen)
+	t.Leechers.Clear()
 
 	for i := uint64(0); i < varIntLen; i++ {
 		if _, err = io.ReadFull(reader, k[:]); err != nil {
@@ -211,10 +254,11 @@ func (t *Torrent) Load(version uint64, reader readerAndByteReader) (err error) {
 			return err
 		}
 
-		t.Leechers[k] = l
+		t.Leechers.Put(k, l)
 	}
 
-	t.LeechersLength.Store(uint32(len(t.Leechers)))
+	t.LeechersLength.Store(uint32(t.Leechers.Len()))
+	t.countPartialSeeds()
 
 	if err = t.Group.Load(version, reader); err != nil {
 		return err
@@ -261,17 +305,17 @@ func (t *Torrent) Append(preAllocatedBuffer []byte) (buf []byte) {
 		t.PeerLock()
 		defer t.PeerUnlock()
 
-		buf = binary.AppendUvarint(buf, uint64(len(t.Seeders)))
+		buf = binary.AppendUvarint(buf, uint64(t.Seeders.Len()))
 
-		for k, s := range t.Seeders {
+		for k, s := range t.Seeders.All() {
 			buf = append(buf, k[:]...)
 
 			buf = s.Append(buf)
 		}
 
-		buf = binary.AppendUvarint(buf, uint64(len(t.Leechers)))
+		buf = binary.AppendUvarint(buf, uint64(t.Leechers.Len()))
 
-		for k, l := range t.Leechers {
+		for k, l := range t.Leechers.All() {
 			buf = append(buf, k[:]...)
 
 			buf = l.Append(buf)
@@ -297,8 +341,8 @@ var encodeJSONTorrentGroupMap = make(map[string]any)
 // This is only safe to call from a single thread at once
 func (t *Torrent) MarshalJSON() (buf []byte, err error) {
 	encodeJSONTorrentMap["ID"] = t.ID.Load()
-	encodeJSONTorrentMap["Seeders"] = t.Seeders
-	encodeJSONTorrentMap["Leechers"] = t.Leechers
+	encodeJSONTorrentMap["Seeders"] = &t.Seeders
+	encodeJSONTorrentMap["Leechers"] = &t.Leechers
 
 	var torrentTypeBuf [8]byte
 
@@ -349,10 +393,11 @@ func (t *Torrent) UnmarshalJSON(buf []byte) (err error) {
 		return err
 	}
 
-	t.Seeders = torrentJSON.Seeders
-	t.Leechers = torrentJSON.Leechers
-	t.SeedersLength.Store(uint32(len(t.Seeders)))
-	t.LeechersLength.Store(uint32(len(t.Leechers)))
+	t.Seeders = NewPeers(torrentJSON.Seeders)
+	t.Leechers = NewPeers(torrentJSON.Leechers)
+	t.SeedersLength.Store(uint32(t.Seeders.Len()))
+	t.LeechersLength.Store(uint32(t.Leechers.Len()))
+	t.countPartialSeeds()
 
 	torrentType, err := TorrentTypeFromString(torrentJSON.Group.TorrentType)
 	if err != nil {
@@ -484,7 +529,7 @@ var TorrentCacheFile = "torrent-cache"
 
 // TorrentCacheVersion Used to distinguish old versions on the on-disk cache.
 // Bump when fields are altered on Torrent, Peer or TorrentGroup structs
-const TorrentCacheVersion = 3
+const TorrentCacheVersion = 6
 
 var TorrentTestCompareOptions = []cmp.Option{
 	cmp.AllowUnexported(atomic.Uint32{}),
@@ -492,4 +537,20 @@ var TorrentTestCompareOptions = []cmp.Option{
 	cmp.AllowUnexported(atomic.Int64{}),
 	cmp.AllowUnexported(atomic.Bool{}),
 	cmpopts.IgnoreFields(Torrent{}, "peerLock"),
+	cmp.Comparer(equalPeers),
+}
+
+// equalPeers Compares swarms regardless of order of their peers
+func equalPeers(a, b Peers) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+
+	for k, peer := range a.All() {
+		if other, exists := b.Get(k); !exists || *other != *peer {
+			return false
+		}
+	}
+
+	return true
 }
@@ -0,0 +1,168 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"iter"
+	"maps"
+	"sync/atomic"
+)
+
+// TorrentShardCount Number of shards of TorrentIndex; info hashes are uniformly distributed, so first byte selects one
+const TorrentShardCount = 256
+
+// TorrentShards Torrents split into maps the same way as in TorrentIndex, used to replace whole index at once
+type TorrentShards [TorrentShardCount]map[TorrentHash]*Torrent
+
+// NewTorrentShards Splits given torrents into shards
+func NewTorrentShards(torrents map[TorrentHash]*Torrent) *TorrentShards {
+	var s TorrentShards
+
+	for h, t := range torrents {
+		s.Put(h, t)
+	}
+
+	return &s
+}
+
+func (s *TorrentShards) Put(h TorrentHash, t *Torrent) {
+	shard := s[h[0]]
+	if shard == nil {
+		shard = make(map[TorrentHash]*Torrent)
+		s[h[0]] = shard
+	}
+
+	shard[h] = t
+}
+
+func (s *TorrentShards) Len() (n int) {
+	for _, shard := range s {
+		n += len(shard)
+	}
+
+	return n
+}
+
+func (s *TorrentShards) All() iter.Seq2[TorrentHash, *Torrent] {
+	return func(yield func(TorrentHash, *Torrent) bool) {
+		for _, shard := range s {
+			for h, t := range shard {
+				if !yield(h, t) {
+					return
+				}
+			}
+		}
+	}
+}
+
+/*
+TorrentIndex Maps info hashes to torrents. Each shard is immutable map which is replaced as whole on change, so that
+lookups never take lock and changes only copy shards they affect instead of all torrents. Writers have to be
+serialized by caller.
+*/
+type TorrentIndex struct {
+	shards [TorrentShardCount]atomic.Pointer[map[TorrentHash]*Torrent]
+}
+
+func (idx *TorrentIndex) Get(h TorrentHash) (*Torrent, bool) {
+	shard := idx.shards[h[0]].Load()
+	if shard == nil {
+		return nil, false
+	}
+
+	t, exists := (*shard)[h]
+
+	return t, exists
+}
+
+// Snapshot Returns current content of index; shards are shared with index and must not be modified
+func (idx *TorrentIndex) Snapshot() *TorrentShards {
+	var s TorrentShards
+
+	for i := range idx.shards {
+		if shard := idx.shards[i].Load(); shard != nil {
+			s[i] = *shard
+		}
+	}
+
+	return &s
+}
+
+func (idx *TorrentIndex) Len() int {
+	return idx.Snapshot().Len()
+}
+
+// All Iterates over all torrents; changes made meanwhile may or may not be seen, depending on shard they affect
+func (idx *TorrentIndex) All() iter.Seq2[TorrentHash, *Torrent] {
+	return func(yield func(TorrentHash, *Torrent) bool) {
+		for i := range idx.shards {
+			shard := idx.shards[i].Load()
+			if shard == nil {
+				continue
+			}
+
+			for h, t := range *shard {
+				if !yield(h, t) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Store Replaces content of index with given shards, which must not be modified afterward
+func (idx *TorrentIndex) Store(s *TorrentShards) {
+	for i := range idx.shards {
+		shard := s[i]
+		if shard == nil {
+			shard = make(map[TorrentHash]*Torrent)
+		}
+
+		idx.shards[i].Store(&shard)
+	}
+}
+
+// Update Adds, replaces or (for nil values) removes given torrents, copying only shards which are affected
+func (idx *TorrentIndex) Update(changes map[TorrentHash]*Torrent) {
+	var updated TorrentShards
+
+	for h, t := range changes {
+		shard := updated[h[0]]
+		if shard == nil {
+			if current := idx.shards[h[0]].Load(); current != nil {
+				shard = maps.Clone(*current)
+			} else {
+				shard = make(map[TorrentHash]*Torrent)
+			}
+
+			updated[h[0]] = shard
+		}
+
+		if t == nil {
+			delete(shard, h)
+		} else {
+			shard[h] = t
+		}
+	}
+
+	for i, shard := range updated {
+		if shard != nil {
+			idx.shards[i].Store(&shard)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"testing"
+)
+
+func TestTorrentIndex(t *testing.T) {
+	var (
+		idx TorrentIndex
+
+		a, b, c = TorrentHash{1, 1}, TorrentHash{1, 2}, TorrentHash{2, 1}
+		ta, tb  = &Torrent{}, &Torrent{}
+	)
+
+	if _, exists := idx.Get(a); exists || idx.Len() != 0 {
+		t.Fatalf("Expected empty index")
+	}
+
+	idx.Store(NewTorrentShards(map[TorrentHash]*Torrent{a: ta, c: tb}))
+
+	if torrent, exists := idx.Get(a); !exists || torrent != ta || idx.Len() != 2 {
+		t.Fatalf("Expected stored torrent to be found")
+	}
+
+	untouched := idx.shards[2].Load()
+
+	idx.Update(map[TorrentHash]*Torrent{a: nil, b: tb})
+
+	if _, exists := idx.Get(a); exists {
+		t.Fatalf("Expected removed torrent to be gone")
+	}
+
+	if torrent, exists := idx.Get(b); !exists || torrent != tb || idx.Len() != 2 {
+		t.Fatalf("Expected added torrent to be found")
+	}
+
+	if idx.shards[2].Load() != untouched {
+		t.Fatalf("Expected unaffected shard not to be copied")
+	}
+
+	snapshot := idx.Snapshot()
+
+	idx.Update(map[TorrentHash]*Torrent{c: nil})
+
+	if snapshot.Len() != 2 || idx.Len() != 1 {
+		t.Fatalf("Expected snapshot not to see later changes")
+	}
+}
@@ -139,6 +139,13 @@ type UserTorrentPair struct {
 	TorrentID uint32
 }
 
+// UserFreeleech Multipliers applying to single user on single torrent (personal freeleech tokens) until Expiry
+type UserFreeleech struct {
+	UpMultiplier   float64
+	DownMultiplier float64
+	Expiry         int64
+}
+
 // UserCacheFile holds filename used by serializer for this type
 var UserCacheFile = "user-cache"
 
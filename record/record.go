@@ -15,105 +15,170 @@
  * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
  */
 
+// Package record writes log of announces as JSON lines, one event per line
 package record
 
 import (
-	"bytes"
-	"fmt"
-	"os"
-	"strconv"
+	"log/slog"
 	"sync"
 	"time"
 
+	"chihaya/collector"
 	"chihaya/config"
 	cdb "chihaya/database/types"
 )
 
+// FormatVersion Stored in every event; bump when meaning of existing fields changes or fields are removed
+const FormatVersion = 1
+
+// Event Single announce as stored in event log
+type Event struct {
+	Version int   `json:"v"`
+	Time    int64 `json:"time"` // unix time
+
+	TorrentID uint32           `json:"torrent_id"`
+	UserID    uint32           `json:"user_id"`
+	PeerID    cdb.PeerID       `json:"peer_id"`
+	ClientID  uint16           `json:"client_id"`
+	Addr      cdb.PeerAddress  `json:"addr,omitzero"`
+	Addr6     cdb.PeerAddress6 `json:"addr6,omitzero"`
+	Event     string           `json:"event"`
+
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+	Left       uint64 `json:"left"`
+
+	// RawDeltaUp and RawDeltaDown Transfer since previous announce as reported by peer
+	RawDeltaUp   int64 `json:"raw_delta_up"`
+	RawDeltaDown int64 `json:"raw_delta_down"`
+	// DeltaUp and DeltaDown Transfer credited to user after applying multipliers (and anticheat)
+	DeltaUp   int64 `json:"delta_up"`
+	DeltaDown int64 `json:"delta_down"`
+
+	UpMultiplier   float64 `json:"up_multiplier"`
+	DownMultiplier float64 `json:"down_multiplier"`
+}
+
 var (
 	enabled = false // overrides default, for testing purposes only
-	header  = "TorrentID,UserID,Addr,Event,Uploaded,Downloaded,Left"
-	channel chan []byte
+
+	dir           string
+	bufferSize    int
+	flushInterval time.Duration
+	maxSize       int64
+	maxAge        time.Duration
+	retention     time.Duration
+	compress      bool
 )
 
-func filename(t time.Time) string {
-	return "events/events_" + t.Format("2006-01-02T15") + ".csv"
+func init() {
+	enabled, _ = config.GetBool("record_announces", enabled)
+
+	recordConfig := config.Section("record")
+
+	dir, _ = recordConfig.Get("dir", "events")
+	bufferSize, _ = recordConfig.GetInt("buffer", 65536)
+	flushIntervalMs, _ := recordConfig.GetInt("flush_interval", 1000)
+	maxSizeMiB, _ := recordConfig.GetInt("max_size", 256)
+	maxAgeSeconds, _ := recordConfig.GetInt("max_age", 3600)
+	retentionSeconds, _ := recordConfig.GetInt("retention", 30*24*3600)
+	compress, _ = recordConfig.GetBool("compress", true)
+
+	flushInterval = time.Duration(flushIntervalMs) * time.Millisecond
+	maxSize = int64(maxSizeMiB) << 20
+	maxAge = time.Duration(maxAgeSeconds) * time.Second
+	retention = time.Duration(retentionSeconds) * time.Second
 }
 
+var (
+	events *ring
+	stop   chan struct{}
+	done   chan struct{}
+)
+
 var initialize = sync.OnceFunc(func() {
-	if err := os.Mkdir("events", 0755); err != nil && !os.IsExist(err) {
-		panic(err)
+	events = newRing(bufferSize)
+	stop, done = make(chan struct{}), make(chan struct{})
+
+	go run(newWriter(dir, maxSize, maxAge, retention, compress))
+})
+
+/*
+Record Queues event to be written to event log. It never blocks: if writer can not keep up and buffer is full, event
+is dropped and counted in metrics instead
+*/
+func Record(e Event) {
+	if !enabled {
+		return
 	}
 
-	start := time.Now()
-	channel = make(chan []byte)
+	initialize()
+
+	e.Version = FormatVersion
+
+	if !events.push(&e) {
+		collector.IncrementRecordDropped("overflow", 1)
+	}
+}
 
-	file, err := os.OpenFile(filename(start), os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		panic(err)
+// Close Writes out all queued events and closes event log; events recorded afterwards are dropped
+func Close() {
+	if !enabled || events == nil {
+		return
 	}
 
-	if _, err = fmt.Fprintln(file, header); err != nil {
-		panic(err)
+	select {
+	case <-stop:
+	default:
+		close(stop)
 	}
 
-	go func() {
-		for buf := range channel {
-			now := time.Now()
-			if now.Hour() != start.Hour() {
-				start = now
+	<-done
+}
 
-				if err = file.Close(); err != nil {
-					panic(err)
-				}
+// run Drains queued events into writer in batches, once per flushInterval, until Close is called
+func run(w *writer) {
+	defer close(done)
 
-				file, err = os.OpenFile(filename(start), os.O_WRONLY|os.O_CREATE, 0644)
-				if err != nil {
-					panic(err)
-				}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
 
-				if _, err = fmt.Fprintln(file, header); err != nil {
-					panic(err)
-				}
-			}
+	var e Event
 
-			if _, err = file.Write(buf); err != nil {
-				panic(err)
+	for {
+		stopping := false
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			stopping = true
+		}
+
+		now := time.Now()
+
+		for events.pop(&e) {
+			if err := w.write(&e, now); err != nil {
+				slog.Error("failed to write event log", "err", err)
+				collector.IncrementRecordDropped("error", 1)
+
+				w.discard()
 			}
 		}
-	}()
-})
 
-func Record(tid, uid uint32, addr cdb.PeerAddress, event string, up, down, left uint64) {
-	if enabled, _ := config.GetBool("record_announces", enabled); !enabled {
-		return
-	}
+		if written, err := w.flush(now); err != nil {
+			slog.Error("failed to flush event log", "err", err)
 
-	if up == 0 && down == 0 {
-		return
-	}
+			w.discard()
+		} else {
+			collector.IncrementRecordedEvents(written)
+		}
 
-	// TODO: rewrite this so it doesn't tank performance
-	go func() {
-		initialize()
-
-		b := make([]byte, 0, 64)
-		buf := bytes.NewBuffer(b)
-
-		buf.WriteString(strconv.FormatUint(uint64(tid), 10))
-		buf.WriteString(",")
-		buf.WriteString(strconv.FormatUint(uint64(uid), 10))
-		buf.WriteString(",")
-		buf.WriteString(addr.IPString() + ":" + strconv.FormatUint(uint64(addr.Port()), 10))
-		buf.WriteString(",")
-		buf.WriteString(event)
-		buf.WriteString(",")
-		buf.WriteString(strconv.FormatUint(up, 10))
-		buf.WriteString(",")
-		buf.WriteString(strconv.FormatUint(down, 10))
-		buf.WriteString(",")
-		buf.WriteString(strconv.FormatUint(left, 10))
-		buf.WriteByte('\n')
-
-		channel <- buf.Bytes()
-	}()
+		if stopping {
+			if err := w.close(); err != nil {
+				slog.Error("failed to close event log", "err", err)
+			}
+
+			return
+		}
+	}
 }
@@ -19,10 +19,14 @@ package record
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
 	"net/netip"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -30,13 +34,6 @@ import (
 	"chihaya/util"
 )
 
-type record struct {
-	port           uint16
-	uid, tid       uint32
-	up, down, left uint64
-	event, ip      string
-}
-
 func TestMain(m *testing.M) {
 	path, err := os.MkdirTemp(os.TempDir(), "chihaya_record-*")
 	if err != nil {
@@ -52,94 +49,236 @@ func TestMain(m *testing.M) {
 	}
 
 	enabled = true // force-enable for tests
+	flushInterval = 10 * time.Millisecond
 
 	os.Exit(m.Run())
 }
 
-func TestRecord(t *testing.T) {
-	var (
-		values  []record
-		outputs []string
-	)
+func randomEvent() Event {
+	return Event{
+		Version:      FormatVersion,
+		Time:         time.Now().Unix(),
+		TorrentID:    util.UnsafeUint32(),
+		UserID:       util.UnsafeUint32(),
+		PeerID:       cdb.PeerIDFromRawString("-TR2940-000000000000"),
+		ClientID:     uint16(util.UnsafeUint32()),
+		Addr:         cdb.NewPeerAddressFromAddrPort(netip.MustParseAddr("127.0.0.1"), uint16(util.UnsafeUint32())),
+		Event:        "completed",
+		Uploaded:     util.UnsafeUint64(),
+		Downloaded:   util.UnsafeUint64(),
+		Left:         util.UnsafeUint64(),
+		RawDeltaUp:   int64(util.UnsafeUint32()),
+		RawDeltaDown: int64(util.UnsafeUint32()),
+		DeltaUp:      int64(util.UnsafeUint32()),
+		UpMultiplier: 0.5,
+	}
+}
 
-	for i := 0; i < 10; i++ {
-		entry := record{
-			uint16(util.UnsafeUint32()),
-			util.UnsafeUint32(),
-			util.UnsafeUint32(),
-			util.UnsafeUint64(),
-			util.UnsafeUint64(),
-			util.UnsafeUint64(),
-			"completed",
-			"127.0.0.1",
-		}
-		values = append(values, entry)
-		outputs = append(
-			outputs,
-			strings.Join([]string{
-				strconv.FormatUint(uint64(entry.tid), 10),
-				strconv.FormatUint(uint64(entry.uid), 10),
-				entry.ip + ":" + strconv.FormatUint(uint64(entry.port), 10),
-				entry.event,
-				strconv.FormatUint(entry.up, 10),
-				strconv.FormatUint(entry.down, 10),
-				strconv.FormatUint(entry.left, 10),
-			}, ","),
-		)
-	}
-
-	for _, entry := range values {
-		Record(
-			entry.tid,
-			entry.uid,
-			cdb.NewPeerAddressFromAddrPort(netip.MustParseAddr(entry.ip), entry.port),
-			entry.event,
-			entry.up,
-			entry.down,
-			entry.left)
-	}
-
-	time.Sleep(200 * time.Millisecond)
-
-	// In theory, below line can fail if this line was called in a different hour than when the file was made
-	// In practice, this would never occur since the file should be made fast enough for it to be in same error.
-	file, err := os.OpenFile(filename(time.Now()), os.O_RDONLY, 0644)
+func readEvents(t *testing.T, name string) (events []Event) {
+	file, err := os.Open(name)
 	if err != nil {
 		t.Fatalf("Faced error in opening file: %s", err)
 	}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var reader io.Reader = file
+
+	if strings.HasSuffix(name, compressSuffix) {
+		if reader, err = gzip.NewReader(file); err != nil {
+			t.Fatalf("Faced error in decompressing file: %s", err)
+		}
+	}
 
-	var recordLines []string
+	scanner := bufio.NewScanner(reader)
 
 	for scanner.Scan() {
-		recordLines = append(recordLines, scanner.Text())
+		var e Event
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Faced error in decoding line %q: %s", scanner.Text(), err)
+		}
+
+		events = append(events, e)
 	}
 
 	if err = scanner.Err(); err != nil {
 		t.Fatalf("Faced error in reading: %s", err)
 	}
 
-	if len(outputs)+1 != len(recordLines) {
-		t.Fatalf("The number of lines in record log do not match with what is expected! (expected %d, got %d)",
-			len(outputs)+1, len(recordLines))
+	return events
+}
+
+func testRing(t *testing.T) {
+	r := newRing(3)
+
+	if len(r.slots) != 4 {
+		t.Fatalf("Expected ring size to be rounded up to %d, got %d", 4, len(r.slots))
 	}
 
-	if recordLines[0] != header {
-		t.Fatalf("Incorrect header in record log (expected %q, got %+q)", header, recordLines[0])
+	var e Event
+
+	for lap := 0; lap < 3; lap++ {
+		for i := 0; i < 4; i++ {
+			if !r.push(&Event{TorrentID: uint32(i)}) {
+				t.Fatalf("Expected push %d to succeed", i)
+			}
+		}
+
+		if r.push(&Event{}) {
+			t.Fatalf("Expected push into full ring to fail")
+		}
+
+		for i := 0; i < 4; i++ {
+			if !r.pop(&e) || e.TorrentID != uint32(i) {
+				t.Fatalf("Expected to pop event %d, got %+v", i, e)
+			}
+		}
+
+		if r.pop(&e) {
+			t.Fatalf("Expected pop from empty ring to fail")
+		}
 	}
+}
+
+func testRingConcurrent(t *testing.T) {
+	const producers, perProducer = 8, 1000
+
+	r := newRing(64)
+
+	var wg sync.WaitGroup
+
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
 
-	for _, recordLine := range recordLines[1:] {
-		for i := range outputs {
-			if outputs[i] == recordLine {
-				outputs = append(outputs[:i], outputs[i+1:]...)
-				break
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < perProducer; i++ {
+				for !r.push(&Event{TorrentID: uint32(p)}) {
+					time.Sleep(time.Microsecond)
+				}
 			}
+		}()
+	}
+
+	var (
+		e      Event
+		counts [producers]int
+	)
+
+	for received := 0; received < producers*perProducer; {
+		if r.pop(&e) {
+			counts[e.TorrentID]++
+			received++
 		}
 	}
 
-	for _, output := range outputs {
-		t.Fatalf("Expected to find line %q in record log (got %+q)", output, recordLines[1:])
+	wg.Wait()
+
+	for p, count := range counts {
+		if count != perProducer {
+			t.Fatalf("Expected %d events from producer %d, got %d", perProducer, p, count)
+		}
 	}
 }
+
+func testWriterRotation(t *testing.T) {
+	path := t.TempDir()
+
+	w := newWriter(path, 1, 0, time.Hour, true)
+	now := time.Now()
+
+	// Every event is over max size, so each one ends up in its own file
+	for i := 0; i < 3; i++ {
+		e := randomEvent()
+
+		if err := w.write(&e, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("Faced error in writing: %s", err)
+		}
+	}
+
+	if err := w.close(); err != nil {
+		t.Fatalf("Faced error in closing: %s", err)
+	}
+
+	compressed, _ := filepath.Glob(filepath.Join(path, filePrefix+"*"+fileSuffix+compressSuffix))
+	plain, _ := filepath.Glob(filepath.Join(path, filePrefix+"*"+fileSuffix))
+
+	if len(compressed) != 2 || len(plain) != 1 {
+		t.Fatalf("Expected 2 compressed files and 1 current file, got %v and %v", compressed, plain)
+	}
+
+	for _, name := range append(compressed, plain...) {
+		if events := readEvents(t, name); len(events) != 1 {
+			t.Fatalf("Expected single event in %s, got %d", name, len(events))
+		}
+	}
+
+	// Rotated files older than retention are removed
+	old := now.Add(-2 * time.Hour)
+	if err := os.Chtimes(compressed[0], old, old); err != nil {
+		panic(err)
+	}
+
+	w.removeExpired(now)
+
+	if _, err := os.Stat(compressed[0]); !os.IsNotExist(err) {
+		t.Fatalf("Expected expired file %s to be removed", compressed[0])
+	}
+
+	if _, err := os.Stat(compressed[1]); err != nil {
+		t.Fatalf("Expected file %s to be kept, got %s", compressed[1], err)
+	}
+}
+
+func testRecord(t *testing.T) {
+	var values []Event
+
+	for i := 0; i < 10; i++ {
+		e := randomEvent()
+		values = append(values, e)
+
+		Record(e)
+	}
+
+	Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileSuffix))
+	if len(files) != 1 {
+		t.Fatalf("Expected single event log, got %v", files)
+	}
+
+	recorded := readEvents(t, files[0])
+
+	if len(recorded) != len(values) {
+		t.Fatalf("The number of events in record log do not match with what is expected! (expected %d, got %d)",
+			len(values), len(recorded))
+	}
+
+	// Events are written in order they were recorded from single goroutine
+	for i := range values {
+		if recorded[i] != values[i] {
+			t.Fatalf("Expected event %+v in record log, got %+v", values[i], recorded[i])
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	t.Run("Ring", func(t *testing.T) {
+		testRing(t)
+	})
+
+	t.Run("RingConcurrent", func(t *testing.T) {
+		testRingConcurrent(t)
+	})
+
+	t.Run("WriterRotation", func(t *testing.T) {
+		testWriterRotation(t)
+	})
+
+	t.Run("Record", func(t *testing.T) {
+		testRecord(t)
+	})
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package record
+
+import (
+	"sync/atomic"
+)
+
+type ringSlot struct {
+	// seq Position this slot is ready to be written at, or position+1 once it holds event written at position
+	seq   atomic.Uint64
+	event Event
+}
+
+/*
+ring Bounded lock-free queue of events with many producers (announces) and single consumer (writer).
+Each slot carries sequence number telling whether it is free to be written or ready to be read, so producers only
+contend on head position and never wait for each other or for consumer.
+*/
+type ring struct {
+	head atomic.Uint64
+	_    [56]byte // keep head and tail on separate cache lines
+	tail uint64   // only accessed by consumer
+
+	mask  uint64
+	slots []ringSlot
+}
+
+// newRing Creates ring holding at least size events (rounded up to power of two)
+func newRing(size int) *ring {
+	capacity := uint64(1)
+	for capacity < uint64(max(size, 1)) {
+		capacity <<= 1
+	}
+
+	r := &ring{mask: capacity - 1, slots: make([]ringSlot, capacity)}
+
+	for i := range r.slots {
+		r.slots[i].seq.Store(uint64(i))
+	}
+
+	return r
+}
+
+// push Copies event into ring; returns false without blocking if ring is full
+func (r *ring) push(e *Event) bool {
+	pos := r.head.Load()
+
+	for {
+		slot := &r.slots[pos&r.mask]
+		seq := slot.seq.Load()
+
+		switch diff := int64(seq - pos); {
+		case diff == 0:
+			if r.head.CompareAndSwap(pos, pos+1) {
+				slot.event = *e
+				slot.seq.Store(pos + 1)
+
+				return true
+			}
+
+			pos = r.head.Load()
+		case diff < 0:
+			// Slot still holds event from previous lap which was not consumed yet
+			return false
+		default:
+			// Another producer took this position already
+			pos = r.head.Load()
+		}
+	}
+}
+
+// pop Moves oldest event out of ring into e; returns false if there is none. Must only be called by single consumer
+func (r *ring) pop(e *Event) bool {
+	slot := &r.slots[r.tail&r.mask]
+
+	if slot.seq.Load() != r.tail+1 {
+		return false
+	}
+
+	*e = slot.event
+	slot.event = Event{}
+	slot.seq.Store(r.tail + r.mask + 1)
+
+	r.tail++
+
+	return true
+}
@@ -0,0 +1,293 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"chihaya/collector"
+)
+
+const (
+	filePrefix     = "events_"
+	fileSuffix     = ".jsonl"
+	compressSuffix = ".gz"
+)
+
+func filename(dir string, t time.Time) string {
+	return filepath.Join(dir, filePrefix+t.UTC().Format("2006-01-02T15-04-05.000000")+fileSuffix)
+}
+
+/*
+writer Writes events as JSON lines into files under dir. File is rotated once it grows over maxSize bytes or gets
+older than maxAge, after which it is compressed (if enabled) and files older than retention are removed.
+Zero value of any limit disables it. Not safe for concurrent use.
+*/
+type writer struct {
+	dir       string
+	maxSize   int64
+	maxAge    time.Duration
+	retention time.Duration
+	compress  bool
+
+	file    *os.File
+	out     *bufio.Writer
+	line    bytes.Buffer
+	encoder *json.Encoder
+	size    int64
+	opened  time.Time
+
+	// pending Number of events buffered in out which were not flushed to file yet
+	pending int
+
+	// compressing Tracks rotated files being compressed in background
+	compressing sync.WaitGroup
+}
+
+func newWriter(dir string, maxSize int64, maxAge, retention time.Duration, compress bool) *writer {
+	w := &writer{dir: dir, maxSize: maxSize, maxAge: maxAge, retention: retention, compress: compress}
+	w.encoder = json.NewEncoder(&w.line)
+
+	return w
+}
+
+func (w *writer) open(now time.Time) error {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename(w.dir, now), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.file, w.size, w.opened = file, 0, now
+
+	if w.out == nil {
+		w.out = bufio.NewWriterSize(file, 64<<10)
+	} else {
+		w.out.Reset(file)
+	}
+
+	return nil
+}
+
+// write Buffers single event, opening new file first if there is none or current one is due for rotation
+func (w *writer) write(e *Event, now time.Time) error {
+	if w.file != nil && w.maxSize > 0 && w.size >= w.maxSize {
+		w.rotate()
+	}
+
+	if w.file == nil {
+		if err := w.open(now); err != nil {
+			return err
+		}
+	}
+
+	w.line.Reset()
+
+	if err := w.encoder.Encode(e); err != nil {
+		return err
+	}
+
+	if _, err := w.out.Write(w.line.Bytes()); err != nil {
+		return err
+	}
+
+	w.size += int64(w.line.Len())
+	w.pending++
+
+	return nil
+}
+
+// flush Writes buffered events to file and rotates it if it got too old; returns number of events written
+func (w *writer) flush(now time.Time) (int, error) {
+	flushed, err := w.flushBuffer()
+	if err != nil {
+		return 0, err
+	}
+
+	if w.file != nil && w.maxAge > 0 && now.Sub(w.opened) >= w.maxAge {
+		w.rotate()
+	}
+
+	return flushed, nil
+}
+
+func (w *writer) flushBuffer() (int, error) {
+	if w.file == nil {
+		return 0, nil
+	}
+
+	flushed := w.pending
+
+	if err := w.out.Flush(); err != nil {
+		return 0, err
+	}
+
+	w.pending = 0
+
+	return flushed, nil
+}
+
+// rotate Closes current file and hands it over for compression and retention, next write opens new file
+func (w *writer) rotate() {
+	if _, err := w.flushBuffer(); err != nil {
+		slog.Error("failed to flush event log before rotation", "err", err)
+		collector.IncrementRecordDropped("error", w.pending)
+	}
+
+	name := w.file.Name()
+
+	if err := w.file.Close(); err != nil {
+		slog.Error("failed to close event log", "file", name, "err", err)
+	}
+
+	w.file, w.pending = nil, 0
+
+	if w.compress {
+		w.compressing.Add(1)
+
+		go func() {
+			defer w.compressing.Done()
+
+			if err := compressFile(name); err != nil {
+				slog.Error("failed to compress event log", "file", name, "err", err)
+			}
+		}()
+	}
+
+	w.removeExpired(time.Now())
+}
+
+// discard Drops current file after failure, without flushing what is buffered; next write opens new file
+func (w *writer) discard() {
+	if w.file == nil {
+		return
+	}
+
+	collector.IncrementRecordDropped("error", w.pending)
+
+	_ = w.file.Close()
+
+	w.file, w.pending = nil, 0
+}
+
+// close Flushes and closes current file and waits for pending compressions to finish
+func (w *writer) close() error {
+	var err error
+
+	if w.file != nil {
+		if _, err = w.flushBuffer(); err != nil {
+			collector.IncrementRecordDropped("error", w.pending)
+		}
+
+		if errClose := w.file.Close(); err == nil {
+			err = errClose
+		}
+
+		w.file = nil
+	}
+
+	w.compressing.Wait()
+
+	return err
+}
+
+// removeExpired Removes rotated files last modified before retention period
+func (w *writer) removeExpired(now time.Time) {
+	if w.retention <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		slog.Error("failed to list event logs", "err", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), filePrefix) || entry.IsDir() {
+			continue
+		}
+
+		name := filepath.Join(w.dir, entry.Name())
+		if w.file != nil && name == w.file.Name() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < w.retention {
+			continue
+		}
+
+		if err = os.Remove(name); err != nil {
+			slog.Error("failed to remove expired event log", "file", name, "err", err)
+		}
+	}
+}
+
+// compressFile Replaces file with its gzip compressed copy
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = src.Close()
+	}()
+
+	tmp := name + compressSuffix + ".tmp"
+
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+
+	if errClose := dst.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, name+compressSuffix); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
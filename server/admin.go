@@ -0,0 +1,285 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chihaya/config"
+	"chihaya/database"
+	cdb "chihaya/database/types"
+
+	"github.com/valyala/fasthttp"
+)
+
+/*
+ * Admin API is served on its own listener so that it is never exposed alongside tracker itself. Endpoints:
+ *   - GET    /torrents/<info_hash|id>              seeders and leechers of torrent
+ *   - DELETE /torrents/<info_hash|id>/peers/<key>  kick peer from torrent
+ *   - GET    /users/<id>                           active peers of user across all torrents
+ *   - DELETE /users/<id>                           evict user and its peers from memory
+ *   - POST   /reload                               reload all caches from database immediately
+ */
+
+type adminHandler struct {
+	db    *database.Database
+	token []byte
+
+	// userScan Held by requests for users, which have to go through all torrents, so that only one of them runs at once
+	userScan sync.Mutex
+}
+
+var (
+	admin         *fasthttp.Server
+	adminListener net.Listener
+)
+
+type adminTorrent struct {
+	ID       uint32                   `json:"id"`
+	InfoHash cdb.TorrentHash          `json:"info_hash"`
+	Seeders  map[cdb.PeerKey]cdb.Peer `json:"seeders"`
+	Leechers map[cdb.PeerKey]cdb.Peer `json:"leechers"`
+}
+
+type adminUserPeer struct {
+	InfoHash cdb.TorrentHash `json:"info_hash"`
+	Key      cdb.PeerKey     `json:"key"`
+	Peer     cdb.Peer        `json:"peer"`
+}
+
+type adminUser struct {
+	ID    uint32          `json:"id"`
+	Peers []adminUserPeer `json:"peers"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeAdminJSON(buf *bytes.Buffer, status int, v any) int {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		panic(err)
+	}
+
+	return status
+}
+
+func (h *adminHandler) findTorrent(s string) (cdb.TorrentHash, *cdb.Torrent) {
+	var infoHash cdb.TorrentHash
+	if err := infoHash.UnmarshalText([]byte(s)); err == nil {
+		torrent, _ := h.db.Torrents.Get(infoHash)
+
+		return infoHash, torrent
+	}
+
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return infoHash, nil
+	}
+
+	infoHash, torrent, _ := h.db.TorrentByID(uint32(id))
+
+	return infoHash, torrent
+}
+
+func (h *adminHandler) torrent(infoHash cdb.TorrentHash, torrent *cdb.Torrent, buf *bytes.Buffer) int {
+	res := adminTorrent{ID: torrent.ID.Load(), InfoHash: infoHash}
+
+	// Copy peers while locked so that encoding does not hold up announces
+	func() {
+		torrent.PeerLock()
+		defer torrent.PeerUnlock()
+
+		res.Seeders = make(map[cdb.PeerKey]cdb.Peer, torrent.Seeders.Len())
+		for k, peer := range torrent.Seeders.All() {
+			res.Seeders[k] = *peer
+		}
+
+		res.Leechers = make(map[cdb.PeerKey]cdb.Peer, torrent.Leechers.Len())
+		for k, peer := range torrent.Leechers.All() {
+			res.Leechers[k] = *peer
+		}
+	}()
+
+	return writeAdminJSON(buf, fasthttp.StatusOK, res)
+}
+
+func (h *adminHandler) user(id uint32, buf *bytes.Buffer) int {
+	res := adminUser{ID: id, Peers: make([]adminUserPeer, 0)}
+
+	for infoHash, torrent := range h.db.Torrents.All() {
+		func() {
+			torrent.PeerLock()
+			defer torrent.PeerUnlock()
+
+			for _, peers := range []*cdb.Peers{&torrent.Seeders, &torrent.Leechers} {
+				for k, peer := range peers.All() {
+					if peer.UserID == id {
+						res.Peers = append(res.Peers, adminUserPeer{infoHash, k, *peer})
+					}
+				}
+			}
+		}()
+	}
+
+	return writeAdminJSON(buf, fasthttp.StatusOK, res)
+}
+
+func (h *adminHandler) route(ctx *fasthttp.RequestCtx, buf *bytes.Buffer) int {
+	parts := strings.Split(strings.Trim(string(ctx.Path()), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "reload" && ctx.IsPost():
+		startTime := time.Now()
+
+		h.db.Reload()
+
+		return writeAdminJSON(buf, fasthttp.StatusOK, map[string]any{"elapsed": time.Since(startTime).Milliseconds()})
+	case len(parts) >= 2 && parts[0] == "torrents":
+		infoHash, torrent := h.findTorrent(parts[1])
+		if torrent == nil {
+			return writeAdminJSON(buf, fasthttp.StatusNotFound, adminError{"torrent not found"})
+		}
+
+		if len(parts) == 2 && ctx.IsGet() {
+			return h.torrent(infoHash, torrent, buf)
+		}
+
+		if len(parts) == 4 && parts[2] == "peers" && ctx.IsDelete() {
+			var k cdb.PeerKey
+			if err := k.UnmarshalText([]byte(parts[3])); err != nil {
+				return writeAdminJSON(buf, fasthttp.StatusBadRequest, adminError{err.Error()})
+			}
+
+			if !h.db.KickPeer(torrent, k) {
+				return writeAdminJSON(buf, fasthttp.StatusNotFound, adminError{"peer not found"})
+			}
+
+			slog.Info("kicked peer via admin api", "torrent", torrent.ID.Load(), "key", parts[3])
+
+			return writeAdminJSON(buf, fasthttp.StatusOK, map[string]any{"kicked": true})
+		}
+	case len(parts) == 2 && parts[0] == "users":
+		id, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return writeAdminJSON(buf, fasthttp.StatusBadRequest, adminError{err.Error()})
+		}
+
+		// Peers are not indexed by user, so concurrent requests would only multiply scans of all torrents
+		if !h.userScan.TryLock() {
+			return writeAdminJSON(buf, fasthttp.StatusTooManyRequests, adminError{"another user request is in progress"})
+		}
+		defer h.userScan.Unlock()
+
+		if ctx.IsGet() {
+			return h.user(uint32(id), buf)
+		}
+
+		if ctx.IsDelete() {
+			found, peers := h.db.EvictUser(uint32(id))
+			if !found {
+				return writeAdminJSON(buf, fasthttp.StatusNotFound, adminError{"user not found"})
+			}
+
+			slog.Info("evicted user via admin api", "user", id, "peers", peers)
+
+			return writeAdminJSON(buf, fasthttp.StatusOK, map[string]any{"evicted": true, "peers": peers})
+		}
+	}
+
+	return writeAdminJSON(buf, fasthttp.StatusNotFound, adminError{"not found"})
+}
+
+func (h *adminHandler) serve(ctx *fasthttp.RequestCtx) {
+	var buf bytes.Buffer
+
+	// Gracefully handle panics so that they're confined to single request and don't crash server
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("recovered from panicking admin handler", "err", err, "url", ctx.URI())
+
+			ctx.Response.ResetBody()
+			ctx.Response.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+	}()
+
+	status := fasthttp.StatusUnauthorized
+
+	token, found := bytes.CutPrefix(ctx.Request.Header.Peek(fasthttp.HeaderAuthorization), []byte("Bearer "))
+	if found && subtle.ConstantTimeCompare(token, h.token) == 1 {
+		status = h.route(ctx, &buf)
+	} else {
+		writeAdminJSON(&buf, status, adminError{"unauthorized"})
+	}
+
+	ctx.Response.Header.SetContentLength(buf.Len())
+	ctx.Response.Header.SetContentTypeBytes([]byte("application/json"))
+	ctx.Response.SetStatusCode(status)
+	_, _ = buf.WriteTo(ctx)
+}
+
+func startAdmin(db *database.Database) {
+	adminConfig := config.Section("admin")
+
+	addr, _ := adminConfig.Get("addr", "")
+	if addr == "" {
+		return
+	}
+
+	token, _ := adminConfig.Get("token", "")
+	if token == "" {
+		slog.Error("admin api requires token to be configured, not starting", "addr", addr)
+		return
+	}
+
+	admin = &fasthttp.Server{
+		Handler:               (&adminHandler{db: db, token: []byte(token)}).serve,
+		ReadTimeout:           5 * time.Second,
+		WriteTimeout:          30 * time.Second,
+		NoDefaultServerHeader: true,
+		NoDefaultContentType:  true,
+		CloseOnShutdown:       true,
+	}
+
+	var err error
+
+	adminListener, err = net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		_ = admin.Serve(adminListener)
+	}()
+
+	slog.Info("admin api ready and accepting new connections", "addr", addr)
+}
+
+func stopAdmin() {
+	if admin != nil {
+		_ = admin.Shutdown()
+	}
+}
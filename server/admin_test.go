@@ -0,0 +1,155 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"chihaya/database"
+	cdb "chihaya/database/types"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newTestAdminHandler() (*adminHandler, cdb.TorrentHash, cdb.PeerKey) {
+	infoHash := cdb.TorrentHash{1, 2, 3}
+	key := cdb.NewPeerKey(7, cdb.PeerIDFromRawString("-TR2940-000000000000"))
+
+	torrent := &cdb.Torrent{
+		Seeders: cdb.NewPeers(map[cdb.PeerKey]*cdb.Peer{key: {
+			Addr:      cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{9, 10, 11, 123}), 24512),
+			UserID:    7,
+			TorrentID: 42,
+			Seeding:   true,
+		}}),
+	}
+	torrent.ID.Store(42)
+	torrent.SeedersLength.Store(1)
+
+	h := &adminHandler{db: &database.Database{}, token: []byte("secret")}
+	h.db.StoreTorrents(map[cdb.TorrentHash]*cdb.Torrent{infoHash: torrent})
+
+	return h, infoHash, key
+}
+
+func doAdminRequest(h *adminHandler, method, uri, token string) *fasthttp.RequestCtx {
+	var (
+		ctx fasthttp.RequestCtx
+		req fasthttp.Request
+	)
+
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+
+	if token != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+token)
+	}
+
+	ctx.Init(&req, nil, nil)
+	h.serve(&ctx)
+
+	return &ctx
+}
+
+func testAdminUnauthorized(t *testing.T) {
+	h, _, _ := newTestAdminHandler()
+
+	for _, token := range []string{"", "wrong", "secret2"} {
+		if ctx := doAdminRequest(h, fasthttp.MethodGet, "/torrents/42", token); ctx.Response.StatusCode() !=
+			fasthttp.StatusUnauthorized {
+			t.Fatalf("Expected status %d for token %q, got %d", fasthttp.StatusUnauthorized, token,
+				ctx.Response.StatusCode())
+		}
+	}
+}
+
+func testAdminTorrent(t *testing.T) {
+	h, infoHash, key := newTestAdminHandler()
+	infoHashText, _ := infoHash.MarshalText()
+
+	for _, id := range []string{"42", string(infoHashText)} {
+		ctx := doAdminRequest(h, fasthttp.MethodGet, "/torrents/"+id, "secret")
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("Expected status %d for torrent %s, got %d", fasthttp.StatusOK, id, ctx.Response.StatusCode())
+		}
+
+		var res adminTorrent
+		if err := json.Unmarshal(ctx.Response.Body(), &res); err != nil {
+			t.Fatalf("Failed to decode response %s: %v", ctx.Response.Body(), err)
+		}
+
+		if res.ID != 42 || len(res.Seeders) != 1 || len(res.Leechers) != 0 || res.Seeders[key].UserID != 7 {
+			t.Fatalf("Unexpected response for torrent %s: %s", id, ctx.Response.Body())
+		}
+	}
+
+	if ctx := doAdminRequest(h, fasthttp.MethodGet, "/torrents/43", "secret"); ctx.Response.StatusCode() !=
+		fasthttp.StatusNotFound {
+		t.Fatalf("Expected status %d for unknown torrent, got %d", fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	}
+}
+
+func testAdminUser(t *testing.T) {
+	h, infoHash, key := newTestAdminHandler()
+
+	ctx := doAdminRequest(h, fasthttp.MethodGet, "/users/7", "secret")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("Expected status %d, got %d", fasthttp.StatusOK, ctx.Response.StatusCode())
+	}
+
+	var res adminUser
+	if err := json.Unmarshal(ctx.Response.Body(), &res); err != nil {
+		t.Fatalf("Failed to decode response %s: %v", ctx.Response.Body(), err)
+	}
+
+	if res.ID != 7 || len(res.Peers) != 1 || res.Peers[0].InfoHash != infoHash || res.Peers[0].Key != key {
+		t.Fatalf("Unexpected response for user: %s", ctx.Response.Body())
+	}
+
+	if ctx = doAdminRequest(h, fasthttp.MethodGet, "/users/garbage", "secret"); ctx.Response.StatusCode() !=
+		fasthttp.StatusBadRequest {
+		t.Fatalf("Expected status %d for invalid user, got %d", fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	}
+
+	// Only one request for user runs at once
+	h.userScan.Lock()
+
+	if ctx = doAdminRequest(h, fasthttp.MethodGet, "/users/7", "secret"); ctx.Response.StatusCode() !=
+		fasthttp.StatusTooManyRequests {
+		t.Fatalf("Expected status %d for concurrent request, got %d", fasthttp.StatusTooManyRequests,
+			ctx.Response.StatusCode())
+	}
+
+	h.userScan.Unlock()
+}
+
+func TestAdmin(t *testing.T) {
+	t.Run("Unauthorized", func(t *testing.T) {
+		testAdminUnauthorized(t)
+	})
+
+	t.Run("Torrent", func(t *testing.T) {
+		testAdminTorrent(t)
+	})
+
+	t.Run("User", func(t *testing.T) {
+		testAdminUser(t)
+	})
+}
@@ -27,13 +27,21 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
-func alive(_ *fasthttp.RequestCtx, _ *database.Database, buf *bytes.Buffer) int {
+func alive(_ *fasthttp.RequestCtx, db *database.Database, buf *bytes.Buffer) int {
 	type response struct {
-		Now    int64 `json:"now"`
-		Uptime int64 `json:"uptime"`
+		Now      int64 `json:"now"`
+		Uptime   int64 `json:"uptime"`
+		Degraded bool  `json:"degraded"`
+		// DisconnectedAt Time since which database is unavailable, omitted while it is available
+		DisconnectedAt int64 `json:"disconnected_at,omitempty"`
 	}
 
-	res, err := json.Marshal(response{time.Now().UnixMilli(), time.Since(handler.startTime).Milliseconds()})
+	res, err := json.Marshal(response{
+		Now:            time.Now().UnixMilli(),
+		Uptime:         time.Since(handler.startTime).Milliseconds(),
+		Degraded:       db.Degraded(),
+		DisconnectedAt: db.DisconnectedAt(),
+	})
 	if err != nil {
 		panic(err)
 	}
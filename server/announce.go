@@ -20,11 +20,14 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"iter"
 	"log/slog"
 	"math"
 	"net/netip"
 	"time"
 
+	"chihaya/anticheat"
+	"chihaya/collector"
 	"chihaya/config"
 	"chihaya/database"
 	cdb "chihaya/database/types"
@@ -44,6 +47,15 @@ var (
 	maxNumWant             int
 
 	strictPort bool
+
+	minIntervalMode string
+)
+
+// Ways of handling peers re-announcing before min interval has passed
+const (
+	minIntervalOff    = "off"    // process announce as usual
+	minIntervalSkip   = "skip"   // respond with current swarm state without updating peer or queueing any writes
+	minIntervalReject = "reject" // respond with failure
 )
 
 func init() {
@@ -58,91 +70,155 @@ func init() {
 	strictPort, _ = announceConfig.GetBool("strict_port", false)
 	defaultNumWant, _ = announceConfig.GetInt("numwant", 25)
 	maxNumWant, _ = announceConfig.GetInt("max_numwant", 50)
+
+	minIntervalMode, _ = announceConfig.Get("min_interval_mode", minIntervalOff)
+	if minIntervalMode != minIntervalOff && minIntervalMode != minIntervalSkip && minIntervalMode != minIntervalReject {
+		slog.Error("unknown min_interval_mode, using default", "mode", minIntervalMode, "default", minIntervalOff)
+
+		minIntervalMode = minIntervalOff
+	}
+}
+
+// announceResponse Contains outcome of announce which is then encoded in protocol-specific manner
+type announceResponse struct {
+	seeders, leechers, snatched int64
+	interval                    int
+
+	// withPeers Whether response should contain peer lists at all (even if empty)
+	withPeers      bool
+	peers4, peers6 []*cdb.Peer
 }
 
-//nolint:gocyclo // can't really by simplified other than by splitting into chunks
 func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, buf *bytes.Buffer) int {
 	qp, err := params.ParseQuery(ctx.Request.URI().QueryArgs())
 	if err != nil {
 		panic(err)
 	}
 
-	if len(qp.Params.InfoHashes) == 0 {
-		failure("Malformed request - missing info_hash", buf, 1*time.Hour)
+	var (
+		compact    = !qp.Exists.Compact || qp.Params.Compact
+		sendPeerID = qp.Exists.NoPeerID && !qp.Params.NoPeerID
+	)
+
+	remoteAddr, err := getIPAddressFromRequest(ctx)
+	if err != nil {
+		respondFailure("announce", &requestFailure{
+			failureInvalidIP, "Malformed request - unable to determine IP address", 1 * time.Hour,
+		}, buf)
+
 		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+	}
+
+	if f := handleAnnounce(&qp, remoteAddr, user, db, func(res *announceResponse) {
+		util.BencodeAnnounceHeader(buf, res.seeders, res.leechers, res.snatched, res.interval, minAnnounceInterval)
+
+		if res.withPeers {
+			util.BencodeAnnouncePeersIP4(buf, res.peers4, compact, sendPeerID)
+
+			if len(res.peers6) > 0 {
+				util.BencodeAnnouncePeersIP6(buf, res.peers6)
+			}
+		}
+
+		util.BencodeAnnounceFooter(buf)
+	}); f != nil {
+		respondFailure("announce", f, buf)
+	}
+
+	return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+}
+
+/*
+handleAnnounce Processes announce regardless of protocol it arrived with. Response is passed to respond function
+which is called while torrent peers are still locked, so it must not block; in case announce could not be processed,
+failure is returned instead.
+*/
+//nolint:gocyclo // can't really by simplified other than by splitting into chunks
+func handleAnnounce(qp *params.QueryParam, remoteAddr netip.Addr, user *cdb.User, db *database.Database,
+	respond func(res *announceResponse)) *requestFailure {
+	collector.IncrementAnnounceEvents(eventLabel(qp.Params.Event))
+
+	if len(qp.Params.InfoHashes) == 0 {
+		return &requestFailure{failureMalformed, "Malformed request - missing info_hash", 1 * time.Hour}
 	} else if len(qp.Params.InfoHashes) > 1 {
-		failure("Malformed request - can only announce singular info_hash", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - can only announce singular info_hash", 1 * time.Hour}
 	}
 
 	if len(qp.Params.PeerID) == 0 {
-		failure("Malformed request - missing peer_id", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - missing peer_id", 1 * time.Hour}
 	}
 
 	if len(qp.Params.PeerID) != 20 {
-		failure("Malformed request - invalid peer_id", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - invalid peer_id", 1 * time.Hour}
 	}
 
 	if !qp.Exists.Port {
-		failure("Malformed request - missing port", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - missing port", 1 * time.Hour}
 	}
 
 	if strictPort && qp.Params.Port < 1024 {
-		failure(fmt.Sprintf("Unacceptable request - port must be outside of well-known range (port: %d)", qp.Params.Port),
-			buf, 1*time.Hour)
-
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{
+			failureUnacceptablePort,
+			fmt.Sprintf("Unacceptable request - port must be outside of well-known range (port: %d)", qp.Params.Port),
+			1 * time.Hour,
+		}
 	}
 
 	if !qp.Exists.Uploaded {
-		failure("Malformed request - missing uploaded", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - missing uploaded", 1 * time.Hour}
 	}
 
 	if !qp.Exists.Downloaded {
-		failure("Malformed request - missing downloaded", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - missing downloaded", 1 * time.Hour}
 	}
 
 	if !qp.Exists.Left {
-		failure("Malformed request - missing left", buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureMalformed, "Malformed request - missing left", 1 * time.Hour}
 	}
 
-	// Pick IP address - either explicitly provided in params (BEP-3 compatible) or fallback to request
-	ipAddr := func() netip.Addr {
-		requestAddr := getIPAddressFromRequest(ctx)
+	// Pick IP addresses - either explicitly provided in params (BEP-3 and BEP-7 compatible) or fallback to request
+	var addr4, addr6 netip.Addr
 
-		if !qp.Exists.IP {
-			return requestAddr // There was no IP provided in QueryParams
+	pickAddr := func(addr netip.Addr) {
+		if addr = addr.Unmap().WithZone(""); addr.Is4() {
+			addr4 = addr
+		} else if addr.Is6() {
+			addr6 = addr
 		}
+	}
 
-		customAddr, _ := netip.ParseAddr(qp.Params.IP)
-		if isPrivateIPAddress(customAddr) {
-			return requestAddr // IP provided in QueryParams was private
+	pickAddr(remoteAddr)
+
+	if qp.Exists.IP {
+		// Ignore IP provided in QueryParams if it is private
+		if customAddr, err := netip.ParseAddr(qp.Params.IP); err == nil && !isPrivateIPAddress(customAddr) {
+			pickAddr(customAddr)
 		}
+	}
 
-		return customAddr
-	}().Unmap()
+	if qp.Exists.IPv6 {
+		// Ignore IP provided in QueryParams if it is private or not IPv6 at all
+		if customAddr, ok := parseIPv6Param(qp.Params.IPv6); ok && !isPrivateIPAddress(customAddr) {
+			pickAddr(customAddr)
+		}
+	}
 
-	if !ipAddr.Is4() {
-		failure(fmt.Sprintf("Invalid IPv4 address (ip: %s)", ipAddr.String()), buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+	if !addr4.IsValid() && !addr6.IsValid() {
+		return &requestFailure{failureInvalidIP, "Invalid IP address", 1 * time.Hour}
 	}
 
 	clientID, matched := isClientApproved(qp.Params.PeerID, db)
 	if !matched {
-		failure(fmt.Sprintf("Your client is not approved (peer_id: %s)", qp.Params.PeerID), buf, 1*time.Hour)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{
+			failureUnapprovedClient,
+			fmt.Sprintf("Your client is not approved (peer_id: %s)", qp.Params.PeerID),
+			1 * time.Hour,
+		}
 	}
 
-	torrent, exists := (*db.Torrents.Load())[qp.Params.InfoHashes[0]]
+	torrent, exists := db.Torrents.Get(qp.Params.InfoHashes[0])
 	if !exists {
-		failure("This torrent does not exist", buf, 5*time.Minute)
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{failureUnregisteredTorrent, "This torrent does not exist", 5 * time.Minute}
 	}
 
 	// Take torrent peers lock to read/write on it to prevent race conditions
@@ -155,14 +231,16 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 		torrent.Status.Store(0)
 
 		/* It is okay to do this asynchronously as tracker's internal in-memory state has already been updated for this
-		torrent. While it is technically possible that we will do this more than once in some cases, the state is of
-		boolean type so there is no risk of data loss. */
-		go db.UnPrune(torrent)
+		torrent. Status goes through torrent flush so that it is ordered after prune which may still be queued there
+		(see purgeInactivePeers); the state is of boolean type so there is no risk of data loss. */
+		db.QueueTorrentStatus(torrent, "")
+		db.SchedulePrune(qp.Params.InfoHashes[0], torrent, time.Now().Unix())
 	} else if torrentStatus != 0 {
-		failure(fmt.Sprintf("This torrent does not exist (status: %d, left: %d)", torrentStatus, qp.Params.Left),
-			buf, 15*time.Minute)
-
-		return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+		return &requestFailure{
+			failureUnregisteredTorrent,
+			fmt.Sprintf("This torrent does not exist (status: %d, left: %d)", torrentStatus, qp.Params.Left),
+			15 * time.Minute,
+		}
 	}
 
 	if !qp.Exists.NumWant {
@@ -181,13 +259,34 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 		active  = true
 	)
 
-	if qp.Params.Left > 0 {
-		if isDisabledDownload(db, user, torrent) {
-			failure("Your download privileges are disabled", buf, 1*time.Hour)
-			return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+	if qp.Params.Left > 0 && isDisabledDownload(db, user, torrent) {
+		return &requestFailure{failureDownloadDisabled, "Your download privileges are disabled", 1 * time.Hour}
+	}
+
+	keyHash := cdb.HashPeerKey(qp.Params.Key)
+	if !verifyPeerKey(torrent, peerKey, keyHash) {
+		collector.IncrementPeerKeyMismatches()
+		return &requestFailure{failurePeerKeyMismatch, "Peer key mismatch", 1 * time.Hour}
+	}
+
+	if early := earlyAnnounce(torrent, peerKey, qp, now); early != nil {
+		collector.IncrementEarlyAnnounces(minIntervalMode)
+
+		if minIntervalMode == minIntervalReject {
+			return &requestFailure{
+				failureIntervalTooShort,
+				fmt.Sprintf("Announce interval too short (min interval: %d)", minAnnounceInterval),
+				time.Duration(int64(minAnnounceInterval)-(now-early.LastAnnounce)) * time.Second,
+			}
 		}
 
-		peer, exists = torrent.Leechers[peerKey]
+		respond(newAnnounceResponse(torrent, early, qp.Params.NumWant, early.Seeding || early.PartialSeed, true))
+
+		return nil
+	}
+
+	if qp.Params.Left > 0 {
+		peer, exists = torrent.Leechers.Get(peerKey)
 		if !exists {
 			peer = &cdb.Peer{
 				ID:           peerKey.PeerID(),
@@ -199,11 +298,11 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 				Downloaded:   qp.Params.Downloaded,
 			}
 
-			torrent.Leechers[peerKey] = peer
-			torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
+			torrent.Leechers.Put(peerKey, peer)
+			torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
 		}
 	} else if qp.Params.Event == "completed" {
-		peer, exists = torrent.Leechers[peerKey]
+		peer, exists = torrent.Leechers.Get(peerKey)
 		if !exists {
 			peer = &cdb.Peer{
 				ID:           peerKey.PeerID(),
@@ -215,22 +314,23 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 				Downloaded:   qp.Params.Downloaded,
 			}
 
-			torrent.Seeders[peerKey] = peer
-			torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
+			torrent.Seeders.Put(peerKey, peer)
+			torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
 		} else {
 			// Previously tracked peer is now a seeder
-			torrent.Seeders[peerKey] = peer
-			delete(torrent.Leechers, peerKey)
+			torrent.Seeders.Put(peerKey, peer)
+			torrent.Leechers.Delete(peerKey)
+			torrent.LeecherRemoved(peer)
 
-			torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
-			torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
+			torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+			torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
 		}
 
 		seeding = true
 	} else {
-		peer, exists = torrent.Seeders[peerKey]
+		peer, exists = torrent.Seeders.Get(peerKey)
 		if !exists {
-			peer, exists = torrent.Leechers[peerKey]
+			peer, exists = torrent.Leechers.Get(peerKey)
 			if !exists {
 				peer = &cdb.Peer{
 					ID:           peerKey.PeerID(),
@@ -242,17 +342,18 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 					Downloaded:   qp.Params.Downloaded,
 				}
 
-				torrent.Seeders[peerKey] = peer
-				torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
+				torrent.Seeders.Put(peerKey, peer)
+				torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
 			} else {
 				/* Previously tracked peer is now a seeder, however we never received their "completed" event.
 				Broken client? Unreported snatch? Cross-seeding? Let's not report it as snatch to avoid
 				over-reporting for cross-seeding */
-				torrent.Seeders[peerKey] = peer
-				delete(torrent.Leechers, peerKey)
+				torrent.Seeders.Put(peerKey, peer)
+				torrent.Leechers.Delete(peerKey)
+				torrent.LeecherRemoved(peer)
 
-				torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
-				torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
+				torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
+				torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
 			}
 		}
 
@@ -260,12 +361,28 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 	}
 
 	// Update peer info
-	peer.Addr = cdb.NewPeerAddressFromAddrPort(ipAddr, qp.Params.Port)
+	peer.Addr, peer.Addr6 = cdb.PeerAddress{}, cdb.PeerAddress6{}
+
+	if addr4.IsValid() {
+		peer.Addr = cdb.NewPeerAddressFromAddrPort(addr4, qp.Params.Port)
+	}
+
+	if addr6.IsValid() {
+		peer.Addr6 = cdb.NewPeerAddress6FromAddrPort(addr6, qp.Params.Port)
+	}
+
 	peer.ClientID = clientID
+	peer.KeyHash = keyHash
 
 	// Update peer state
 	peer.Seeding = seeding
 
+	if seeding {
+		peer.PartialSeed = false
+	} else {
+		torrent.SetPartialSeed(peer, isPartialSeed(qp))
+	}
+
 	rawDeltaUpload := int64(qp.Params.Uploaded) - int64(peer.Uploaded) // fixme: possible interger overflow here
 	if rawDeltaUpload < 0 {
 		rawDeltaUpload = 0 // attenuate negative deltas to 0
@@ -286,23 +403,41 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 		torrentGroupUpMultiplier = torrentGroupFreeleech.UpMultiplier
 	}
 
-	var deltaDownload int64
-	if !database.GlobalFreeleech.Load() {
-		deltaDownload = int64(
-			float64(rawDeltaDownload) *
-				math.Abs(math.Float64frombits(user.DownMultiplier.Load())) *
-				math.Abs(torrentGroupDownMultiplier) *
-				math.Abs(math.Float64frombits(torrent.DownMultiplier.Load())),
-		)
-	}
-
-	deltaUpload := int64(
-		float64(rawDeltaUpload) *
-			math.Abs(math.Float64frombits(user.UpMultiplier.Load())) *
-			math.Abs(torrentGroupUpMultiplier) *
-			math.Abs(math.Float64frombits(torrent.UpMultiplier.Load())),
+	// Windows are loaded ahead of time, so that they start and end exactly on schedule
+	windowDownMultiplier, windowUpMultiplier := db.FreeleechWindows.Load().Multipliers(torrent.Group.Key(), now)
+
+	var (
+		userFreeleechDownMultiplier = 1.0
+		userFreeleechUpMultiplier   = 1.0
 	)
 
+	// Personal freeleech is only reloaded periodically, so it may have expired in the meantime
+	if userFreeleech, exists := (*db.UsersFreeleech.Load())[cdb.UserTorrentPair{
+		UserID:    peer.UserID,
+		TorrentID: peer.TorrentID,
+	}]; exists && userFreeleech.Expiry > now {
+		userFreeleechDownMultiplier = userFreeleech.DownMultiplier
+		userFreeleechUpMultiplier = userFreeleech.UpMultiplier
+	}
+
+	var downMultiplier float64
+	if !database.GlobalFreeleech.Load() {
+		downMultiplier = math.Abs(math.Float64frombits(user.DownMultiplier.Load())) *
+			math.Abs(torrentGroupDownMultiplier) *
+			math.Abs(userFreeleechDownMultiplier) *
+			math.Abs(windowDownMultiplier) *
+			math.Abs(math.Float64frombits(torrent.DownMultiplier.Load()))
+	}
+
+	upMultiplier := math.Abs(math.Float64frombits(user.UpMultiplier.Load())) *
+		math.Abs(torrentGroupUpMultiplier) *
+		math.Abs(userFreeleechUpMultiplier) *
+		math.Abs(windowUpMultiplier) *
+		math.Abs(math.Float64frombits(torrent.UpMultiplier.Load()))
+
+	deltaDownload := int64(float64(rawDeltaDownload) * downMultiplier)
+	deltaUpload := int64(float64(rawDeltaUpload) * upMultiplier)
+
 	// Update peer stats
 	peer.Uploaded = qp.Params.Uploaded
 	peer.Downloaded = qp.Params.Downloaded
@@ -322,6 +457,28 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 		deltaSeedTime = 0
 	}
 
+	otherLeechers := torrent.Leechers.Len()
+	if _, leeching := torrent.Leechers.Get(peerKey); leeching {
+		otherLeechers--
+	}
+
+	// Suspicious transfer is recorded for review and credit for it is withheld if configured so
+	for _, suspicion := range anticheat.Default.Inspect(&anticheat.Announce{
+		UserID:           peer.UserID,
+		TorrentID:        peer.TorrentID,
+		RawDeltaUpload:   rawDeltaUpload,
+		RawDeltaDownload: rawDeltaDownload,
+		DeltaTime:        now - peer.LastAnnounce,
+		Time:             now,
+		OtherLeechers:    otherLeechers,
+	}) {
+		if suspicion.Withhold {
+			deltaUpload = 0
+		}
+
+		db.QueueSuspicion(peer, suspicion.Rule, suspicion.Details, rawDeltaUpload, suspicion.Withhold, now)
+	}
+
 	// Update peer timings
 	peer.LastAnnounce = now
 
@@ -339,11 +496,12 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 		since we still have a reference to their object. After flushing, all references
 		should be gone, allowing the peer to be GC'd. */
 		if seeding {
-			delete(torrent.Seeders, peerKey)
-			torrent.SeedersLength.Store(uint32(len(torrent.Seeders)))
+			torrent.Seeders.Delete(peerKey)
+			torrent.SeedersLength.Store(uint32(torrent.Seeders.Len()))
 		} else {
-			delete(torrent.Leechers, peerKey)
-			torrent.LeechersLength.Store(uint32(len(torrent.Leechers)))
+			torrent.Leechers.Delete(peerKey)
+			torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+			torrent.LeecherRemoved(peer)
 		}
 
 		active = false
@@ -353,55 +511,171 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 		db.QueueSnatch(peer, now) // Non-blocking
 	}
 
-	persistAddr := peer.Addr // This is done here so that we don't have to keep two instances of Addr for each Peer
+	// Peers are scheduled for expiry once, when they join swarm; later announces only move their last announce
+	if !exists && active {
+		db.SchedulePeerExpiry(qp.Params.InfoHashes[0], peer)
+	}
+
+	// This is done here so that we don't have to keep two instances of Addr for each Peer
+	persistAddr, persistAddr6 := peer.Addr, peer.Addr6
 	if user.TrackerHide.Load() {
-		persistAddr = cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{127, 0, 0, 1}), qp.Params.Port)
+		if persistAddr.IsValid() {
+			persistAddr = cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{127, 0, 0, 1}), qp.Params.Port)
+		}
+
+		if persistAddr6.IsValid() {
+			persistAddr6 = cdb.NewPeerAddress6FromAddrPort(netip.IPv6Loopback(), qp.Params.Port)
+		}
 	}
 
-	// Underlying queue operations are non-blocking by spawning new goroutine if channel is already full
+	// Underlying queue operations are non-blocking by spilling to disk if channel is already full
 	db.QueueTorrent(torrent, deltaSnatch)
 	db.QueueTransferHistory(peer, rawDeltaUpload, rawDeltaDownload, deltaTime, deltaSeedTime, deltaSnatch, active)
 	db.QueueUser(user, rawDeltaUpload, rawDeltaDownload, deltaUpload, deltaDownload)
-	db.QueueTransferIP(peer, persistAddr, rawDeltaUpload, rawDeltaDownload)
+	db.QueueTransferIP(peer, persistAddr, persistAddr6, rawDeltaUpload, rawDeltaDownload)
+
+	record.Record(record.Event{
+		Time:           now,
+		TorrentID:      peer.TorrentID,
+		UserID:         peer.UserID,
+		PeerID:         peer.ID,
+		ClientID:       peer.ClientID,
+		Addr:           peer.Addr,
+		Addr6:          peer.Addr6,
+		Event:          qp.Params.Event,
+		Uploaded:       qp.Params.Uploaded,
+		Downloaded:     qp.Params.Downloaded,
+		Left:           qp.Params.Left,
+		RawDeltaUp:     rawDeltaUpload,
+		RawDeltaDown:   rawDeltaDownload,
+		DeltaUp:        deltaUpload,
+		DeltaDown:      deltaDownload,
+		UpMultiplier:   upMultiplier,
+		DownMultiplier: downMultiplier,
+	})
+
+	respond(newAnnounceResponse(torrent, peer, qp.Params.NumWant, seeding || peer.PartialSeed, active))
+
+	return nil
+}
+
+/*
+verifyPeerKey Returns false if previously tracked peer sent key and given one does not match it. Peers which never sent
+key (or were tracked before keys were stored) adopt key of their next announce
+*/
+func verifyPeerKey(torrent *cdb.Torrent, peerKey cdb.PeerKey, keyHash uint64) bool {
+	peer, exists := torrent.Seeders.Get(peerKey)
+	if !exists {
+		if peer, exists = torrent.Leechers.Get(peerKey); !exists {
+			return true
+		}
+	}
+
+	return peer.KeyHash == 0 || peer.KeyHash == keyHash
+}
+
+// isPartialSeed Returns whether peer announced itself as partial seed, either via BEP-21 event or upload_only param
+func isPartialSeed(qp *params.QueryParam) bool {
+	return qp.Params.Event == "paused" || qp.Params.UploadOnly
+}
+
+/*
+earlyAnnounce Returns previously tracked peer if it announced again before min interval has passed without any event
+or change of its state, nil otherwise (or when min interval is not enforced)
+*/
+func earlyAnnounce(torrent *cdb.Torrent, peerKey cdb.PeerKey, qp *params.QueryParam, now int64) *cdb.Peer {
+	// Partial seeds send paused event on every announce, so it is not treated as an event here
+	if minIntervalMode == minIntervalOff || (qp.Params.Event != "" && qp.Params.Event != "paused") {
+		return nil
+	}
+
+	peer, exists := torrent.Seeders.Get(peerKey)
+	if !exists {
+		if peer, exists = torrent.Leechers.Get(peerKey); !exists {
+			return nil
+		}
+	}
+
+	if peer.Seeding != (qp.Params.Left == 0) || peer.PartialSeed != (qp.Params.Left > 0 && isPartialSeed(qp)) ||
+		now-peer.LastAnnounce >= int64(minAnnounceInterval) {
+		return nil
+	}
+
+	return peer
+}
+
+/*
+randomPeers Returns all peers in random order: from random position by random step coprime with number of peers, so
+that peers sent together are not simply those which joined one after another (as peers are stored in join order)
+*/
+func randomPeers(peers *cdb.Peers) iter.Seq2[cdb.PeerKey, *cdb.Peer] {
+	n := peers.Len()
+	if n < 3 {
+		return peers.From(util.UnsafeIntn(max(n, 1)))
+	}
+
+	step := 1 + util.UnsafeIntn(n-1)
+	for gcd(step, n) != 1 {
+		step = 1 + util.UnsafeIntn(n-1)
+	}
 
-	record.Record(peer.TorrentID, user.ID.Load(), peer.Addr, qp.Params.Event, qp.Params.Uploaded, qp.Params.Downloaded,
-		qp.Params.Left)
+	return peers.Stride(util.UnsafeIntn(n), step)
+}
 
-	// Generate response
-	seedCount := int(torrent.SeedersLength.Load())
-	leechCount := int(torrent.LeechersLength.Load())
-	snatchCount := uint16(torrent.Snatched.Load())
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
 
-	/* We ask clients to announce each interval seconds. In order to spread the load on tracker,
-	we will vary the interval given to client by random number of seconds between 0 and value
-	specified in config */
-	interval := announceInterval + util.UnsafeIntn(maxAccounceDrift)
+	return a
+}
 
-	util.BencodeAnnounceHeader(buf, int64(seedCount), int64(leechCount), int64(snatchCount), interval, minAnnounceInterval)
+func containsUser(peers []*cdb.Peer, userID uint32) bool {
+	for _, peer := range peers {
+		if peer.UserID == userID {
+			return true
+		}
+	}
 
-	if qp.Params.NumWant > 0 && active {
+	return false
+}
+
+/*
+newAnnounceResponse Generates response for peer from current state of torrent; torrent peers must be locked.
+Seeding should be also set for partial seeds, which like seeders only get sent leechers which are still downloading
+*/
+func newAnnounceResponse(torrent *cdb.Torrent, peer *cdb.Peer, numWant uint16, seeding, active bool) *announceResponse {
+	res := announceResponse{
+		seeders:  int64(torrent.SeedersLength.Load()),
+		leechers: int64(torrent.LeechersLength.Load()),
+		snatched: int64(uint16(torrent.Snatched.Load())),
+
+		/* We ask clients to announce each interval seconds. In order to spread the load on tracker,
+		we will vary the interval given to client by random number of seconds between 0 and value
+		specified in config */
+		interval: announceInterval + util.UnsafeIntn(maxAccounceDrift),
+
+		withPeers: numWant > 0 && active,
+	}
+
+	if res.withPeers {
 		var peerCount int
 
 		if seeding {
-			peerCount = min(int(qp.Params.NumWant), leechCount)
+			peerCount = min(int(numWant), int(res.leechers))
 		} else {
-			peerCount = min(int(qp.Params.NumWant), seedCount+leechCount)
+			peerCount = min(int(numWant), int(res.seeders+res.leechers))
 		}
 
 		peersToSend := make([]*cdb.Peer, 0, peerCount)
 
-		/*
-		 * The iteration is already "random", so we don't need to randomize ourselves:
-		 * - Each time an element is inserted into the map, it gets a some arbitrary position for iteration
-		 * - Each time you range over the map, it starts at a random offset into the map's elements
-		 */
 		if seeding {
-			for _, leech := range torrent.Leechers {
-				if len(peersToSend) >= int(qp.Params.NumWant) {
+			for _, leech := range randomPeers(&torrent.Leechers) {
+				if len(peersToSend) >= int(numWant) {
 					break
 				}
 
-				if leech.UserID == peer.UserID || leech.Addr.Port() < 1024 {
+				if leech.UserID == peer.UserID || leech.Port() < 1024 || leech.PartialSeed {
 					continue
 				}
 
@@ -409,30 +683,28 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 			}
 		} else {
 			/* Send only one peer per user. This is to ensure that users seeding at multiple locations don't end up
-			exclusively acting as peers. */
-			uniqueSeeders := make(map[uint32]*cdb.Peer)
-
-			for _, seed := range torrent.Seeders {
-				if len(peersToSend) >= int(qp.Params.NumWant) {
+			exclusively acting as peers. Only few peers are sent, so it is cheaper to look through them than to
+			allocate map. */
+			for _, seed := range randomPeers(&torrent.Seeders) {
+				if len(peersToSend) >= int(numWant) {
 					break
 				}
 
-				if seed.UserID == peer.UserID || seed.Addr.Port() < 1024 {
+				if seed.UserID == peer.UserID || seed.Port() < 1024 {
 					continue
 				}
 
-				if _, exists = uniqueSeeders[seed.UserID]; !exists {
-					uniqueSeeders[seed.UserID] = seed
+				if !containsUser(peersToSend, seed.UserID) {
 					peersToSend = append(peersToSend, seed)
 				}
 			}
 
-			for _, leech := range torrent.Leechers {
-				if len(peersToSend) >= int(qp.Params.NumWant) {
+			for _, leech := range randomPeers(&torrent.Leechers) {
+				if len(peersToSend) >= int(numWant) {
 					break
 				}
 
-				if leech.UserID == peer.UserID || leech.Addr.Port() < 1024 {
+				if leech.UserID == peer.UserID || leech.Port() < 1024 {
 					continue
 				}
 
@@ -440,13 +712,20 @@ func announce(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, b
 			}
 		}
 
-		util.BencodeAnnouncePeersIP4(buf, peersToSend,
-			/* is compact */ !qp.Exists.Compact || qp.Params.Compact,
-			/* send peerID */ qp.Exists.NoPeerID && !qp.Params.NoPeerID,
-		)
-	}
+		// Dual-stack peers are sent in both lists, as it is up to the client to decide which family it can reach
+		res.peers4 = make([]*cdb.Peer, 0, len(peersToSend))
+		res.peers6 = make([]*cdb.Peer, 0, len(peersToSend))
+
+		for _, other := range peersToSend {
+			if other.Addr.IsValid() {
+				res.peers4 = append(res.peers4, other)
+			}
 
-	util.BencodeAnnounceFooter(buf)
+			if other.Addr6.IsValid() {
+				res.peers6 = append(res.peers6, other)
+			}
+		}
+	}
 
-	return fasthttp.StatusOK
+	return &res
 }
@@ -0,0 +1,434 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"chihaya/database"
+	cdb "chihaya/database/types"
+	"chihaya/server/params"
+)
+
+func newTestAnnounce(lastAnnounce int64) (*database.Database, *cdb.User, *cdb.Peer, *params.QueryParam) {
+	var (
+		infoHash = cdb.TorrentHash{1, 2, 3}
+		peerID   = "-TR2940-000000000000"
+	)
+
+	user := &cdb.User{}
+	user.ID.Store(7)
+
+	peer := &cdb.Peer{
+		Addr:         cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{9, 10, 11, 123}), 24512),
+		ID:           cdb.PeerIDFromRawString(peerID),
+		UserID:       7,
+		TorrentID:    42,
+		Uploaded:     100,
+		LastAnnounce: lastAnnounce,
+		Seeding:      true,
+	}
+
+	leech := &cdb.Peer{
+		Addr:   cdb.NewPeerAddressFromAddrPort(netip.AddrFrom4([4]byte{9, 10, 11, 124}), 24512),
+		UserID: 8,
+	}
+
+	torrent := &cdb.Torrent{
+		Seeders:  cdb.NewPeers(map[cdb.PeerKey]*cdb.Peer{cdb.NewPeerKey(7, peer.ID): peer}),
+		Leechers: cdb.NewPeers(map[cdb.PeerKey]*cdb.Peer{cdb.NewPeerKey(8, peer.ID): leech}),
+	}
+	torrent.ID.Store(42)
+	torrent.SeedersLength.Store(1)
+	torrent.LeechersLength.Store(1)
+
+	db := &database.Database{}
+	db.Torrents.Store(cdb.NewTorrentShards(map[cdb.TorrentHash]*cdb.Torrent{infoHash: torrent}))
+	db.Clients.Store(&map[uint16]string{1: "-TR"})
+
+	var qp params.QueryParam
+
+	qp.Params.InfoHashes = []cdb.TorrentHash{infoHash}
+	qp.Params.PeerID = peerID
+	qp.Params.Port = 24512
+	qp.Params.Uploaded = 200
+	qp.Exists.Port, qp.Exists.Uploaded, qp.Exists.Downloaded, qp.Exists.Left = true, true, true, true
+
+	return db, user, peer, &qp
+}
+
+func testAnnounceEarlySkip(t *testing.T) {
+	db, user, peer, qp := newTestAnnounce(time.Now().Unix() - 5)
+
+	minIntervalMode = minIntervalSkip
+	defer func() {
+		minIntervalMode = minIntervalOff
+	}()
+
+	var res *announceResponse
+
+	if f := handleAnnounce(qp, netip.MustParseAddr("9.10.11.123"), user, db, func(r *announceResponse) {
+		res = r
+	}); f != nil {
+		t.Fatalf("Expected early announce to be answered, got failure %s", f.reason)
+	}
+
+	if res == nil || res.seeders != 1 || res.leechers != 1 || len(res.peers4) != 1 {
+		t.Fatalf("Expected response with current swarm state, got %+v", res)
+	}
+
+	if peer.Uploaded != 100 {
+		t.Fatalf("Expected peer stats not to be updated by early announce, got uploaded %d", peer.Uploaded)
+	}
+}
+
+func testAnnounceEarlyReject(t *testing.T) {
+	db, user, _, qp := newTestAnnounce(time.Now().Unix() - 5)
+
+	minIntervalMode = minIntervalReject
+	defer func() {
+		minIntervalMode = minIntervalOff
+	}()
+
+	f := handleAnnounce(qp, netip.MustParseAddr("9.10.11.123"), user, db, func(_ *announceResponse) {
+		t.Fatalf("Expected early announce to be rejected")
+	})
+	if f == nil {
+		t.Fatalf("Expected early announce to be rejected")
+	}
+
+	if expected := time.Duration(minAnnounceInterval-5) * time.Second; f.interval != expected {
+		t.Fatalf("Expected retry interval %s, got %s", expected, f.interval)
+	}
+}
+
+func testEarlyAnnounce(t *testing.T) {
+	now := time.Now().Unix()
+
+	minIntervalMode = minIntervalSkip
+	defer func() {
+		minIntervalMode = minIntervalOff
+	}()
+
+	testCases := []struct {
+		lastAnnounce int64
+		event        string
+		left         uint64
+		early        bool
+	}{
+		{now - 5, "", 0, true},
+		{now - int64(minAnnounceInterval), "", 0, false},
+		{now - 5, "started", 0, false},
+		{now - 5, "completed", 0, false},
+		{now - 5, "stopped", 0, false},
+		{now - 5, "", 1, false}, // seeder becoming leecher
+		{now - 5, "paused", 0, true},
+		{now - 5, "paused", 1, false}, // seeder becoming partial seed
+	}
+
+	for _, testCase := range testCases {
+		db, _, _, qp := newTestAnnounce(testCase.lastAnnounce)
+		qp.Params.Event, qp.Params.Left = testCase.event, testCase.left
+
+		torrent, _ := db.Torrents.Get(qp.Params.InfoHashes[0])
+
+		early := earlyAnnounce(torrent, cdb.NewPeerKey(7, cdb.PeerIDFromRawString(qp.Params.PeerID)), qp, now)
+		if (early != nil) != testCase.early {
+			t.Fatalf("Expected early %t for %+v, got %t", testCase.early, testCase, early != nil)
+		}
+	}
+
+	// Unknown peer is never early
+	db, _, _, qp := newTestAnnounce(now)
+	torrent, _ := db.Torrents.Get(qp.Params.InfoHashes[0])
+
+	if earlyAnnounce(torrent, cdb.NewPeerKey(9, cdb.PeerIDFromRawString(qp.Params.PeerID)), qp, now) != nil {
+		t.Fatalf("Expected unknown peer not to be early")
+	}
+
+	// Nothing is early unless operator opted in
+	minIntervalMode = minIntervalOff
+
+	db, _, _, qp = newTestAnnounce(now - 5)
+	torrent, _ = db.Torrents.Get(qp.Params.InfoHashes[0])
+
+	if earlyAnnounce(torrent, cdb.NewPeerKey(7, cdb.PeerIDFromRawString(qp.Params.PeerID)), qp, now) != nil {
+		t.Fatalf("Expected early announce to be processed as usual with min_interval_mode %s", minIntervalOff)
+	}
+}
+
+func testAnnouncePartialSeed(t *testing.T) {
+	db, _, peer, qp := newTestAnnounce(time.Now().Unix())
+
+	torrent, _ := db.Torrents.Get(qp.Params.InfoHashes[0])
+	for _, leech := range torrent.Leechers.All() {
+		torrent.SetPartialSeed(leech, true)
+	}
+
+	if res := newAnnounceResponse(torrent, peer, 50, true, true); len(res.peers4) != 0 {
+		t.Fatalf("Expected partial seed not to be sent to seeder, got %d peers", len(res.peers4))
+	}
+
+	if res := newAnnounceResponse(torrent, &cdb.Peer{UserID: 9}, 50, false, true); len(res.peers4) != 2 {
+		t.Fatalf("Expected seeder and partial seed to be sent to leecher, got %d peers", len(res.peers4))
+	}
+
+	if downloaders := torrent.Downloaders(); downloaders != 0 {
+		t.Fatalf("Expected no downloaders, got %d", downloaders)
+	}
+
+	_, leech := torrent.Leechers.At(0)
+	torrent.SetPartialSeed(leech, false)
+
+	if downloaders := torrent.Downloaders(); downloaders != 1 {
+		t.Fatalf("Expected leecher which resumed downloading to be counted, got %d", downloaders)
+	}
+
+	torrent.SetPartialSeed(leech, true)
+	torrent.Leechers.Delete(cdb.NewPeerKey(8, peer.ID))
+	torrent.LeechersLength.Store(uint32(torrent.Leechers.Len()))
+	torrent.LeecherRemoved(leech)
+
+	if partialSeeds := torrent.PartialSeedsLength.Load(); partialSeeds != 0 {
+		t.Fatalf("Expected removed partial seed not to be counted, got %d", partialSeeds)
+	}
+}
+
+func testAnnouncePeerKey(t *testing.T) {
+	db, user, peer, qp := newTestAnnounce(time.Now().Unix() - 5)
+	peer.KeyHash = cdb.HashPeerKey("1a2b3c4d")
+
+	qp.Params.Key = "deadbeef"
+
+	if f := handleAnnounce(qp, netip.MustParseAddr("9.10.11.200"), user, db, func(_ *announceResponse) {
+		t.Fatalf("Expected announce with mismatched key to be rejected")
+	}); f == nil {
+		t.Fatalf("Expected announce with mismatched key to be rejected")
+	}
+
+	torrent, _ := db.Torrents.Get(qp.Params.InfoHashes[0])
+
+	// Peer which never sent key adopts one from its next announce
+	peer.KeyHash = 0
+
+	if !verifyPeerKey(torrent, cdb.NewPeerKey(7, peer.ID), cdb.HashPeerKey("deadbeef")) {
+		t.Fatalf("Expected peer without key to accept any key")
+	}
+
+	// Unknown peers are always accepted
+	if !verifyPeerKey(torrent, cdb.NewPeerKey(9, peer.ID), cdb.HashPeerKey("deadbeef")) {
+		t.Fatalf("Expected unknown peer to accept any key")
+	}
+}
+
+func testAnnouncePeerKeyProtocols(t *testing.T) {
+	minIntervalMode = minIntervalSkip
+	defer func() {
+		minIntervalMode = minIntervalOff
+	}()
+
+	var args fasthttp.Args
+
+	args.Parse("key=1a2b3c4d")
+
+	httpQp, err := params.ParseQuery(&args)
+	if err != nil {
+		panic(err)
+	}
+
+	udpAnnounce := func(key uint32) *params.QueryParam {
+		packet := make([]byte, udpAnnounceRequestSize)
+		copy(packet[16:36], []byte{1, 2, 3})
+		copy(packet[36:56], "-TR2940-000000000000")
+		binary.BigEndian.PutUint64(packet[72:80], 200)
+		binary.BigEndian.PutUint32(packet[88:92], key)
+		binary.BigEndian.PutUint16(packet[96:98], 24512)
+
+		qp := parseUDPAnnounce(packet)
+
+		return &qp
+	}
+
+	// Peer first announced over HTTP and then switched to UDP
+	db, user, peer, _ := newTestAnnounce(time.Now().Unix() - 5)
+	peer.KeyHash = cdb.HashPeerKey(httpQp.Params.Key)
+
+	if f := handleAnnounce(udpAnnounce(0x1a2b3c4d), netip.MustParseAddr("9.10.11.123"), user, db,
+		func(_ *announceResponse) {}); f != nil {
+		t.Fatalf("Expected UDP announce with same key as HTTP one to be accepted, got failure %s", f.reason)
+	}
+
+	if f := handleAnnounce(udpAnnounce(0xdeadbeef), netip.MustParseAddr("9.10.11.123"), user, db,
+		func(_ *announceResponse) {}); f == nil || f.category != failurePeerKeyMismatch {
+		t.Fatalf("Expected UDP announce with different key to be rejected")
+	}
+
+	// Peer first announced over UDP and then switched to HTTP
+	db, user, peer, qp := newTestAnnounce(time.Now().Unix() - 5)
+	peer.KeyHash = cdb.HashPeerKey(udpAnnounce(0x1a2b3c4d).Params.Key)
+
+	qp.Params.Key = httpQp.Params.Key
+
+	if f := handleAnnounce(qp, netip.MustParseAddr("9.10.11.123"), user, db, func(_ *announceResponse) {}); f != nil {
+		t.Fatalf("Expected HTTP announce with same key as UDP one to be accepted, got failure %s", f.reason)
+	}
+}
+
+func testRandomPeers(t *testing.T) {
+	const (
+		rounds = 50000
+		picked = 5
+	)
+
+	for _, n := range []int{20, 23} {
+		var peers cdb.Peers
+
+		for i := range uint32(n) {
+			peers.Put(cdb.NewPeerKey(i, cdb.PeerID{}), &cdb.Peer{UserID: i})
+		}
+
+		counts := make([]int, n)
+		pairs := make(map[[2]uint32]int)
+
+		for range rounds {
+			selection := make([]uint32, 0, picked)
+
+			for _, peer := range randomPeers(&peers) {
+				if len(selection) == picked {
+					break
+				}
+
+				if slices.Contains(selection, peer.UserID) {
+					t.Fatalf("Expected every peer to be returned once, got %d twice", peer.UserID)
+				}
+
+				selection = append(selection, peer.UserID)
+			}
+
+			for i, a := range selection {
+				counts[a]++
+
+				for _, b := range selection[i+1:] {
+					pairs[[2]uint32{min(a, b), max(a, b)}]++
+				}
+			}
+		}
+
+		expected := rounds * picked / n
+		for id, count := range counts {
+			if count < expected*9/10 || count > expected*11/10 {
+				t.Fatalf("Expected peer %d of %d to be picked about %d times, got %d", id, n, expected, count)
+			}
+		}
+
+		// Peers that joined one after another should not be sent together much more often than any other pair
+		expectedPair := rounds * picked * (picked - 1) / (n * (n - 1))
+		if count := pairs[[2]uint32{0, 1}]; count > 2*expectedPair {
+			t.Fatalf("Expected adjacent peers to be picked together about %d times, got %d", expectedPair, count)
+		}
+
+		if n == 23 && len(pairs) != n*(n-1)/2 {
+			t.Fatalf("Expected every pair of %d peers to be picked together, got %d pairs", n, len(pairs))
+		}
+	}
+}
+
+func testAnnounceFailureCategory(t *testing.T) {
+	testCases := []struct {
+		name     string
+		modify   func(db *database.Database, qp *params.QueryParam)
+		category string
+	}{
+		{"missing info_hash", func(_ *database.Database, qp *params.QueryParam) {
+			qp.Params.InfoHashes = nil
+		}, failureMalformed},
+		{"missing left", func(_ *database.Database, qp *params.QueryParam) {
+			qp.Exists.Left = false
+		}, failureMalformed},
+		{"unapproved client", func(_ *database.Database, qp *params.QueryParam) {
+			qp.Params.PeerID = "-XX0001-000000000000"
+		}, failureUnapprovedClient},
+		{"unknown torrent", func(_ *database.Database, qp *params.QueryParam) {
+			qp.Params.InfoHashes = []cdb.TorrentHash{{4, 5, 6}}
+		}, failureUnregisteredTorrent},
+		{"pruned torrent", func(db *database.Database, qp *params.QueryParam) {
+			torrent, _ := db.Torrents.Get(qp.Params.InfoHashes[0])
+			torrent.Status.Store(1)
+			qp.Params.Left = 1
+		}, failureUnregisteredTorrent},
+		{"peer key mismatch", func(_ *database.Database, qp *params.QueryParam) {
+			qp.Params.Key = "deadbeef"
+		}, failurePeerKeyMismatch},
+	}
+
+	for _, tc := range testCases {
+		db, user, peer, qp := newTestAnnounce(time.Now().Unix() - 5)
+		peer.KeyHash = cdb.HashPeerKey("1a2b3c4d")
+
+		tc.modify(db, qp)
+
+		f := handleAnnounce(qp, netip.MustParseAddr("9.10.11.123"), user, db, func(_ *announceResponse) {})
+		if f == nil {
+			t.Fatalf("Expected announce with %s to fail", tc.name)
+		}
+
+		if f.category != tc.category {
+			t.Fatalf("Expected failure category of %s to be %s, got %s (%s)", tc.name, tc.category, f.category, f.reason)
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	t.Run("EarlyAnnounce", func(t *testing.T) {
+		testEarlyAnnounce(t)
+	})
+
+	t.Run("EarlySkip", func(t *testing.T) {
+		testAnnounceEarlySkip(t)
+	})
+
+	t.Run("EarlyReject", func(t *testing.T) {
+		testAnnounceEarlyReject(t)
+	})
+
+	t.Run("PartialSeed", func(t *testing.T) {
+		testAnnouncePartialSeed(t)
+	})
+
+	t.Run("PeerKey", func(t *testing.T) {
+		testAnnouncePeerKey(t)
+	})
+
+	t.Run("PeerKeyProtocols", func(t *testing.T) {
+		testAnnouncePeerKeyProtocols(t)
+	})
+
+	t.Run("RandomPeers", func(t *testing.T) {
+		testRandomPeers(t)
+	})
+
+	t.Run("FailureCategory", func(t *testing.T) {
+		testAnnounceFailureCategory(t)
+	})
+}
@@ -30,7 +30,7 @@ import (
 func metrics(_ *fasthttp.RequestCtx, db *database.Database, buf *bytes.Buffer) int {
 	collector.UpdateUptime(handler.startTime)
 	collector.UpdatePeers(func() (c int) {
-		for _, t := range *db.Torrents.Load() {
+		for _, t := range db.Torrents.All() {
 			c += int(t.LeechersLength.Load()) + int(t.SeedersLength.Load())
 		}
 
@@ -37,13 +37,16 @@ type QueryParam struct {
 
 		PeerID string
 		IPv4   string
+		IPv6   string
 		IP     string
 		Event  string
+		Key    string
 
 		testGarbageUnescape string // for testing purposes
 
-		Compact  bool
-		NoPeerID bool
+		Compact    bool
+		NoPeerID   bool
+		UploadOnly bool
 
 		InfoHashes []cdb.TorrentHash
 	}
@@ -58,12 +61,15 @@ type QueryParam struct {
 
 		PeerID bool
 		IP     bool
+		IPv6   bool
 		Event  bool
+		Key    bool
 
 		testGarbageUnescape bool // for testing purposes
 
-		Compact  bool
-		NoPeerID bool
+		Compact    bool
+		NoPeerID   bool
+		UploadOnly bool
 
 		InfoHashes bool
 	}
@@ -78,7 +84,9 @@ var numWant = []byte("numwant")
 
 var peerIDKey = []byte("peer_id")
 var ipKey = []byte("ip")
+var ipv6Key = []byte("ipv6")
 var eventKey = []byte("event")
+var keyKey = []byte("key")
 
 var testGarbageUnescapeKey = []byte("!@#") // for testing purposes
 
@@ -86,6 +94,7 @@ var infoHashKey = []byte("info_hash")
 
 var compactKey = []byte("compact")
 var noPeerIDKey = []byte("no_peer_id")
+var uploadOnlyKey = []byte("upload_only")
 
 func ParseQuery(queryArgs *fasthttp.Args) (qp QueryParam, err error) {
 	for key, value := range queryArgs.All() {
@@ -143,9 +152,15 @@ func ParseQuery(queryArgs *fasthttp.Args) (qp QueryParam, err error) {
 		case bytes.Equal(key, ipKey):
 			qp.Params.IP = string(value)
 			qp.Exists.IP = true
+		case bytes.Equal(key, ipv6Key):
+			qp.Params.IPv6 = string(value)
+			qp.Exists.IPv6 = true
 		case bytes.Equal(key, eventKey):
 			qp.Params.Event = string(value)
 			qp.Exists.Event = true
+		case bytes.Equal(key, keyKey):
+			qp.Params.Key = string(value)
+			qp.Exists.Key = true
 		case bytes.Equal(key, testGarbageUnescapeKey): // for testing purposes
 			qp.Params.testGarbageUnescape = string(value)
 			qp.Exists.testGarbageUnescape = true
@@ -160,6 +175,9 @@ func ParseQuery(queryArgs *fasthttp.Args) (qp QueryParam, err error) {
 		case bytes.Equal(key, noPeerIDKey):
 			qp.Params.NoPeerID = bytes.Equal(value, []byte{'1'})
 			qp.Exists.NoPeerID = true
+		case bytes.Equal(key, uploadOnlyKey):
+			qp.Params.UploadOnly = bytes.Equal(value, []byte{'1'})
+			qp.Exists.UploadOnly = true
 		}
 	}
 
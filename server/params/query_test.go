@@ -52,12 +52,17 @@ func TestParseQuery(t *testing.T) {
 	queryParsed.Params.Port, queryParsed.Exists.Port = 25362, true
 	queryParsed.Params.PeerID, queryParsed.Exists.PeerID = "-CH010-VnpZR7uz31I1A", true
 	queryParsed.Params.Left, queryParsed.Exists.Left = 0, true
+	queryParsed.Params.IPv6, queryParsed.Exists.IPv6 = "2001:db8::1", true
+	queryParsed.Params.UploadOnly, queryParsed.Exists.UploadOnly = true, true
+	queryParsed.Params.Key, queryParsed.Exists.Key = "1a2b3c4d", true
 
-	query := fmt.Sprintf("event=%s&port=%d&peer_id=%s&left=%d",
+	query := fmt.Sprintf("event=%s&port=%d&peer_id=%s&left=%d&ipv6=%s&upload_only=1&key=%s",
 		queryParsed.Params.Event,
 		queryParsed.Params.Port,
 		queryParsed.Params.PeerID,
 		queryParsed.Params.Left,
+		url.QueryEscape(queryParsed.Params.IPv6),
+		queryParsed.Params.Key,
 	)
 
 	for _, infoHash := range infoHashes {
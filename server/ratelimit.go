@@ -0,0 +1,228 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"chihaya/collector"
+	"chihaya/config"
+)
+
+const rateLimitShards = 64
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+tokenBuckets Set of token buckets sharing same budget, keyed by K. Buckets are refilled at rate tokens per second
+up to burst tokens; requests are allowed as long as there is at least one token in bucket.
+Each shard holds at most shardLimit buckets (unless it is 0), so that clients cycling through many keys can not
+grow it without bound between purges.
+*/
+type tokenBuckets[K comparable] struct {
+	rate       float64
+	burst      float64
+	shardLimit int
+
+	seed   maphash.Seed
+	shards [rateLimitShards]struct {
+		sync.Mutex
+		buckets map[K]*tokenBucket
+	}
+}
+
+// newTokenBuckets Returns nil (which allows everything) when rate is not positive
+func newTokenBuckets[K comparable](perMinute, burst, limit int) *tokenBuckets[K] {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	b := &tokenBuckets[K]{
+		rate:  float64(perMinute) / 60,
+		burst: float64(max(burst, 1)),
+		seed:  maphash.MakeSeed(),
+	}
+
+	if limit > 0 {
+		b.shardLimit = max(limit/rateLimitShards, 1)
+	}
+
+	for i := range b.shards {
+		b.shards[i].buckets = make(map[K]*tokenBucket)
+	}
+
+	return b
+}
+
+// allow Takes single token from bucket of key; if there is none, returns time after which request can be retried
+func (b *tokenBuckets[K]) allow(key K, now time.Time) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	shard := &b.shards[maphash.Comparable(b.seed, key)%rateLimitShards]
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	bucket, exists := shard.buckets[key]
+	if !exists {
+		if b.shardLimit > 0 && len(shard.buckets) >= b.shardLimit && b.purgeShard(shard.buckets, now) == 0 {
+			// Nothing is idle, make room by evicting arbitrary bucket
+			for k := range shard.buckets {
+				delete(shard.buckets, k)
+				break
+			}
+		}
+
+		bucket = &tokenBucket{tokens: b.burst, last: now}
+		shard.buckets[key] = bucket
+	} else {
+		bucket.tokens = min(b.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return false, time.Duration(math.Ceil((1-bucket.tokens)/b.rate)) * time.Second
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+// purge Removes buckets that would be full by now, as they are indistinguishable from new ones
+func (b *tokenBuckets[K]) purge(now time.Time) (count int) {
+	if b == nil {
+		return 0
+	}
+
+	for i := range b.shards {
+		shard := &b.shards[i]
+
+		shard.Lock()
+		count += b.purgeShard(shard.buckets, now)
+		shard.Unlock()
+	}
+
+	return count
+}
+
+// purgeShard Removes full buckets from single shard, caller must hold its lock
+func (b *tokenBuckets[K]) purgeShard(buckets map[K]*tokenBucket, now time.Time) (count int) {
+	for key, bucket := range buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate >= b.burst {
+			delete(buckets, key)
+
+			count++
+		}
+	}
+
+	return count
+}
+
+// rateLimiter Holds separate per-user and per-IP budgets for single kind of request
+type rateLimiter struct {
+	action string
+
+	users *tokenBuckets[uint32]
+	ips   *tokenBuckets[netip.Addr]
+}
+
+func newRateLimiter(action string) *rateLimiter {
+	rateLimitConfig := config.Section("rate_limit")
+	section := rateLimitConfig.Section(action)
+
+	maxBuckets, _ := rateLimitConfig.GetInt("max_buckets", 1<<20)
+	userRate, _ := section.GetInt("user_rate", 0)
+	userBurst, _ := section.GetInt("user_burst", 10)
+	ipRate, _ := section.GetInt("ip_rate", 0)
+	ipBurst, _ := section.GetInt("ip_burst", 30)
+
+	return &rateLimiter{
+		action: action,
+		users:  newTokenBuckets[uint32](userRate, userBurst, maxBuckets),
+		ips:    newTokenBuckets[netip.Addr](ipRate, ipBurst, maxBuckets),
+	}
+}
+
+/*
+rateLimitAddr Returns address under which requests from addr are counted: IPv4 addresses as they are and IPv6 ones
+by their /64 prefix, as that is usually the smallest network assigned to single client
+*/
+func rateLimitAddr(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return addr
+	}
+
+	prefix, err := addr.Prefix(64)
+	if err != nil {
+		return addr
+	}
+
+	return prefix.Addr()
+}
+
+func (l *rateLimiter) allowIP(addr netip.Addr) *requestFailure {
+	if l == nil {
+		return nil
+	}
+
+	if ok, retry := l.ips.allow(rateLimitAddr(addr), time.Now()); !ok {
+		collector.IncrementThrottledRequests(l.action, "ip")
+		return &requestFailure{failureRateLimited, fmt.Sprintf("Rate limit exceeded (%s)", l.action), retry}
+	}
+
+	return nil
+}
+
+func (l *rateLimiter) allowUser(id uint32) *requestFailure {
+	if l == nil {
+		return nil
+	}
+
+	if ok, retry := l.users.allow(id, time.Now()); !ok {
+		collector.IncrementThrottledRequests(l.action, "user")
+		return &requestFailure{failureRateLimited, fmt.Sprintf("Rate limit exceeded (%s)", l.action), retry}
+	}
+
+	return nil
+}
+
+func (l *rateLimiter) purge(now time.Time) int {
+	return l.users.purge(now) + l.ips.purge(now)
+}
+
+var (
+	announceLimiter *rateLimiter
+	scrapeLimiter   *rateLimiter
+)
+
+func init() {
+	announceLimiter = newRateLimiter("announce")
+	scrapeLimiter = newRateLimiter("scrape")
+}
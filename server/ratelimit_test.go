@@ -0,0 +1,158 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testTokenBucketsAllow(t *testing.T) {
+	var (
+		b    = newTokenBuckets[uint32](60, 3, 0) // 1 token per second
+		now  = time.Now()
+		ok   bool
+		wait time.Duration
+	)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ = b.allow(1, now); !ok {
+			t.Fatalf("Expected request %d within burst to be allowed", i)
+		}
+	}
+
+	if ok, wait = b.allow(1, now); ok || wait != time.Second {
+		t.Fatalf("Expected request over burst to be denied with retry of %s, got %t and %s", time.Second, ok, wait)
+	}
+
+	if ok, _ = b.allow(2, now); !ok {
+		t.Fatalf("Expected request of other key to be allowed")
+	}
+
+	if ok, _ = b.allow(1, now.Add(time.Second)); !ok {
+		t.Fatalf("Expected request to be allowed after refill")
+	}
+
+	if ok, _ = b.allow(1, now.Add(time.Second)); ok {
+		t.Fatalf("Expected request to be denied after consuming refilled token")
+	}
+}
+
+func testTokenBucketsPurge(t *testing.T) {
+	var (
+		b   = newTokenBuckets[netip.Addr](60, 3, 0)
+		now = time.Now()
+	)
+
+	b.allow(netip.MustParseAddr("9.10.11.123"), now)
+	b.allow(netip.MustParseAddr("2001:db8::1"), now.Add(2*time.Second))
+
+	if count := b.purge(now.Add(time.Second)); count != 1 {
+		t.Fatalf("Expected %d bucket to be purged, got %d", 1, count)
+	}
+
+	if count := b.purge(now.Add(3 * time.Second)); count != 1 {
+		t.Fatalf("Expected %d bucket to be purged, got %d", 1, count)
+	}
+}
+
+func testTokenBucketsLimit(t *testing.T) {
+	var (
+		b   = newTokenBuckets[uint32](60, 3, rateLimitShards) // single bucket per shard
+		now = time.Now()
+	)
+
+	for i := uint32(0); i < 1000; i++ {
+		b.allow(i, now)
+	}
+
+	for i := range b.shards {
+		if count := len(b.shards[i].buckets); count > 1 {
+			t.Fatalf("Expected shard to hold at most %d bucket, got %d", 1, count)
+		}
+	}
+}
+
+func testRateLimitAddr(t *testing.T) {
+	testCases := []struct {
+		addr, expected string
+	}{
+		{"9.10.11.123", "9.10.11.123"},
+		{"::ffff:9.10.11.123", "9.10.11.123"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::"},
+	}
+
+	for _, tc := range testCases {
+		if got := rateLimitAddr(netip.MustParseAddr(tc.addr)); got != netip.MustParseAddr(tc.expected) {
+			t.Fatalf("Expected %s to be limited as %s, got %s", tc.addr, tc.expected, got)
+		}
+	}
+
+	l := &rateLimiter{action: "announce", ips: newTokenBuckets[netip.Addr](60, 1, 0)}
+
+	if f := l.allowIP(netip.MustParseAddr("2001:db8:1:2::1")); f != nil {
+		t.Fatalf("Expected first request to be allowed, got %v", f)
+	}
+
+	if f := l.allowIP(netip.MustParseAddr("2001:db8:1:2::2")); f == nil {
+		t.Fatalf("Expected request from same /64 to share budget")
+	}
+}
+
+func testTokenBucketsDisabled(t *testing.T) {
+	b := newTokenBuckets[uint32](0, 3, 0)
+	if b != nil {
+		t.Fatalf("Expected token buckets with zero rate to be disabled")
+	}
+
+	for i := 0; i < 100; i++ {
+		if ok, _ := b.allow(1, time.Now()); !ok {
+			t.Fatalf("Expected disabled token buckets to allow every request")
+		}
+	}
+
+	var l *rateLimiter
+	if f := l.allowUser(1); f != nil {
+		t.Fatalf("Expected nil rate limiter to allow every request, got %v", f)
+	}
+}
+
+func TestTokenBuckets(t *testing.T) {
+	t.Run("Allow", func(t *testing.T) {
+		testTokenBucketsAllow(t)
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		testTokenBucketsPurge(t)
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		testTokenBucketsLimit(t)
+	})
+
+	t.Run("Addr", func(t *testing.T) {
+		testRateLimitAddr(t)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		testTokenBucketsDisabled(t)
+	})
+}
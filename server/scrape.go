@@ -48,14 +48,13 @@ func scrape(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, buf
 		// pre-sort keys
 		util.BencodeSortTorrentHashKeys(qp.Params.InfoHashes)
 
-		dbTorrents := *db.Torrents.Load()
-
 		for _, infoHash := range qp.Params.InfoHashes {
-			if torrent, exists := dbTorrents[infoHash]; exists {
+			if torrent, exists := db.Torrents.Get(infoHash); exists {
 				if !isDisabledDownload(db, user, torrent) {
 					util.BencodeScrapeTorrent(buf, infoHash,
 						int64(torrent.SeedersLength.Load()),
 						int64(torrent.Snatched.Load()),
+						int64(torrent.Downloaders()),
 						int64(torrent.LeechersLength.Load()),
 					)
 				}
@@ -67,7 +66,9 @@ func scrape(ctx *fasthttp.RequestCtx, user *cdb.User, db *database.Database, buf
 		return fasthttp.StatusOK
 	}
 
-	failure("Unsupported request - must provide at least one info_hash", buf, 0)
+	respondFailure("scrape", &requestFailure{
+		failureUnsupported, "Unsupported request - must provide at least one info_hash", 0,
+	}, buf)
 
 	return fasthttp.StatusOK // Required by torrent clients to interpret failure response
 }
@@ -28,6 +28,7 @@ import (
 	"chihaya/collector"
 	"chihaya/config"
 	"chihaya/database"
+	"chihaya/record"
 	"chihaya/util"
 
 	"github.com/valyala/fasthttp"
@@ -82,6 +83,11 @@ func (handler *httpHandler) serve(ctx *fasthttp.RequestCtx) {
 		}
 	}()
 
+	var (
+		start    = time.Now()
+		endpoint string
+	)
+
 	/* Pass flow to handler; note that handler should be responsible for actually canceling
 	its own work based on request context cancellation */
 	status := func() int {
@@ -91,8 +97,11 @@ func (handler *httpHandler) serve(ctx *fasthttp.RequestCtx) {
 		case "/":
 			switch file {
 			case "alive":
+				endpoint = file
 				return alive(ctx, handler.db, buf)
 			case "metrics":
+				endpoint = file
+
 				if enabled, _ := config.GetBool("enable_metrics", false); !enabled {
 					return fasthttp.StatusNotFound
 				}
@@ -100,12 +109,40 @@ func (handler *httpHandler) serve(ctx *fasthttp.RequestCtx) {
 				return metrics(ctx, handler.db, buf)
 			}
 		default:
+			var limiter *rateLimiter
+
+			switch file {
+			case "announce":
+				limiter, endpoint = announceLimiter, file
+			case "scrape":
+				limiter, endpoint = scrapeLimiter, file
+			}
+
+			// Failures of requests to unknown endpoints are counted together to keep number of labels bounded
+			action := endpoint
+			if action == "" {
+				action = "unknown"
+			}
+
+			// Malformed forwarding headers are reported by handler itself, so limiting by IP is skipped for them
+			if remoteAddr, err := getIPAddressFromRequest(ctx); err == nil {
+				if f := limiter.allowIP(remoteAddr); f != nil {
+					respondFailure(action, f, buf)
+					return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+				}
+			}
+
 			user := isPasskeyValid(path.Base(dir), handler.db)
 			if user == nil {
-				failure("Your passkey is invalid", buf, 1*time.Hour)
+				respondFailure(action, &requestFailure{failureInvalidPasskey, "Your passkey is invalid", 1 * time.Hour}, buf)
 				return fasthttp.StatusOK
 			}
 
+			if f := limiter.allowUser(user.ID.Load()); f != nil {
+				respondFailure(action, f, buf)
+				return fasthttp.StatusOK // Required by torrent clients to interpret failure response
+			}
+
 			ctx.SetUserValue("user", user) // Pass user in request's context
 
 			switch file {
@@ -127,6 +164,10 @@ func (handler *httpHandler) serve(ctx *fasthttp.RequestCtx) {
 	ctx.Response.Header.SetContentTypeBytes([]byte("text/plain"))
 	ctx.Response.SetStatusCode(status)
 	_, _ = buf.WriteTo(ctx)
+
+	if endpoint != "" {
+		collector.UpdateRequestDuration(endpoint, "http", time.Since(start))
+	}
 }
 
 func (handler *httpHandler) error(ctx *fasthttp.RequestCtx, err error) {
@@ -199,6 +240,16 @@ func Start() {
 		}
 	}()
 
+	// Start new goroutine to purge rate limiting buckets of clients that went quiet
+	go func() {
+		for !handler.terminate {
+			time.Sleep(time.Minute)
+
+			announceLimiter.purge(time.Now())
+			scrapeLimiter.purge(time.Now())
+		}
+	}()
+
 	// Initialize database
 	handler.db.Init()
 
@@ -212,17 +263,29 @@ func Start() {
 
 	slog.Info("ready and accepting new connections", "addr", addr)
 
+	// Start UDP listener (if configured); it shares database and request accounting with HTTP one
+	startUDP(handler.db)
+
+	// Start admin API listener (if configured)
+	startAdmin(handler.db)
+
 	/* Start serving new request. Behind the scenes, this works by spawning a new goroutine for each client.
 	This is pretty fast and scalable since goroutines are nice and efficient. Blocks until TCP listener is closed. */
 	_ = server.Serve(listener)
 
-	// Wait for active connections to finish processing
+	// Wait for active connections and packets to finish processing
 	handler.waitGroup.Wait()
+	waitUDP()
 
 	_ = server.Shutdown()
 
+	stopAdmin()
+
 	slog.Info("now closed and not accepting any new connections")
 
+	// Write out announces which were recorded but not written to event log yet
+	record.Close()
+
 	// Close database connection
 	handler.db.Terminate()
 
@@ -235,5 +298,7 @@ func Stop() {
 		_ = listener.Close()
 	}
 
+	stopUDP()
+
 	handler.terminate = true
 }
@@ -0,0 +1,488 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"path"
+	"runtime"
+	"sync"
+	"time"
+
+	"chihaya/collector"
+	"chihaya/config"
+	"chihaya/database"
+	cdb "chihaya/database/types"
+	"chihaya/server/params"
+)
+
+// Protocol constants as defined in BEP-15 and BEP-41
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectRequestSize  = 16
+	udpAnnounceRequestSize = 98
+	udpScrapeRequestSize   = 16
+
+	udpMaxScrapeHashes = 74
+
+	udpOptionEndOfOptions = 0
+	udpOptionNOP          = 1
+	udpOptionURLData      = 2
+
+	// udpConnectionIDWindow Connection IDs are accepted in window they were issued in and in the one following it
+	udpConnectionIDWindow = time.Minute
+)
+
+var (
+	errUDPMalformedOptions = errors.New("malformed request options")
+
+	// Event 4 is defined by BEP-21 for partial seeds
+	udpAnnounceEvents = [...]string{"", "completed", "started", "stopped", "paused"}
+)
+
+type udpServer struct {
+	conn *net.UDPConn
+	db   *database.Database
+
+	connectionIDs *connectionIDGenerator
+
+	// scrapeEnabled Whether scrape is served; unlike announce it carries no passkey, so it is opt-in via udp.scrape
+	scrapeEnabled bool
+
+	waitGroup sync.WaitGroup
+}
+
+var udp *udpServer
+
+// connectionIDGenerator Issues stateless connection IDs which are HMAC of client address and time window
+type connectionIDGenerator struct {
+	pool sync.Pool
+}
+
+func newConnectionIDGenerator() *connectionIDGenerator {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	return &connectionIDGenerator{pool: sync.Pool{New: func() any {
+		return hmac.New(sha256.New, secret)
+	}}}
+}
+
+func (g *connectionIDGenerator) generate(addr netip.Addr, window int64) uint64 {
+	var buf [8 + 16]byte
+
+	binary.BigEndian.PutUint64(buf[:8], uint64(window))
+	ip := addr.As16()
+	copy(buf[8:], ip[:])
+
+	mac := g.pool.Get().(hash.Hash)
+	defer g.pool.Put(mac)
+
+	mac.Reset()
+	_, _ = mac.Write(buf[:])
+
+	var sum [sha256.Size]byte
+
+	return binary.BigEndian.Uint64(mac.Sum(sum[:0]))
+}
+
+func (g *connectionIDGenerator) issue(addr netip.Addr, now time.Time) uint64 {
+	return g.generate(addr, now.Unix()/int64(udpConnectionIDWindow.Seconds()))
+}
+
+func (g *connectionIDGenerator) validate(id uint64, addr netip.Addr, now time.Time) bool {
+	window := now.Unix() / int64(udpConnectionIDWindow.Seconds())
+
+	return id == g.generate(addr, window) || id == g.generate(addr, window-1)
+}
+
+// parseUDPURLData Concatenates all BEP-41 URLData options and returns passkey found in resulting path
+func parseUDPURLData(options []byte) (string, error) {
+	var urlData []byte
+
+loop:
+	for len(options) > 0 {
+		switch options[0] {
+		case udpOptionEndOfOptions:
+			break loop
+		case udpOptionNOP:
+			options = options[1:]
+		case udpOptionURLData:
+			if len(options) < 2 || len(options) < 2+int(options[1]) {
+				return "", errUDPMalformedOptions
+			}
+
+			urlData = append(urlData, options[2:2+int(options[1])]...)
+			options = options[2+int(options[1]):]
+		default:
+			// Unknown options carry length as well, so that they can be skipped
+			if len(options) < 2 || len(options) < 2+int(options[1]) {
+				return "", errUDPMalformedOptions
+			}
+
+			options = options[2+int(options[1]):]
+		}
+	}
+
+	if i := bytes.IndexByte(urlData, '?'); i >= 0 {
+		urlData = urlData[:i]
+	}
+
+	dir, _ := path.Split(string(urlData))
+	if dir == "" || dir == "/" {
+		return "", nil
+	}
+
+	return path.Base(dir), nil
+}
+
+// parseUDPAnnounce Translates announce packet into query params so that it can be processed same way as HTTP one
+func parseUDPAnnounce(packet []byte) (qp params.QueryParam) {
+	qp.Params.InfoHashes = []cdb.TorrentHash{cdb.TorrentHashFromBytes(packet[16:36])}
+	qp.Exists.InfoHashes = true
+
+	qp.Params.PeerID = string(packet[36:56])
+	qp.Exists.PeerID = true
+
+	qp.Params.Downloaded = binary.BigEndian.Uint64(packet[56:64])
+	qp.Exists.Downloaded = true
+
+	qp.Params.Left = binary.BigEndian.Uint64(packet[64:72])
+	qp.Exists.Left = true
+
+	qp.Params.Uploaded = binary.BigEndian.Uint64(packet[72:80])
+	qp.Exists.Uploaded = true
+
+	if event := binary.BigEndian.Uint32(packet[80:84]); int(event) < len(udpAnnounceEvents) {
+		qp.Params.Event = udpAnnounceEvents[event]
+		qp.Exists.Event = qp.Params.Event != ""
+	}
+
+	if ip := [4]byte(packet[84:88]); ip != [4]byte{} {
+		qp.Params.IP = netip.AddrFrom4(ip).String()
+		qp.Exists.IP = true
+	}
+
+	// Formatted as hex, same as most clients send key over HTTP; HashPeerKey compares both by value
+	qp.Params.Key = fmt.Sprintf("%08X", binary.BigEndian.Uint32(packet[88:92]))
+	qp.Exists.Key = true
+
+	// Negative value means client wants default amount of peers
+	if numWant := int32(binary.BigEndian.Uint32(packet[92:96])); numWant >= 0 {
+		qp.Params.NumWant = uint16(min(numWant, math.MaxUint16))
+		qp.Exists.NumWant = true
+	}
+
+	qp.Params.Port = binary.BigEndian.Uint16(packet[96:98])
+	qp.Exists.Port = true
+
+	return qp
+}
+
+func appendUDPHeader(buf []byte, action uint32, transactionID []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, action)
+	return append(buf, transactionID...)
+}
+
+func appendUDPError(buf []byte, transactionID []byte, reason string) []byte {
+	buf = appendUDPHeader(buf[:0], udpActionError, transactionID)
+	return append(buf, reason...)
+}
+
+// appendUDPFailure Counts failure of given action in metrics and appends it as error response
+func appendUDPFailure(buf []byte, transactionID []byte, action string, f *requestFailure) []byte {
+	collector.IncrementFailures(action, f.category)
+	return appendUDPError(buf, transactionID, f.reason)
+}
+
+func (s *udpServer) connect(buf []byte, remoteAddr netip.Addr, packet []byte) []byte {
+	buf = appendUDPHeader(buf, udpActionConnect, packet[12:16])
+	return binary.BigEndian.AppendUint64(buf, s.connectionIDs.issue(remoteAddr, time.Now()))
+}
+
+func (s *udpServer) announce(buf []byte, remoteAddr netip.Addr, packet []byte) []byte {
+	transactionID := packet[12:16]
+
+	if len(packet) < udpAnnounceRequestSize {
+		return appendUDPFailure(buf, transactionID, "announce", &requestFailure{
+			category: failureMalformed, reason: "Malformed request - announce packet too short",
+		})
+	}
+
+	if f := announceLimiter.allowIP(remoteAddr); f != nil {
+		return appendUDPFailure(buf, transactionID, "announce", f)
+	}
+
+	passkey, err := parseUDPURLData(packet[udpAnnounceRequestSize:])
+	if err != nil {
+		return appendUDPFailure(buf, transactionID, "announce", &requestFailure{
+			category: failureMalformed, reason: "Malformed request - " + err.Error(),
+		})
+	}
+
+	user := isPasskeyValid(passkey, s.db)
+	if user == nil {
+		return appendUDPFailure(buf, transactionID, "announce", &requestFailure{
+			category: failureInvalidPasskey, reason: "Your passkey is invalid",
+		})
+	}
+
+	if f := announceLimiter.allowUser(user.ID.Load()); f != nil {
+		return appendUDPFailure(buf, transactionID, "announce", f)
+	}
+
+	qp := parseUDPAnnounce(packet)
+
+	if f := handleAnnounce(&qp, remoteAddr, user, s.db, func(res *announceResponse) {
+		buf = appendUDPHeader(buf, udpActionAnnounce, transactionID)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(res.interval))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(res.leechers))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(res.seeders))
+
+		if !res.withPeers {
+			return
+		}
+
+		// Peers are returned in address family of socket request came from, as there is no way to tell them apart
+		if remoteAddr.Is4() {
+			for _, peer := range res.peers4 {
+				buf = append(buf, peer.Addr[:]...)
+			}
+		} else {
+			for _, peer := range res.peers6 {
+				buf = append(buf, peer.Addr6[:]...)
+			}
+		}
+	}); f != nil {
+		return appendUDPFailure(buf, transactionID, "announce", f)
+	}
+
+	return buf
+}
+
+func (s *udpServer) scrape(buf []byte, remoteAddr netip.Addr, packet []byte) []byte {
+	transactionID := packet[12:16]
+
+	if f := scrapeLimiter.allowIP(remoteAddr); f != nil {
+		return appendUDPFailure(buf, transactionID, "scrape", f)
+	}
+
+	if enabled, _ := config.GetBool("enable_scrape", true); !enabled || !s.scrapeEnabled {
+		return appendUDPFailure(buf, transactionID, "scrape", &requestFailure{
+			category: failureUnsupported, reason: "Unsupported request - scrape is disabled",
+		})
+	}
+
+	hashes := packet[udpScrapeRequestSize:]
+	if len(hashes) == 0 || len(hashes)%cdb.TorrentHashSize != 0 {
+		return appendUDPFailure(buf, transactionID, "scrape", &requestFailure{
+			category: failureUnsupported, reason: "Unsupported request - must provide at least one info_hash",
+		})
+	}
+
+	buf = appendUDPHeader(buf, udpActionScrape, transactionID)
+
+	// Order of response entries must match the request, so unknown torrents are reported as empty
+	for i := 0; i < len(hashes)/cdb.TorrentHashSize && i < udpMaxScrapeHashes; i++ {
+		var seeders, snatched, leechers uint32
+
+		if torrent, exists := s.db.Torrents.Get(cdb.TorrentHashFromBytes(hashes[i*cdb.TorrentHashSize:])); exists {
+			seeders = torrent.SeedersLength.Load()
+			snatched = uint32(torrent.Snatched.Load())
+			leechers = torrent.LeechersLength.Load()
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, seeders)
+		buf = binary.BigEndian.AppendUint32(buf, snatched)
+		buf = binary.BigEndian.AppendUint32(buf, leechers)
+	}
+
+	return buf
+}
+
+/*
+handle Processes single packet and returns response to be sent back (if any); buf is used as backing storage for
+response so that workers do not have to allocate memory for every packet
+*/
+func (s *udpServer) handle(buf []byte, remoteAddr netip.Addr, packet []byte) []byte {
+	// Packets that are too short to contain transaction ID are silently dropped as there is no way to respond to them
+	if len(packet) < udpConnectRequestSize {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+
+		return s.connect(buf[:0], remoteAddr, packet)
+	}
+
+	// Name of action as used in metrics, unknown actions are counted together to keep number of labels bounded
+	name := "unknown"
+
+	switch action {
+	case udpActionAnnounce:
+		name = "announce"
+	case udpActionScrape:
+		name = "scrape"
+	}
+
+	if !s.connectionIDs.validate(connectionID, remoteAddr, time.Now()) {
+		return appendUDPFailure(buf, transactionID, name, &requestFailure{
+			category: failureConnectionID, reason: "Connection ID mismatch",
+		})
+	}
+
+	if name == "unknown" {
+		return appendUDPFailure(buf, transactionID, name, &requestFailure{
+			category: failureUnsupported, reason: "Unsupported request - unknown action",
+		})
+	}
+
+	start := time.Now()
+
+	defer func() {
+		collector.UpdateRequestDuration(name, "udp", time.Since(start))
+	}()
+
+	if action == udpActionAnnounce {
+		return s.announce(buf[:0], remoteAddr, packet)
+	}
+
+	return s.scrape(buf[:0], remoteAddr, packet)
+}
+
+func (s *udpServer) serve() {
+	defer s.waitGroup.Done()
+
+	var (
+		packet = make([]byte, 2048)
+		buf    = make([]byte, 0, 2048)
+	)
+
+	for {
+		n, remoteAddrPort, err := s.conn.ReadFromUDPAddrPort(packet)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			slog.Error("failed to read udp packet", "err", err)
+
+			continue
+		}
+
+		// Count new request (done before everything else so that failed numbers match)
+		handler.requests.Add(1)
+		collector.IncrementRequests()
+
+		remoteAddr := remoteAddrPort.Addr().Unmap()
+
+		// Gracefully handle panics so that they're confined to single packet and don't crash server
+		response := func() (response []byte) {
+			defer func() {
+				if err := recover(); err != nil {
+					slog.Error("recovered from panicking udp handler", "err", err, "addr", remoteAddrPort)
+
+					collector.IncrementErroredRequests()
+
+					response = nil
+				}
+			}()
+
+			return s.handle(buf, remoteAddr, packet[:n])
+		}()
+
+		if len(response) == 0 {
+			continue
+		}
+
+		if _, err = s.conn.WriteToUDPAddrPort(response, remoteAddrPort); err != nil {
+			slog.Error("failed to write udp packet", "err", err, "addr", remoteAddrPort)
+		}
+
+		// Keep grown buffer around for next packets
+		buf = response[:0]
+	}
+}
+
+func startUDP(db *database.Database) {
+	addr, _ := config.Section("udp").Get("addr", "")
+	if addr == "" {
+		return
+	}
+
+	workers, _ := config.Section("udp").GetInt("workers", runtime.GOMAXPROCS(0))
+	scrape, _ := config.Section("udp").GetBool("scrape", false)
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		panic(err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		panic(err)
+	}
+
+	udp = &udpServer{conn: conn, db: db, connectionIDs: newConnectionIDGenerator(), scrapeEnabled: scrape}
+
+	for i := 0; i < max(workers, 1); i++ {
+		udp.waitGroup.Add(1)
+
+		go udp.serve()
+	}
+
+	slog.Info("ready and accepting new udp packets", "addr", addr, "workers", workers)
+}
+
+func stopUDP() {
+	if udp != nil {
+		_ = udp.conn.Close()
+	}
+}
+
+func waitUDP() {
+	if udp != nil {
+		udp.waitGroup.Wait()
+	}
+}
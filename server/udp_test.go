@@ -0,0 +1,245 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"chihaya/database"
+	cdb "chihaya/database/types"
+)
+
+func testUDPConnectionIDs(t *testing.T) {
+	var (
+		g     = newConnectionIDGenerator()
+		addr  = netip.MustParseAddr("9.10.11.123")
+		other = netip.MustParseAddr("2001:db8::1")
+		now   = time.Now()
+	)
+
+	id := g.issue(addr, now)
+
+	if !g.validate(id, addr, now) {
+		t.Fatalf("Expected connection ID %d to be valid", id)
+	}
+
+	if !g.validate(id, addr, now.Add(udpConnectionIDWindow)) {
+		t.Fatalf("Expected connection ID %d to be valid in following window", id)
+	}
+
+	if g.validate(id, addr, now.Add(2*udpConnectionIDWindow)) {
+		t.Fatalf("Expected connection ID %d to be expired", id)
+	}
+
+	if g.validate(id, other, now) {
+		t.Fatalf("Expected connection ID %d to be invalid for other address", id)
+	}
+}
+
+func testUDPURLData(t *testing.T) {
+	testCases := []struct {
+		options []byte
+		passkey string
+		err     error
+	}{
+		{nil, "", nil},
+		{[]byte{udpOptionEndOfOptions}, "", nil},
+		{append([]byte{udpOptionURLData, 18}, "/passkey/announce?"...), "passkey", nil},
+		{
+			append(append(append([]byte{udpOptionNOP, udpOptionURLData, 5}, "/pass"...), udpOptionURLData, 12),
+				"key/announce"...),
+			"passkey",
+			nil,
+		},
+		{append([]byte{udpOptionURLData, 20}, "/passkey/announce"...), "", errUDPMalformedOptions},
+		{[]byte{udpOptionURLData}, "", errUDPMalformedOptions},
+		{append([]byte{udpOptionURLData, 9, '/', 'a', 'n', 'n', 'o', 'u', 'n', 'c', 'e', udpOptionEndOfOptions}, 'x'),
+			"",
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		passkey, err := parseUDPURLData(testCase.options)
+		if passkey != testCase.passkey || err != testCase.err { //nolint:errorlint // sentinel comparison is intended
+			t.Fatalf("Expected (%q, %v) for options %v, got (%q, %v)",
+				testCase.passkey, testCase.err, testCase.options, passkey, err)
+		}
+	}
+}
+
+func testUDPParseAnnounce(t *testing.T) {
+	packet := make([]byte, udpAnnounceRequestSize)
+	copy(packet[16:36], bytes.Repeat([]byte{0xab}, 20))
+	copy(packet[36:56], "-TR2940-000000000000")
+	binary.BigEndian.PutUint64(packet[56:64], 1)
+	binary.BigEndian.PutUint64(packet[64:72], 2)
+	binary.BigEndian.PutUint64(packet[72:80], 3)
+	binary.BigEndian.PutUint32(packet[80:84], 2)
+	copy(packet[84:88], []byte{9, 10, 11, 123})
+	binary.BigEndian.PutUint32(packet[88:92], 0x1a2b3c)
+	binary.BigEndian.PutUint32(packet[92:96], 0xffffffff)
+	binary.BigEndian.PutUint16(packet[96:98], 24512)
+
+	qp := parseUDPAnnounce(packet)
+
+	if qp.Params.InfoHashes[0] != cdb.TorrentHashFromBytes(packet[16:36]) {
+		t.Fatalf("Expected info_hash %x, got %x", packet[16:36], qp.Params.InfoHashes[0])
+	}
+
+	if qp.Params.PeerID != "-TR2940-000000000000" {
+		t.Fatalf("Expected peer_id %s, got %s", "-TR2940-000000000000", qp.Params.PeerID)
+	}
+
+	if qp.Params.Downloaded != 1 || qp.Params.Left != 2 || qp.Params.Uploaded != 3 {
+		t.Fatalf("Expected downloaded/left/uploaded 1/2/3, got %d/%d/%d",
+			qp.Params.Downloaded, qp.Params.Left, qp.Params.Uploaded)
+	}
+
+	if !qp.Exists.Event || qp.Params.Event != "started" {
+		t.Fatalf("Expected event %s, got %s", "started", qp.Params.Event)
+	}
+
+	if !qp.Exists.IP || qp.Params.IP != "9.10.11.123" {
+		t.Fatalf("Expected ip %s, got %s", "9.10.11.123", qp.Params.IP)
+	}
+
+	if !qp.Exists.Key || qp.Params.Key != "001A2B3C" {
+		t.Fatalf("Expected key %s, got %s", "001A2B3C", qp.Params.Key)
+	}
+
+	if qp.Exists.NumWant {
+		t.Fatalf("Expected numwant to be default, got %d", qp.Params.NumWant)
+	}
+
+	if !qp.Exists.Port || qp.Params.Port != 24512 {
+		t.Fatalf("Expected port %d, got %d", 24512, qp.Params.Port)
+	}
+}
+
+func testUDPHandleConnect(t *testing.T) {
+	s := &udpServer{connectionIDs: newConnectionIDGenerator()}
+	addr := netip.MustParseAddr("9.10.11.123")
+
+	packet := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	packet = binary.BigEndian.AppendUint32(packet, udpActionConnect)
+	packet = append(packet, 1, 2, 3, 4)
+
+	response := s.handle(nil, addr, packet)
+	if len(response) != 16 {
+		t.Fatalf("Expected connect response of length %d, got %d", 16, len(response))
+	}
+
+	if action := binary.BigEndian.Uint32(response[0:4]); action != udpActionConnect {
+		t.Fatalf("Expected action %d, got %d", udpActionConnect, action)
+	}
+
+	if !bytes.Equal(response[4:8], packet[12:16]) {
+		t.Fatalf("Expected transaction ID %v, got %v", packet[12:16], response[4:8])
+	}
+
+	if id := binary.BigEndian.Uint64(response[8:16]); !s.connectionIDs.validate(id, addr, time.Now()) {
+		t.Fatalf("Expected issued connection ID %d to be valid", id)
+	}
+
+	// Connect with wrong protocol ID must be ignored
+	binary.BigEndian.PutUint64(packet[0:8], 0)
+
+	if response = s.handle(nil, addr, packet); response != nil {
+		t.Fatalf("Expected no response for invalid protocol ID, got %v", response)
+	}
+}
+
+func testUDPHandleInvalidConnectionID(t *testing.T) {
+	s := &udpServer{connectionIDs: newConnectionIDGenerator()}
+
+	packet := binary.BigEndian.AppendUint64(nil, 1234)
+	packet = binary.BigEndian.AppendUint32(packet, udpActionAnnounce)
+	packet = append(packet, 1, 2, 3, 4)
+
+	response := s.handle(nil, netip.MustParseAddr("9.10.11.123"), packet)
+
+	expected := append([]byte{0, 0, 0, udpActionError, 1, 2, 3, 4}, "Connection ID mismatch"...)
+	if !bytes.Equal(response, expected) {
+		t.Fatalf("Expected error response %v, got %v", expected, response)
+	}
+}
+
+func testUDPHandleScrape(t *testing.T) {
+	var (
+		known   = cdb.TorrentHash{1}
+		unknown = cdb.TorrentHash{2}
+		addr    = netip.MustParseAddr("9.10.11.123")
+	)
+
+	torrent := &cdb.Torrent{}
+	torrent.SeedersLength.Store(3)
+	torrent.LeechersLength.Store(4)
+	torrent.Snatched.Store(5)
+
+	s := &udpServer{db: &database.Database{}, connectionIDs: newConnectionIDGenerator(), scrapeEnabled: true}
+	s.db.Torrents.Store(cdb.NewTorrentShards(map[cdb.TorrentHash]*cdb.Torrent{known: torrent}))
+
+	packet := binary.BigEndian.AppendUint64(nil, s.connectionIDs.issue(addr, time.Now()))
+	packet = binary.BigEndian.AppendUint32(packet, udpActionScrape)
+	packet = append(packet, 1, 2, 3, 4)
+	packet = append(packet, unknown[:]...)
+	packet = append(packet, known[:]...)
+
+	response := s.handle(nil, addr, packet)
+
+	expected := []byte{0, 0, 0, udpActionScrape, 1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 5,
+		0, 0, 0, 4}
+	if !bytes.Equal(response, expected) {
+		t.Fatalf("Expected scrape response %v, got %v", expected, response)
+	}
+
+	// Scrape is not authenticated, so it is refused unless enabled
+	s.scrapeEnabled = false
+
+	response = s.handle(nil, addr, packet)
+
+	expected = append([]byte{0, 0, 0, udpActionError, 1, 2, 3, 4}, "Unsupported request - scrape is disabled"...)
+	if !bytes.Equal(response, expected) {
+		t.Fatalf("Expected error response %v, got %v", expected, response)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	t.Run("ConnectionIDs", func(t *testing.T) {
+		testUDPConnectionIDs(t)
+	})
+
+	t.Run("URLData", func(t *testing.T) {
+		testUDPURLData(t)
+	})
+
+	t.Run("ParseAnnounce", func(t *testing.T) {
+		testUDPParseAnnounce(t)
+	})
+
+	t.Run("Handle", func(t *testing.T) {
+		testUDPHandleConnect(t)
+		testUDPHandleInvalidConnectionID(t)
+		testUDPHandleScrape(t)
+	})
+}
@@ -19,10 +19,15 @@ package server
 
 import (
 	"bytes"
+	"errors"
+	"log/slog"
 	"net"
 	"net/netip"
+	"strings"
 	"time"
 
+	"chihaya/collector"
+	"chihaya/config"
 	"chihaya/database"
 	cdb "chihaya/database/types"
 	"chihaya/util"
@@ -30,12 +35,77 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
+var (
+	trustedProxies []netip.Prefix
+	proxyHeaders   []string
+
+	errMalformedForwardingHeader = errors.New("malformed forwarding header")
+)
+
+func init() {
+	httpConfig := config.Section("http")
+
+	proxies, _ := httpConfig.GetStrings("trusted_proxies", []string{"127.0.0.0/8", "::1/128"})
+	proxyHeaders, _ = httpConfig.GetStrings("proxy_headers", []string{"X-Real-Ip", "X-Forwarded-For"})
+
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			slog.Error("ignoring invalid trusted proxy", "prefix", proxy, "err", err)
+			continue
+		}
+
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+}
+
+// Categories of failures, used as label of failure metrics so that reasons with varying details are grouped together
+const (
+	failureMalformed           = "malformed"
+	failureUnsupported         = "unsupported"
+	failureInvalidPasskey      = "invalid_passkey"
+	failureInvalidIP           = "invalid_ip"
+	failureUnacceptablePort    = "unacceptable_port"
+	failureUnapprovedClient    = "unapproved_client"
+	failureUnregisteredTorrent = "unregistered_torrent"
+	failureDownloadDisabled    = "download_disabled"
+	failurePeerKeyMismatch     = "peer_key_mismatch"
+	failureIntervalTooShort    = "interval_too_short"
+	failureRateLimited         = "rate_limited"
+	failureConnectionID        = "connection_id_mismatch"
+)
+
+// requestFailure Describes why request could not be processed, independently of protocol it is reported with
+type requestFailure struct {
+	category string
+	reason   string
+	interval time.Duration
+}
+
 func failure(err string, buf *bytes.Buffer, interval time.Duration) {
 	// Reset buffer to prevent reuse of any written bytes
 	buf.Reset()
 	util.BencodeFailure(buf, err, interval)
 }
 
+// respondFailure Counts failure of given action in metrics and writes it into buf as bencoded response
+func respondFailure(action string, f *requestFailure, buf *bytes.Buffer) {
+	collector.IncrementFailures(action, f.category)
+	failure(f.reason, buf, f.interval)
+}
+
+// eventLabel Returns name of announce event as used in metrics, unknown events are grouped together
+func eventLabel(event string) string {
+	switch event {
+	case "":
+		return "empty"
+	case "started", "completed", "stopped", "paused":
+		return event
+	default:
+		return "unknown"
+	}
+}
+
 func isClientApproved(peerID string, db *database.Database) (uint16, bool) {
 	var (
 		widLen, i int
@@ -92,29 +162,99 @@ func isPrivateIPAddress(address netip.Addr) bool {
 	return !address.IsGlobalUnicast() || address.IsPrivate()
 }
 
-func getIPAddressFromRequest(ctx *fasthttp.RequestCtx) netip.Addr {
-	xRealIP := ctx.Request.Header.Peek("X-Real-Ip")
-	xForwardedFor := ctx.Request.Header.Peek("X-Forwarded-For")
+// parseIPv6Param parses BEP-7 "ipv6" param, which can either be plain address or address with port (ignored)
+func parseIPv6Param(value string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(value)
+		if err != nil {
+			return netip.Addr{}, false
+		}
 
-	// Try to use value from X-Real-Ip header if exists
-	if len(xRealIP) > 0 {
-		return netip.MustParseAddr(string(xRealIP))
+		addr = addrPort.Addr()
 	}
 
-	// Check list of IPs in X-Forwarded-For and try to return the first public address
-	for _, remoteBytes := range bytes.Split(xForwardedFor, []byte(",")) {
-		if remoteIP, err := netip.ParseAddr(string(bytes.TrimSpace(remoteBytes))); err != nil {
-			if !isPrivateIPAddress(remoteIP) {
-				return remoteIP
-			}
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Addr{}, false
+	}
+
+	return addr, true
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
 		}
 	}
 
-	// Try to use socket address directly
+	return false
+}
+
+// parseForwardedFor Walks X-Forwarded-For from right to left and returns first address not belonging to trusted proxy
+func parseForwardedFor(value []byte) (addr netip.Addr, err error) {
+	for value = bytes.TrimSpace(value); len(value) > 0; {
+		var hop []byte
+
+		if i := bytes.LastIndexByte(value, ','); i >= 0 {
+			hop, value = value[i+1:], bytes.TrimSpace(value[:i])
+		} else {
+			hop, value = value, nil
+		}
+
+		if addr, err = netip.ParseAddr(string(bytes.TrimSpace(hop))); err != nil {
+			return netip.Addr{}, errMalformedForwardingHeader
+		}
+
+		if addr = addr.Unmap(); !isTrustedProxy(addr) {
+			return addr, nil
+		}
+	}
+
+	// Every hop is trusted, so left-most one is the client
+	if !addr.IsValid() {
+		return netip.Addr{}, errMalformedForwardingHeader
+	}
+
+	return addr, nil
+}
+
+/*
+getIPAddressFromRequest Returns address of client; forwarding headers are only honoured (in configured order of
+precedence) if request came from trusted proxy, otherwise socket address is used
+*/
+func getIPAddressFromRequest(ctx *fasthttp.RequestCtx) (netip.Addr, error) {
+	var remoteAddr netip.Addr
+
 	if addr, ok := ctx.RemoteAddr().(*net.TCPAddr); ok {
-		return addr.AddrPort().Addr()
+		remoteAddr = addr.AddrPort().Addr().Unmap()
+	} else if addrPort, err := netip.ParseAddrPort(ctx.RemoteAddr().String()); err == nil {
+		remoteAddr = addrPort.Addr().Unmap()
+	} else {
+		return netip.Addr{}, err
+	}
+
+	if !isTrustedProxy(remoteAddr) {
+		return remoteAddr, nil
+	}
+
+	for _, header := range proxyHeaders {
+		value := ctx.Request.Header.Peek(header)
+		if len(value) == 0 {
+			continue
+		}
+
+		if strings.EqualFold(header, fasthttp.HeaderXForwardedFor) {
+			return parseForwardedFor(value)
+		}
+
+		addr, err := netip.ParseAddr(string(bytes.TrimSpace(value)))
+		if err != nil {
+			return netip.Addr{}, errMalformedForwardingHeader
+		}
+
+		return addr.Unmap(), nil
 	}
 
-	// Parse address from context (fallback)
-	return netip.MustParseAddrPort(ctx.RemoteAddr().String()).Addr()
+	return remoteAddr, nil
 }
@@ -19,9 +19,12 @@ package server
 
 import (
 	"bytes"
+	"net"
 	"net/netip"
 	"testing"
 	"time"
+
+	"github.com/valyala/fasthttp"
 )
 
 func TestFailure(t *testing.T) {
@@ -35,6 +38,23 @@ func TestFailure(t *testing.T) {
 	}
 }
 
+func TestEventLabel(t *testing.T) {
+	labels := map[string]string{
+		"":          "empty",
+		"started":   "started",
+		"completed": "completed",
+		"stopped":   "stopped",
+		"paused":    "paused",
+		"c0mPl3tED": "unknown",
+	}
+
+	for event, expected := range labels {
+		if label := eventLabel(event); label != expected {
+			t.Fatalf("Expected label of event %q to be %s, got %s", event, expected, label)
+		}
+	}
+}
+
 func TestIsPrivateIpAddress(t *testing.T) {
 	privateIps := []string{
 		"0.0.0.0",
@@ -65,3 +85,89 @@ func TestIsPrivateIpAddress(t *testing.T) {
 		}
 	}
 }
+
+func TestParseIPv6Param(t *testing.T) {
+	validParams := map[string]string{
+		"2001:db8::1":          "2001:db8::1",
+		"[2001:db8::1]:24512":  "2001:db8::1",
+		"2606:4700:4700::1111": "2606:4700:4700::1111",
+	}
+
+	for param, expected := range validParams {
+		addr, ok := parseIPv6Param(param)
+		if !ok || addr != netip.MustParseAddr(expected) {
+			t.Fatalf("Expected %s to be parsed as %s, got %s (ok: %t)", param, expected, addr, ok)
+		}
+	}
+
+	invalidParams := []string{
+		"",
+		"garbage",
+		"45.128.19.54",
+		"45.128.19.54:24512",
+		"::ffff:45.128.19.54",
+	}
+
+	for _, param := range invalidParams {
+		if addr, ok := parseIPv6Param(param); ok {
+			t.Fatalf("Expected %s to be rejected, got %s", param, addr)
+		}
+	}
+}
+
+func TestGetIPAddressFromRequest(t *testing.T) {
+	testCases := []struct {
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+		err        bool
+	}{
+		{"45.128.19.54:34000", nil, "45.128.19.54", false},
+		{"[2606:4700:4700::1111]:34000", nil, "2606:4700:4700::1111", false},
+		{"45.128.19.54:34000", map[string]string{"X-Real-Ip": "1.1.1.1"}, "45.128.19.54", false},
+		{"45.128.19.54:34000", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "45.128.19.54", false},
+		{"45.128.19.54:34000", map[string]string{"X-Real-Ip": "garbage"}, "45.128.19.54", false},
+		{"127.0.0.1:34000", nil, "127.0.0.1", false},
+		{"127.0.0.1:34000", map[string]string{"X-Real-Ip": "1.1.1.1"}, "1.1.1.1", false},
+		{"[::1]:34000", map[string]string{"X-Real-Ip": "2606:4700:4700::1111"}, "2606:4700:4700::1111", false},
+		{
+			"127.0.0.1:34000",
+			map[string]string{"X-Real-Ip": "1.1.1.1", "X-Forwarded-For": "8.8.8.8"},
+			"1.1.1.1",
+			false,
+		},
+		{"127.0.0.1:34000", map[string]string{"X-Forwarded-For": "8.8.8.8, 1.1.1.1"}, "1.1.1.1", false},
+		{"127.0.0.1:34000", map[string]string{"X-Forwarded-For": "8.8.8.8, 1.1.1.1, 127.0.0.5"}, "1.1.1.1", false},
+		{"127.0.0.1:34000", map[string]string{"X-Forwarded-For": "127.0.0.6,127.0.0.5"}, "127.0.0.6", false},
+		{"127.0.0.1:34000", map[string]string{"X-Real-Ip": "garbage"}, "", true},
+		{"127.0.0.1:34000", map[string]string{"X-Forwarded-For": "8.8.8.8, garbage"}, "", true},
+		{"127.0.0.1:34000", map[string]string{"X-Forwarded-For": ","}, "", true},
+	}
+
+	for _, testCase := range testCases {
+		var (
+			ctx fasthttp.RequestCtx
+			req fasthttp.Request
+		)
+
+		for k, v := range testCase.headers {
+			req.Header.Set(k, v)
+		}
+
+		ctx.Init(&req, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(testCase.remoteAddr)), nil)
+
+		addr, err := getIPAddressFromRequest(&ctx)
+		if testCase.err {
+			if err == nil {
+				t.Fatalf("Expected error for %s with headers %v, got %s", testCase.remoteAddr, testCase.headers, addr)
+			}
+
+			continue
+		}
+
+		if err != nil || addr != netip.MustParseAddr(testCase.expected) {
+			t.Fatalf("Expected %s for %s with headers %v, got %s (err: %v)",
+				testCase.expected, testCase.remoteAddr, testCase.headers, addr, err)
+		}
+	}
+}
@@ -62,7 +62,8 @@ func BencodeScrapeHeader(buf *bytes.Buffer) {
 	buf.WriteByte('d')
 }
 
-func BencodeScrapeTorrent(buf *bytes.Buffer, infoHash cdb.TorrentHash, complete, downloaded, incomplete int64) {
+func BencodeScrapeTorrent(buf *bytes.Buffer, infoHash cdb.TorrentHash, complete, downloaded, downloaders,
+	incomplete int64) {
 	bencodeWriteString(buf, string(infoHash[:]))
 
 	buf.WriteByte('d')
@@ -73,6 +74,10 @@ func BencodeScrapeTorrent(buf *bytes.Buffer, infoHash cdb.TorrentHash, complete,
 	bencodeWriteString(buf, "downloaded")
 	bencodeWriteNumber(buf, downloaded)
 
+	// BEP-21: number of leechers excluding partial seeds
+	bencodeWriteString(buf, "downloaders")
+	bencodeWriteNumber(buf, downloaders)
+
 	bencodeWriteString(buf, "incomplete")
 	bencodeWriteNumber(buf, incomplete)
 
@@ -95,7 +100,8 @@ func BencodeScrapeFooter(buf *bytes.Buffer, scrapeInterval int) {
 }
 
 // BencodeAnnounceHeader Writes the announce header.
-// Call BencodeAnnouncePeersIP4 afterwards, then finish with BencodeAnnounceFooter
+// Call BencodeAnnouncePeersIP4 (and optionally BencodeAnnouncePeersIP6) afterwards,
+// then finish with BencodeAnnounceFooter
 // TODO: convert interval and minInterval to time.Duration
 func BencodeAnnounceHeader(buf *bytes.Buffer, complete, incomplete, downloaded int64, interval, minInterval int) {
 	buf.WriteByte('d')
@@ -157,6 +163,21 @@ func BencodeAnnouncePeersIP4(buf *bytes.Buffer, peers []*cdb.Peer, compact, peer
 	}
 }
 
+/*
+BencodeAnnouncePeersIP6 Writes BEP-7 "peers6" key; must be called after BencodeAnnouncePeersIP4 to keep keys sorted.
+BEP-7 only defines compact form, so it is written even to clients which did not ask for compact response (those get
+IPv4 peers as list of dictionaries in "peers" as usual)
+*/
+func BencodeAnnouncePeersIP6(buf *bytes.Buffer, peers []*cdb.Peer) {
+	bencodeWriteString(buf, "peers6")
+	bencodeWriteInt64(buf, len(peers)*cdb.PeerAddress6Size)
+	buf.WriteByte(':')
+
+	for _, peer := range peers {
+		buf.Write(peer.Addr6[:])
+	}
+}
+
 func BencodeAnnounceFooter(buf *bytes.Buffer) {
 	buf.WriteByte('e')
 }
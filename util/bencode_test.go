@@ -19,6 +19,11 @@ var testPeers = []*cdb.Peer{
 	{Addr: cdb.NewPeerAddressFromAddrPort(netip.MustParseAddr("1.1.10.10"), 22), ID: cdb.PeerID{0, 1, 2, 3, 4, 5}},
 }
 
+var testPeers6 = []*cdb.Peer{
+	{Addr6: cdb.NewPeerAddress6FromAddrPort(netip.MustParseAddr("2001:db8::1"), 12345), ID: cdb.PeerID{1, 2, 3, 4}},
+	{Addr6: cdb.NewPeerAddress6FromAddrPort(netip.MustParseAddr("2606:4700:4700::1111"), 443), ID: cdb.PeerID{5, 6}},
+}
+
 var testTorrents map[cdb.TorrentHash]*cdb.Torrent
 
 var testTorrentKeys []cdb.TorrentHash
@@ -31,6 +36,9 @@ func init() {
 		t.SeedersLength.Store(UnsafeUint32())
 		t.Snatched.Store(UnsafeUint32())
 		t.LeechersLength.Store(UnsafeUint32())
+		t.Leechers.Put(cdb.NewPeerKey(1, cdb.PeerID{1}), &cdb.Peer{})
+		t.Leechers.Put(cdb.NewPeerKey(2, cdb.PeerID{2}), &cdb.Peer{PartialSeed: true})
+		t.PartialSeedsLength.Store(1)
 
 		var tKey cdb.TorrentHash
 
@@ -69,7 +77,8 @@ func testBencodeScrape(t *testing.T,
 
 	for _, k := range torrentKeys {
 		t := torrents[k]
-		BencodeScrapeTorrent(buf2, k, int64(t.SeedersLength.Load()), int64(t.Snatched.Load()), int64(t.LeechersLength.Load()))
+		BencodeScrapeTorrent(buf2, k, int64(t.SeedersLength.Load()), int64(t.Snatched.Load()), int64(t.Downloaders()),
+			int64(t.LeechersLength.Load()))
 	}
 
 	BencodeScrapeFooter(buf2, scrapeInterval)
@@ -82,13 +91,18 @@ func testBencodeScrape(t *testing.T,
 func testBencodeAnnounce(t *testing.T,
 	complete, incomplete, downloaded int64,
 	interval, minInterval int,
-	peers []*cdb.Peer, compact, peerID bool) {
+	peers, peers6 []*cdb.Peer, compact, peerID bool) {
 	buf1 := new(bytes.Buffer)
-	marshalerBencodeAnnounce(buf1, complete, incomplete, downloaded, interval, minInterval, peers, compact, peerID)
+	marshalerBencodeAnnounce(buf1, complete, incomplete, downloaded, interval, minInterval, peers, peers6, compact, peerID)
 
 	buf2 := new(bytes.Buffer)
 	BencodeAnnounceHeader(buf2, complete, incomplete, downloaded, interval, minInterval)
 	BencodeAnnouncePeersIP4(buf2, peers, compact, peerID)
+
+	if len(peers6) > 0 {
+		BencodeAnnouncePeersIP6(buf2, peers6)
+	}
+
 	BencodeAnnounceFooter(buf2)
 
 	if slices.Compare(buf1.Bytes(), buf2.Bytes()) != 0 {
@@ -136,9 +150,10 @@ func marshalerBencodeScrape(buf *bytes.Buffer,
 		kk := string(k[:])
 
 		files[kk] = map[string]any{
-			"complete":   torrent.SeedersLength.Load(),
-			"downloaded": torrent.Snatched.Load(),
-			"incomplete": torrent.LeechersLength.Load(),
+			"complete":    torrent.SeedersLength.Load(),
+			"downloaded":  torrent.Snatched.Load(),
+			"downloaders": torrent.Downloaders(),
+			"incomplete":  torrent.LeechersLength.Load(),
 		}
 	}
 
@@ -153,7 +168,7 @@ func marshalerBencodeScrape(buf *bytes.Buffer,
 func marshalerBencodeAnnounce(buf *bytes.Buffer,
 	complete, incomplete, downloaded int64,
 	interval, minInterval int,
-	peers []*cdb.Peer, compact, peerID bool) {
+	peers, peers6 []*cdb.Peer, compact, peerID bool) {
 	data := make(map[string]any)
 	data["complete"] = complete
 	data["incomplete"] = incomplete
@@ -188,6 +203,17 @@ func marshalerBencodeAnnounce(buf *bytes.Buffer,
 		data["peers"] = peerList
 	}
 
+	// BEP-7 only defines compact form of peers6
+	if len(peers6) > 0 {
+		peerBuff := make([]byte, 0, len(peers6)*cdb.PeerAddress6Size)
+
+		for _, other := range peers6 {
+			peerBuff = append(peerBuff, other.Addr6[:]...)
+		}
+
+		data["peers6"] = peerBuff
+	}
+
 	errx := marshalerBencode(buf, data)
 	if errx != nil {
 		panic(errx)
@@ -202,11 +228,14 @@ func TestBencode(t *testing.T) {
 	})
 
 	t.Run("Announce", func(t *testing.T) {
-		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, nil, true, false)
-		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, nil, false, false)
-		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, true, false)
-		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, false, false)
-		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, false, true)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, nil, nil, true, false)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, nil, nil, false, false)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, nil, true, false)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, nil, false, false)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, nil, false, true)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, testPeers6, true, false)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, nil, testPeers6, true, false)
+		testBencodeAnnounce(t, 1234, 5678, 9101112, 60, 45, testPeers, testPeers6, false, true)
 	})
 
 	t.Run("Scrape", func(t *testing.T) {
@@ -264,7 +293,7 @@ func BenchmarkBencode(b *testing.B) {
 
 					for pb.Next() {
 						buf.Reset()
-						marshalerBencodeAnnounce(buf, 1234, 5678, 9101112, 60, 45, testPeers, true, false)
+						marshalerBencodeAnnounce(buf, 1234, 5678, 9101112, 60, 45, testPeers, nil, true, false)
 					}
 				})
 			})
@@ -291,7 +320,7 @@ func BenchmarkBencode(b *testing.B) {
 
 					for pb.Next() {
 						buf.Reset()
-						marshalerBencodeAnnounce(buf, 1234, 5678, 9101112, 60, 45, testPeers, false, false)
+						marshalerBencodeAnnounce(buf, 1234, 5678, 9101112, 60, 45, testPeers, nil, false, false)
 					}
 				})
 			})
@@ -313,6 +342,7 @@ func BenchmarkBencode(b *testing.B) {
 						BencodeScrapeTorrent(buf, k,
 							int64(t.SeedersLength.Load()),
 							int64(t.Snatched.Load()),
+							int64(t.Downloaders()),
 							int64(t.LeechersLength.Load()),
 						)
 					}